@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// A daily window, such as 01:00-06:00, outside of which a run pauses.
+// The window may wrap around midnight, e.g. 22:00-05:00.
+type activeHours struct {
+	// Minutes after midnight.
+	start, end int
+	loc        *time.Location
+}
+
+// Parses "HH:MM-HH:MM" in the named IANA time zone, or local time if timezone is empty.
+func parseActiveHours(spec string, timezone string) (*activeHours, error) {
+	parts := strings.Split(spec, "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid --active-hours [%s], expected HH:MM-HH:MM", spec)
+	}
+	a := &activeHours{loc: time.Local}
+	for i, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("invalid --active-hours [%s], expected HH:MM-HH:MM", spec)
+		}
+		minutes := t.Hour()*60 + t.Minute()
+		if i == 0 {
+			a.start = minutes
+		} else {
+			a.end = minutes
+		}
+	}
+	if a.start == a.end {
+		return nil, fmt.Errorf("invalid --active-hours [%s], the window is empty", spec)
+	}
+	if timezone != "" {
+		loc, err := time.LoadLocation(timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --timezone: %v", err)
+		}
+		a.loc = loc
+	}
+	return a, nil
+}
+
+func (a *activeHours) contains(t time.Time) bool {
+	t = t.In(a.loc)
+	minutes := t.Hour()*60 + t.Minute()
+	if a.start < a.end {
+		return minutes >= a.start && minutes < a.end
+	}
+	return minutes >= a.start || minutes < a.end
+}
+
+// Returns when the window next opens after t.
+func (a *activeHours) nextOpen(t time.Time) time.Time {
+	t = t.In(a.loc)
+	open := time.Date(t.Year(), t.Month(), t.Day(), a.start/60, a.start%60, 0, 0, a.loc)
+	if !open.After(t) {
+		open = open.AddDate(0, 0, 1)
+	}
+	return open
+}
+
+// Sleeps until the window is open, if it isn't.
+func (a *activeHours) wait() {
+	now := time.Now()
+	if a.contains(now) {
+		return
+	}
+	open := a.nextOpen(now)
+	log.Printf("Outside active hours, pausing until %s\n", open.Format(time.RFC3339))
+	time.Sleep(time.Until(open))
+}
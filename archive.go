@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/mail"
+	"sort"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+
+	"github.com/weineran/gmail-cleanup/internal/mimeutil"
+)
+
+// Removes the INBOX label from every message matching a query.
+func runArchive(args []string) {
+	fs := flag.NewFlagSet("archive", flag.ExitOnError)
+	var opts mailboxOptions
+	opts.register(fs)
+	query := fs.String("query", "older_than:1y in:inbox", "Gmail search query selecting the messages to archive")
+	dryRun := fs.Bool("dry-run", false, "Only print counts and the per-sender breakdown")
+	allowQueryProblems := fs.Bool("allow-query-problems", false, "Run even if the query has unknown operators or values, such as lager:10M")
+	parseFlags(fs, args)
+	checkQuery(*query, true, *allowQueryProblems)
+
+	mb := openMailbox(&opts)
+	defer mb.quota.printSummary()
+
+	fmt.Printf("Using query string [%v]\n", *query)
+	c := mb.cleaner()
+	c.MetadataHeaders = []string{"From"}
+	var messages []*gmail.Message
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for r := range c.Messages(ctx, *query) {
+		if errors.Is(r.Err, errQuotaBudgetExceeded) {
+			log.Printf("Stopping: %v\n", r.Err)
+			return
+		}
+		if r.Err != nil {
+			log.Fatalf("Unable to retrieve messages: %v", r.Err)
+		}
+		messages = append(messages, r.Message)
+	}
+	if len(messages) == 0 {
+		fmt.Println("No messages found.")
+		return
+	}
+
+	printSenderBreakdown(countSenders(messages))
+	fmt.Printf("Count: %+v\n", len(messages))
+
+	if *dryRun {
+		fmt.Printf("Dry run: would archive %d messages.\n", len(messages))
+		return
+	}
+
+	if !askYesNo(fmt.Sprintf("Do you want to archive these %d messages?", len(messages))) {
+		log.Println("Nothing archived.")
+		return
+	}
+
+	ids := make([]string, 0, len(messages))
+	for _, m := range messages {
+		ids = append(ids, m.Id)
+	}
+	if err := mb.batchModify(ids, nil, []string{"INBOX"}); err != nil {
+		log.Fatalf("Unable to archive messages: %v", err)
+	}
+	fmt.Printf("Archived %d messages.\n", len(ids))
+}
+
+type senderCount struct {
+	sender string
+	count  int
+}
+
+// Counts messages per sender address, using the From header of their metadata.
+func countSenders(messages []*gmail.Message) []senderCount {
+	counts := map[string]int{}
+	for _, msg := range messages {
+		var from string
+		if msg.Payload != nil {
+			from = mimeutil.HeaderValue(msg.Payload.Headers, "From")
+		}
+		counts[senderAddress(from)]++
+	}
+
+	var senders []senderCount
+	for sender, count := range counts {
+		senders = append(senders, senderCount{sender: sender, count: count})
+	}
+	sort.Slice(senders, func(i, j int) bool {
+		if senders[i].count != senders[j].count {
+			return senders[i].count > senders[j].count
+		}
+		return senders[i].sender < senders[j].sender
+	})
+
+	return senders
+}
+
+// Reduces a From header to a lowercase address, falling back to the raw value.
+func senderAddress(from string) string {
+	addr, err := mail.ParseAddress(from)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(from))
+	}
+	return strings.ToLower(addr.Address)
+}
+
+func printSenderBreakdown(senders []senderCount) {
+	fmt.Println("Senders:")
+	for _, s := range senders {
+		fmt.Printf("* %+v: %+v\n", s.sender, s.count)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/base64"
+
+	"google.golang.org/api/gmail/v1"
+
+	"github.com/weineran/gmail-cleanup/internal/mimeutil"
+	"github.com/weineran/gmail-cleanup/transform"
+)
+
+// Returns the parts of p to remove as attachments: parts with a filename and downloadable
+// content, and attached emails as a whole, without descending into them.
+func attachmentParts(p *gmail.MessagePart) []*gmail.MessagePart {
+	if mimeutil.IsAttachedMessage(p) && p.Body != nil && (p.Body.AttachmentId != "" || p.Body.Data != "") {
+		return []*gmail.MessagePart{p}
+	}
+	var parts []*gmail.MessagePart
+	if p.Filename != "" && p.Body != nil && (p.Body.AttachmentId != "" || p.Body.Data != "") {
+		parts = append(parts, p)
+	}
+	for _, subpart := range p.Parts {
+		parts = append(parts, attachmentParts(subpart)...)
+	}
+	return parts
+}
+
+// Names an attached email after its subject, e.g. "Re: Quarterly numbers.eml". spool
+// has its body if it was left there, and may be nil otherwise.
+func attachedMessageFilename(p *gmail.MessagePart, spool *mimeutil.Spool) string {
+	var headers []*gmail.MessagePartHeader
+	if len(p.Parts) > 0 {
+		// The Gmail API puts the attached email's own headers on its first part.
+		headers = p.Parts[0].Headers
+	} else if spool != nil && mimeutil.IsSpooled(p) {
+		if r, err := spool.Open(p); err == nil {
+			block, _ := mimeutil.ReadHeaderBlock(r)
+			headers = mimeutil.ParseHeaderBlock(block)
+		}
+	} else if p.Body != nil && p.Body.Data != "" {
+		data, _ := base64.URLEncoding.DecodeString(p.Body.Data)
+		block, _ := mimeutil.SplitHeaderBlock(data)
+		headers = mimeutil.ParseHeaderBlock(block)
+	}
+	subject := mimeutil.DecodeFilename(mimeutil.HeaderValue(headers, "Subject"))
+	if subject == "" {
+		subject = "attached message"
+	}
+	return subject + ".eml"
+}
+
+// Keeps attached emails whole in rewritten messages while other attachments are removed.
+type attachedMessageKeeper struct{}
+
+func (attachedMessageKeeper) Transform(m *transform.ParsedMessage) error {
+	for _, part := range m.Parts() {
+		if !m.Downloaded(part) || !mimeutil.IsAttachedMessage(part) {
+			continue
+		}
+		m.Keep(part)
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+	_ "modernc.org/sqlite"
+
+	"github.com/weineran/gmail-cleanup/internal/mimeutil"
+)
+
+// Name of the attachment index inside the archive directory.
+const attachmentIndexFile = "index.db"
+
+// An attachment part together with its downloaded body.
+type fetchedAttachment struct {
+	part *gmail.MessagePart
+	body *gmail.MessagePartBody
+	// Has the body instead, if it is spooled.
+	spool *mimeutil.Spool
+}
+
+// Returns a reader of the decoded content.
+func (a fetchedAttachment) open() (io.Reader, error) {
+	if a.spool != nil && mimeutil.IsSpooled(a.part) {
+		return a.spool.Open(a.part)
+	}
+	data, err := base64.URLEncoding.DecodeString(a.body.Data)
+	if err != nil {
+		return nil, fmt.Errorf("decoding attachment [%s]: %w", a.part.Filename, err)
+	}
+	return bytes.NewReader(data), nil
+}
+
+// Returns the decoded content, read into memory.
+func (a fetchedAttachment) data() ([]byte, error) {
+	r, err := a.open()
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// `attachments search` queries the index; anything else removes attachments.
+func runAttachments(args []string) {
+	if len(args) > 0 && args[0] == "search" {
+		runAttachmentsSearch(args[1:])
+		return
+	}
+	runRemoveAttachments(args)
+}
+
+func openAttachmentIndex(dir string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", filepath.Join(dir, attachmentIndexFile))
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS attachments USING fts5(
+		filename, sender, subject, date,
+		hash UNINDEXED, location UNINDEXED, message_id UNINDEXED
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// An attachment written to the archive directory.
+type archivedAttachment struct {
+	// The decoded filename.
+	Filename string
+	// Filename made safe and unique within the message, for saving it.
+	SafeName string
+	MimeType string
+	Size     int64
+	SHA256   string
+	Location string
+}
+
+// Writes each attachment to the store, records the message's ref, and indexes it.
+// With a scanner, attachments it rejects are quarantined instead.
+func archiveAttachments(store *attachmentStore, scanner *attachmentScanner, m *gmail.Message, attachments []fetchedAttachment) ([]archivedAttachment, error) {
+	db, err := openAttachmentIndex(store.dir)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	ref := messageRef{
+		MessageId: m.Id,
+		From:      mimeutil.HeaderValue(m.Payload.Headers, "From"),
+		Subject:   mimeutil.HeaderValue(m.Payload.Headers, "Subject"),
+		Date:      messageDate(m).Format("2006-01-02"),
+	}
+
+	var names, safeNames []string
+	for _, a := range attachments {
+		name := mimeutil.DecodeFilename(a.part.Filename)
+		names = append(names, name)
+		safeNames = append(safeNames, sanitizeFilename(name))
+	}
+	safeNames = uniqueFilenames(safeNames)
+
+	var archived []archivedAttachment
+	for i, a := range attachments {
+		data, err := a.data()
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", a.part.Filename, err)
+		}
+		if scanner != nil {
+			ok, output, err := scanner.scan(data)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				if err := scanner.quarantine(m.Id, names[i], safeNames[i], data, output); err != nil {
+					return nil, fmt.Errorf("quarantining %s: %w", names[i], err)
+				}
+				continue
+			}
+		}
+
+		hash, location, err := store.put(data)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = db.Exec(`INSERT INTO attachments (filename, sender, subject, date, hash, location, message_id) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			names[i], ref.From, ref.Subject, ref.Date, hash, location, m.Id)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Archived attachment [%s] to [%s]\n", names[i], location)
+
+		attachment := attachmentRef{Filename: names[i], SafeName: safeNames[i], MimeType: a.part.MimeType, Size: int64(len(data)), SHA256: hash}
+		if a.part.Filename != names[i] {
+			attachment.OriginalFilename = a.part.Filename
+		}
+		ref.Attachments = append(ref.Attachments, attachment)
+		archived = append(archived, archivedAttachment{
+			Filename: names[i],
+			SafeName: safeNames[i],
+			MimeType: a.part.MimeType,
+			Size:     int64(len(data)),
+			SHA256:   hash,
+			Location: location,
+		})
+	}
+
+	if err := store.addRef(ref); err != nil {
+		return nil, err
+	}
+
+	return archived, nil
+}
+
+// Full-text search over archived attachments.
+func runAttachmentsSearch(args []string) {
+	fs := flag.NewFlagSet("attachments search", flag.ExitOnError)
+	archiveDir := fs.String("archive-dir", "", "Archive directory given to --archive-dir when attachments were removed")
+	parseFlags(fs, args)
+
+	if *archiveDir == "" || fs.NArg() == 0 {
+		log.Fatalf("Usage: gmail-cleanup attachments search --archive-dir DIR TERMS...")
+	}
+
+	db, err := openAttachmentIndex(*archiveDir)
+	if err != nil {
+		log.Fatalf("Unable to open attachment index: %v", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT filename, sender, subject, date, hash, location FROM attachments WHERE attachments MATCH ? ORDER BY rank`,
+		ftsQuery(strings.Join(fs.Args(), " ")))
+	if err != nil {
+		log.Fatalf("Unable to search attachment index: %v", err)
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		var filename, sender, subject, date, hash, location string
+		if err := rows.Scan(&filename, &sender, &subject, &date, &hash, &location); err != nil {
+			log.Fatalf("Unable to read attachment index: %v", err)
+		}
+		count++
+		fmt.Println("------------------------------")
+		fmt.Printf("Filename: %+v\n", filename)
+		fmt.Printf("From: %+v\n", sender)
+		fmt.Printf("Subject: %+v\n", subject)
+		fmt.Printf("Date: %+v\n", date)
+		fmt.Printf("SHA-256: %+v\n", hash)
+		fmt.Printf("Location: %+v\n", location)
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalf("Unable to search attachment index: %v", err)
+	}
+	fmt.Printf("Count: %+v\n", count)
+}
+
+// Quotes each term so user input can't be read as FTS5 query syntax. All terms must match.
+func ftsQuery(terms string) string {
+	var quoted []string
+	for _, term := range strings.Fields(terms) {
+		quoted = append(quoted, `"`+strings.ReplaceAll(term, `"`, `""`)+`"`)
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+// What each line of an audit export signs: a journal entry chained to the line before it,
+// so removed, reordered or edited lines are detected.
+type auditPayload struct {
+	Seq int `json:"seq"`
+	// Hex SHA-256 of the previous line, or "" for the first.
+	Prev  string       `json:"prev"`
+	Entry journalEntry `json:"entry"`
+}
+
+// One line of an audit export. Signature is an Ed25519 signature of the exact Payload bytes.
+type auditLine struct {
+	Payload   json.RawMessage `json:"payload"`
+	Signature string          `json:"signature"`
+}
+
+func runAudit(args []string) {
+	if len(args) == 0 {
+		log.Fatalf("Usage: gmail-cleanup audit export|verify")
+	}
+	switch args[0] {
+	case "export":
+		runAuditExport(args[1:])
+	case "verify":
+		runAuditVerify(args[1:])
+	default:
+		log.Fatalf("Unknown audit command [%s], expected export or verify", args[0])
+	}
+}
+
+func runAuditExport(args []string) {
+	fs := flag.NewFlagSet("audit export", flag.ExitOnError)
+	profile := fs.String("profile", "", "Export the journal of this profile")
+	keyFile := fs.String("key", "audit.key", "Ed25519 signing key, created with a matching .pub file if missing")
+	out := fs.String("out", "audit.jsonl", "File to write the signed export to")
+	runId := fs.String("run", "", "Only export entries of this run")
+	parseFlags(fs, args)
+
+	key, err := loadOrCreateSigningKey(*keyFile)
+	if err != nil {
+		log.Fatalf("Unable to load signing key: %v", err)
+	}
+	entries, err := readJournal(profileJournalFile(*profile))
+	if err != nil {
+		log.Fatalf("Unable to read journal: %v", err)
+	}
+
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w := bufio.NewWriter(f)
+	prev := ""
+	n := 0
+	for _, e := range entries {
+		if *runId != "" && e.RunId != *runId {
+			continue
+		}
+		n++
+		payload, err := json.Marshal(auditPayload{Seq: n, Prev: prev, Entry: e})
+		if err != nil {
+			log.Fatal(err)
+		}
+		line, err := json.Marshal(auditLine{Payload: payload, Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, payload))})
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Write(line)
+		w.WriteString("\n")
+		sum := sha256.Sum256(line)
+		prev = hex.EncodeToString(sum[:])
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Exported %d entries to %s, signed with %s.pub\n", n, *out, *keyFile)
+}
+
+func runAuditVerify(args []string) {
+	fs := flag.NewFlagSet("audit verify", flag.ExitOnError)
+	pubFile := fs.String("pub", "audit.key.pub", "Ed25519 public key of the export")
+	in := fs.String("in", "audit.jsonl", "Signed export to verify")
+	parseFlags(fs, args)
+
+	pub, err := readPublicKey(*pubFile)
+	if err != nil {
+		log.Fatalf("Unable to read public key: %v", err)
+	}
+	f, err := os.Open(*in)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	problems := 0
+	prev := ""
+	n := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		n++
+		if err := verifyAuditLine(pub, scanner.Bytes(), n, prev); err != nil {
+			fmt.Printf("* line %d: %v\n", n, err)
+			problems++
+		}
+		sum := sha256.Sum256(scanner.Bytes())
+		prev = hex.EncodeToString(sum[:])
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+	if problems > 0 {
+		fmt.Printf("%d of %d lines failed verification\n", problems, n)
+		os.Exit(exitVerification)
+	}
+	fmt.Printf("All %d lines verified\n", n)
+}
+
+func verifyAuditLine(pub ed25519.PublicKey, data []byte, seq int, prev string) error {
+	var line auditLine
+	if err := json.Unmarshal(data, &line); err != nil {
+		return err
+	}
+	signature, err := base64.StdEncoding.DecodeString(line.Signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, line.Payload, signature) {
+		return errors.New("bad signature")
+	}
+	var payload auditPayload
+	if err := json.Unmarshal(line.Payload, &payload); err != nil {
+		return err
+	}
+	if payload.Seq != seq {
+		return fmt.Errorf("sequence number %d, expected %d", payload.Seq, seq)
+	}
+	if payload.Prev != prev {
+		return errors.New("doesn't chain to the line before it")
+	}
+	return nil
+}
+
+// Reads a hex Ed25519 seed from path, or generates one and writes it along with the
+// public key in path.pub.
+func loadOrCreateSigningKey(path string) (ed25519.PrivateKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err == nil {
+		seed, err := hex.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("%s is not a hex Ed25519 seed", path)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(path, []byte(hex.EncodeToString(key.Seed())+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(path+".pub", []byte(hex.EncodeToString(pub)+"\n"), 0644); err != nil {
+		return nil, err
+	}
+	log.Printf("Created signing key %s and public key %s.pub\n", path, path)
+	return key, nil
+}
+
+func readPublicKey(path string) (ed25519.PublicKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%s is not a hex Ed25519 public key", path)
+	}
+	return ed25519.PublicKey(pub), nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+
+	"github.com/weineran/gmail-cleanup/transform"
+)
+
+// Signature headers that cover the original body, so they never validate on a rewritten
+// copy. Authentication-Results and Received-SPF record what the receiving server checked
+// when the original arrived, and stay true of it, so they are kept.
+var authHeaders = []string{"DKIM-Signature", "ARC-Seal", "ARC-Message-Signature", "ARC-Authentication-Results"}
+
+func isAuthHeader(name string) bool {
+	for _, h := range authHeaders {
+		if strings.EqualFold(name, h) {
+			return true
+		}
+	}
+	return false
+}
+
+// Removes the signature headers from the copy, for --drop-auth-headers.
+type authHeaderDropper struct{}
+
+func (authHeaderDropper) Transform(m *transform.ParsedMessage) error {
+	var kept []*gmail.MessagePartHeader
+	for _, header := range m.Payload.Headers {
+		if !isAuthHeader(header.Name) {
+			kept = append(kept, header)
+		}
+	}
+	m.Payload.Headers = kept
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+
+	"github.com/weineran/gmail-cleanup/cleaner"
+	"github.com/weineran/gmail-cleanup/internal/mimeutil"
+)
+
+// Selects messages in a backend-independent way.
+type searchCriteria struct {
+	// Only messages larger than this many bytes, if not 0.
+	larger int64
+	// Only messages received before this time, if not zero.
+	before time.Time
+}
+
+// Stores whole raw messages. Implemented for the Gmail API and for IMAP, so
+// processMessage strips attachments the same way from any mailbox.
+type mailBackend interface {
+	// Returns the ids of the messages matching c.
+	search(c searchCriteria) ([]string, error)
+	// Returns a message parsed into its parts, with the metadata the backend has for it
+	// (Gmail labels or IMAP flags as LabelIds), and its raw source in a spool file, where
+	// the bodies of its attachments are left. The caller closes the spool.
+	fetch(id string) (*gmail.Message, *mimeutil.Spool, error)
+	// Stores copy as a new message with copy's labels, dated date where the backend
+	// can't take the date from the Date header. Returns its id.
+	add(copy *messageCopy, date time.Time) (string, error)
+	// Moves a message to the trash, from where it can still be restored.
+	trash(id string) error
+	// Permanently removes a message.
+	remove(id string) error
+	close() error
+}
+
+// Returns the backend processMessage goes through: the one opts was given, or else the
+// Gmail API through mb.
+func (opts *removeOptions) mailBackend(mb *mailbox) mailBackend {
+	if opts.backend != nil {
+		return opts.backend
+	}
+	return &gmailBackend{mb: mb, insertMethod: opts.insertMethod}
+}
+
+// The Gmail API as a mailBackend.
+type gmailBackend struct {
+	mb *mailbox
+	// insertMethodInsert or insertMethodImport.
+	insertMethod string
+}
+
+func (b *gmailBackend) search(c searchCriteria) ([]string, error) {
+	var terms []string
+	if c.larger > 0 {
+		terms = append(terms, fmt.Sprintf("larger:%d", c.larger))
+	}
+	if !c.before.IsZero() {
+		terms = append(terms, "before:"+c.before.Format("2006/01/02"))
+	}
+	messages, err := cleaner.Collect(b.mb.cleaner().List(context.Background(), strings.Join(terms, " ")))
+	var ids []string
+	for _, m := range messages {
+		ids = append(ids, m.Id)
+	}
+	return ids, err
+}
+
+func (b *gmailBackend) fetch(id string) (*gmail.Message, *mimeutil.Spool, error) {
+	return b.mb.getSpooledMessage(id)
+}
+
+// Gmail dates the copy from its Date header, so date isn't needed.
+func (b *gmailBackend) add(copy *messageCopy, date time.Time) (string, error) {
+	m, err := b.mb.addRaw(copy.Message, copy.source(), b.insertMethod)
+	if err != nil {
+		return "", err
+	}
+	return m.Id, nil
+}
+
+func (b *gmailBackend) trash(id string) error {
+	_, err := b.mb.trashMessage(id)
+	return err
+}
+
+func (b *gmailBackend) remove(id string) error {
+	return b.mb.deleteMessage(id)
+}
+
+func (b *gmailBackend) close() error {
+	return nil
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// `backups verify` and `backups prune`.
+func runBackups(args []string) {
+	if len(args) == 0 {
+		log.Fatalf("Usage: gmail-cleanup backups verify|prune --backup-dir DIR")
+	}
+	switch args[0] {
+	case "verify":
+		runBackupsVerify(args[1:])
+	case "prune":
+		runBackupsPrune(args[1:])
+	default:
+		log.Fatalf("Unknown backups command [%s], expected verify or prune", args[0])
+	}
+}
+
+// One file to hash, and the SHA-256 the journal recorded for it.
+type backupCheck struct {
+	// What it is, for the report, e.g. "backup RUN/ID.eml".
+	name     string
+	expected string
+	hash     func() (string, error)
+}
+
+// Re-hashes the .eml backups of replaced messages, and with --archive-dir their archived
+// attachments, against the hashes in the journal, so a restore doesn't find out too late
+// that they are damaged or gone. Files are hashed in parallel.
+func runBackupsVerify(args []string) {
+	fs := flag.NewFlagSet("backups verify", flag.ExitOnError)
+	profile := fs.String("profile", "", "Verify the backups of this profile's runs")
+	backupDir := fs.String("backup-dir", "", "The --backup-dir runs saved originals to")
+	archiveDir := fs.String("archive-dir", "", "Also verify the attachments archived to this directory")
+	storeURL := fs.String("store", "", "sftp://user@host/path or s3://bucket/prefix the attachments were stored at instead of the archive directory")
+	run := fs.String("run", "", "Only verify the backups of this run")
+	workers := fs.Int("workers", runtime.NumCPU(), "Number of files to hash at once")
+	parseFlags(fs, args)
+	if *backupDir == "" {
+		log.Fatalf("Usage: gmail-cleanup backups verify --backup-dir DIR [--archive-dir DIR]")
+	}
+	if *workers < 1 {
+		log.Fatalf("--workers must be at least 1, got %d", *workers)
+	}
+
+	entries, err := readJournal(profileJournalFile(*profile))
+	if err != nil {
+		log.Fatalf("Unable to read journal: %v", err)
+	}
+	var s *attachmentStore
+	if *archiveDir != "" || *storeURL != "" {
+		s, err = openAttachmentStore(*archiveDir, *storeURL, "")
+		if err != nil {
+			log.Fatalf("Unable to open store: %v", err)
+		}
+		defer s.close()
+	}
+
+	var checks []backupCheck
+	var problems []string
+	journaled := map[string]bool{}
+	checkedObjects := map[string]bool{}
+	for _, e := range entries {
+		if e.Action != journalStripped || (*run != "" && e.RunId != *run) {
+			continue
+		}
+		path := backupPath(*backupDir, e.RunId, e.MessageId)
+		journaled[path] = true
+		// Runs without --backup-dir have no directory and nothing to check.
+		if _, err := os.Stat(filepath.Dir(path)); err == nil {
+			name := "backup " + filepath.Join(e.RunId, e.MessageId+".eml")
+			if e.RawSHA256 == "" {
+				problems = append(problems, name+": the journal has no hash for it")
+			} else {
+				checks = append(checks, backupCheck{name: name, expected: e.RawSHA256, hash: func() (string, error) { return hashFile(path) }})
+			}
+		}
+		if s == nil {
+			continue
+		}
+		ref, err := s.readRef(e.MessageId)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("ref %s: %v", e.MessageId, err))
+			continue
+		}
+		recorded := map[string]bool{}
+		for _, a := range e.Attachments {
+			recorded[a.SHA256] = true
+		}
+		for _, a := range ref.Attachments {
+			name := fmt.Sprintf("attachment [%s] of %s", a.Filename, e.MessageId)
+			if !recorded[a.SHA256] {
+				problems = append(problems, name+": its hash isn't the one the journal recorded")
+				continue
+			}
+			if checkedObjects[a.SHA256] {
+				continue
+			}
+			checkedObjects[a.SHA256] = true
+			hash := a.SHA256
+			checks = append(checks, backupCheck{name: name, expected: hash, hash: func() (string, error) { return s.hashObject(hash) }})
+		}
+	}
+
+	// Backups the journal doesn't know about, e.g. from a run that crashed before
+	// recording the copy, can't be checked.
+	runDirs, err := ioutil.ReadDir(*backupDir)
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatalf("Unable to list backups: %v", err)
+	}
+	var unknown int
+	for _, d := range runDirs {
+		if !d.IsDir() || (*run != "" && d.Name() != *run) {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(*backupDir, d.Name()))
+		if err != nil {
+			log.Fatalf("Unable to list backups: %v", err)
+		}
+		for _, f := range files {
+			if strings.HasSuffix(f.Name(), ".eml") && !journaled[filepath.Join(*backupDir, d.Name(), f.Name())] {
+				fmt.Printf("* backup %s: not in the journal, not verified\n", filepath.Join(d.Name(), f.Name()))
+				unknown++
+			}
+		}
+	}
+
+	problems = append(problems, verifyBackupChecks(checks, *workers)...)
+	sort.Strings(problems)
+	for _, p := range problems {
+		fmt.Printf("* %s\n", p)
+	}
+	fmt.Printf("Checked %d files (%d not in the journal), found %d problems.\n", len(checks), unknown, len(problems))
+	if len(problems) > 0 {
+		os.Exit(exitVerification)
+	}
+}
+
+// Hashes the files of checks with the given number of workers and returns what is wrong
+// with them.
+func verifyBackupChecks(checks []backupCheck, workers int) []string {
+	jobs := make(chan backupCheck)
+	var mu sync.Mutex
+	var problems []string
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range jobs {
+				var problem string
+				actual, err := c.hash()
+				if os.IsNotExist(err) {
+					problem = c.name + ": missing"
+				} else if err != nil {
+					problem = fmt.Sprintf("%s: %v", c.name, err)
+				} else if actual != c.expected {
+					problem = fmt.Sprintf("%s: content hashes to %s, the journal has %s", c.name, actual, c.expected)
+				}
+				if problem != "" {
+					mu.Lock()
+					problems = append(problems, problem)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, c := range checks {
+		jobs <- c
+	}
+	close(jobs)
+	wg.Wait()
+	return problems
+}
+
+// The backups of one run: the directory --backup-dir has for it.
+type runBackupDir struct {
+	runId   string
+	started time.Time
+	bytes   int64
+}
+
+// Returns when the run with id runId started, and false if runId isn't a run id.
+func parseRunId(runId string) (time.Time, bool) {
+	started, err := time.ParseInLocation("20060102-150405", runId, time.Local)
+	if err != nil || newRunId(started) != runId {
+		return time.Time{}, false
+	}
+	return started, true
+}
+
+// Lists the run directories under dir, oldest first. Directories not named like a run id
+// aren't backups of a run, and are left out.
+func listRunBackups(dir string) ([]runBackupDir, error) {
+	runDirs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var runs []runBackupDir
+	for _, d := range runDirs {
+		started, ok := parseRunId(d.Name())
+		if !d.IsDir() || !ok {
+			continue
+		}
+		r := runBackupDir{runId: d.Name(), started: started}
+		files, err := ioutil.ReadDir(filepath.Join(dir, d.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			r.bytes += f.Size()
+		}
+		runs = append(runs, r)
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].started.Before(runs[j].started) })
+	return runs, nil
+}
+
+// Picks the runs to delete from runs, oldest first: those started more than keep ago,
+// then the oldest of the rest until they add up to maxBytes or less. 0 means no limit.
+func backupsToPrune(runs []runBackupDir, keep time.Duration, maxBytes int64, now time.Time) []runBackupDir {
+	var total int64
+	for _, r := range runs {
+		total += r.bytes
+	}
+	var pruned []runBackupDir
+	for _, r := range runs {
+		if (keep > 0 && now.Sub(r.started) > keep) || (maxBytes > 0 && total > maxBytes) {
+			pruned = append(pruned, r)
+			total -= r.bytes
+		}
+	}
+	return pruned
+}
+
+// Returns the number of failed messages of each run that recorded its completion in the
+// state database. A run missing from it crashed or was interrupted.
+func completedRuns(profile string) (map[string]int, error) {
+	db, err := openStateDB(profile)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rows, err := db.Query(`SELECT run_id, failed FROM runs`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	runs := map[string]int{}
+	for rows.Next() {
+		var runId string
+		var failed int
+		if err := rows.Scan(&runId, &failed); err != nil {
+			return nil, err
+		}
+		runs[runId] = failed
+	}
+	return runs, rows.Err()
+}
+
+// The profile whose journal has a run, and what the journal says about the run.
+type runOwner struct {
+	profile string
+	// Whether other profiles' journals have the run too, so it can't be told whose it is.
+	ambiguous bool
+	// Messages deleted before their copy was recorded, which only the backups have.
+	deletedFirst int
+}
+
+// Finds the profile each of runs belongs to by reading the journals of every profile,
+// the default one included. Runs no journal has are missing from the result.
+func runOwners(runs []runBackupDir) (map[string]*runOwner, error) {
+	profiles, err := listProfiles()
+	if err != nil {
+		return nil, err
+	}
+	wanted := map[string]bool{}
+	for _, r := range runs {
+		wanted[r.runId] = true
+	}
+	owners := map[string]*runOwner{}
+	for _, profile := range append([]string{""}, profiles...) {
+		entries, err := readJournal(profileJournalFile(profile))
+		if err != nil {
+			return nil, err
+		}
+		// Messages of each run deleted first, until their copy is recorded.
+		deletedFirst := map[string]map[string]bool{}
+		for _, e := range entries {
+			if !wanted[e.RunId] {
+				continue
+			}
+			owner, ok := owners[e.RunId]
+			if !ok {
+				owner = &runOwner{profile: profile}
+				owners[e.RunId] = owner
+			}
+			if owner.profile != profile {
+				owner.ambiguous = true
+				continue
+			}
+			if deletedFirst[e.RunId] == nil {
+				deletedFirst[e.RunId] = map[string]bool{}
+			}
+			switch {
+			case e.Action == journalCopying && e.DeletedFirst:
+				deletedFirst[e.RunId][e.MessageId] = true
+			case e.Action == journalStripped:
+				delete(deletedFirst[e.RunId], e.MessageId)
+			}
+		}
+		for runId, messages := range deletedFirst {
+			owners[runId].deletedFirst = len(messages)
+		}
+	}
+	return owners, nil
+}
+
+// Deletes the backups of old runs, as keep_backups and max_backup_size in the config
+// file say. The backups of a run that didn't finish cleanly may be the only copy of
+// its messages, so they are listed and asked about separately, and --yes alone doesn't
+// delete them. Whether a run finished is checked with the profile whose journal has it.
+func runBackupsPrune(args []string) {
+	fs := flag.NewFlagSet("backups prune", flag.ExitOnError)
+	profile := fs.String("profile", "", "Read keep_backups and max_backup_size from this profile's config file")
+	backupDir := fs.String("backup-dir", "", "The --backup-dir runs saved originals to")
+	keep := fs.String("keep", "", "Keep the backups of runs started within this age, e.g. 180d, instead of keep_backups in the config file")
+	maxSize := fs.String("max-size", "", "Delete the oldest backups until the rest take up at most this much, e.g. 50G, instead of max_backup_size in the config file")
+	dryRun := fs.Bool("dry-run", false, "Only list the backups that would be deleted")
+	assumeYes := fs.Bool("yes", false, "Delete the backups of runs that finished cleanly without asking")
+	includeUnverified := fs.Bool("include-unverified", false, "With --yes, also delete the backups of runs that didn't finish cleanly or that no profile's journal has")
+	parseFlags(fs, args)
+	if *backupDir == "" {
+		log.Fatalf("Usage: gmail-cleanup backups prune --backup-dir DIR [--keep 180d] [--max-size 50G]")
+	}
+
+	path := profileConfigFile(*profile)
+	c, err := loadConfig(path)
+	if err != nil {
+		log.Fatalf("Unable to read config: %v", err)
+	}
+	if *keep == "" {
+		*keep = c.KeepBackups
+	}
+	if *maxSize == "" {
+		*maxSize = c.MaxBackupSize
+	}
+	if *keep == "" && *maxSize == "" {
+		log.Fatalf("Nothing to prune by: set keep_backups or max_backup_size in [%s], or pass --keep or --max-size", path)
+	}
+	var keepAge time.Duration
+	if *keep != "" {
+		keepAge, err = parseAge(*keep)
+		if err != nil {
+			log.Fatalf("keep_backups: %v", err)
+		}
+	}
+	var maxBytes int64
+	if *maxSize != "" {
+		maxBytes, err = parseSize(*maxSize)
+		if err != nil {
+			log.Fatalf("max_backup_size: %v", err)
+		}
+	}
+
+	runs, err := listRunBackups(*backupDir)
+	if err != nil {
+		log.Fatalf("Unable to list backups: %v", err)
+	}
+	candidates := backupsToPrune(runs, keepAge, maxBytes, time.Now())
+	owners, err := runOwners(candidates)
+	if err != nil {
+		log.Fatalf("Unable to read journals: %v", err)
+	}
+	// Finished runs, by profile.
+	completed := map[string]map[string]int{}
+	var finished, unfinished []runBackupDir
+	for _, r := range candidates {
+		owner := owners[r.runId]
+		var failed int
+		var done bool
+		if owner != nil && !owner.ambiguous {
+			if completed[owner.profile] == nil {
+				if completed[owner.profile], err = completedRuns(owner.profile); err != nil {
+					log.Fatalf("Unable to read finished runs: %v", err)
+				}
+			}
+			failed, done = completed[owner.profile][r.runId]
+		}
+		switch {
+		case owner == nil:
+			fmt.Printf("* %s (%s) - warning: no profile's journal has the run, so it can't be checked\n", r.runId, formatBytes(r.bytes))
+			unfinished = append(unfinished, r)
+		case owner.ambiguous:
+			fmt.Printf("* %s (%s) - warning: the journals of several profiles have the run, so it can't be checked\n", r.runId, formatBytes(r.bytes))
+			unfinished = append(unfinished, r)
+		case owner.deletedFirst > 0:
+			fmt.Printf("* %s (%s) - warning: %d messages of the run were deleted before their copies were recorded, and may only be in these backups\n", r.runId, formatBytes(r.bytes), owner.deletedFirst)
+			unfinished = append(unfinished, r)
+		case !done:
+			fmt.Printf("* %s (%s) - warning: the run has no completion record; it may have crashed, and these may be the only copies of its messages\n", r.runId, formatBytes(r.bytes))
+			unfinished = append(unfinished, r)
+		case failed > 0:
+			fmt.Printf("* %s (%s) - warning: %d messages failed in the run\n", r.runId, formatBytes(r.bytes), failed)
+			unfinished = append(unfinished, r)
+		default:
+			fmt.Printf("* %s (%s)\n", r.runId, formatBytes(r.bytes))
+			finished = append(finished, r)
+		}
+	}
+	if len(finished)+len(unfinished) == 0 {
+		fmt.Printf("Nothing to prune among the backups of %d runs.\n", len(runs))
+		return
+	}
+	if *dryRun {
+		fmt.Printf("Dry run: would delete the backups of %d runs, %d of them with warnings.\n", len(finished)+len(unfinished), len(unfinished))
+		return
+	}
+
+	var prune []runBackupDir
+	if len(finished) > 0 && (*assumeYes || askYesNo(fmt.Sprintf("Do you want to delete the backups of these %d runs?", len(finished)))) {
+		prune = append(prune, finished...)
+	}
+	switch {
+	case len(unfinished) == 0:
+	case *assumeYes && !*includeUnverified:
+		fmt.Printf("Keeping the backups of the %d runs with warnings; pass --include-unverified to delete them too.\n", len(unfinished))
+	case *assumeYes || askYesNo(fmt.Sprintf("Do you also want to delete the backups of the %d runs with warnings?", len(unfinished))):
+		prune = append(prune, unfinished...)
+	}
+	var freed int64
+	for _, r := range prune {
+		if err := os.RemoveAll(filepath.Join(*backupDir, r.runId)); err != nil {
+			log.Fatalf("Unable to delete the backups of run [%s]: %v", r.runId, err)
+		}
+		freed += r.bytes
+	}
+	fmt.Printf("Deleted the backups of %d runs, freeing %s.\n", len(prune), formatBytes(freed))
+}
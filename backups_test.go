@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRunId(t *testing.T) {
+	tests := []struct {
+		runId string
+		want  bool
+	}{
+		{"20240113-093012", true},
+		{"20240113-093012.old", false},
+		{"2024-01-13", false},
+		{"20241313-093012", false},
+		{"lost+found", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.runId, func(t *testing.T) {
+			started, ok := parseRunId(tt.runId)
+			if ok != tt.want {
+				t.Fatalf("parseRunId() ok = %v, want %v", ok, tt.want)
+			}
+			if ok && newRunId(started) != tt.runId {
+				t.Errorf("parseRunId() = %v, which is run %s", started, newRunId(started))
+			}
+		})
+	}
+}
+
+func TestListRunBackups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gmail-cleanup-backups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"20240201-120000", "20240113-093012", "lost+found", "notes"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name, "m1.eml"), []byte("Subject: hi\r\n\r\nbody"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "20240301-000000"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	runs, err := listRunBackups(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range runs {
+		got = append(got, r.runId)
+		if r.bytes != 19 {
+			t.Errorf("run %s has %d bytes, want 19", r.runId, r.bytes)
+		}
+	}
+	if want := []string{"20240113-093012", "20240201-120000"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("listRunBackups() = %v, want %v", got, want)
+	}
+}
+
+func TestBackupsToPrune(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.Local)
+	runs := []runBackupDir{
+		{runId: "a", started: now.AddDate(0, 0, -300), bytes: 30},
+		{runId: "b", started: now.AddDate(0, 0, -100), bytes: 20},
+		{runId: "c", started: now.AddDate(0, 0, -10), bytes: 10},
+	}
+	tests := []struct {
+		name     string
+		keep     time.Duration
+		maxBytes int64
+		want     []string
+	}{
+		{"no limits", 0, 0, nil},
+		{"by age", 180 * 24 * time.Hour, 0, []string{"a"}},
+		{"by size", 0, 25, []string{"a", "b"}},
+		{"by both", 180 * 24 * time.Hour, 40, []string{"a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, r := range backupsToPrune(runs, tt.keep, tt.maxBytes, now) {
+				got = append(got, r.runId)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("backupsToPrune() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
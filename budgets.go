@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+
+	"github.com/weineran/gmail-cleanup/internal/mimeutil"
+)
+
+// Query whose messages count towards sender budgets by default; small messages barely affect storage.
+const defaultBudgetQuery = "larger:100K"
+
+// Returns the first budget matching sender, or nil.
+func budgetFor(budgets []policyBudget, sender string) *policyBudget {
+	for i, b := range budgets {
+		switch {
+		case b.sender == "":
+		case strings.HasPrefix(b.sender, "@"):
+			if !strings.HasSuffix(sender, b.sender) {
+				continue
+			}
+		case b.sender != sender:
+			continue
+		}
+		return &budgets[i]
+	}
+	return nil
+}
+
+// Totals SizeEstimate per sender address.
+func senderUsage(messages []*gmail.Message) map[string]int64 {
+	usage := map[string]int64{}
+	for _, m := range messages {
+		usage[messageSender(m)] += m.SizeEstimate
+	}
+	return usage
+}
+
+func messageSender(m *gmail.Message) string {
+	if m.Payload == nil {
+		return ""
+	}
+	return senderAddress(mimeutil.HeaderValue(m.Payload.Headers, "From"))
+}
+
+// Picks, for each sender over its budget, the oldest messages of at least the budget's
+// min_size whose sizes add up to the excess, skipping those already tried.
+func pickOverBudget(messages []*gmail.Message, budgets []policyBudget, tried map[string]bool) map[string]*policyBudget {
+	usage := senderUsage(messages)
+	sorted := append([]*gmail.Message(nil), messages...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].InternalDate < sorted[j].InternalDate
+	})
+
+	picked := map[string]*policyBudget{}
+	excess := map[string]int64{}
+	for sender, used := range usage {
+		if b := budgetFor(budgets, sender); b != nil && used > b.maxBytes {
+			excess[sender] = used - b.maxBytes
+			fmt.Printf("Sender [%s] uses %s, over its budget of %s\n", sender, formatBytes(used), formatBytes(b.maxBytes))
+		}
+	}
+	for _, m := range sorted {
+		sender := messageSender(m)
+		if excess[sender] <= 0 || tried[m.Id] {
+			continue
+		}
+		b := budgetFor(budgets, sender)
+		if m.SizeEstimate < b.minSize {
+			continue
+		}
+		picked[m.Id] = b
+		excess[sender] -= m.SizeEstimate
+	}
+	return picked
+}
+
+// Strips or deletes the oldest large messages of each sender over its budget, counting
+// the messages matching queryString, and measures again until every sender is under
+// budget or has nothing left to try. Returns false if the run should stop.
+func enforceBudgets(mb *mailbox, queryString string, budgets []policyBudget, removeOpts *removeOptions, force bool, summary *runSummary) bool {
+	tried := map[string]bool{}
+	for {
+		c := mb.cleaner()
+		c.MetadataHeaders = []string{"From"}
+		var messages []*gmail.Message
+		for r := range c.Messages(context.Background(), queryString) {
+			if r.Err != nil {
+				if code := exitCodeFor(r.Err); code == exitQuota || code == exitAuth {
+					summary.stop(r.Err)
+					return false
+				}
+				exitf(exitCodeFor(r.Err), "Unable to retrieve messages: %v", r.Err)
+			}
+			messages = append(messages, r.Message)
+		}
+
+		removeOpts.overBudget = pickOverBudget(messages, budgets, tried)
+		if len(removeOpts.overBudget) == 0 {
+			fmt.Println("Every sender is under budget, or has no more messages large enough to strip or delete.")
+			return true
+		}
+		var picked []*gmail.Message
+		for _, m := range messages {
+			if removeOpts.overBudget[m.Id] != nil {
+				picked = append(picked, m)
+				tried[m.Id] = true
+			}
+		}
+		fmt.Printf("Picked %d messages to bring senders under budget\n", len(picked))
+		summary.Matched += len(picked)
+		if !processMessages(mb, queryString, picked, removeOpts, force, summary, nil) {
+			return false
+		}
+		// Stripped copies are smaller but not empty, so measure again.
+		force = true
+	}
+}
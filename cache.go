@@ -0,0 +1,172 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// A local SQLite cache of message skeletons: messages in full format with body data
+// removed, which is enough for sizes, headers, labels and attachment lists. It remembers
+// the mailbox historyId it is current as of, and on open drops every message that the
+// History API reports as deleted or relabeled since then.
+type metadataCache struct {
+	db *sql.DB
+}
+
+// Opens the cache at path and brings it up to date with the mailbox.
+func openMetadataCache(mb *mailbox, path string) (*metadataCache, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS messages (id TEXT PRIMARY KEY, skeleton TEXT NOT NULL);
+		CREATE TABLE IF NOT EXISTS state (key TEXT PRIMARY KEY, value TEXT NOT NULL);`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	c := &metadataCache{db: db}
+	if err := c.sync(mb); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *metadataCache) close() error {
+	return c.db.Close()
+}
+
+// Returns the cached skeleton of id, or nil if it isn't cached.
+func (c *metadataCache) get(id string) (*gmail.Message, error) {
+	var skeleton string
+	err := c.db.QueryRow(`SELECT skeleton FROM messages WHERE id = ?`, id).Scan(&skeleton)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m gmail.Message
+	if err := json.Unmarshal([]byte(skeleton), &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (c *metadataCache) put(m *gmail.Message) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec(`INSERT OR REPLACE INTO messages (id, skeleton) VALUES (?, ?)`, m.Id, string(b))
+	return err
+}
+
+func (c *metadataCache) historyId() (uint64, error) {
+	var value string
+	err := c.db.QueryRow(`SELECT value FROM state WHERE key = 'historyId'`).Scan(&value)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+func (c *metadataCache) setHistoryId(id uint64) error {
+	_, err := c.db.Exec(`INSERT OR REPLACE INTO state (key, value) VALUES ('historyId', ?)`, strconv.FormatUint(id, 10))
+	return err
+}
+
+// Invalidates messages changed since the stored historyId. When there is no stored
+// historyId, or Gmail no longer has history that old, the cache starts over.
+func (c *metadataCache) sync(mb *mailbox) error {
+	last, err := c.historyId()
+	if err != nil {
+		return err
+	}
+	if last == 0 {
+		return c.reset(mb)
+	}
+
+	invalidated := 0
+	newest := last
+	pageToken := ""
+	for {
+		r, err := mb.listHistory(last, pageToken)
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+			log.Println("Metadata cache is older than the mailbox history, starting over.")
+			return c.reset(mb)
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, h := range r.History {
+			var changed []*gmail.Message
+			for _, d := range h.MessagesDeleted {
+				changed = append(changed, d.Message)
+			}
+			for _, a := range h.LabelsAdded {
+				changed = append(changed, a.Message)
+			}
+			for _, rm := range h.LabelsRemoved {
+				changed = append(changed, rm.Message)
+			}
+			for _, m := range changed {
+				if _, err := c.db.Exec(`DELETE FROM messages WHERE id = ?`, m.Id); err != nil {
+					return err
+				}
+				invalidated++
+			}
+		}
+		if r.HistoryId > newest {
+			newest = r.HistoryId
+		}
+		if r.NextPageToken == "" {
+			break
+		}
+		pageToken = r.NextPageToken
+	}
+
+	if invalidated > 0 {
+		log.Printf("Metadata cache: invalidated %d changes since history [%d]\n", invalidated, last)
+	}
+	return c.setHistoryId(newest)
+}
+
+func (c *metadataCache) reset(mb *mailbox) error {
+	profile, err := mb.getProfile()
+	if err != nil {
+		return err
+	}
+	if _, err := c.db.Exec(`DELETE FROM messages`); err != nil {
+		return err
+	}
+	return c.setHistoryId(profile.HistoryId)
+}
+
+// Clears the data of every body in p, keeping sizes and attachment ids.
+func stripBodyData(p *gmail.MessagePart) {
+	if p == nil {
+		return
+	}
+	if p.Body != nil {
+		p.Body.Data = ""
+	}
+	for _, subpart := range p.Parts {
+		stripBodyData(subpart)
+	}
+}
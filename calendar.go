@@ -0,0 +1,24 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// Reports whether p is a calendar invitation: a text/calendar or application/ics part, or
+// an .ics file. They are tiny, and Gmail shows the event chip from them.
+func isCalendarPart(p *gmail.MessagePart) bool {
+	mimeType := strings.ToLower(p.MimeType)
+	return mimeType == "text/calendar" || mimeType == "application/ics" || strings.EqualFold(filepath.Ext(p.Filename), ".ics")
+}
+
+func calendarOnly(attachments []fetchedAttachment) bool {
+	for _, a := range attachments {
+		if !isCalendarPart(a.part) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+
+	"github.com/weineran/gmail-cleanup/internal/mimeutil"
+)
+
+// Heuristic message categories that policies can target.
+const (
+	categoryFromMe           = "from me"
+	categoryNewsletter       = "newsletter"
+	categoryPhotos           = "photos from contacts"
+	categoryWorkDocuments    = "work documents"
+	categoryAutomatedReports = "automated reports"
+	categoryOther            = "other"
+)
+
+var automatedSenderPattern = regexp.MustCompile(`^(no-?reply|do-?not-?reply|notifications?|alerts?|reports?|reporting|mailer-daemon|postmaster|automated|system|daemon)\b`)
+
+var documentExtensions = map[string]bool{
+	".pdf": true, ".doc": true, ".docx": true, ".xls": true, ".xlsx": true, ".ppt": true, ".pptx": true,
+	".odt": true, ".ods": true, ".odp": true, ".rtf": true, ".pages": true, ".numbers": true, ".key": true,
+}
+
+var reportExtensions = map[string]bool{".csv": true, ".xls": true, ".xlsx": true, ".json": true, ".xml": true, ".log": true}
+
+// Classifies a message fetched in full format using its sender, List-Id and attachment types.
+// Mail from one of own, the user's addresses, is always from me.
+func classifyMessage(m *gmail.Message, own map[string]bool) string {
+	if m.Payload == nil {
+		return categoryOther
+	}
+	headers := m.Payload.Headers
+	sender := senderAddress(mimeutil.HeaderValue(headers, "From"))
+	if own[sender] {
+		return categoryFromMe
+	}
+	localPart := sender
+	if i := strings.Index(sender, "@"); i >= 0 {
+		localPart = sender[:i]
+	}
+	automated := automatedSenderPattern.MatchString(localPart) ||
+		(mimeutil.HeaderValue(headers, "Auto-Submitted") != "" && !strings.EqualFold(mimeutil.HeaderValue(headers, "Auto-Submitted"), "no"))
+	mailingList := mimeutil.HeaderValue(headers, "List-Id") != "" || mimeutil.HeaderValue(headers, "List-Unsubscribe") != ""
+
+	var media, documents, reports, total int
+	var parts []*gmail.MessagePart
+	for _, part := range getMessagePartsRecursively(m.Payload, parts) {
+		if part.Filename == "" {
+			continue
+		}
+		total++
+		ext := strings.ToLower(filepath.Ext(part.Filename))
+		mimeType := strings.ToLower(part.MimeType)
+		switch {
+		case strings.HasPrefix(mimeType, "image/") || strings.HasPrefix(mimeType, "video/"):
+			media++
+		case documentExtensions[ext]:
+			documents++
+		}
+		if reportExtensions[ext] {
+			reports++
+		}
+	}
+
+	subject := strings.ToLower(mimeutil.HeaderValue(headers, "Subject"))
+	switch {
+	case automated && (reports > 0 || strings.Contains(subject, "report")):
+		return categoryAutomatedReports
+	case mailingList && !automated:
+		return categoryNewsletter
+	case automated:
+		return categoryAutomatedReports
+	case total > 0 && media*2 > total:
+		return categoryPhotos
+	case documents > 0:
+		return categoryWorkDocuments
+	}
+	return categoryOther
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"log"
+)
+
+// Label of messages from Google Chat (and classic Hangouts) saved to Gmail.
+const chatLabel = "CHAT"
+
+// Reports whether a message with these labels came from Chat. Chat messages don't have the MIME structure of
+// email, so they are counted and skipped rather than rebuilt.
+func isChatMessage(labelIds []string) bool {
+	for _, id := range labelIds {
+		if id == chatLabel {
+			return true
+		}
+	}
+	return false
+}
+
+// Logs that a Chat message is skipped, and returns its outcome.
+func skipChatMessage(id string) outcome {
+	log.Printf("Warning: message [%+v] is a Chat message, skipping. Add -in:chats to the query to leave Chat out.\n", id)
+	return outcomeChat
+}
@@ -0,0 +1,235 @@
+// Package cleaner is the library interface to gmail-cleanup. It hides pagination,
+// metadata batching and rate limiting from callers.
+package cleaner
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// Gmail allows 250 quota units per user per second.
+const DefaultUnitsPerSecond = 250
+
+// Quota units of the calls made by Messages.
+var methodUnits = map[string]int{
+	"messages.list": 5,
+	"messages.get":  5,
+}
+
+type Cleaner struct {
+	Service *gmail.Service
+	// The mailbox to read; "me" if empty.
+	User string
+	// Rate limit in quota units per second; DefaultUnitsPerSecond if zero.
+	UnitsPerSecond int
+	// Number of metadata fetches in flight at once; 10 if zero.
+	BatchSize int
+	// Headers returned with each message's metadata; all headers if empty.
+	MetadataHeaders []string
+	// Called before every API call. A non-nil error stops iteration and is reported.
+	Charge func(method string) error
+
+	once    sync.Once
+	limiter *limiter
+}
+
+func New(service *gmail.Service) *Cleaner {
+	return &Cleaner{Service: service}
+}
+
+// One step of the Messages iterator: a message in metadata format, or the error that ended iteration.
+type MessageResult struct {
+	Message *gmail.Message
+	Err     error
+}
+
+// Streams the metadata of every message matching query. The channel is closed after
+// the last message, after an error result, or when ctx is done. Callers that stop
+// reading before then must cancel ctx, or the goroutine filling it stays blocked.
+func (c *Cleaner) Messages(ctx context.Context, query string) <-chan MessageResult {
+	return c.iterate(ctx, query, func(page []*gmail.Message, send func(MessageResult) bool) bool {
+		for start := 0; start < len(page); start += c.batchSize() {
+			end := start + c.batchSize()
+			if end > len(page) {
+				end = len(page)
+			}
+			for _, r := range c.getBatch(ctx, page[start:end]) {
+				if !send(r) || r.Err != nil {
+					return false
+				}
+			}
+		}
+		return true
+	})
+}
+
+// Streams every message matching query as the list returns it, with only Id and
+// ThreadId set, for callers that don't need the metadata. The channel is closed as
+// Messages' is.
+func (c *Cleaner) List(ctx context.Context, query string) <-chan MessageResult {
+	return c.iterate(ctx, query, func(page []*gmail.Message, send func(MessageResult) bool) bool {
+		for _, m := range page {
+			if !send(MessageResult{Message: m}) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// Lists the pages of messages matching query in a goroutine and passes each to
+// handle, which sends results and reports whether to go on.
+func (c *Cleaner) iterate(ctx context.Context, query string, handle func(page []*gmail.Message, send func(MessageResult) bool) bool) <-chan MessageResult {
+	results := make(chan MessageResult)
+	go func() {
+		defer close(results)
+		send := func(r MessageResult) bool {
+			select {
+			case results <- r:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		pageToken := ""
+		for {
+			if err := c.call(ctx, "messages.list"); err != nil {
+				send(MessageResult{Err: err})
+				return
+			}
+			page, err := c.Service.Users.Messages.List(c.user()).Q(query).PageToken(pageToken).MaxResults(500).Context(ctx).Do()
+			if err != nil {
+				send(MessageResult{Err: err})
+				return
+			}
+			if !handle(page.Messages, send) || page.NextPageToken == "" {
+				return
+			}
+			pageToken = page.NextPageToken
+		}
+	}()
+	return results
+}
+
+// Reads results until the channel is closed, returning the messages and the error
+// that ended iteration, if any.
+func Collect(results <-chan MessageResult) ([]*gmail.Message, error) {
+	var messages []*gmail.Message
+	var err error
+	for r := range results {
+		if r.Err != nil {
+			err = r.Err
+			continue
+		}
+		messages = append(messages, r.Message)
+	}
+	return messages, err
+}
+
+// Fetches metadata for a batch concurrently, returning results in the batch's order.
+func (c *Cleaner) getBatch(ctx context.Context, batch []*gmail.Message) []MessageResult {
+	results := make([]MessageResult, len(batch))
+	var wg sync.WaitGroup
+	for i, m := range batch {
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			if err := c.call(ctx, "messages.get"); err != nil {
+				results[i].Err = err
+				return
+			}
+			get := c.Service.Users.Messages.Get(c.user(), id).Format("metadata").Context(ctx)
+			if len(c.MetadataHeaders) > 0 {
+				get = get.MetadataHeaders(c.MetadataHeaders...)
+			}
+			results[i].Message, results[i].Err = get.Do()
+		}(i, m.Id)
+	}
+	wg.Wait()
+
+	// Stop at the first error so callers never see messages after it.
+	for i, r := range results {
+		if r.Err != nil {
+			return results[:i+1]
+		}
+	}
+	return results
+}
+
+// Charges and rate-limits one API call.
+func (c *Cleaner) call(ctx context.Context, method string) error {
+	if c.Charge != nil {
+		if err := c.Charge(method); err != nil {
+			return err
+		}
+	}
+	c.once.Do(func() {
+		rate := c.UnitsPerSecond
+		if rate <= 0 {
+			rate = DefaultUnitsPerSecond
+		}
+		c.limiter = newLimiter(rate)
+	})
+	return c.limiter.wait(ctx, methodUnits[method])
+}
+
+func (c *Cleaner) user() string {
+	if c.User == "" {
+		return "me"
+	}
+	return c.User
+}
+
+func (c *Cleaner) batchSize() int {
+	if c.BatchSize <= 0 {
+		return 10
+	}
+	return c.BatchSize
+}
+
+// A token bucket holding up to one second's worth of quota units, or the units of the
+// call waiting, if that is more, so that a call costing more than the rate still goes.
+type limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(unitsPerSecond int) *limiter {
+	return &limiter{rate: float64(unitsPerSecond), tokens: float64(unitsPerSecond), last: time.Now()}
+}
+
+// Blocks until units are available or ctx is done.
+func (l *limiter) wait(ctx context.Context, units int) error {
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		capacity := l.rate
+		if float64(units) > capacity {
+			capacity = float64(units)
+		}
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > capacity {
+			l.tokens = capacity
+		}
+		l.last = now
+		if l.tokens >= float64(units) {
+			l.tokens -= float64(units)
+			l.mu.Unlock()
+			return nil
+		}
+		delay := time.Duration((float64(units) - l.tokens) / l.rate * float64(time.Second))
+		l.mu.Unlock()
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
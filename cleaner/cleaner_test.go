@@ -0,0 +1,219 @@
+package cleaner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
+)
+
+// A mailbox of ids m0 to m(count-1), listed pageSize at a time. Getting an id in
+// failing answers 404, and getting one in slow waits first.
+type fakeMailbox struct {
+	count    int
+	pageSize int
+	failing  map[string]bool
+	slow     map[string]time.Duration
+}
+
+func (f *fakeMailbox) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	const prefix = "/gmail/v1/users/me/messages"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		http.NotFound(w, r)
+		return
+	}
+	if id := strings.TrimPrefix(r.URL.Path, prefix+"/"); id != r.URL.Path {
+		time.Sleep(f.slow[id])
+		if f.failing[id] {
+			http.Error(w, `{"error": {"code": 404, "message": "Not Found"}}`, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(&gmail.Message{Id: id, Snippet: "metadata of " + id})
+		return
+	}
+
+	start, _ := strconv.Atoi(r.URL.Query().Get("pageToken"))
+	end := start + f.pageSize
+	if end > f.count {
+		end = f.count
+	}
+	page := &gmail.ListMessagesResponse{}
+	for i := start; i < end; i++ {
+		page.Messages = append(page.Messages, &gmail.Message{Id: fmt.Sprintf("m%d", i)})
+	}
+	if end < f.count {
+		page.NextPageToken = strconv.Itoa(end)
+	}
+	json.NewEncoder(w).Encode(page)
+}
+
+func newTestCleaner(t *testing.T, f *fakeMailbox) *Cleaner {
+	t.Helper()
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	service, err := gmail.NewService(context.Background(), option.WithHTTPClient(srv.Client()), option.WithEndpoint(srv.URL+"/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New(service)
+	// Not limited, so tests don't wait for the rate.
+	c.UnitsPerSecond = 1000000
+	c.BatchSize = 4
+	return c
+}
+
+func ids(n int) []string {
+	var ids []string
+	for i := 0; i < n; i++ {
+		ids = append(ids, fmt.Sprintf("m%d", i))
+	}
+	return ids
+}
+
+func TestListPagination(t *testing.T) {
+	tests := []struct {
+		name     string
+		count    int
+		pageSize int
+	}{
+		{"empty", 0, 3},
+		{"one page", 2, 3},
+		{"full pages", 6, 3},
+		{"last page short", 7, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCleaner(t, &fakeMailbox{count: tt.count, pageSize: tt.pageSize})
+			messages, err := Collect(c.List(context.Background(), ""))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, m := range messages {
+				got = append(got, m.Id)
+			}
+			if want := ids(tt.count); !reflect.DeepEqual(got, want) {
+				t.Errorf("List() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestMessagesInOrder(t *testing.T) {
+	// Earlier messages of each batch answer last.
+	slow := map[string]time.Duration{}
+	for i := 0; i < 10; i++ {
+		slow[fmt.Sprintf("m%d", i)] = time.Duration(4-i%4) * 5 * time.Millisecond
+	}
+	c := newTestCleaner(t, &fakeMailbox{count: 10, pageSize: 6, slow: slow})
+	messages, err := Collect(c.Messages(context.Background(), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range messages {
+		if m.Snippet != "metadata of "+m.Id {
+			t.Errorf("message [%s] has snippet %q, want its metadata", m.Id, m.Snippet)
+		}
+		got = append(got, m.Id)
+	}
+	if want := ids(10); !reflect.DeepEqual(got, want) {
+		t.Errorf("Messages() = %v, want %v", got, want)
+	}
+}
+
+func TestMessagesStopsAtFirstError(t *testing.T) {
+	tests := []struct {
+		name    string
+		failing []string
+		want    []string
+	}{
+		{"first of a batch", []string{"m4"}, ids(4)},
+		{"within a batch", []string{"m6"}, ids(6)},
+		{"two in a batch", []string{"m7", "m5"}, ids(5)},
+		{"on a later page", []string{"m9"}, ids(9)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			failing := map[string]bool{}
+			for _, id := range tt.failing {
+				failing[id] = true
+			}
+			c := newTestCleaner(t, &fakeMailbox{count: 12, pageSize: 8, failing: failing})
+			var got []string
+			var errs int
+			for r := range c.Messages(context.Background(), "") {
+				if r.Err != nil {
+					errs++
+					continue
+				}
+				if errs > 0 {
+					t.Errorf("got message [%s] after the error", r.Message.Id)
+				}
+				got = append(got, r.Message.Id)
+			}
+			if errs != 1 {
+				t.Errorf("got %d errors, want 1", errs)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Messages() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMessagesCancel(t *testing.T) {
+	c := newTestCleaner(t, &fakeMailbox{count: 100, pageSize: 10})
+	ctx, cancel := context.WithCancel(context.Background())
+	results := c.Messages(ctx, "")
+	if r := <-results; r.Err != nil {
+		t.Fatal(r.Err)
+	}
+	cancel()
+
+	// The channel is closed soon after, with no more than the batch in flight.
+	timeout := time.After(5 * time.Second)
+	for n := 0; ; n++ {
+		select {
+		case _, ok := <-results:
+			if !ok {
+				return
+			}
+			if n > c.BatchSize {
+				t.Fatalf("got %d more results after cancelling", n)
+			}
+		case <-timeout:
+			t.Fatal("the channel wasn't closed after cancelling")
+		}
+	}
+}
+
+func TestLimiterCallOverRate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	l := newLimiter(4)
+	if err := l.wait(ctx, methodUnits["messages.get"]); err != nil {
+		t.Errorf("wait() for more units than the rate = %v, want it to go once they are available", err)
+	}
+}
+
+func TestLimiterCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	l := newLimiter(5)
+	if err := l.wait(ctx, 5); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := l.wait(ctx, 5); err != context.Canceled {
+		t.Errorf("wait() after cancelling = %v, want %v", err, context.Canceled)
+	}
+}
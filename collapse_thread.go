@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+
+	"github.com/weineran/gmail-cleanup/internal/mimeutil"
+	"github.com/weineran/gmail-cleanup/transform"
+)
+
+// Matches the line introducing quoted text, e.g. "On Mon, 3 Jan 2022 at 10:00, Ann <ann@example.com> wrote:".
+var quoteAttributionPattern = regexp.MustCompile(`(?i)^\s*On .+ wrote:\s*$`)
+
+// Matches the separator Outlook puts above the message it replies to.
+var originalMessagePattern = regexp.MustCompile(`(?i)^\s*-{2,}\s*Original Message\s*-{2,}\s*$`)
+
+// Keeps a long thread's latest message whole, since its quoted history already holds
+// the whole conversation, and replaces each older message with a copy without quoted
+// text and without attachments the latest message also has.
+func runCollapseThread(args []string) {
+	fs := flag.NewFlagSet("collapse-thread", flag.ExitOnError)
+	var opts mailboxOptions
+	opts.register(fs)
+	insertMethod := fs.String("insert-method", insertMethodInsert, insertMethodUsage)
+	dryRun := fs.Bool("dry-run", false, "Only report the bytes each message would save")
+	assumeYes := fs.Bool("yes", false, "Replace every message without asking")
+	force := fs.Bool("force", false, "With --yes, don't ask to type a confirmation before originals are deleted permanently")
+	limit := registerDestructiveLimit(fs)
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		log.Fatal("Usage: gmail-cleanup collapse-thread [--dry-run] THREAD_ID")
+	}
+	if err := checkInsertMethod(*insertMethod); err != nil {
+		log.Fatal(err)
+	}
+
+	mb := openMailbox(&opts)
+	defer mb.quota.printSummary()
+
+	thread, err := mb.getThread(fs.Arg(0), "full")
+	if err != nil {
+		exitf(exitCodeFor(err), "Unable to get thread [%s]: %v", fs.Arg(0), err)
+	}
+	var messages []*gmail.Message
+	for _, m := range thread.Messages {
+		if isChatMessage(m.LabelIds) {
+			skipChatMessage(m.Id)
+			continue
+		}
+		if hasLabel(m, "DRAFT") {
+			continue
+		}
+		messages = append(messages, m)
+	}
+	if len(messages) < 2 {
+		fmt.Println("Nothing to collapse: the thread has fewer than two messages.")
+		return
+	}
+	latest := messages[len(messages)-1]
+	older := messages[:len(messages)-1]
+	fmt.Printf("Keeping latest message [%s] whole, collapsing %d older messages\n", latest.Id, len(older))
+
+	if !*dryRun {
+		limit.check(opts.profile, len(older))
+	}
+	if *assumeYes && !*dryRun && !*force && !confirmHardDelete(len(older)) {
+		log.Println("Confirmation didn't match, nothing deleted.")
+		return
+	}
+
+	journal := newRunJournal(opts.profile, newRunId(time.Now()))
+	duplicates := attachmentKeys(latest)
+	var total int64
+	for _, m := range older {
+		saved, err := collapseMessage(mb, m, duplicates, journal, *insertMethod, *dryRun, *assumeYes)
+		if err != nil {
+			exitf(exitCodeFor(err), "Unable to collapse message [%s]: %v", m.Id, err)
+		}
+		total += saved
+	}
+	if *dryRun {
+		fmt.Printf("Dry run: collapsing would save %s\n", formatBytes(total))
+		return
+	}
+	fmt.Printf("Saved %s\n", formatBytes(total))
+}
+
+func hasLabel(m *gmail.Message, label string) bool {
+	for _, id := range m.LabelIds {
+		if id == label {
+			return true
+		}
+	}
+	return false
+}
+
+// Identifies an attachment by filename and size, which is enough to recognize
+// the same file attached again further down a thread without downloading it.
+func attachmentKey(p *gmail.MessagePart) string {
+	return fmt.Sprintf("%s/%d", p.Filename, p.Body.Size)
+}
+
+func attachmentKeys(m *gmail.Message) map[string]bool {
+	keys := map[string]bool{}
+	for _, part := range attachmentParts(m.Payload) {
+		keys[attachmentKey(part)] = true
+	}
+	return keys
+}
+
+// Replaces m with a collapsed copy, if confirmed, and returns the bytes saved.
+func collapseMessage(mb *mailbox, m *gmail.Message, duplicates map[string]bool, journal *runJournal, insertMethod string, dryRun bool, assumeYes bool) (int64, error) {
+	var fetched []fetchedAttachment
+	for _, part := range attachmentParts(m.Payload) {
+		if duplicates[attachmentKey(part)] {
+			continue
+		}
+		body := part.Body
+		if attachmentId := part.Body.AttachmentId; attachmentId != "" {
+			var err error
+			body, err = mb.getAttachment(m.Id, attachmentId)
+			if err != nil {
+				return 0, fmt.Errorf("Unable to get attachment [%+v]: %w", attachmentId, err)
+			}
+		}
+		fetched = append(fetched, fetchedAttachment{part: part, body: body})
+	}
+
+	newMsg, err := copyMessageExAttachments(m, fetched, []transform.Transformer{quoteStripper{}, attachmentKeeper{}})
+	if err != nil {
+		return 0, err
+	}
+	saved := m.SizeEstimate - int64(base64.URLEncoding.DecodedLen(len(newMsg.Raw)))
+	if saved <= 0 {
+		fmt.Printf("Message [%s]: nothing to collapse\n", m.Id)
+		return 0, nil
+	}
+	fmt.Printf("Message [%s] (%s): saves %s\n", m.Id, mimeutil.HeaderValue(m.Payload.Headers, "Subject"), formatBytes(saved))
+	if dryRun {
+		return saved, nil
+	}
+	if !assumeYes && !askYesNo("Do you want to replace this message with the collapsed copy?") {
+		log.Printf("Skipped message [%+v]\n", m.Id)
+		return 0, nil
+	}
+
+	if err := journal.record(newJournalEntry(journalCopying, m)); err != nil {
+		return 0, fmt.Errorf("Unable to write journal: %w", err)
+	}
+	insertResponse, err := mb.addCopy(newMsg, insertMethod)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to insert message: %w", err)
+	}
+	entry := newJournalEntry(journalStripped, m)
+	entry.CopyId = insertResponse.Id
+	if err := journal.record(entry); err != nil {
+		return 0, fmt.Errorf("Unable to write journal: %w", err)
+	}
+	log.Printf("Deleting original message [%+v]\n", m.Id)
+	if err := mb.deleteMessage(m.Id); err != nil {
+		return 0, fmt.Errorf("Unable to delete message: %w", err)
+	}
+	return saved, nil
+}
+
+// Keeps every attachment that was downloaded for the copy.
+type attachmentKeeper struct{}
+
+func (attachmentKeeper) Transform(m *transform.ParsedMessage) error {
+	for _, part := range m.Parts() {
+		if !m.Downloaded(part) {
+			continue
+		}
+		m.Keep(part)
+	}
+	return nil
+}
+
+// Removes quoted history from the text/plain and text/html bodies.
+type quoteStripper struct{}
+
+func (quoteStripper) Transform(m *transform.ParsedMessage) error {
+	for _, part := range m.Parts() {
+		if part.Filename != "" || part.Body == nil || part.Body.Data == "" {
+			continue
+		}
+		body, err := transform.Body(part)
+		if err != nil {
+			return err
+		}
+		switch strings.ToLower(part.MimeType) {
+		case "text/plain":
+			transform.SetBody(part, []byte(stripQuotedText(string(body))))
+		case "text/html":
+			transform.SetBody(part, []byte(stripQuotedHTML(string(body))))
+		}
+	}
+	return nil
+}
+
+// Drops lines starting with ">", the attribution line above them, and everything
+// below an Outlook "Original Message" separator.
+func stripQuotedText(body string) string {
+	lines := strings.SplitAfter(body, "\n")
+	isQuoted := func(line string) bool {
+		return strings.HasPrefix(strings.TrimLeft(line, " \t"), ">")
+	}
+	var out strings.Builder
+	for i, line := range lines {
+		if originalMessagePattern.MatchString(line) {
+			break
+		}
+		if isQuoted(line) {
+			continue
+		}
+		if quoteAttributionPattern.MatchString(line) {
+			next := i + 1
+			for next < len(lines) && strings.TrimSpace(lines[next]) == "" {
+				next++
+			}
+			if next < len(lines) && isQuoted(lines[next]) {
+				continue
+			}
+		}
+		out.WriteString(line)
+	}
+	return out.String()
+}
+
+// Drops Gmail's quote container and any blockquote elements.
+func stripQuotedHTML(body string) string {
+	body = removeHTMLElements(body, "div", func(startTag string) bool {
+		return strings.Contains(strings.ToLower(startTag), "gmail_quote")
+	})
+	return removeHTMLElements(body, "blockquote", func(string) bool { return true })
+}
+
+// Removes each element named name whose start tag satisfies match, with its content,
+// counting nested elements of the same name to find its end.
+func removeHTMLElements(body string, name string, match func(startTag string) bool) string {
+	lower := strings.ToLower(body)
+	var out strings.Builder
+	i := 0
+	for {
+		start := indexStartTag(lower, name, i)
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(lower[start:], '>')
+		if end < 0 {
+			break
+		}
+		end += start + 1
+		if !match(body[start:end]) {
+			out.WriteString(body[i:end])
+			i = end
+			continue
+		}
+		out.WriteString(body[i:start])
+		depth := 1
+		j := end
+		for depth > 0 {
+			nextStart := indexStartTag(lower, name, j)
+			nextEnd := strings.Index(lower[j:], "</"+name)
+			if nextEnd < 0 {
+				// Unclosed: drop the rest of the body.
+				j = len(body)
+				break
+			}
+			nextEnd += j
+			if nextStart >= 0 && nextStart < nextEnd {
+				depth++
+				j = nextStart + 1
+				continue
+			}
+			depth--
+			j = nextEnd + len("</"+name)
+			if gt := strings.IndexByte(lower[j:], '>'); gt >= 0 {
+				j += gt + 1
+			}
+		}
+		i = j
+	}
+	out.WriteString(body[i:])
+	return out.String()
+}
+
+// Returns the index in lower of the next start tag named name at or after from, or -1.
+func indexStartTag(lower string, name string, from int) int {
+	for from < len(lower) {
+		k := strings.Index(lower[from:], "<"+name)
+		if k < 0 {
+			return -1
+		}
+		k += from
+		after := k + 1 + len(name)
+		if after >= len(lower) || strings.IndexByte(" \t\r\n>/", lower[after]) >= 0 {
+			return k
+		}
+		from = after
+	}
+	return -1
+}
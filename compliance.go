@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+
+	"github.com/weineran/gmail-cleanup/internal/mimeutil"
+)
+
+// One line of the compliance export manifest, linking an untouched original to its stripped copy.
+type manifestEntry struct {
+	OriginalId  string               `json:"originalId"`
+	CopyId      string               `json:"copyId"`
+	ThreadId    string               `json:"threadId"`
+	From        string               `json:"from"`
+	Subject     string               `json:"subject"`
+	Date        string               `json:"date"`
+	Attachments []manifestAttachment `json:"attachments"`
+	InsertedAt  string               `json:"insertedAt"`
+}
+
+type manifestAttachment struct {
+	Filename string `json:"filename"`
+	MimeType string `json:"mimeType"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+}
+
+func newManifestEntry(original *gmail.Message, copyId string, attachments []fetchedAttachment) manifestEntry {
+	entry := manifestEntry{
+		OriginalId:  original.Id,
+		CopyId:      copyId,
+		ThreadId:    original.ThreadId,
+		From:        mimeutil.HeaderValue(original.Payload.Headers, "From"),
+		Subject:     mimeutil.HeaderValue(original.Payload.Headers, "Subject"),
+		Date:        messageDate(original).Format(time.RFC3339),
+		InsertedAt:  time.Now().Format(time.RFC3339),
+		Attachments: describeAttachments(attachments),
+	}
+	return entry
+}
+
+// Describes attachments with the SHA-256 of their content.
+func describeAttachments(attachments []fetchedAttachment) []manifestAttachment {
+	var result []manifestAttachment
+	for _, a := range attachments {
+		h := sha256.New()
+		if r, err := a.open(); err == nil {
+			io.Copy(h, r)
+		}
+		result = append(result, manifestAttachment{
+			Filename: a.part.Filename,
+			MimeType: a.part.MimeType,
+			Size:     a.body.Size,
+			SHA256:   hex.EncodeToString(h.Sum(nil)),
+		})
+	}
+	return result
+}
+
+// Appends entry to the JSON Lines manifest at path.
+func appendManifest(path string, entry manifestEntry) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(entry)
+}
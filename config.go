@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// Settings kept in config.yaml, written by init, in the profile directory or, for every
+// profile without one, the config directory.
+type configFile struct {
+	// Values for command-line flags by name, e.g. backup-dir, used by every command that
+	// has the flag unless it is given on the command line.
+	Flags map[string]string `yaml:"flags"`
+	// Most messages a run may delete or strip before it has to be given
+	// --i-know-what-im-doing and a higher --max-destructive-per-run; 0 means no limit.
+	MaxDestructivePerRun int `yaml:"max_destructive_per_run,omitempty"`
+	// How long `backups prune` keeps the backups of a run, e.g. 180d, and how much all
+	// backups may take up, e.g. 50G, deleting the oldest first; "" means no limit.
+	KeepBackups   string `yaml:"keep_backups,omitempty"`
+	MaxBackupSize string `yaml:"max_backup_size,omitempty"`
+
+	// The line of each flag's value, for errors.
+	lines map[string]int
+}
+
+// Flags that always have to be given on the command line, since they skip confirmations.
+var unconfigurableFlags = map[string]bool{"yes": true, "force": true, "i-know-what-im-doing": true, "max-destructive-per-run": true}
+
+// Returns the config file profile uses, which may not exist.
+func profileConfigFile(profile string) string {
+	if profile != "" {
+		path := profilePath(profile, "config.yaml")
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return profilePath("", "config.yaml")
+}
+
+// Reads the config file at path. A missing file is an empty config.
+func loadConfig(path string) (*configFile, error) {
+	c := configFile{lines: map[string]int{}}
+	root, err := readValidatedYAML(path, configFileSchema, &c)
+	if os.IsNotExist(err) || root == nil {
+		return &c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value != "flags" {
+			continue
+		}
+		flags := root.Content[i+1]
+		for j := 0; j+1 < len(flags.Content); j += 2 {
+			c.lines[flags.Content[j].Value] = flags.Content[j+1].Line
+		}
+	}
+	for name := range c.Flags {
+		if unconfigurableFlags[name] {
+			return nil, fmt.Errorf("%s:%d: flags.%s: can only be given on the command line", path, c.lines[name], name)
+		}
+	}
+	return &c, nil
+}
+
+// Parses args into fs, then sets the flags the config file has values for and args
+// didn't give.
+func parseFlags(fs *flag.FlagSet, args []string) {
+	lang := fs.String("lang", "", "Language of prompts, summaries and the note added to copies: "+strings.Join(languages(), ", ")+" (default from the locale)")
+	fs.Parse(args)
+	var profile string
+	if f := fs.Lookup("profile"); f != nil {
+		profile = f.Value.String()
+	}
+	path := profileConfigFile(profile)
+	c, err := loadConfig(path)
+	if err != nil {
+		log.Fatalf("Unable to read config: %v", err)
+	}
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	for name, value := range c.Flags {
+		if fs.Lookup(name) == nil || given[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			log.Fatalf("%s:%d: flags.%s: %v", path, c.lines[name], name, err)
+		}
+	}
+	if err := setLanguage(*lang); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Asks the user to type a phrase such as "delete 1,284 messages" before count messages
+// are deleted permanently, instead of skipping past a y/n question.
+func confirmHardDelete(count int) bool {
+	phrase := fmt.Sprintf("delete %s messages", formatCount(count))
+	// The phrase stays English, so it is the same whatever the language.
+	fmt.Println(trf("This permanently deletes %s messages; they can't be restored from the trash.", formatCount(count)))
+	fmt.Println(trf("Type \"%s\" to continue, or pass --force:", phrase))
+	return strings.TrimSpace(readLine()) == phrase
+}
+
+// The max_destructive_per_run init writes to the config file.
+const defaultMaxDestructivePerRun = 500
+
+// Returns the most messages a run may delete or strip: max_destructive_per_run from the
+// config file, which only --i-know-what-im-doing can raise, with --max-destructive-per-run.
+// 0 means no limit.
+func destructiveCap(profile string, override int, iKnow bool) int {
+	path := profileConfigFile(profile)
+	c, err := loadConfig(path)
+	if err != nil {
+		log.Fatalf("Unable to read config: %v", err)
+	}
+	if override < 0 {
+		log.Fatalf("--max-destructive-per-run must be at least 1, got %d", override)
+	}
+	if override == 0 {
+		if iKnow && c.MaxDestructivePerRun > 0 {
+			log.Fatalf("--i-know-what-im-doing needs --max-destructive-per-run with a limit above %d", c.MaxDestructivePerRun)
+		}
+		return c.MaxDestructivePerRun
+	}
+	if c.MaxDestructivePerRun > 0 && override > c.MaxDestructivePerRun && !iKnow {
+		log.Fatalf("--max-destructive-per-run %d is above max_destructive_per_run %d in [%s]; pass --i-know-what-im-doing too", override, c.MaxDestructivePerRun, path)
+	}
+	return override
+}
+
+// Reports whether count messages are more than a run with a limit of max may delete,
+// strip or trash, and if so says how to allow it.
+func overDestructiveCap(count int, max int) bool {
+	if max <= 0 || count <= max {
+		return false
+	}
+	fmt.Printf("The run would delete, strip or trash up to %s messages, more than max_destructive_per_run allows (%s).\n",
+		formatCount(count), formatCount(max))
+	fmt.Println("Check the query, or pass --i-know-what-im-doing --max-destructive-per-run N with a higher limit.")
+	return true
+}
+
+// The --max-destructive-per-run and --i-know-what-im-doing flags of a command that
+// deletes or trashes messages outside processMessages.
+type destructiveLimit struct {
+	override *int
+	iKnow    *bool
+}
+
+func registerDestructiveLimit(fs *flag.FlagSet) *destructiveLimit {
+	return &destructiveLimit{
+		override: fs.Int("max-destructive-per-run", 0, "With --i-know-what-im-doing, allow the run to delete or trash this many messages, above max_destructive_per_run in the config file"),
+		iKnow:    fs.Bool("i-know-what-im-doing", false, "Let --max-destructive-per-run raise the config file's max_destructive_per_run"),
+	}
+}
+
+// Exits before anything is changed if count messages are more than the run may delete
+// or trash.
+func (l *destructiveLimit) check(profile string, count int) {
+	if overDestructiveCap(count, destructiveCap(profile, *l.override, *l.iKnow)) {
+		os.Exit(exitError)
+	}
+}
+
+// Reads one line from stdin a byte at a time, so nothing past it is consumed.
+// The carriage return a Windows console sends before the newline is dropped.
+func readLine() string {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := os.Stdin.Read(b)
+		if n == 0 || err != nil || b[0] == '\n' {
+			return strings.TrimSuffix(string(line), "\r")
+		}
+		line = append(line, b[0])
+	}
+}
+
+// Formats n with thousands separators, e.g. 1,284.
+func formatCount(n int) string {
+	s := strconv.Itoa(n)
+	if n < 0 {
+		return "-" + formatCount(-n)
+	}
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestOverDestructiveCap(t *testing.T) {
+	tests := []struct {
+		name  string
+		count int
+		max   int
+		want  bool
+	}{
+		{"no limit", 100000, 0, false},
+		{"under the limit", 499, 500, false},
+		{"at the limit", 500, 500, false},
+		{"over the limit", 501, 500, true},
+		{"nothing to do", 0, 500, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := overDestructiveCap(tt.count, tt.max); got != tt.want {
+				t.Errorf("overDestructiveCap(%d, %d) = %v, want %v", tt.count, tt.max, got, tt.want)
+			}
+		})
+	}
+}
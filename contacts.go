@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"google.golang.org/api/option"
+	"google.golang.org/api/people/v1"
+)
+
+// Values of --protect-contacts.
+const (
+	protectStarred = "starred"
+	protectAll     = "all"
+	protectNone    = "none"
+)
+
+// Most resource names accepted by one people.getBatchGet call.
+const maxBatchGet = 200
+
+// Returns the lowercase email addresses of the contacts selected by mode.
+func loadProtectedContacts(ctx context.Context, client *http.Client, mode string) (map[string]bool, error) {
+	if mode == protectNone {
+		return nil, nil
+	}
+
+	service, err := people.NewService(ctx, option.WithHTTPClient(client))
+	if err != nil {
+		return nil, err
+	}
+
+	var persons []*people.Person
+	switch mode {
+	case protectAll:
+		persons, err = listConnections(ctx, service)
+	case protectStarred:
+		persons, err = listStarredContacts(ctx, service)
+	default:
+		return nil, fmt.Errorf("unknown --protect-contacts value [%s], expected %s, %s or %s", mode, protectStarred, protectAll, protectNone)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w (if the token predates contact protection, delete it and authorize again)", err)
+	}
+
+	addresses := map[string]bool{}
+	for _, person := range persons {
+		for _, email := range person.EmailAddresses {
+			addresses[strings.ToLower(email.Value)] = true
+		}
+	}
+	return addresses, nil
+}
+
+func listConnections(ctx context.Context, service *people.Service) ([]*people.Person, error) {
+	var persons []*people.Person
+	pageToken := ""
+	for {
+		r, err := service.People.Connections.List("people/me").PersonFields("emailAddresses").PageSize(1000).PageToken(pageToken).Context(ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+		persons = append(persons, r.Connections...)
+		if r.NextPageToken == "" {
+			return persons, nil
+		}
+		pageToken = r.NextPageToken
+	}
+}
+
+func listStarredContacts(ctx context.Context, service *people.Service) ([]*people.Person, error) {
+	group, err := service.ContactGroups.Get("contactGroups/starred").MaxMembers(10000).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return getPeople(ctx, service, group.MemberResourceNames)
+}
+
+func getPeople(ctx context.Context, service *people.Service, resourceNames []string) ([]*people.Person, error) {
+	var persons []*people.Person
+	for start := 0; start < len(resourceNames); start += maxBatchGet {
+		end := start + maxBatchGet
+		if end > len(resourceNames) {
+			end = len(resourceNames)
+		}
+		r, err := service.People.GetBatchGet().ResourceNames(resourceNames[start:end]...).PersonFields("emailAddresses").Context(ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+		for _, response := range r.Responses {
+			if response.Person != nil {
+				persons = append(persons, response.Person)
+			}
+		}
+	}
+	return persons, nil
+}
+
+// Whether any of rules is limited to a contact group, so the contacts scope is needed.
+func usesContactGroups(rules []policyRule) bool {
+	for _, rule := range rules {
+		if rule.contactGroup != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Fills in the members of the contact groups rules are limited to, matching group names
+// case-insensitively. Fails for a name with no group, listing the groups there are.
+func resolveContactGroups(ctx context.Context, client *http.Client, rules []policyRule) error {
+	if !usesContactGroups(rules) {
+		return nil
+	}
+	service, err := people.NewService(ctx, option.WithHTTPClient(client))
+	if err != nil {
+		return err
+	}
+	groups, err := listContactGroups(ctx, service)
+	if err != nil {
+		return fmt.Errorf("%w (if the token predates contact groups in policies, delete it and authorize again)", err)
+	}
+
+	members := map[string]map[string]bool{}
+	for i, rule := range rules {
+		if rule.contactGroup == "" {
+			continue
+		}
+		name := strings.ToLower(rule.contactGroup)
+		if _, ok := members[name]; !ok {
+			group, ok := groups[name]
+			if !ok {
+				var names []string
+				for _, g := range groups {
+					names = append(names, g.FormattedName)
+				}
+				sort.Strings(names)
+				return fmt.Errorf("no contact group [%s], expected one of %s", rule.contactGroup, strings.Join(names, ", "))
+			}
+			members[name], err = loadGroupMembers(ctx, service, group.ResourceName)
+			if err != nil {
+				return fmt.Errorf("Unable to get contact group [%s]: %w", rule.contactGroup, err)
+			}
+		}
+		rules[i].groupMembers = members[name]
+	}
+	return nil
+}
+
+// Returns the contact groups by lowercase name, both as named and as Google Contacts
+// shows them, so the system groups are found as "starred" as well as "Starred".
+func listContactGroups(ctx context.Context, service *people.Service) (map[string]*people.ContactGroup, error) {
+	groups := map[string]*people.ContactGroup{}
+	pageToken := ""
+	for {
+		r, err := service.ContactGroups.List().PageSize(1000).PageToken(pageToken).Context(ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+		for _, group := range r.ContactGroups {
+			groups[strings.ToLower(group.Name)] = group
+			groups[strings.ToLower(group.FormattedName)] = group
+		}
+		if r.NextPageToken == "" {
+			return groups, nil
+		}
+		pageToken = r.NextPageToken
+	}
+}
+
+// Returns the lowercase email addresses of the members of a contact group.
+func loadGroupMembers(ctx context.Context, service *people.Service, resourceName string) (map[string]bool, error) {
+	group, err := service.ContactGroups.Get(resourceName).MaxMembers(10000).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	persons, err := getPeople(ctx, service, group.MemberResourceNames)
+	if err != nil {
+		return nil, err
+	}
+	addresses := map[string]bool{}
+	for _, person := range persons {
+		for _, email := range person.EmailAddresses {
+			addresses[strings.ToLower(email.Value)] = true
+		}
+	}
+	return addresses, nil
+}
+
+// Most addresses contactGroupQuery puts in a query; Gmail rejects very long queries.
+const maxGroupQueryAddresses = 100
+
+// Returns a query term such as "{from:a@example.com from:b@example.com}" matching only
+// mail from the members of rules' contact groups, or "" unless every rule is limited to
+// a group with at most maxGroupQueryAddresses members in all, in which case matching
+// the rules one message at a time has to do.
+func contactGroupQuery(rules []policyRule) string {
+	addresses := map[string]bool{}
+	for _, rule := range rules {
+		if rule.contactGroup == "" {
+			return ""
+		}
+		for address := range rule.groupMembers {
+			addresses[address] = true
+		}
+	}
+	if len(addresses) == 0 || len(addresses) > maxGroupQueryAddresses {
+		return ""
+	}
+	var terms []string
+	for address := range addresses {
+		terms = append(terms, "from:"+address)
+	}
+	sort.Strings(terms)
+	return "{" + strings.Join(terms, " ") + "}"
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// Where a run stopped because of --max-messages-per-run. Messages are processed in
+// order of size, then id, so the next run skips everything up to and including the
+// last processed message.
+type continuation struct {
+	Query string `json:"query"`
+	Id    string `json:"id"`
+	Size  int64  `json:"size"`
+}
+
+func (c *continuation) token() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func parseContinuation(token string) (*continuation, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid continuation token: %w", err)
+	}
+	var c continuation
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("invalid continuation token: %w", err)
+	}
+	return &c, nil
+}
+
+// Reports whether m comes after the continuation point in processing order.
+func (c *continuation) before(m *gmail.Message) bool {
+	if m.SizeEstimate != c.Size {
+		return m.SizeEstimate > c.Size
+	}
+	return m.Id > c.Id
+}
+
+// Orders messages for processing: by estimated size, then id so the order is stable across runs.
+func sortForProcessing(messages []*gmail.Message) {
+	sort.Slice(messages, func(i, j int) bool {
+		if messages[i].SizeEstimate != messages[j].SizeEstimate {
+			return messages[i].SizeEstimate < messages[j].SizeEstimate
+		}
+		return messages[i].Id < messages[j].Id
+	})
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// The daemon's schedule, kept in the profile directory so a restarted daemon keeps to it
+// and resumes a run it was killed during. Saved whole on every change, so a crash leaves
+// the old or the new state. The mutex guards it against the usage watcher.
+type daemonState struct {
+	mu   sync.Mutex
+	path string
+	// When the current or last run started, and whether it finished.
+	RunStarted  time.Time `json:"runStarted"`
+	RunFinished bool      `json:"runFinished"`
+	// When storage usage was last checked for --alert-at.
+	LastUsageCheck time.Time `json:"lastUsageCheck"`
+	// When the trash was last swept for --trash-max-age.
+	LastTrashSweep time.Time `json:"lastTrashSweep"`
+}
+
+// Reads the state at path. A missing file means the daemon hasn't run before.
+func loadDaemonState(path string) (*daemonState, error) {
+	s := &daemonState{path: path}
+	if err := readJSON(path, s); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Applies change to the state and saves it.
+func (s *daemonState) update(change func(s *daemonState)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	change(s)
+	if err := writeJSONAtomic(s.path, s); err != nil {
+		log.Printf("Daemon: unable to save state: %v\n", err)
+	}
+}
+
+// Runs the default command again and again, each time in a new process, within active hours.
+// Each run records the messages it processes, so after a restart the daemon resumes
+// an unfinished run where it stopped, and otherwise waits for the next one as scheduled.
+func runDaemon(args []string) {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	interval := fs.Duration("interval", 24*time.Hour, "Time between the start of one run and the next")
+	activeHoursSpec := fs.String("active-hours", "", "Only work between these times of day, e.g. 01:00-06:00, pausing outside them")
+	timezone := fs.String("timezone", "", "IANA time zone of --active-hours, e.g. Europe/Berlin (default: local time)")
+	alertAt := fs.String("alert-at", "", "Also check storage usage every --watch-interval and alert when it crosses these thresholds, e.g. 80%,90%,14G")
+	notify := fs.String("notify", "", "With --alert-at, where to send alerts: webhook:URL, email or desktop")
+	watchInterval := fs.Duration("watch-interval", 24*time.Hour, "Time between storage usage checks for --alert-at")
+	notifyWebhook := fs.String("notify-webhook", "", "Post each run's summary as JSON to this URL when it finishes")
+	trashMaxAgeSpec := fs.String("trash-max-age", "", "Also delete messages trashed longer ago than this, e.g. 7d, every night within --active-hours (default: trash.max_age of the runs' --policy file)")
+	parseFlags(fs, args)
+	if fs.NArg() == 0 {
+		log.Fatal("Usage: gmail-cleanup daemon [--interval 24h] [--active-hours 01:00-06:00] -- FLAGS [QUERY]")
+	}
+
+	var window *activeHours
+	childArgs := fs.Args()
+	if *activeHoursSpec != "" {
+		var err error
+		window, err = parseActiveHours(*activeHoursSpec, *timezone)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// The run itself pauses when the window closes part way through.
+		childArgs = append([]string{"--active-hours", *activeHoursSpec, "--timezone", *timezone}, childArgs...)
+	}
+	if *notifyWebhook != "" {
+		childArgs = append([]string{"--notify-webhook", *notifyWebhook}, childArgs...)
+	}
+	profile := flagValue(childArgs, "profile")
+	state, err := loadDaemonState(profilePath(profile, "daemon.json"))
+	if err != nil {
+		log.Fatalf("Unable to read daemon state: %v", err)
+	}
+	progressPath := profilePath(profile, "daemon-progress.txt")
+	childArgs = append([]string{"--progress-file", progressPath}, childArgs...)
+	self, err := os.Executable()
+	if err != nil {
+		log.Fatalf("Unable to find executable: %v", err)
+	}
+	if *alertAt != "" {
+		if _, err := parseUsageThresholds(*alertAt); err != nil {
+			log.Fatal(err)
+		}
+		if *notify == "" {
+			log.Fatal("--alert-at needs --notify")
+		}
+		if _, err := parseNotifier(*notify); err != nil {
+			log.Fatal(err)
+		}
+		watchArgs := []string{"usage", "--wait-for-lock", "--alert-at", *alertAt, "--notify", *notify}
+		if profile != "" {
+			watchArgs = append(watchArgs, "--profile", profile)
+		}
+		state.mu.Lock()
+		lastCheck := state.LastUsageCheck
+		state.mu.Unlock()
+		go repeatCommand("checking storage usage", self, watchArgs, *watchInterval, nil, state, lastCheck,
+			func(s *daemonState, t time.Time) { s.LastUsageCheck = t })
+	}
+	trashMaxAge, err := loadTrashMaxAge(flagValue(childArgs, "policy"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *trashMaxAgeSpec != "" {
+		if trashMaxAge, err = parseAge(*trashMaxAgeSpec); err != nil {
+			log.Fatalf("Invalid --trash-max-age: %v", err)
+		}
+	}
+	if trashMaxAge > 0 {
+		sweepArgs := []string{"empty-trash", "--wait-for-lock", "--force", "--trashed-for", fmt.Sprintf("%dd", trashAgeDays(trashMaxAge))}
+		if profile != "" {
+			sweepArgs = append(sweepArgs, "--profile", profile)
+		}
+		state.mu.Lock()
+		lastSweep := state.LastTrashSweep
+		state.mu.Unlock()
+		go repeatCommand("sweeping the trash", self, sweepArgs, 24*time.Hour, window, state, lastSweep,
+			func(s *daemonState, t time.Time) { s.LastTrashSweep = t })
+	}
+
+	state.mu.Lock()
+	started, resuming := state.RunStarted, !state.RunStarted.IsZero() && !state.RunFinished
+	state.mu.Unlock()
+	if !started.IsZero() && !resuming {
+		next := started.Add(*interval)
+		log.Printf("Daemon: last run started at %s, next run at %s\n", started.Format(time.RFC3339), next.Format(time.RFC3339))
+		time.Sleep(time.Until(next))
+	}
+	for {
+		if window != nil {
+			window.wait()
+		}
+		if resuming {
+			log.Printf("Daemon: resuming the run started at %s\n", started.Format(time.RFC3339))
+			resuming = false
+		} else {
+			if err := os.Remove(progressPath); err != nil && !os.IsNotExist(err) {
+				log.Fatalf("Unable to clear progress: %v", err)
+			}
+			started = time.Now()
+			state.update(func(s *daemonState) { s.RunStarted, s.RunFinished = started, false })
+			log.Println("Daemon: starting run")
+		}
+		cmd := exec.Command(self, childArgs...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			log.Printf("Daemon: run failed: %v\n", err)
+		}
+		state.update(func(s *daemonState) { s.RunFinished = true })
+		next := started.Add(*interval)
+		log.Printf("Daemon: next run at %s\n", next.Format(time.RFC3339))
+		time.Sleep(time.Until(next))
+	}
+}
+
+// Runs the command args every interval after last, or with a window, once each time it
+// opens, alongside the runs, recording when each time started with record.
+func repeatCommand(what string, self string, args []string, interval time.Duration, window *activeHours, state *daemonState, last time.Time, record func(s *daemonState, t time.Time)) {
+	next := func(t time.Time) time.Time {
+		if window != nil {
+			return window.nextOpen(t)
+		}
+		return t.Add(interval)
+	}
+	time.Sleep(time.Until(next(last)))
+	for {
+		if window != nil {
+			window.wait()
+		}
+		log.Printf("Daemon: %s\n", what)
+		started := time.Now()
+		cmd := exec.Command(self, args...)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			log.Printf("Daemon: %s failed: %v\n", what, err)
+		}
+		state.update(func(s *daemonState) { record(s, started) })
+		time.Sleep(time.Until(next(started)))
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log"
+	"net/mail"
+	"strings"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+
+	"github.com/weineran/gmail-cleanup/internal/mimeutil"
+	"github.com/weineran/gmail-cleanup/transform"
+)
+
+// Date of m from its Date header, falling back to Gmail's internal date.
+func messageDate(m *gmail.Message) time.Time {
+	if m.Payload != nil {
+		if t, err := mail.ParseDate(mimeutil.HeaderValue(m.Payload.Headers, "Date")); err == nil {
+			return t
+		}
+	}
+	return internalDate(m)
+}
+
+func internalDate(m *gmail.Message) time.Time {
+	return time.Unix(0, m.InternalDate*int64(time.Millisecond))
+}
+
+// Insert with InternalDateSource("dateHeader") silently uses the time of insertion when
+// the Date header is missing or malformed, which moves the copy to the top of the inbox.
+// In that case the Date header is replaced with the original message's internal date.
+func ensureDateHeader(m *transform.ParsedMessage) {
+	value := mimeutil.HeaderValue(m.Payload.Headers, "Date")
+	if _, err := mail.ParseDate(value); err == nil {
+		return
+	}
+
+	date := internalDate(m.Original).Format(time.RFC1123Z)
+	log.Printf("Message [%s] has invalid Date header [%s], using internal date [%s]\n", m.Original.Id, value, date)
+
+	var headers []*gmail.MessagePartHeader
+	for _, header := range m.Payload.Headers {
+		if !strings.EqualFold(header.Name, "Date") {
+			headers = append(headers, header)
+		}
+	}
+	m.Payload.Headers = append(headers, &gmail.MessagePartHeader{Name: "Date", Value: date})
+}
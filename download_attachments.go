@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/weineran/gmail-cleanup/cleaner"
+)
+
+// Saves the attachments of the messages matching a query to a directory, named by the
+// same template as --export-dir, without changing the messages, to get the files out
+// before deciding anything.
+func runDownloadAttachments(args []string) {
+	fs := flag.NewFlagSet("download-attachments", flag.ExitOnError)
+	var opts mailboxOptions
+	opts.register(fs)
+	query := fs.String("query", "has:attachment", `Messages whose attachments to save, e.g. "from:photos@example.com"`)
+	dir := fs.String("dir", "attachments", "Directory to save the attachments to")
+	nameTemplate := fs.String("name-template", defaultNameTemplate, `Go template for each attachment's path, e.g. '{{.Date.Format "2006/01"}}/{{.From}}/{{.Filename}}'`)
+	dryRun := fs.Bool("dry-run", false, "Only print the paths attachments would be saved at")
+	parseFlags(fs, args)
+
+	exporter, err := newAttachmentExporter(*dir, *nameTemplate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts.readOnly = true
+	mb := openMailbox(&opts)
+	defer mb.quota.printSummary()
+	fmt.Printf("Using query string [%v]\n", *query)
+	messages, err := cleaner.Collect(mb.cleaner().List(context.Background(), *query))
+	if err != nil {
+		exitf(exitCodeFor(err), "Unable to list messages: %v", err)
+	}
+	fmt.Printf("Count: %+v\n", len(messages))
+
+	var saved, withAttachments int
+	var total int64
+	for _, msg := range messages {
+		m, _, err := mb.getParsedMessage(msg.Id)
+		if err != nil {
+			exitf(exitCodeFor(err), "Unable to get message [%s] after %d attachments: %v", msg.Id, saved, err)
+		}
+		if isChatMessage(m.LabelIds) {
+			skipChatMessage(m.Id)
+			continue
+		}
+		parts := attachmentParts(m.Payload)
+		if len(parts) > 0 {
+			withAttachments++
+		}
+		for _, part := range parts {
+			if part.Filename == "" {
+				part.Filename = attachedMessageFilename(part, nil)
+			}
+			data, err := base64.URLEncoding.DecodeString(part.Body.Data)
+			if err != nil {
+				exitf(exitError, "Unable to decode attachment [%s] of message [%s]: %v", part.Filename, m.Id, err)
+			}
+			n := newAttachmentName(m, part.Filename, data)
+			if *dryRun {
+				rel, err := exporter.relativePath(n)
+				if err != nil {
+					log.Fatal(err)
+				}
+				fmt.Printf("* %s (%s)\n", rel, formatBytes(int64(len(data))))
+				continue
+			}
+			path, err := exporter.export(n, data)
+			if err != nil {
+				exitf(exitError, "Unable to save attachment [%s] of message [%s]: %v", part.Filename, m.Id, err)
+			}
+			fmt.Printf("* %s (%s)\n", path, formatBytes(int64(len(data))))
+			saved++
+			total += int64(len(data))
+		}
+	}
+	if *dryRun {
+		fmt.Printf("Dry run: nothing saved from %d messages with attachments.\n", withAttachments)
+		return
+	}
+	fmt.Printf("Saved %d attachments (%s) from %d messages to [%s]. The messages weren't changed.\n", saved, formatBytes(total), withAttachments, *dir)
+}
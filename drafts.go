@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// A stripped copy created as a draft by --preview-as-draft, waiting for --commit-drafts.
+type pendingDraft struct {
+	DraftId string `json:"draftId"`
+	// The journal entry to record on commit, describing the original message.
+	Entry journalEntry `json:"entry"`
+}
+
+func pendingDraftsFile(profile string) string {
+	return profilePath(profile, "pending-drafts.json")
+}
+
+func readPendingDrafts(path string) ([]pendingDraft, error) {
+	var drafts []pendingDraft
+	err := readJSON(path, &drafts)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return drafts, err
+}
+
+// Creates newMsg as a draft instead of inserting it, and remembers it for --commit-drafts.
+// A draft already pending for the same original is deleted and replaced, so running
+// again doesn't commit two copies.
+func previewAsDraft(mb *mailbox, newMsg *gmail.Message, entry journalEntry, path string) error {
+	drafts, err := readPendingDrafts(path)
+	if err != nil {
+		return err
+	}
+	draft, err := mb.createDraft(&gmail.Message{Raw: newMsg.Raw, ThreadId: newMsg.ThreadId})
+	if err != nil {
+		return fmt.Errorf("Unable to create draft: %w", err)
+	}
+	var kept []pendingDraft
+	for _, d := range drafts {
+		if d.Entry.MessageId != entry.MessageId {
+			kept = append(kept, d)
+			continue
+		}
+		err := mb.deleteDraft(d.DraftId)
+		var apiErr *googleapi.Error
+		if err != nil && !(errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound) {
+			log.Printf("Unable to delete replaced draft [%s], delete it in Gmail: %v\n", d.DraftId, err)
+		}
+	}
+	kept = append(kept, pendingDraft{DraftId: draft.Id, Entry: entry})
+	if err := writeJSONAtomic(path, kept); err != nil {
+		return err
+	}
+	log.Printf("Created draft [%s] for message [%s]. Check it in Gmail, then run with --commit-drafts.\n", draft.Id, entry.MessageId)
+	return nil
+}
+
+// Inserts each pending draft as a message with the original's labels, deletes the original
+// and the draft, and records the replacement in the journal. Drafts deleted in Gmail are
+// treated as rejected and their originals are kept.
+func commitDrafts(mb *mailbox, opts *removeOptions, path string, force bool, summary *runSummary) {
+	drafts, err := readPendingDrafts(path)
+	if err != nil {
+		log.Fatalf("Unable to read pending drafts: %v", err)
+	}
+	if len(drafts) == 0 {
+		fmt.Println("No pending drafts.")
+		return
+	}
+	fmt.Printf("%d pending drafts\n", len(drafts))
+	summary.Matched = len(drafts)
+	if overDestructiveCap(len(drafts), opts.maxDestructive) {
+		summary.stop(fmt.Errorf("over max_destructive_per_run %d", opts.maxDestructive))
+		return
+	}
+	if opts.assumeYes && !force && !confirmHardDelete(len(drafts)) {
+		log.Println("Confirmation didn't match, nothing deleted.")
+		return
+	}
+
+	var remaining []pendingDraft
+	defer func() {
+		if err := writeJSONAtomic(path, remaining); err != nil {
+			log.Printf("Unable to write pending drafts: %v\n", err)
+		}
+	}()
+	for i, d := range drafts {
+		result, err := commitDraft(mb, opts, d)
+		if err != nil {
+			remaining = append(remaining, drafts[i:]...)
+			summary.stop(err)
+			return
+		}
+		if result == outcomeSkipped {
+			remaining = append(remaining, d)
+		}
+		summary.Outcomes[result]++
+	}
+}
+
+func commitDraft(mb *mailbox, opts *removeOptions, d pendingDraft) (outcome, error) {
+	draft, err := mb.getDraft(d.DraftId, "raw")
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		log.Printf("Draft [%s] was deleted, keeping original message [%s].\n", d.DraftId, d.Entry.MessageId)
+		return outcomeRejected, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("Unable to get draft [%s]: %w", d.DraftId, err)
+	}
+
+	fmt.Printf("Draft [%s] replaces message [%s]\n", d.DraftId, d.Entry.MessageId)
+	if !opts.assumeYes && !askYesNo("Do you want to replace the original with this draft?") {
+		log.Printf("Skipped draft [%s]\n", d.DraftId)
+		return outcomeSkipped, nil
+	}
+
+	intent := d.Entry
+	intent.Action = journalCopying
+	if err := opts.journal.record(intent); err != nil {
+		return "", fmt.Errorf("Unable to write journal: %w", err)
+	}
+	copyMsg := &gmail.Message{Raw: draft.Message.Raw, LabelIds: d.Entry.LabelIds, ThreadId: d.Entry.ThreadId}
+	insertResponse, err := mb.addCopy(copyMsg, opts.insertMethod)
+	if err != nil {
+		return "", fmt.Errorf("Unable to insert message: %w", err)
+	}
+	entry := d.Entry
+	entry.CopyId = insertResponse.Id
+	if err := opts.journal.record(entry); err != nil {
+		return "", fmt.Errorf("Unable to write journal: %w", err)
+	}
+	log.Printf("Deleting original message [%+v]\n", d.Entry.MessageId)
+	if err := mb.deleteMessage(d.Entry.MessageId); err != nil {
+		return "", fmt.Errorf("Unable to delete message: %w", err)
+	}
+	if err := mb.deleteDraft(d.DraftId); err != nil {
+		return "", fmt.Errorf("Unable to delete draft: %w", err)
+	}
+	return outcomeStripped, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+
+	"github.com/weineran/gmail-cleanup/internal/mimeutil"
+)
+
+// A draft and what the drafts command found out about it.
+type staleDraft struct {
+	id      string
+	edited  time.Time
+	to      string
+	subject string
+	size    int64
+	// Whether it has no text and no attachments.
+	empty bool
+	// Whether it has no To, Cc or Bcc.
+	noRecipients bool
+}
+
+var htmlTagPattern = regexp.MustCompile(`<[^>]*>`)
+
+// Lists drafts last edited before --older-than, optionally only empty ones or those
+// without recipients, and deletes them. Drafts created by --preview-as-draft are left
+// for --commit-drafts.
+func runDrafts(args []string) {
+	fs := flag.NewFlagSet("drafts", flag.ExitOnError)
+	var opts mailboxOptions
+	opts.register(fs)
+	olderThan := fs.String("older-than", "", "Only drafts last edited longer ago than this, e.g. 90d or 1y")
+	emptyOnly := fs.Bool("empty-only", false, "Only drafts without text or attachments")
+	noRecipients := fs.Bool("no-recipients", false, "Only drafts without To, Cc or Bcc")
+	dryRun := fs.Bool("dry-run", false, "Only list the drafts")
+	assumeYes := fs.Bool("yes", false, "Delete the drafts without asking")
+	force := fs.Bool("force", false, "With --yes, don't ask to type a confirmation before drafts are deleted permanently")
+	limit := registerDestructiveLimit(fs)
+	parseFlags(fs, args)
+
+	var age time.Duration
+	if *olderThan != "" {
+		var err error
+		age, err = parseAge(*olderThan)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	pending, err := readPendingDrafts(pendingDraftsFile(opts.profile))
+	if err != nil {
+		log.Fatalf("Unable to read pending drafts: %v", err)
+	}
+	previews := map[string]bool{}
+	for _, d := range pending {
+		previews[d.DraftId] = true
+	}
+
+	mb := openMailbox(&opts)
+	defer mb.quota.printSummary()
+	drafts, err := mb.listAllDrafts()
+	if err != nil {
+		exitf(exitCodeFor(err), "Unable to list drafts: %v", err)
+	}
+
+	now := time.Now()
+	var stale []staleDraft
+	var total int64
+	for _, d := range drafts {
+		if previews[d.Id] {
+			continue
+		}
+		s, err := inspectDraft(mb, d.Id)
+		if err != nil {
+			exitf(exitCodeFor(err), "Unable to get draft [%s]: %v", d.Id, err)
+		}
+		if now.Sub(s.edited) < age || (*emptyOnly && !s.empty) || (*noRecipients && !s.noRecipients) {
+			continue
+		}
+		stale = append(stale, *s)
+		total += s.size
+	}
+
+	fmt.Printf("Drafts: %d, matching: %d (%s)\n", len(drafts), len(stale), formatBytes(total))
+	for _, s := range stale {
+		var notes []string
+		if s.empty {
+			notes = append(notes, "empty")
+		}
+		if s.noRecipients {
+			notes = append(notes, "no recipients")
+		}
+		fmt.Printf("* %s: %s, to [%s], subject [%s], %s %v\n", s.id, s.edited.Format("2006-01-02"), s.to, s.subject, formatBytes(s.size), notes)
+	}
+	if *dryRun || len(stale) == 0 {
+		return
+	}
+	limit.check(opts.profile, len(stale))
+	if *assumeYes {
+		if !*force && !confirmHardDelete(len(stale)) {
+			log.Println("Confirmation didn't match, nothing deleted.")
+			return
+		}
+	} else if !askYesNo(fmt.Sprintf("Do you want to delete these %d drafts permanently?", len(stale))) {
+		return
+	}
+
+	deleted := 0
+	for _, s := range stale {
+		if err := mb.deleteDraft(s.id); err != nil {
+			if errors.Is(err, errQuotaBudgetExceeded) {
+				exitf(exitQuota, "Stopping after deleting %d drafts: %v", deleted, err)
+			}
+			exitf(exitCodeFor(err), "Unable to delete draft [%s] after deleting %d: %v", s.id, deleted, err)
+		}
+		deleted++
+	}
+	fmt.Printf("Deleted %d drafts, %s\n", deleted, formatBytes(total))
+}
+
+// Fetches draft id and parses its message locally.
+func inspectDraft(mb *mailbox, id string) (*staleDraft, error) {
+	d, err := mb.getDraft(id, "raw")
+	if err != nil {
+		return nil, err
+	}
+	raw, err := base64.URLEncoding.DecodeString(d.Message.Raw)
+	if err != nil {
+		return nil, err
+	}
+	m, err := mimeutil.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	headers := m.Payload.Headers
+	s := &staleDraft{
+		id:      id,
+		edited:  time.Unix(0, d.Message.InternalDate*int64(time.Millisecond)),
+		to:      mimeutil.HeaderValue(headers, "To"),
+		subject: mimeutil.HeaderValue(headers, "Subject"),
+		size:    int64(len(raw)),
+		empty:   len(attachmentParts(m.Payload)) == 0 && strings.TrimSpace(draftText(m.Payload)) == "",
+	}
+	s.noRecipients = strings.TrimSpace(s.to) == "" && strings.TrimSpace(mimeutil.HeaderValue(headers, "Cc")) == "" &&
+		strings.TrimSpace(mimeutil.HeaderValue(headers, "Bcc")) == ""
+	return s, nil
+}
+
+// Returns the text of p's text parts, with HTML tags removed.
+func draftText(p *gmail.MessagePart) string {
+	var b strings.Builder
+	for _, part := range getMessagePartsRecursively(p, nil) {
+		if part.Filename != "" || part.Body == nil || !strings.HasPrefix(part.MimeType, "text/") {
+			continue
+		}
+		data, _ := base64.URLEncoding.DecodeString(part.Body.Data)
+		text := string(data)
+		if part.MimeType == "text/html" {
+			text = html.UnescapeString(htmlTagPattern.ReplaceAllString(text, ""))
+		}
+		b.WriteString(text)
+	}
+	return b.String()
+}
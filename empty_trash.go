@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/weineran/gmail-cleanup/cleaner"
+)
+
+// Loads trash.max_age from the policies file named by spec, or 0 if it has none.
+func loadTrashMaxAge(spec string) (time.Duration, error) {
+	if !isPolicyFile(spec) {
+		return 0, nil
+	}
+	f, err := readPolicyFile(spec)
+	if err != nil {
+		return 0, err
+	}
+	if f.Trash.MaxAge == "" {
+		return 0, nil
+	}
+	maxAge, err := parseAge(f.Trash.MaxAge)
+	if err != nil {
+		return 0, fmt.Errorf("%s: trash.max_age: %v", spec, err)
+	}
+	return maxAge, nil
+}
+
+// Returns maxAge in whole days, at least one, since older_than only takes days, months
+// and years.
+func trashAgeDays(maxAge time.Duration) int {
+	days := int(maxAge.Hours() / 24)
+	if days < 1 {
+		days = 1
+	}
+	return days
+}
+
+// Returns the messages journaled as trashed before cutoff. A message trashed more than
+// once counts from the last time.
+func trashedBefore(entries []journalEntry, cutoff time.Time) (map[string]bool, error) {
+	trashed := map[string]time.Time{}
+	for _, e := range entries {
+		if e.Action != journalTrashed {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, e.Time)
+		if err != nil {
+			return nil, fmt.Errorf("journal entry for message [%s]: %v", e.MessageId, err)
+		}
+		if t.After(trashed[e.MessageId]) {
+			trashed[e.MessageId] = t
+		}
+	}
+	before := map[string]bool{}
+	for id, t := range trashed {
+		if t.Before(cutoff) {
+			before[id] = true
+		}
+	}
+	return before, nil
+}
+
+// Permanently deletes messages in the trash, optionally only those matching a query,
+// older than a date, or trashed longer ago than a policy's trash.max_age.
+func runEmptyTrash(args []string) {
+	fs := flag.NewFlagSet("empty-trash", flag.ExitOnError)
+	var opts mailboxOptions
+	opts.register(fs)
+	query := fs.String("query", "", "Only delete trashed messages matching this query")
+	olderThan := fs.String("older-than", "", "Only delete trashed messages that arrived longer ago than this, e.g. 7d")
+	trashedFor := fs.String("trashed-for", "", "Only delete messages gmail-cleanup trashed at least this long ago, by its journal, e.g. 7d, instead of waiting for Gmail's 30 days")
+	policy := fs.String("policy", "", "Policies file whose trash.max_age gives --trashed-for")
+	force := fs.Bool("force", false, "Don't ask to type a confirmation")
+	allowQueryProblems := fs.Bool("allow-query-problems", false, "Run even if the query has unknown operators or values, such as lager:10M")
+	limit := registerDestructiveLimit(fs)
+	parseFlags(fs, args)
+	checkQuery(*query, true, *allowQueryProblems)
+	maxAge, err := loadTrashMaxAge(*policy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *trashedFor != "" {
+		if maxAge, err = parseAge(*trashedFor); err != nil {
+			log.Fatalf("Invalid --trashed-for: %v", err)
+		}
+	}
+	search := strings.TrimSpace("in:trash " + *query)
+	if *olderThan != "" {
+		age, err := parseAge(*olderThan)
+		if err != nil {
+			log.Fatalf("Invalid --older-than: %v", err)
+		}
+		search += fmt.Sprintf(" older_than:%dd", trashAgeDays(age))
+	}
+	// Gmail dates trashed messages by when they arrived, not when they were trashed,
+	// so the journal says how long they've been in the trash.
+	var expired map[string]bool
+	if maxAge > 0 {
+		entries, err := readJournal(profileJournalFile(opts.profile))
+		if err != nil {
+			log.Fatalf("Unable to read journal: %v", err)
+		}
+		if expired, err = trashedBefore(entries, time.Now().Add(-maxAge)); err != nil {
+			log.Fatalf("Unable to read journal: %v", err)
+		}
+	}
+
+	mb := openMailbox(&opts)
+	defer mb.quota.printSummary()
+
+	messages, err := cleaner.Collect(mb.cleaner().List(context.Background(), search))
+	if errors.Is(err, errQuotaBudgetExceeded) {
+		log.Printf("Stopping: %v\n", err)
+		return
+	}
+	if err != nil {
+		log.Fatalf("Unable to retrieve messages: %v", err)
+	}
+	if expired != nil {
+		var kept int
+		for _, m := range messages {
+			if expired[m.Id] {
+				messages[kept] = m
+				kept++
+			}
+		}
+		messages = messages[:kept]
+	}
+	if len(messages) == 0 {
+		fmt.Println("No messages found.")
+		return
+	}
+	limit.check(opts.profile, len(messages))
+	if !*force && !confirmHardDelete(len(messages)) {
+		log.Println("Confirmation didn't match, nothing deleted.")
+		return
+	}
+
+	ids := make([]string, 0, len(messages))
+	for _, m := range messages {
+		ids = append(ids, m.Id)
+	}
+	if err := mb.batchDelete(ids); err != nil {
+		log.Fatalf("Unable to delete messages: %v", err)
+	}
+	fmt.Printf("Deleted %s messages.\n", formatCount(len(ids)))
+}
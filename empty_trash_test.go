@@ -0,0 +1,40 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTrashedBefore(t *testing.T) {
+	at := func(day int) string {
+		return time.Date(2024, 6, day, 12, 0, 0, 0, time.UTC).Format(time.RFC3339)
+	}
+	entries := []journalEntry{
+		{Action: journalTrashed, MessageId: "old", Time: at(1)},
+		{Action: journalTrashed, MessageId: "recent", Time: at(9)},
+		{Action: journalStripped, MessageId: "stripped", Time: at(1)},
+		{Action: journalTrashed, MessageId: "again", Time: at(1)},
+		{Action: journalTrashed, MessageId: "again", Time: at(9)},
+	}
+	tests := []struct {
+		name   string
+		cutoff time.Time
+		want   map[string]bool
+	}{
+		{"before everything", time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), map[string]bool{}},
+		{"between", time.Date(2024, 6, 5, 0, 0, 0, 0, time.UTC), map[string]bool{"old": true}},
+		{"after everything", time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC), map[string]bool{"old": true, "recent": true, "again": true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := trashedBefore(entries, tt.cutoff)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("trashedBefore() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
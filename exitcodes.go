@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// Exit codes, so scripts and cron monitoring can tell outcomes apart.
+// Other errors exit with 1, and invalid flags with 2.
+const (
+	exitOK             = 0
+	exitError          = 1
+	exitAuth           = 3
+	exitQuota          = 4
+	exitPartial        = 5
+	exitVerification   = 6
+	exitNothingMatched = 7
+	exitStorageFull    = 8
+)
+
+// Kinds of error, by exit code, as they appear in the run summary.
+var exitStatuses = map[int]string{
+	exitOK:             "ok",
+	exitError:          "error",
+	exitAuth:           "auth failure",
+	exitQuota:          "quota exhausted",
+	exitPartial:        "partial failure",
+	exitVerification:   "verification failure",
+	exitNothingMatched: "nothing matched",
+	exitStorageFull:    "storage full",
+}
+
+// Returned, wrapped, when a copy fails a check against its original.
+var errVerificationFailed = errors.New("verification failed")
+
+// Returns the exit code for err.
+func exitCodeFor(err error) int {
+	var apiErr *googleapi.Error
+	var retrieveErr *oauth2.RetrieveError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, errQuotaBudgetExceeded):
+		return exitQuota
+	case errors.Is(err, errVerificationFailed):
+		return exitVerification
+	case errors.As(err, &retrieveErr):
+		return exitAuth
+	case isStorageFull(err):
+		return exitStorageFull
+	case errors.As(err, &apiErr):
+		if apiErr.Code == http.StatusUnauthorized {
+			return exitAuth
+		}
+		if apiErr.Code == http.StatusTooManyRequests {
+			return exitQuota
+		}
+		for _, e := range apiErr.Errors {
+			if e.Reason == "quotaExceeded" || e.Reason == "dailyLimitExceeded" || e.Reason == "rateLimitExceeded" || e.Reason == "userRateLimitExceeded" {
+				return exitQuota
+			}
+		}
+	}
+	return exitError
+}
+
+// Logs like log.Fatalf, but exits with code.
+func exitf(code int, format string, v ...interface{}) {
+	log.Output(2, fmt.Sprintf(format, v...))
+	os.Exit(code)
+}
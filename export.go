@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+
+	"github.com/weineran/gmail-cleanup/internal/mimeutil"
+)
+
+// Names exported attachments unless --name-template says otherwise.
+const defaultNameTemplate = `{{.Date.Format "2006-01"}}/{{.Filename}}`
+
+// What a naming template can use, e.g. {{.Date.Format "2006/01"}}/{{.From}}/{{.Filename}}.
+type attachmentName struct {
+	// The message's Date header, or when Gmail received it.
+	Date time.Time
+	// The sender's address, lowercased.
+	From string
+	// The sender's display name, the subject and the decoded filename, made safe filenames
+	// so they can't add directories, and the filename's extension without the dot.
+	FromName  string
+	Subject   string
+	Filename  string
+	Ext       string
+	MessageId string
+	// Hex SHA-256 of the content.
+	SHA256 string
+}
+
+func newAttachmentName(m *gmail.Message, filename string, data []byte) attachmentName {
+	sum := sha256.Sum256(data)
+	n := attachmentName{
+		Date:      messageDate(m),
+		Filename:  sanitizeFilename(mimeutil.DecodeFilename(filename)),
+		MessageId: m.Id,
+		SHA256:    hex.EncodeToString(sum[:]),
+	}
+	n.Ext = strings.TrimPrefix(filepath.Ext(n.Filename), ".")
+	if m.Payload != nil {
+		from := mimeutil.HeaderValue(m.Payload.Headers, "From")
+		n.From = senderAddress(from)
+		if name := senderName(from); name != "" {
+			n.FromName = sanitizeFilename(name)
+		}
+		if subject := mimeutil.HeaderValue(m.Payload.Headers, "Subject"); subject != "" {
+			n.Subject = sanitizeFilename(subject)
+		}
+	}
+	return n
+}
+
+// Returns the display name of a From header, or "" if it has none.
+func senderName(from string) string {
+	addr, err := mail.ParseAddress(from)
+	if err != nil {
+		return ""
+	}
+	return addr.Name
+}
+
+// Writes attachments under a directory, at paths from a naming template, so they land in
+// whatever structure the user's documents already have.
+type attachmentExporter struct {
+	dir  string
+	tmpl *template.Template
+}
+
+func newAttachmentExporter(dir string, nameTemplate string) (*attachmentExporter, error) {
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(nameTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("--name-template: %w", err)
+	}
+	// Catch references to fields that don't exist before anything is removed.
+	if _, err := (&attachmentExporter{tmpl: tmpl}).relativePath(attachmentName{Date: time.Now(), Filename: "x"}); err != nil {
+		return nil, err
+	}
+	return &attachmentExporter{dir: dir, tmpl: tmpl}, nil
+}
+
+// Returns the path the template gives n, relative to the directory. Each element is made
+// a safe filename, so a template can't reach outside the directory.
+func (e *attachmentExporter) relativePath(n attachmentName) (string, error) {
+	var b bytes.Buffer
+	if err := e.tmpl.Execute(&b, n); err != nil {
+		return "", fmt.Errorf("--name-template: %w", err)
+	}
+	var elems []string
+	for _, elem := range strings.FieldsFunc(b.String(), func(r rune) bool { return r == '/' || r == '\\' }) {
+		if trimmed := strings.TrimSpace(elem); trimmed != "" && trimmed != "." && trimmed != ".." {
+			elems = append(elems, sanitizeFilename(elem))
+		}
+	}
+	if len(elems) == 0 {
+		elems = []string{sanitizeFilename(n.Filename)}
+	}
+	return filepath.Join(elems...), nil
+}
+
+// Writes data at the path the template gives n and returns the path. If a different file
+// is there already, " (2)", " (3)" and so on are added before the extension; if the same
+// content is, nothing is written.
+func (e *attachmentExporter) export(n attachmentName, data []byte) (string, error) {
+	rel, err := e.relativePath(n)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(e.dir, rel)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	ext := filepath.Ext(path)
+	for i := 2; ; i++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			if hash, err := hashFile(path); err == nil && hash == n.SHA256 {
+				return path, nil
+			}
+			path = filepath.Join(e.dir, strings.TrimSuffix(rel, ext)+" ("+strconv.Itoa(i)+")"+ext)
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if _, err := f.Write(data); err != nil {
+			f.Close()
+			os.Remove(path)
+			return "", err
+		}
+		return path, f.Close()
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Device names that Windows reserves in every directory, whatever follows the first dot.
+var reservedFilenames = regexp.MustCompile(`(?i)^(con|prn|aux|nul|conin\$|conout\$|com[0-9¹²³]|lpt[0-9¹²³])$`)
+
+// Longest sanitized name in bytes, leaving room for a collision suffix.
+const maxFilenameBytes = 200
+
+// Makes a decoded filename safe to create on any common filesystem: no directories,
+// control or reserved characters, reserved names or trailing dots, and a bounded length.
+func sanitizeFilename(name string) string {
+	name = strings.ToValidUTF8(name, "_")
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`/\<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(strings.TrimRight(name, ". "))
+
+	ext := filepath.Ext(name)
+	if len(ext) > 16 {
+		ext = ""
+	}
+	base := strings.TrimSuffix(name, ext)
+	// Windows also ignores trailing spaces, so "nul .tar.gz" is the device too.
+	stem := strings.TrimRight(strings.SplitN(base, ".", 2)[0], " ")
+	if reservedFilenames.MatchString(stem) {
+		base = "_" + base
+	}
+	if len(base)+len(ext) > maxFilenameBytes {
+		base = truncateUTF8(base, maxFilenameBytes-len(ext))
+	}
+	if base == "" {
+		base = "attachment"
+	}
+	return base + ext
+}
+
+// Truncates s to at most n bytes without splitting a character.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// Makes names unique, ignoring case, by appending " (2)", " (3)" and so on before the extension.
+func uniqueFilenames(names []string) []string {
+	used := map[string]bool{}
+	result := make([]string, len(names))
+	for i, name := range names {
+		candidate := name
+		ext := filepath.Ext(name)
+		for n := 2; used[strings.ToLower(candidate)]; n++ {
+			candidate = strings.TrimSuffix(name, ext) + " (" + strconv.Itoa(n) + ")" + ext
+		}
+		used[strings.ToLower(candidate)] = true
+		result[i] = candidate
+	}
+	return result
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"google.golang.org/api/googleapi"
+
+	"github.com/weineran/gmail-cleanup/cleaner"
+)
+
+// An inconsistency between the journal and the mailbox.
+type fsckIssue struct {
+	entry   journalEntry
+	problem string
+	// Asked before repair runs. Without a repair the issue is only reported.
+	question string
+	repair   func() error
+	// Whether repair deletes a message permanently.
+	hardDelete bool
+}
+
+// Cross-checks the replacements in the journal against the mailbox: a stripped message's
+// copy should exist and its original should be gone, and a copy whose insert was started
+// but never recorded shouldn't be left behind. Offers to repair what it finds.
+func runFsck(args []string) {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	var opts mailboxOptions
+	opts.register(fs)
+	dryRun := fs.Bool("dry-run", false, "Only report inconsistencies")
+	assumeYes := fs.Bool("yes", false, "Repair every inconsistency without asking")
+	force := fs.Bool("force", false, "With --yes, don't ask to type a confirmation before originals are deleted permanently")
+	limit := registerDestructiveLimit(fs)
+	parseFlags(fs, args)
+
+	entries, err := readJournal(profileJournalFile(opts.profile))
+	if err != nil {
+		log.Fatalf("Unable to read journal: %v", err)
+	}
+	// The last copying or stripped entry of each message, in journal order.
+	latest := map[string]journalEntry{}
+	var order []string
+	copies := map[string]bool{}
+	// Copies deleted by rollback, whose originals were re-inserted.
+	rolledBack := map[string]bool{}
+	for _, e := range entries {
+		if e.Action == journalRolledBack {
+			rolledBack[e.MessageId] = true
+			copies[e.CopyId] = true
+		}
+	}
+	for _, e := range entries {
+		if e.Action != journalCopying && e.Action != journalStripped {
+			continue
+		}
+		if e.Action == journalStripped && rolledBack[e.CopyId] {
+			delete(latest, e.MessageId)
+			continue
+		}
+		if _, ok := latest[e.MessageId]; !ok {
+			order = append(order, e.MessageId)
+		}
+		latest[e.MessageId] = e
+		if e.CopyId != "" {
+			copies[e.CopyId] = true
+		}
+	}
+	// Without the rolled back replacements, each message once.
+	var checked []string
+	seen := map[string]bool{}
+	for _, id := range order {
+		if _, ok := latest[id]; ok && !seen[id] {
+			checked = append(checked, id)
+			seen[id] = true
+		}
+	}
+	order = checked
+	if len(order) == 0 {
+		fmt.Println("The journal has no replacements to check.")
+		return
+	}
+
+	mb := openMailbox(&opts)
+	defer mb.quota.printSummary()
+	journal := newRunJournal(opts.profile, newRunId(time.Now()))
+
+	var issues []fsckIssue
+	for _, id := range order {
+		e := latest[id]
+		var found []fsckIssue
+		if e.Action == journalStripped {
+			found = checkStripped(mb, journal, e)
+		} else {
+			found = checkCopying(mb, journal, e, copies)
+		}
+		issues = append(issues, found...)
+	}
+
+	fmt.Printf("Checked %d replacements: %d inconsistencies\n", len(order), len(issues))
+	hardDeletes := 0
+	for _, issue := range issues {
+		fmt.Printf("* message [%s] (run %s): %s\n", issue.entry.MessageId, issue.entry.RunId, issue.problem)
+		if issue.hardDelete {
+			hardDeletes++
+		}
+	}
+	if *dryRun || len(issues) == 0 {
+		return
+	}
+	limit.check(opts.profile, hardDeletes)
+	if *assumeYes && hardDeletes > 0 && !*force && !confirmHardDelete(hardDeletes) {
+		log.Println("Confirmation didn't match, nothing repaired.")
+		return
+	}
+
+	repaired, failed := 0, 0
+	for _, issue := range issues {
+		if issue.repair == nil {
+			continue
+		}
+		fmt.Printf("Message [%s]: %s\n", issue.entry.MessageId, issue.problem)
+		if !*assumeYes && !askYesNo(issue.question) {
+			continue
+		}
+		if err := issue.repair(); err != nil {
+			if errors.Is(err, errQuotaBudgetExceeded) {
+				exitf(exitQuota, "Stopping: %v", err)
+			}
+			log.Printf("Unable to repair message [%s]: %v\n", issue.entry.MessageId, err)
+			failed++
+			continue
+		}
+		repaired++
+	}
+	fmt.Printf("Repaired %d inconsistencies\n", repaired)
+	if failed > 0 {
+		exitf(exitPartial, "%d repairs failed", failed)
+	}
+}
+
+// Checks that the copy of a stripped message exists and its original is gone.
+func checkStripped(mb *mailbox, journal *runJournal, e journalEntry) []fsckIssue {
+	original := messageExists(mb, e.MessageId)
+	copied := messageExists(mb, e.CopyId)
+	switch {
+	case copied && original:
+		return []fsckIssue{{
+			entry:    e,
+			problem:  fmt.Sprintf("copy [%s] was inserted but the original wasn't deleted", e.CopyId),
+			question: "Do you want to delete the original permanently?",
+			repair: func() error {
+				if err := journal.record(e); err != nil {
+					return fmt.Errorf("Unable to write journal: %w", err)
+				}
+				return mb.deleteMessage(e.MessageId)
+			},
+			hardDelete: true,
+		}}
+	case !copied && original:
+		return []fsckIssue{{entry: e, problem: fmt.Sprintf("copy [%s] is gone but the original is intact; run it again to strip it", e.CopyId)}}
+	case !copied && !original:
+		return []fsckIssue{{entry: e, problem: fmt.Sprintf("both the original and copy [%s] are gone; restore the attachments from the archive, if any", e.CopyId)}}
+	}
+	return nil
+}
+
+// Looks for a copy of a message whose insert started but was never recorded: a message
+// with the same Message-ID in the same thread that the journal doesn't know about.
+func checkCopying(mb *mailbox, journal *runJournal, e journalEntry, copies map[string]bool) []fsckIssue {
+	if e.RFC822MessageId == "" {
+		return []fsckIssue{{entry: e, problem: "an insert was started but not recorded, and without a Message-ID a copy can't be looked for"}}
+	}
+	query := "in:anywhere rfc822msgid:" + strings.Trim(e.RFC822MessageId, "<>")
+	messages, err := cleaner.Collect(mb.cleaner().List(context.Background(), query))
+	if err != nil {
+		exitf(exitCodeFor(err), "Unable to search [%s]: %v", query, err)
+	}
+	original := false
+	var orphans []string
+	for _, m := range messages {
+		if m.Id == e.MessageId {
+			original = true
+			continue
+		}
+		if copies[m.Id] {
+			continue
+		}
+		if m.ThreadId == e.ThreadId {
+			orphans = append(orphans, m.Id)
+		}
+	}
+
+	var issues []fsckIssue
+	if e.DeletedFirst && len(messages) == 0 {
+		issues = append(issues, fsckIssue{entry: e, problem: fmt.Sprintf("the original was deleted before its copy was inserted, and neither is in the mailbox; its backup is %s in the run's --backup-dir",
+			filepath.Join(e.RunId, e.MessageId+".eml"))})
+	}
+	for _, id := range orphans {
+		id := id
+		if original {
+			issues = append(issues, fsckIssue{
+				entry:    e,
+				problem:  fmt.Sprintf("copy [%s] was inserted but never recorded, and the original is intact", id),
+				question: "Do you want to move the unrecorded copy to the trash?",
+				repair: func() error {
+					_, err := mb.trashMessage(id)
+					return err
+				},
+			})
+			continue
+		}
+		issues = append(issues, fsckIssue{
+			entry:    e,
+			problem:  fmt.Sprintf("copy [%s] was inserted but never recorded, and the original is gone", id),
+			question: "Do you want to record it as the replacement of the original?",
+			repair: func() error {
+				entry := e
+				entry.Action = journalStripped
+				entry.CopyId = id
+				return journal.record(entry)
+			},
+		})
+	}
+	return issues
+}
+
+// Reports whether message id exists, exiting on errors other than not found.
+func messageExists(mb *mailbox, id string) bool {
+	_, err := mb.getMessage(id, "minimal")
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		return false
+	}
+	if err != nil {
+		exitf(exitCodeFor(err), "Unable to get message [%s]: %v", id, err)
+	}
+	return true
+}
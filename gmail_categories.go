@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// Gmail inbox tabs and smart labels usable with category: in a query.
+var gmailCategories = map[string]bool{
+	"promotions":   true,
+	"social":       true,
+	"updates":      true,
+	"forums":       true,
+	"purchases":    true,
+	"reservations": true,
+}
+
+// Values of --action for the categories command, with the labels each adds and removes.
+var categoryActions = map[string]struct{ add, remove []string }{
+	"trash":     {add: []string{"TRASH"}},
+	"archive":   {remove: []string{"INBOX"}},
+	"mark-read": {remove: []string{"UNREAD"}},
+}
+
+// Trashes, archives or marks read the messages in Gmail categories older than an age.
+func runCategories(args []string) {
+	fs := flag.NewFlagSet("categories", flag.ExitOnError)
+	var opts mailboxOptions
+	opts.register(fs)
+	categories := fs.String("category", "promotions", "Comma-separated Gmail categories: promotions, social, updates, forums, purchases or reservations")
+	olderThan := fs.String("older-than", "90d", "Only messages older than this, e.g. 90d, 6m or 1y")
+	action := fs.String("action", "trash", "What to do with the messages: trash, archive or mark-read")
+	dryRun := fs.Bool("dry-run", false, "Only print counts and the per-sender breakdown")
+	assumeYes := fs.Bool("yes", false, "Don't ask for confirmation")
+	limit := registerDestructiveLimit(fs)
+	parseFlags(fs, args)
+
+	labels, ok := categoryActions[*action]
+	if !ok {
+		log.Fatalf("Unknown --action [%s], expected trash, archive or mark-read", *action)
+	}
+	age, err := parseAge(*olderThan)
+	if err != nil {
+		log.Fatal(err)
+	}
+	query, err := categoryQuery(splitList(*categories), age)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mb := openMailbox(&opts)
+	defer mb.quota.printSummary()
+
+	fmt.Printf("Using query string [%v]\n", query)
+	c := mb.cleaner()
+	c.MetadataHeaders = []string{"From"}
+	var messages []*gmail.Message
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for r := range c.Messages(ctx, query) {
+		if errors.Is(r.Err, errQuotaBudgetExceeded) {
+			log.Printf("Stopping: %v\n", r.Err)
+			return
+		}
+		if r.Err != nil {
+			log.Fatalf("Unable to retrieve messages: %v", r.Err)
+		}
+		messages = append(messages, r.Message)
+	}
+	if len(messages) == 0 {
+		fmt.Println("No messages found.")
+		return
+	}
+
+	printSenderBreakdown(countSenders(messages))
+	fmt.Printf("Count: %+v\n", len(messages))
+
+	if *dryRun {
+		fmt.Printf("Dry run: would %s %d messages.\n", *action, len(messages))
+		return
+	}
+	if *action == "trash" {
+		limit.check(opts.profile, len(messages))
+	}
+	if !*assumeYes && !askYesNo(fmt.Sprintf("Do you want to %s these %d messages?", *action, len(messages))) {
+		log.Println("Nothing changed.")
+		return
+	}
+
+	ids := make([]string, 0, len(messages))
+	for _, m := range messages {
+		ids = append(ids, m.Id)
+	}
+	if *action == "trash" {
+		journal := newRunJournal(opts.profile, newRunId(time.Now()))
+		for _, m := range messages {
+			if err := journal.record(newJournalEntry(journalTrashed, m)); err != nil {
+				log.Fatalf("Unable to write journal: %v", err)
+			}
+		}
+	}
+	if err := mb.batchModify(ids, labels.add, labels.remove); err != nil {
+		log.Fatalf("Unable to %s messages: %v", *action, err)
+	}
+	fmt.Printf("Done: %s %d messages.\n", *action, len(ids))
+}
+
+// Builds a query for messages in any of categories received more than age ago.
+func categoryQuery(categories []string, age time.Duration) (string, error) {
+	if len(categories) == 0 {
+		return "", errors.New("no --category given")
+	}
+	var terms []string
+	for _, c := range categories {
+		c = strings.ToLower(c)
+		if !gmailCategories[c] {
+			return "", fmt.Errorf("unknown category [%s], expected promotions, social, updates, forums, purchases or reservations", c)
+		}
+		terms = append(terms, "category:"+c)
+	}
+	query := terms[0]
+	if len(terms) > 1 {
+		query = "{" + strings.Join(terms, " ") + "}"
+	}
+	days := int(age / (24 * time.Hour))
+	return fmt.Sprintf("%s older_than:%dd", query, days), nil
+}
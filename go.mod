@@ -3,6 +3,12 @@ module github.com/weineran/gmail-cleanup
 go 1.16
 
 require (
+	github.com/emersion/go-imap v1.2.1
+	github.com/emersion/go-sasl v0.0.0-20200509203442-7bfe0ed36a21 // indirect
+	github.com/pkg/sftp v1.13.4
+	golang.org/x/crypto v0.0.0-20211215153901-e495a2d5b3d3
 	golang.org/x/oauth2 v0.0.0-20211104180415-d3ed0bb246c8
 	google.golang.org/api v0.63.0
+	gopkg.in/yaml.v3 v3.0.1
+	modernc.org/sqlite v1.14.2
 )
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The language of prompts, summaries and the text added to copies, set by --lang or
+// from the locale.
+var language = "en"
+
+// Translations of the English texts, by language. A text without one stays English.
+var translations = map[string]map[string]string{
+	"de": {
+		"%s (y or n)":                            "%s (j oder n)",
+		"%s (y or n, l to ask later, q to quit)": "%s (j oder n, l für später, q zum Beenden)",
+		"%s (y or n, l to ask later, q to quit, a to approve or s to skip all remaining from %s)": "%s (j oder n, l für später, q zum Beenden, a um alle weiteren von %s zu bestätigen oder s um sie zu überspringen)",
+		"This permanently deletes %s messages; they can't be restored from the trash.":            "Damit werden %s Nachrichten endgültig gelöscht; sie lassen sich nicht aus dem Papierkorb wiederherstellen.",
+		"Type \"%s\" to continue, or pass --force:":                                               "Geben Sie \"%s\" ein, um fortzufahren, oder verwenden Sie --force:",
+		"Invalid input. Allowed values are [%s]. Exiting.":                                        "Ungültige Eingabe. Erlaubt sind [%s]. Beende.",
+		"Save this decision for [%s] in [%s] for later runs?":                                     "Diese Entscheidung für [%s] in [%s] für spätere Läufe speichern?",
+		"This email is from protected contact [%s]. Do you still want to consider it?":            "Diese E-Mail stammt vom geschützten Kontakt [%s]. Möchten Sie sie trotzdem bearbeiten?",
+		"Policy says delete. Do you want to move this email to the trash?":                        "Laut Richtlinie löschen. Möchten Sie diese E-Mail in den Papierkorb verschieben?",
+		"Do you want to delete the attachments from this email?":                                  "Möchten Sie die Anhänge dieser E-Mail löschen?",
+		"Do you want to delete the attachments from this email and redact it?":                    "Möchten Sie die Anhänge dieser E-Mail löschen und sie schwärzen?",
+		"Do you want to redact this email?":                                                       "Möchten Sie diese E-Mail schwärzen?",
+		"Do you want to delete the attachments from the %d messages of this thread?":              "Möchten Sie die Anhänge der %d Nachrichten dieser Konversation löschen?",
+		"Summary:":                "Zusammenfassung:",
+		"Profile: %+v":            "Profil: %+v",
+		"Query: %+v":              "Suche: %+v",
+		"Matched: %+v":            "Gefunden: %+v",
+		"Reclaimed: about %s":     "Freigegeben: etwa %s",
+		"Reclaimed, verified: %s": "Freigegeben, geprüft: %s",
+		"Replacements that freed less than expected:":       "Ersetzungen, die weniger als erwartet freigegeben haben:",
+		"* %+v: original still exists next to copy %+v":     "* %+v: Original besteht neben Kopie %+v weiter",
+		"* %+v: %s to %s with %s of attachments (copy %+v)": "* %+v: %s auf %s bei %s Anhängen (Kopie %+v)",
+		"Stopped early: %+v":                                "Vorzeitig beendet: %+v",
+		"To continue, run with --continue-from %s":          "Zum Fortsetzen mit --continue-from %s ausführen",
+		"Errors:":                               "Fehler:",
+		"Quarantined attachments:":              "Unter Quarantäne gestellte Anhänge:",
+		"* %+v of message %+v: %+v (%+v)":       "* %+v der Nachricht %+v: %+v (%+v)",
+		"Status: %+v (exit code %d)":            "Status: %+v (Exit-Code %d)",
+		"Attachments removed by gmail-cleanup.": "Anhänge von gmail-cleanup entfernt.",
+		"Archived copies":                       "Archivierte Kopien",
+		string(outcomeNoAttachments):            "keine Anhänge",
+		string(outcomeSkipped):                  "übersprungen",
+		string(outcomeLater):                    "für später",
+		string(outcomeStripped):                 "bereinigt",
+		string(outcomeKept):                     "bereinigt, Original behalten",
+		string(outcomeTrashed):                  "im Papierkorb",
+		string(outcomeProtected):                "geschützt",
+		string(outcomeDrafted):                  "als Entwurf zur Vorschau",
+		string(outcomeRejected):                 "Entwurf abgelehnt",
+		string(outcomeFailed):                   "fehlgeschlagen",
+		string(outcomeChat):                     "übersprungen, Chat-Nachricht",
+		string(outcomePlanned):                  "geplant",
+		string(outcomeNotPlanned):               "übersprungen, nicht wie geplant",
+	},
+	"fr": {
+		"%s (y or n)":                            "%s (o ou n)",
+		"%s (y or n, l to ask later, q to quit)": "%s (o ou n, l pour plus tard, q pour quitter)",
+		"%s (y or n, l to ask later, q to quit, a to approve or s to skip all remaining from %s)": "%s (o ou n, l pour plus tard, q pour quitter, a pour accepter ou s pour ignorer tous les suivants de %s)",
+		"This permanently deletes %s messages; they can't be restored from the trash.":            "Cela supprime définitivement %s messages ; ils ne pourront pas être restaurés depuis la corbeille.",
+		"Type \"%s\" to continue, or pass --force:":                                               "Tapez \"%s\" pour continuer, ou passez --force :",
+		"Invalid input. Allowed values are [%s]. Exiting.":                                        "Saisie invalide. Valeurs autorisées : [%s]. Arrêt.",
+		"Save this decision for [%s] in [%s] for later runs?":                                     "Enregistrer cette décision pour [%s] dans [%s] pour les prochaines exécutions ?",
+		"This email is from protected contact [%s]. Do you still want to consider it?":            "Cet e-mail vient du contact protégé [%s]. Voulez-vous quand même le traiter ?",
+		"Policy says delete. Do you want to move this email to the trash?":                        "La règle dit de supprimer. Voulez-vous placer cet e-mail dans la corbeille ?",
+		"Do you want to delete the attachments from this email?":                                  "Voulez-vous supprimer les pièces jointes de cet e-mail ?",
+		"Do you want to delete the attachments from this email and redact it?":                    "Voulez-vous supprimer les pièces jointes de cet e-mail et le caviarder ?",
+		"Do you want to redact this email?":                                                       "Voulez-vous caviarder cet e-mail ?",
+		"Do you want to delete the attachments from the %d messages of this thread?":              "Voulez-vous supprimer les pièces jointes des %d messages de cette conversation ?",
+		"Summary:":                "Résumé :",
+		"Profile: %+v":            "Profil : %+v",
+		"Query: %+v":              "Recherche : %+v",
+		"Matched: %+v":            "Trouvés : %+v",
+		"Reclaimed: about %s":     "Libéré : environ %s",
+		"Reclaimed, verified: %s": "Libéré, vérifié : %s",
+		"Replacements that freed less than expected:":       "Remplacements qui ont libéré moins que prévu :",
+		"* %+v: original still exists next to copy %+v":     "* %+v : l'original existe toujours à côté de la copie %+v",
+		"* %+v: %s to %s with %s of attachments (copy %+v)": "* %+v : de %s à %s avec %s de pièces jointes (copie %+v)",
+		"Stopped early: %+v":                                "Arrêté avant la fin : %+v",
+		"To continue, run with --continue-from %s":          "Pour continuer, relancez avec --continue-from %s",
+		"Errors:":                               "Erreurs :",
+		"Quarantined attachments:":              "Pièces jointes en quarantaine :",
+		"* %+v of message %+v: %+v (%+v)":       "* %+v du message %+v : %+v (%+v)",
+		"Status: %+v (exit code %d)":            "État : %+v (code de sortie %d)",
+		"Attachments removed by gmail-cleanup.": "Pièces jointes retirées par gmail-cleanup.",
+		"Archived copies":                       "Copies archivées",
+		string(outcomeNoAttachments):            "sans pièces jointes",
+		string(outcomeSkipped):                  "ignorés",
+		string(outcomeLater):                    "laissés pour plus tard",
+		string(outcomeStripped):                 "nettoyés",
+		string(outcomeKept):                     "nettoyés, original conservé",
+		string(outcomeTrashed):                  "mis à la corbeille",
+		string(outcomeProtected):                "protégés",
+		string(outcomeDrafted):                  "prévisualisés en brouillon",
+		string(outcomeRejected):                 "brouillon refusé",
+		string(outcomeFailed):                   "en échec",
+		string(outcomeChat):                     "ignorés, message de chat",
+		string(outcomePlanned):                  "planifiés",
+		string(outcomeNotPlanned):               "ignorés, pas comme prévu",
+	},
+	"es": {
+		"%s (y or n)":                            "%s (s o n)",
+		"%s (y or n, l to ask later, q to quit)": "%s (s o n, l para preguntar después, q para salir)",
+		"%s (y or n, l to ask later, q to quit, a to approve or s to skip all remaining from %s)": "%s (s o n, l para preguntar después, q para salir, a para aprobar, o para omitir todos los restantes de %s)",
+		"This permanently deletes %s messages; they can't be restored from the trash.":            "Esto elimina definitivamente %s mensajes; no se podrán recuperar de la papelera.",
+		"Type \"%s\" to continue, or pass --force:":                                               "Escribe \"%s\" para continuar, o usa --force:",
+		"Invalid input. Allowed values are [%s]. Exiting.":                                        "Entrada no válida. Valores permitidos: [%s]. Saliendo.",
+		"Save this decision for [%s] in [%s] for later runs?":                                     "¿Guardar esta decisión para [%s] en [%s] para próximas ejecuciones?",
+		"This email is from protected contact [%s]. Do you still want to consider it?":            "Este correo es del contacto protegido [%s]. ¿Quieres tenerlo en cuenta de todos modos?",
+		"Policy says delete. Do you want to move this email to the trash?":                        "La política indica eliminar. ¿Quieres mover este correo a la papelera?",
+		"Do you want to delete the attachments from this email?":                                  "¿Quieres eliminar los adjuntos de este correo?",
+		"Do you want to delete the attachments from this email and redact it?":                    "¿Quieres eliminar los adjuntos de este correo y censurarlo?",
+		"Do you want to redact this email?":                                                       "¿Quieres censurar este correo?",
+		"Do you want to delete the attachments from the %d messages of this thread?":              "¿Quieres eliminar los adjuntos de los %d mensajes de esta conversación?",
+		"Summary:":                "Resumen:",
+		"Profile: %+v":            "Perfil: %+v",
+		"Query: %+v":              "Búsqueda: %+v",
+		"Matched: %+v":            "Encontrados: %+v",
+		"Reclaimed: about %s":     "Liberado: unos %s",
+		"Reclaimed, verified: %s": "Liberado, verificado: %s",
+		"Replacements that freed less than expected:":       "Reemplazos que liberaron menos de lo esperado:",
+		"* %+v: original still exists next to copy %+v":     "* %+v: el original sigue existiendo junto a la copia %+v",
+		"* %+v: %s to %s with %s of attachments (copy %+v)": "* %+v: de %s a %s con %s de adjuntos (copia %+v)",
+		"Stopped early: %+v":                                "Detenido antes de terminar: %+v",
+		"To continue, run with --continue-from %s":          "Para continuar, ejecuta con --continue-from %s",
+		"Errors:":                               "Errores:",
+		"Quarantined attachments:":              "Adjuntos en cuarentena:",
+		"* %+v of message %+v: %+v (%+v)":       "* %+v del mensaje %+v: %+v (%+v)",
+		"Status: %+v (exit code %d)":            "Estado: %+v (código de salida %d)",
+		"Attachments removed by gmail-cleanup.": "Adjuntos eliminados por gmail-cleanup.",
+		"Archived copies":                       "Copias archivadas",
+		string(outcomeNoAttachments):            "sin adjuntos",
+		string(outcomeSkipped):                  "omitidos",
+		string(outcomeLater):                    "para preguntar después",
+		string(outcomeStripped):                 "limpiados",
+		string(outcomeKept):                     "limpiados, original conservado",
+		string(outcomeTrashed):                  "en la papelera",
+		string(outcomeProtected):                "protegidos",
+		string(outcomeDrafted):                  "previsualizados como borrador",
+		string(outcomeRejected):                 "borrador rechazado",
+		string(outcomeFailed):                   "con error",
+		string(outcomeChat):                     "omitidos, mensaje de chat",
+		string(outcomePlanned):                  "planificados",
+		string(outcomeNotPlanned):               "omitidos, no según el plan",
+	},
+	"pt": {
+		"%s (y or n)":                            "%s (s ou n)",
+		"%s (y or n, l to ask later, q to quit)": "%s (s ou n, l para perguntar depois, q para sair)",
+		"%s (y or n, l to ask later, q to quit, a to approve or s to skip all remaining from %s)": "%s (s ou n, l para perguntar depois, q para sair, a para aprovar ou i para ignorar todas as restantes de %s)",
+		"This permanently deletes %s messages; they can't be restored from the trash.":            "Isto exclui permanentemente %s mensagens; elas não poderão ser restauradas da lixeira.",
+		"Type \"%s\" to continue, or pass --force:":                                               "Digite \"%s\" para continuar, ou use --force:",
+		"Invalid input. Allowed values are [%s]. Exiting.":                                        "Entrada inválida. Valores permitidos: [%s]. Saindo.",
+		"Save this decision for [%s] in [%s] for later runs?":                                     "Salvar esta decisão para [%s] em [%s] para as próximas execuções?",
+		"This email is from protected contact [%s]. Do you still want to consider it?":            "Este e-mail é do contato protegido [%s]. Deseja considerá-lo mesmo assim?",
+		"Policy says delete. Do you want to move this email to the trash?":                        "A política diz para excluir. Deseja mover este e-mail para a lixeira?",
+		"Do you want to delete the attachments from this email?":                                  "Deseja excluir os anexos deste e-mail?",
+		"Do you want to delete the attachments from this email and redact it?":                    "Deseja excluir os anexos deste e-mail e ocultar dados dele?",
+		"Do you want to redact this email?":                                                       "Deseja ocultar dados deste e-mail?",
+		"Do you want to delete the attachments from the %d messages of this thread?":              "Deseja excluir os anexos das %d mensagens desta conversa?",
+		"Summary:":                "Resumo:",
+		"Profile: %+v":            "Perfil: %+v",
+		"Query: %+v":              "Pesquisa: %+v",
+		"Matched: %+v":            "Encontradas: %+v",
+		"Reclaimed: about %s":     "Liberado: cerca de %s",
+		"Reclaimed, verified: %s": "Liberado, verificado: %s",
+		"Replacements that freed less than expected:":       "Substituições que liberaram menos que o esperado:",
+		"* %+v: original still exists next to copy %+v":     "* %+v: o original ainda existe ao lado da cópia %+v",
+		"* %+v: %s to %s with %s of attachments (copy %+v)": "* %+v: de %s para %s com %s de anexos (cópia %+v)",
+		"Stopped early: %+v":                                "Interrompido antes do fim: %+v",
+		"To continue, run with --continue-from %s":          "Para continuar, execute com --continue-from %s",
+		"Errors:":                               "Erros:",
+		"Quarantined attachments:":              "Anexos em quarentena:",
+		"* %+v of message %+v: %+v (%+v)":       "* %+v da mensagem %+v: %+v (%+v)",
+		"Status: %+v (exit code %d)":            "Status: %+v (código de saída %d)",
+		"Attachments removed by gmail-cleanup.": "Anexos removidos pelo gmail-cleanup.",
+		"Archived copies":                       "Cópias arquivadas",
+		string(outcomeNoAttachments):            "sem anexos",
+		string(outcomeSkipped):                  "ignoradas",
+		string(outcomeLater):                    "para perguntar depois",
+		string(outcomeStripped):                 "limpas",
+		string(outcomeKept):                     "limpas, original mantido",
+		string(outcomeTrashed):                  "na lixeira",
+		string(outcomeProtected):                "protegidas",
+		string(outcomeDrafted):                  "pré-visualizadas como rascunho",
+		string(outcomeRejected):                 "rascunho rejeitado",
+		string(outcomeFailed):                   "com falha",
+		string(outcomeChat):                     "ignoradas, mensagem de chat",
+		string(outcomePlanned):                  "planejadas",
+		string(outcomeNotPlanned):               "ignoradas, fora do plano",
+	},
+}
+
+// The answers askYesNo takes for yes and for no besides y, yes, n and no, by language.
+var yesNoAnswers = map[string][2][]string{
+	"de": {{"j", "ja"}, {"nein"}},
+	"fr": {{"o", "oui"}, {"non"}},
+	"es": {{"s", "si", "sí"}, {}},
+	"pt": {{"s", "sim"}, {"nao", "não"}},
+}
+
+// The key askSenderDecision takes to skip all remaining messages from a sender, by
+// language, where s already means yes.
+var skipAllKeys = map[string]string{
+	"es": "o",
+	"pt": "i",
+}
+
+// Returns the key for skipping all remaining messages from a sender in the current
+// language.
+func skipAllKey() string {
+	if key, ok := skipAllKeys[language]; ok {
+		return key
+	}
+	return "s"
+}
+
+// Returns s in the current language.
+func tr(s string) string {
+	if t, ok := translations[language][s]; ok {
+		return t
+	}
+	return s
+}
+
+// Formats the translation of format with args.
+func trf(format string, args ...interface{}) string {
+	return fmt.Sprintf(tr(format), args...)
+}
+
+// Returns the languages there are translations for, and English.
+func languages() []string {
+	langs := []string{"en"}
+	for lang := range translations {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// Sets the language from --lang, or without one, from $LC_ALL, $LC_MESSAGES or $LANG,
+// e.g. de_DE.UTF-8. A locale without a translation is English.
+func setLanguage(lang string) error {
+	if lang != "" {
+		lang = strings.ToLower(lang)
+		if lang != "en" && translations[lang] == nil {
+			return fmt.Errorf("unknown --lang [%s], expected one of %s", lang, strings.Join(languages(), ", "))
+		}
+		language = lang
+		return nil
+	}
+	language = "en"
+	for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		locale := os.Getenv(name)
+		if locale == "" {
+			continue
+		}
+		fields := strings.FieldsFunc(strings.ToLower(locale), func(r rune) bool { return r == '_' || r == '.' || r == '-' || r == '@' })
+		if len(fields) > 0 && translations[fields[0]] != nil {
+			language = fields[0]
+		}
+		return nil
+	}
+	return nil
+}
+
+// Returns the answers parseYesNo takes in the current language, followed by extra.
+func yesNoChoices(extra ...string) string {
+	localized := yesNoAnswers[language]
+	choices := append([]string{"y", "yes"}, localized[0]...)
+	choices = append(append(choices, "n", "no"), localized[1]...)
+	return strings.Join(append(choices, extra...), ", ")
+}
+
+// Reports whether answer is yes or no in English or the current language, and which.
+func parseYesNo(answer string) (yes bool, ok bool) {
+	localized := yesNoAnswers[language]
+	for _, a := range append([]string{"y", "yes"}, localized[0]...) {
+		if answer == a {
+			return true, true
+		}
+	}
+	for _, a := range append([]string{"n", "no"}, localized[1]...) {
+		if answer == a {
+			return false, true
+		}
+	}
+	return false, false
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"strings"
+
+	"github.com/weineran/gmail-cleanup/transform"
+)
+
+// Keeps image attachments as smaller re-encoded versions instead of removing them.
+// JPEGs are re-encoded at the given quality, PNGs losslessly; both are scaled down so
+// their longest side is at most maxDimension. An image is only kept if that shrinks it.
+// EXIF metadata, including orientation, is not carried over.
+type imageRecompressor struct {
+	quality      int
+	maxDimension int
+}
+
+func (r *imageRecompressor) Transform(m *transform.ParsedMessage) error {
+	for _, part := range m.Parts() {
+		mimeType := strings.ToLower(part.MimeType)
+		if !m.Downloaded(part) || (mimeType != "image/jpeg" && mimeType != "image/png") {
+			continue
+		}
+		data, _, err := m.Attachment(part)
+		if err != nil {
+			return fmt.Errorf("reading [%s]: %w", part.Filename, err)
+		}
+
+		smaller, err := r.recompress(data, mimeType)
+		if err != nil {
+			log.Printf("Unable to recompress [%s], removing it instead: %v\n", part.Filename, err)
+			continue
+		}
+		if len(smaller) >= len(data) {
+			log.Printf("Recompressing [%s] doesn't make it smaller, removing it instead.\n", part.Filename)
+			continue
+		}
+
+		log.Printf("Recompressed [%s] from %s to %s\n", part.Filename, formatBytes(int64(len(data))), formatBytes(int64(len(smaller))))
+		transform.SetBody(part, smaller)
+		part.Body.AttachmentId = ""
+		m.Keep(part)
+	}
+	return nil
+}
+
+func (r *imageRecompressor) recompress(data []byte, mimeType string) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	img = scaleDown(img, r.maxDimension)
+
+	var b bytes.Buffer
+	if mimeType == "image/png" {
+		enc := png.Encoder{CompressionLevel: png.BestCompression}
+		err = enc.Encode(&b, img)
+	} else {
+		err = jpeg.Encode(&b, img, &jpeg.Options{Quality: r.quality})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Scales img so its longest side is at most max, averaging the source pixels
+// that fall into each destination pixel.
+func scaleDown(img image.Image, max int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if max <= 0 || (w <= max && h <= max) {
+		return img
+	}
+
+	dw, dh := max, h*max/w
+	if h > w {
+		dw, dh = w*max/h, max
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := bounds.Min.Y+y*h/dh, bounds.Min.Y+(y+1)*h/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := bounds.Min.X+x*w/dw, bounds.Min.X+(x+1)*w/dw
+			var rs, gs, bs, as, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					rs, gs, bs, as = rs+uint64(cr), gs+uint64(cg), bs+uint64(cb), as+uint64(ca)
+					n++
+				}
+			}
+			if n == 0 {
+				continue
+			}
+			dst.Set(x, y, color.RGBA64{R: uint16(rs / n), G: uint16(gs / n), B: uint16(bs / n), A: uint16(as / n)})
+		}
+	}
+	return dst
+}
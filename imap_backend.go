@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	imapcommands "github.com/emersion/go-imap/commands"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/gmail/v1"
+
+	"github.com/weineran/gmail-cleanup/internal/auth"
+	"github.com/weineran/gmail-cleanup/internal/mimeutil"
+)
+
+// A folder on an IMAP server as a mailBackend. Message ids are UIDs.
+type imapBackend struct {
+	c      *client.Client
+	folder string
+	// Where trash moves messages, if not "".
+	trashFolder string
+}
+
+// Options for connecting to an IMAP server.
+type imapOptions struct {
+	server   string
+	username string
+	password string
+	// Used for XOAUTH2 instead of the password, e.g. for imap.gmail.com.
+	tokenSource oauth2.TokenSource
+	folder      string
+	trashFolder string
+}
+
+func openIMAPBackend(opts *imapOptions) (*imapBackend, error) {
+	c, err := client.DialTLS(opts.server, nil)
+	if err != nil {
+		return nil, err
+	}
+	if opts.tokenSource != nil {
+		tok, err := opts.tokenSource.Token()
+		if err == nil {
+			err = c.Authenticate(&xoauth2Client{username: opts.username, token: tok.AccessToken})
+		}
+		if err != nil {
+			c.Logout()
+			return nil, fmt.Errorf("XOAUTH2: %w", err)
+		}
+	} else if err := c.Login(opts.username, opts.password); err != nil {
+		c.Logout()
+		return nil, err
+	}
+	// Without UID EXPUNGE, removing a message would also purge every other message in
+	// the folder flagged \Deleted, and without APPENDUID the journal can't name copies.
+	if ok, err := c.Support("UIDPLUS"); err != nil || !ok {
+		c.Logout()
+		if err == nil {
+			err = fmt.Errorf("the server doesn't support UIDPLUS, needed to remove messages one at a time")
+		}
+		return nil, err
+	}
+	if _, err := c.Select(opts.folder, false); err != nil {
+		c.Logout()
+		return nil, fmt.Errorf("selecting [%s]: %w", opts.folder, err)
+	}
+	return &imapBackend{c: c, folder: opts.folder, trashFolder: opts.trashFolder}, nil
+}
+
+func (b *imapBackend) search(c searchCriteria) ([]string, error) {
+	criteria := imap.NewSearchCriteria()
+	criteria.WithoutFlags = []string{imap.DeletedFlag}
+	if c.larger > 0 {
+		criteria.Larger = uint32(c.larger)
+	}
+	criteria.Before = c.before
+	uids, err := b.c.UidSearch(criteria)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, uid := range uids {
+		ids = append(ids, strconv.FormatUint(uint64(uid), 10))
+	}
+	return ids, nil
+}
+
+func (b *imapBackend) fetch(id string) (*gmail.Message, *mimeutil.Spool, error) {
+	seqset, err := uidSet(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	spool, err := mimeutil.NewSpool()
+	if err != nil {
+		return nil, nil, err
+	}
+	section := &imap.BodySectionName{Peek: true}
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchInternalDate, section.FetchItem()}
+
+	messages := make(chan *imap.Message, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- b.c.UidFetch(seqset, items, messages)
+	}()
+	var fetched *imap.Message
+	var copyErr error
+	for msg := range messages {
+		body := msg.GetBody(section)
+		if body == nil || fetched != nil {
+			continue
+		}
+		// go-imap has already read the literal into memory; the spool still keeps
+		// parsing and rebuilding from making more copies of it.
+		if _, err := io.Copy(spool, body); err != nil {
+			// The rest of the response still has to be read.
+			copyErr = err
+		}
+		fetched = msg
+	}
+	err = <-done
+	if err == nil {
+		err = copyErr
+	}
+	if err == nil && fetched == nil {
+		err = fmt.Errorf("message [%s] not found in [%s]", id, b.folder)
+	}
+	if err != nil {
+		spool.Close()
+		return nil, nil, err
+	}
+	m, err := spool.Parse()
+	if err != nil {
+		spool.Close()
+		return nil, nil, fmt.Errorf("Unable to parse message [%s]: %w", id, err)
+	}
+	m.Id, m.LabelIds, m.SizeEstimate = id, fetched.Flags, spool.Size()
+	m.InternalDate = fetched.InternalDate.UnixNano() / int64(time.Millisecond)
+	return m, spool, nil
+}
+
+// An IMAP literal read from a spool file.
+type spoolLiteral struct {
+	io.Reader
+	size int64
+}
+
+func (l spoolLiteral) Len() int {
+	return int(l.size)
+}
+
+// Appends the copy with its flags, and returns the UID the server reports with APPENDUID.
+func (b *imapBackend) add(copy *messageCopy, date time.Time) (string, error) {
+	var flags []string
+	for _, f := range copy.LabelIds {
+		// \Recent can only be set by the server.
+		if f != imap.RecentFlag {
+			flags = append(flags, f)
+		}
+	}
+	status, err := b.c.Execute(&imapcommands.Append{Mailbox: b.folder, Flags: flags, Date: date, Message: spoolLiteral{Reader: copy.raw.Reader(), size: copy.size()}}, nil)
+	if err != nil {
+		return "", err
+	}
+	if err := status.Err(); err != nil {
+		return "", err
+	}
+	if status.Code != "APPENDUID" || len(status.Arguments) < 2 {
+		return "", fmt.Errorf("the server didn't report the UID of the copy")
+	}
+	uid, err := imap.ParseNumber(status.Arguments[1])
+	if err != nil {
+		return "", fmt.Errorf("APPENDUID: %w", err)
+	}
+	return strconv.FormatUint(uint64(uid), 10), nil
+}
+
+// Moves the message to the trash folder. Without MOVE, it is copied there and removed.
+func (b *imapBackend) trash(id string) error {
+	if b.trashFolder == "" {
+		return fmt.Errorf("no --imap-trash-folder to move message [%s] to", id)
+	}
+	seqset, err := uidSet(id)
+	if err != nil {
+		return err
+	}
+	// go-imap's own fallback for servers without MOVE expunges the whole folder.
+	if ok, err := b.c.Support("MOVE"); err != nil {
+		return err
+	} else if ok {
+		return b.c.UidMove(seqset, b.trashFolder)
+	}
+	if err := b.c.UidCopy(seqset, b.trashFolder); err != nil {
+		return err
+	}
+	return b.remove(id)
+}
+
+// Flags the message \Deleted and expunges just it with UID EXPUNGE, leaving alone other
+// messages in the folder flagged \Deleted, e.g. by another client.
+func (b *imapBackend) remove(id string) error {
+	seqset, err := uidSet(id)
+	if err != nil {
+		return err
+	}
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	if err := b.c.UidStore(seqset, item, []interface{}{imap.DeletedFlag}, nil); err != nil {
+		return err
+	}
+	status, err := b.c.Execute(&imapcommands.Uid{Cmd: &imap.Command{Name: "EXPUNGE", Arguments: []interface{}{seqset}}}, nil)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
+
+func (b *imapBackend) close() error {
+	return b.c.Logout()
+}
+
+func uidSet(id string) (*imap.SeqSet, error) {
+	uid, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UID [%s]", id)
+	}
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uint32(uid))
+	return seqset, nil
+}
+
+// SASL XOAUTH2, as used by Gmail and Outlook IMAP.
+type xoauth2Client struct {
+	username string
+	token    string
+}
+
+func (a *xoauth2Client) Start() (string, []byte, error) {
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+// The server only sends a challenge, a JSON error, if authentication failed. An empty
+// response completes the exchange so the server reports the failure.
+func (a *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	return []byte{}, nil
+}
+
+// Returns a token source for the mail.google.com scope, authorized with the profile's token.
+func profileTokenSource(opts *mailboxOptions) (oauth2.TokenSource, error) {
+	b, err := ioutil.ReadFile(profileCredentialsFile(opts.profile))
+	if err != nil {
+		return nil, err
+	}
+	config, err := google.ConfigFromJSON(b, gmail.MailGoogleComScope)
+	if err != nil {
+		return nil, err
+	}
+	tok, err := auth.TokenFromFile(profileTokenFile(opts.profile), opts.tokenEncryption().Passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("no token for profile, run any Gmail command first: %w", err)
+	}
+	return config.TokenSource(context.Background(), tok), nil
+}
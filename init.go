@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/gmail/v1"
+	"gopkg.in/yaml.v3"
+)
+
+const credentialsHelpURL = "https://developers.google.com/workspace/guides/create-credentials#oauth-client-id"
+
+// Walks through a first setup: OAuth client credentials, consent, a backup directory and
+// the marker labels, and writes config.yaml so later commands use the choices.
+func runInit(args []string) {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	var opts mailboxOptions
+	opts.register(fs)
+	fs.Parse(args)
+
+	configPath := profilePath(opts.profile, "config.yaml")
+	fmt.Printf("Setting up gmail-cleanup in [%s]\n", filepath.Dir(configPath))
+	if _, err := os.Stat(configPath); err == nil && !askYesNo(fmt.Sprintf("[%s] exists. Do you want to replace it?", configPath)) {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(configPath), 0700); err != nil {
+		log.Fatal(err)
+	}
+	config := configFile{Flags: map[string]string{}, MaxDestructivePerRun: defaultMaxDestructivePerRun}
+
+	fmt.Println("\n1. Credentials")
+	credentialsPath := profileCredentialsFile(opts.profile)
+	if _, err := os.Stat(credentialsPath); err == nil && !opts.adc {
+		fmt.Printf("Using the OAuth client in [%s]\n", credentialsPath)
+	} else if !opts.adc && !askYesNo("Do you want to use Application Default Credentials (gcloud auth application-default login) instead of an OAuth client?") {
+		fmt.Printf("Create an OAuth client ID for a desktop app as described at %s and download its JSON file.\n", credentialsHelpURL)
+		credentialsPath = profilePath(opts.profile, "credentials.json")
+		copyCredentials(promptLine("Path of the downloaded file: ", ""), credentialsPath)
+		fmt.Printf("Saved the OAuth client to [%s]\n", credentialsPath)
+	} else {
+		opts.adc = true
+		config.Flags["adc"] = "true"
+	}
+	if !opts.adc && !opts.encryptToken && askYesNo("Do you want to encrypt the token with a passphrase?") {
+		opts.encryptToken = true
+		config.Flags["encrypt-token"] = "true"
+	}
+
+	fmt.Println("\n2. Consent")
+	fmt.Println("Authorize gmail-cleanup to read, insert and delete your mail.")
+	mb := openMailbox(&opts)
+	defer mb.quota.printSummary()
+	profile, err := mb.getProfile()
+	if err != nil {
+		exitf(exitCodeFor(err), "Unable to get profile: %v", err)
+	}
+	fmt.Printf("Authorized as [%s], %s messages\n", profile.EmailAddress, formatCount(int(profile.MessagesTotal)))
+
+	fmt.Println("\n3. Backups")
+	fmt.Println("Originals can be saved before they are replaced, so `rollback` can restore a run.")
+	defaultBackupDir := "gmail-cleanup-backups"
+	if home, err := os.UserHomeDir(); err == nil {
+		defaultBackupDir = filepath.Join(home, defaultBackupDir)
+	}
+	if backupDir := promptLine(fmt.Sprintf("Backup directory, or none [%s]: ", defaultBackupDir), defaultBackupDir); backupDir != "none" {
+		if err := os.MkdirAll(backupDir, 0700); err != nil {
+			log.Fatalf("Unable to create backup directory: %v", err)
+		}
+		config.Flags["backup-dir"] = backupDir
+	}
+
+	fmt.Println("\n4. Labels")
+	labels := []string{threadLabelStripped, threadLabelArchived, defaultProtectedLabel}
+	fmt.Printf("Runs mark what they change and leave alone with the labels %s.\n", strings.Join(labels, ", "))
+	if askYesNo("Do you want to create them now?") {
+		for _, name := range labels {
+			if _, err := mb.ensureLabel(name); err != nil {
+				exitf(exitCodeFor(err), "Unable to create label [%s]: %v", name, err)
+			}
+		}
+	}
+
+	b, err := yaml.Marshal(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	header := "# Written by gmail-cleanup init. Values for command-line flags by name, used unless given on the command line,\n" +
+		"# and the most messages a run may delete or strip.\n"
+	if err := writeFileAtomic(configPath, append([]byte(header), b...)); err != nil {
+		log.Fatalf("Unable to write config: %v", err)
+	}
+	fmt.Printf("\nWrote [%s]. Try a run that changes nothing first:\n", configPath)
+	fmt.Println("  gmail-cleanup list")
+}
+
+// Prints prompt and returns the line typed, or def if it is empty.
+func promptLine(prompt string, def string) string {
+	fmt.Print(prompt)
+	line := strings.TrimSpace(readLine())
+	if line == "" {
+		return def
+	}
+	return line
+}
+
+// Checks that the file at from is an OAuth client and copies it to to.
+func copyCredentials(from string, to string) {
+	b, err := ioutil.ReadFile(from)
+	if err != nil {
+		log.Fatalf("Unable to read client secret file: %v", err)
+	}
+	if _, err := google.ConfigFromJSON(b, gmail.MailGoogleComScope); err != nil {
+		log.Fatalf("[%s] isn't an OAuth client secret file: %v", from, err)
+	}
+	if err := writeFileAtomic(to, b); err != nil {
+		log.Fatalf("Unable to save client secret file: %v", err)
+	}
+}
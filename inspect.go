@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/people/v1"
+
+	"github.com/weineran/gmail-cleanup/internal/mimeutil"
+)
+
+// Prints the MIME tree of one message and what a run with the given flags would do to it.
+func runInspect(args []string) {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	var opts mailboxOptions
+	opts.register(fs)
+	recompressImages := fs.Bool("recompress-images", false, "As for the default command")
+	recompressPDF := fs.Bool("recompress-pdf", false, "As for the default command")
+	protectKeywords := fs.String("protect-keywords", "", "As for the default command")
+	overrideProtection := fs.Bool("override-protection", false, "As for the default command")
+	policy := fs.String("policy", "", "As for the default command")
+	parseFlags(fs, args)
+
+	if fs.NArg() != 1 {
+		log.Fatal("Usage: gmail-cleanup inspect [flags] MESSAGE_ID")
+	}
+	rules, err := loadPolicy(*policy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var patterns []protectionPattern
+	if !*overrideProtection {
+		patterns, err = loadProtectionPatterns(*protectKeywords)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	opts.readOnly = true
+	if usesContactGroups(rules) {
+		opts.extraScopes = append(opts.extraScopes, people.ContactsReadonlyScope)
+	}
+	mb := openMailbox(&opts)
+	defer mb.quota.printSummary()
+	if err := resolveContactGroups(context.Background(), mb.client, rules); err != nil {
+		log.Fatalf("Unable to load contact groups: %v", err)
+	}
+	m, err := mb.getMessage(fs.Arg(0), "full")
+	if err != nil {
+		log.Fatalf("Unable to get message: %v", err)
+	}
+	own, err := mb.ownAddresses()
+	if err != nil {
+		exitf(exitCodeFor(err), "Unable to list send-as addresses: %v", err)
+	}
+
+	fmt.Printf("Id: %s\n", m.Id)
+	fmt.Printf("From: %s\n", mimeutil.HeaderValue(m.Payload.Headers, "From"))
+	fmt.Printf("Subject: %s\n", mimeutil.HeaderValue(m.Payload.Headers, "Subject"))
+	fmt.Printf("Date: %s\n", messageDate(m).Format("2006-01-02 15:04"))
+	fmt.Printf("SizeEstimate: %s\n", formatBytes(m.SizeEstimate))
+	fmt.Printf("LabelIds: %v\n", m.LabelIds)
+	category := classifyMessage(m, own)
+	fmt.Printf("Category: %s\n", category)
+
+	// What happens to the message as a whole, before looking at its parts.
+	verdict := "attachments are removed"
+	if pattern := matchProtection(patterns, m); pattern != "" {
+		verdict = fmt.Sprintf("left alone: matches protection pattern [%s]", pattern)
+	} else if rules != nil {
+		rule := matchPolicy(rules, newPolicySubject(m, own))
+		switch {
+		case rule == nil:
+			verdict = "left alone: no policy rule matches"
+		case rule.action == actionDelete:
+			verdict = "moved to the trash by policy"
+		}
+	}
+	fmt.Printf("Verdict: %s\n", verdict)
+	fmt.Println()
+
+	removing := strings.HasPrefix(verdict, "attachments")
+	printPartTree(m.Payload, "", true, func(p *gmail.MessagePart) string {
+		return plannedPartAction(p, removing, *recompressImages, *recompressPDF)
+	})
+}
+
+// Describes what a run would do to part p.
+func plannedPartAction(p *gmail.MessagePart, removing bool, recompressImages bool, recompressPDF bool) string {
+	switch {
+	case mimeutil.IsAttachedMessage(p) && removing:
+		return "remove, saved as .eml"
+	case mimeutil.IsAttachedMessage(p) || len(p.Parts) > 0:
+		return ""
+	case p.Filename == "" || !removing:
+		return "keep"
+	case recompressImages && (strings.EqualFold(p.MimeType, "image/jpeg") || strings.EqualFold(p.MimeType, "image/png")):
+		return "recompress if smaller, else remove"
+	case recompressPDF && isPDF(p.MimeType, p.Filename):
+		return "recompress if smaller, else remove"
+	}
+	return "remove"
+}
+
+// Prints p and its subparts as a tree with their sizes, types, encodings and filenames.
+func printPartTree(p *gmail.MessagePart, indent string, last bool, action func(*gmail.MessagePart) string) {
+	branch, childIndent := "├── ", indent+"│   "
+	if last {
+		branch, childIndent = "└── ", indent+"    "
+	}
+	if p.PartId == "" {
+		branch, childIndent = "", ""
+	}
+
+	var size int64
+	if p.Body != nil {
+		size = p.Body.Size
+	}
+	line := fmt.Sprintf("%s%s[%s] %s %s", indent, branch, partLabel(p), p.MimeType, formatBytes(size))
+	if encoding := mimeutil.HeaderValue(p.Headers, "Content-Transfer-Encoding"); encoding != "" {
+		line += " " + strings.ToLower(encoding)
+	}
+	if p.Filename != "" {
+		line += fmt.Sprintf(" %q", p.Filename)
+	}
+	if a := action(p); a != "" {
+		line += " -> " + a
+	}
+	fmt.Println(line)
+
+	for i, subpart := range p.Parts {
+		printPartTree(subpart, childIndent, i == len(p.Parts)-1, action)
+	}
+}
+
+func partLabel(p *gmail.MessagePart) string {
+	if p.PartId == "" {
+		return "root"
+	}
+	return p.PartId
+}
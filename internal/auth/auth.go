@@ -0,0 +1,179 @@
+// Package auth handles the lifecycle of the OAuth token gmail-cleanup keeps per profile:
+// loading it, running the authorization flow when there is none, and saving the result,
+// optionally encrypted with a passphrase.
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// How token files are encrypted at rest.
+type Encryption struct {
+	// Returns the passphrase of encrypted token files, if not nil. Only called when one
+	// is read or written.
+	Passphrase func() (string, error)
+	// Save tokens encrypted, and encrypt a plaintext token file when it is read.
+	Encrypt bool
+}
+
+// Returns a client authorized with the token in tokFile. Without one, the user is sent
+// through the authorization flow on in and out, and the new token is saved to tokFile.
+// A token file that can't be decrypted is an error rather than a reason to authorize
+// again. The client refreshes the token as needed.
+func Client(ctx context.Context, config *oauth2.Config, tokFile string, enc Encryption, in io.Reader, out io.Writer) (*http.Client, error) {
+	tok, err := TokenFromFile(tokFile, enc.Passphrase)
+	if errors.Is(err, ErrEncrypted) {
+		return nil, err
+	}
+	if err != nil {
+		return Reauthorize(ctx, config, tokFile, enc, in, out)
+	}
+	if enc.Encrypt && !fileEncrypted(tokFile) {
+		fmt.Fprintf(out, "Encrypting credential file: %s\n", tokFile)
+		if err := saveToken(tokFile, tok, enc); err != nil {
+			return nil, fmt.Errorf("unable to encrypt oauth token: %w", err)
+		}
+	}
+	return config.Client(ctx, tok), nil
+}
+
+// Sends the user through the authorization flow for config's scopes on in and out, saves
+// the new token to tokFile, replacing any there, and returns a client authorized with it.
+func Reauthorize(ctx context.Context, config *oauth2.Config, tokFile string, enc Encryption, in io.Reader, out io.Writer) (*http.Client, error) {
+	tok, err := TokenFromWeb(ctx, config, in, out)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(out, "Saving credential file to: %s\n", tokFile)
+	if err := saveToken(tokFile, tok, enc); err != nil {
+		return nil, fmt.Errorf("unable to cache oauth token: %w", err)
+	}
+	return config.Client(ctx, tok), nil
+}
+
+// Prints the authorization URL to out, reads the code the user pastes from in, and
+// exchanges it for a token.
+func TokenFromWeb(ctx context.Context, config *oauth2.Config, in io.Reader, out io.Writer) (*oauth2.Token, error) {
+	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
+	fmt.Fprintf(out, "Go to the following link in your browser then type the "+
+		"authorization code: \n%v\n", authURL)
+
+	authCode, err := readLine(in)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read authorization code: %w", err)
+	}
+	tok, err := config.Exchange(ctx, authCode)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve token from web: %w", err)
+	}
+	return tok, nil
+}
+
+// Reads one line a byte at a time, so the line break, CRLF on Windows, isn't left
+// behind for the next prompt. Surrounding whitespace is trimmed.
+func readLine(in io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := in.Read(b)
+		if n == 1 && b[0] != '\n' {
+			line = append(line, b[0])
+			continue
+		}
+		if n == 1 || (err == io.EOF && len(line) > 0) {
+			return strings.TrimSpace(string(line)), nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// Reads a token saved by SaveToken, decrypting it with the passphrase from passphrase
+// if it is encrypted.
+func TokenFromFile(path string, passphrase func() (string, error)) (*oauth2.Token, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if IsEncrypted(b) {
+		if passphrase == nil {
+			return nil, fmt.Errorf("%s: %w and no passphrase was given", path, ErrEncrypted)
+		}
+		p, err := passphrase()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w: %v", path, ErrEncrypted, err)
+		}
+		b, err = Decrypt(b, p)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w: %v", path, ErrEncrypted, err)
+		}
+	}
+	tok := &oauth2.Token{}
+	if err := json.Unmarshal(b, tok); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return tok, nil
+}
+
+// Writes token to path as JSON, readable only by the user, encrypted with passphrase
+// unless it is "".
+func SaveToken(path string, token *oauth2.Token, passphrase string) error {
+	b, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	if passphrase == "" {
+		b = append(b, '\n')
+	} else {
+		b, err = Encrypt(b, passphrase)
+		if err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func saveToken(path string, token *oauth2.Token, enc Encryption) error {
+	if !enc.Encrypt {
+		return SaveToken(path, token, "")
+	}
+	if enc.Passphrase == nil {
+		return errors.New("encrypting the token needs a passphrase")
+	}
+	p, err := enc.Passphrase()
+	if err != nil {
+		return err
+	}
+	if p == "" {
+		return errors.New("empty passphrase")
+	}
+	return SaveToken(path, token, p)
+}
+
+func fileEncrypted(path string) bool {
+	b, err := ioutil.ReadFile(path)
+	return err == nil && IsEncrypted(b)
+}
@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestReadLine(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       string
+		want     string
+		wantRest string
+		wantErr  bool
+	}{
+		{"line feed", "code\nnext", "code", "next", false},
+		{"crlf", "code\r\nnext", "code", "next", false},
+		{"surrounding whitespace", "  code \t\n", "code", "", false},
+		{"last line without line break", "code", "code", "", false},
+		{"empty line", "\nnext", "", "next", false},
+		{"nothing", "", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := strings.NewReader(tt.in)
+			got, err := readLine(in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readLine() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("readLine() = %q, want %q", got, tt.want)
+			}
+			rest, _ := ioutil.ReadAll(in)
+			if string(rest) != tt.wantRest {
+				t.Errorf("readLine() left %q, want %q", rest, tt.wantRest)
+			}
+		})
+	}
+}
+
+func TestTokenFromFile(t *testing.T) {
+	dir := t.TempDir()
+	token := &oauth2.Token{AccessToken: "access", TokenType: "Bearer", RefreshToken: "refresh"}
+	plainPath := filepath.Join(dir, "plain.json")
+	if err := SaveToken(plainPath, token, ""); err != nil {
+		t.Fatal(err)
+	}
+	encryptedPath := filepath.Join(dir, "profile", "encrypted.json")
+	if err := SaveToken(encryptedPath, token, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(encryptedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 && os.PathSeparator == '/' {
+		t.Errorf("token file mode = %v, want 0600", perm)
+	}
+
+	passphrase := func(p string) func() (string, error) {
+		return func() (string, error) { return p, nil }
+	}
+	tests := []struct {
+		name          string
+		path          string
+		passphrase    func() (string, error)
+		wantEncrypted bool
+		wantErr       bool
+	}{
+		{"plaintext", plainPath, nil, false, false},
+		{"plaintext ignores the passphrase", plainPath, passphrase("secret"), false, false},
+		{"encrypted", encryptedPath, passphrase("secret"), false, false},
+		{"encrypted without a passphrase", encryptedPath, nil, true, true},
+		{"encrypted with the wrong passphrase", encryptedPath, passphrase("wrong"), true, true},
+		{"passphrase fails", encryptedPath, func() (string, error) { return "", errors.New("no terminal") }, true, true},
+		{"missing", filepath.Join(dir, "missing.json"), nil, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := TokenFromFile(tt.path, tt.passphrase)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("TokenFromFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if errors.Is(err, ErrEncrypted) != tt.wantEncrypted {
+				t.Errorf("TokenFromFile() error = %v, want ErrEncrypted %v", err, tt.wantEncrypted)
+			}
+			if err != nil {
+				return
+			}
+			if got.AccessToken != token.AccessToken || got.RefreshToken != token.RefreshToken {
+				t.Errorf("TokenFromFile() = %+v, want %+v", got, token)
+			}
+		})
+	}
+}
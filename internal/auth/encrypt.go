@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Returned, wrapped, when a token file is encrypted and can't be decrypted: no
+// passphrase was given, getting it failed, or it is wrong.
+var ErrEncrypted = errors.New("token is encrypted")
+
+// Identifies an encrypted token file.
+const encryptionFormat = "aes-256-gcm+scrypt"
+
+// scrypt parameters for new files, as recommended for interactive logins in 2017.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// A token file encrypted with AES-256-GCM under a key derived from a passphrase with
+// scrypt. The parameters are stored so they can be raised later.
+type encryptedFile struct {
+	Format     string `json:"format"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// Reports whether data was written by Encrypt.
+func IsEncrypted(data []byte) bool {
+	var f encryptedFile
+	return json.Unmarshal(data, &f) == nil && f.Format == encryptionFormat
+}
+
+// Encrypts plaintext with passphrase.
+func Encrypt(plaintext []byte, passphrase string) ([]byte, error) {
+	f := encryptedFile{Format: encryptionFormat, N: scryptN, R: scryptR, P: scryptP, Salt: make([]byte, 16)}
+	if _, err := rand.Read(f.Salt); err != nil {
+		return nil, err
+	}
+	gcm, err := f.cipher(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	f.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(f.Nonce); err != nil {
+		return nil, err
+	}
+	f.Ciphertext = gcm.Seal(nil, f.Nonce, plaintext, []byte(encryptionFormat))
+	return json.Marshal(f)
+}
+
+// Decrypts data written by Encrypt. A wrong passphrase fails authentication.
+func Decrypt(data []byte, passphrase string) ([]byte, error) {
+	var f encryptedFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	if f.Format != encryptionFormat {
+		return nil, fmt.Errorf("unknown format [%s], expected %s", f.Format, encryptionFormat)
+	}
+	gcm, err := f.cipher(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if len(f.Nonce) != gcm.NonceSize() {
+		return nil, errors.New("invalid nonce")
+	}
+	plaintext, err := gcm.Open(nil, f.Nonce, f.Ciphertext, []byte(encryptionFormat))
+	if err != nil {
+		return nil, errors.New("wrong passphrase or damaged file")
+	}
+	return plaintext, nil
+}
+
+func (f *encryptedFile) cipher(passphrase string) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), f.Salt, f.N, f.R, f.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
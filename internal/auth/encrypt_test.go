@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	plaintext := []byte(`{"access_token":"a","refresh_token":"r"}`)
+	data, err := Encrypt(plaintext, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("refresh_token")) {
+		t.Errorf("Encrypt() output contains the plaintext: %s", data)
+	}
+	if !IsEncrypted(data) {
+		t.Errorf("IsEncrypted() = false for Encrypt() output")
+	}
+	got, err := Decrypt(data, "correct horse")
+	if err != nil {
+		t.Fatalf("Decrypt() error = %v", err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("Decrypt() = %s, want %s", got, plaintext)
+	}
+
+	again, err := Encrypt(plaintext, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(again, data) {
+		t.Errorf("Encrypt() gave the same output twice; salt and nonce should be random")
+	}
+}
+
+func TestDecryptFailures(t *testing.T) {
+	data, err := Encrypt([]byte("secret"), "right")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var f encryptedFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		t.Fatal(err)
+	}
+	tampered := f
+	tampered.Ciphertext = append([]byte{}, f.Ciphertext...)
+	tampered.Ciphertext[0] ^= 1
+	otherFormat := f
+	otherFormat.Format = "rot13"
+	shortNonce := f
+	shortNonce.Nonce = f.Nonce[:4]
+
+	tests := []struct {
+		name       string
+		data       []byte
+		passphrase string
+	}{
+		{"wrong passphrase", data, "wrong"},
+		{"tampered ciphertext", marshal(t, tampered), "right"},
+		{"unknown format", marshal(t, otherFormat), "right"},
+		{"short nonce", marshal(t, shortNonce), "right"},
+		{"not json", []byte("{"), "right"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := Decrypt(tt.data, tt.passphrase); err == nil {
+				t.Errorf("Decrypt() = %q, want an error", got)
+			}
+		})
+	}
+}
+
+func TestIsEncrypted(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want bool
+	}{
+		{"plaintext token", `{"access_token":"a","token_type":"Bearer"}`, false},
+		{"other format", `{"format":"rot13"}`, false},
+		{"not json", "token", false},
+		{"encrypted", `{"format":"aes-256-gcm+scrypt"}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsEncrypted([]byte(tt.data)); got != tt.want {
+				t.Errorf("IsEncrypted(%s) = %v, want %v", tt.data, got, tt.want)
+			}
+		})
+	}
+}
+
+func marshal(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
@@ -0,0 +1,355 @@
+// Package gmailapi wraps the Gmail API calls gmail-cleanup makes in typed methods that
+// retry calls Gmail turned away because of rate limits or server errors.
+//
+// Calls that change the mailbox in a way that can't safely happen twice, such as
+// inserting a message, are only retried when Gmail rate limited them, since a server
+// error may come after the change was made.
+package gmailapi
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	DefaultAttempts = 4
+	DefaultBackoff  = time.Second
+)
+
+type Client struct {
+	Service *gmail.Service
+	// The authorized client Service uses, for streaming raw messages.
+	HTTP *http.Client
+	// The mailbox to use; "me" if empty.
+	User string
+	// Tries per call, including the first; DefaultAttempts if zero.
+	Attempts int
+	// Wait before the first retry, doubled before each further one; DefaultBackoff if zero.
+	Backoff time.Duration
+	// Called instead of time.Sleep between tries, if set.
+	Sleep func(time.Duration)
+	// Called before each retry with the quota method of the call, e.g. "messages.get",
+	// since Gmail charges every try. An error stops the retries and is returned.
+	Charge func(method string) error
+}
+
+func New(service *gmail.Service) *Client {
+	return &Client{Service: service}
+}
+
+func (c *Client) user() string {
+	if c.User == "" {
+		return "me"
+	}
+	return c.User
+}
+
+// Reports whether err means Gmail rate limited the call, so it wasn't carried out.
+func RateLimited(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	if apiErr.Code == http.StatusTooManyRequests {
+		return true
+	}
+	if apiErr.Code == http.StatusForbidden {
+		for _, e := range apiErr.Errors {
+			if e.Reason == "rateLimitExceeded" || e.Reason == "userRateLimitExceeded" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Reports whether err is worth retrying a call that is safe to repeat.
+func Retryable(err error) bool {
+	if RateLimited(err) {
+		return true
+	}
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.Code {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Runs call until it succeeds, fails with an error retry rejects, or runs out of tries.
+// Each retry is charged as method; the first try is charged by the caller.
+func (c *Client) do(method string, retry func(error) bool, call func() error) error {
+	attempts := c.Attempts
+	if attempts <= 0 {
+		attempts = DefaultAttempts
+	}
+	wait := c.Backoff
+	if wait <= 0 {
+		wait = DefaultBackoff
+	}
+	sleep := c.Sleep
+	if sleep == nil {
+		sleep = time.Sleep
+	}
+	for attempt := 1; ; attempt++ {
+		err := call()
+		if err == nil || attempt >= attempts || !retry(err) {
+			return err
+		}
+		sleep(wait)
+		wait *= 2
+		if c.Charge != nil {
+			if err := c.Charge(method); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *Client) ListMessages(query string, pageToken string, maxResults int64) (*gmail.ListMessagesResponse, error) {
+	var r *gmail.ListMessagesResponse
+	err := c.do("messages.list", Retryable, func() (err error) {
+		call := c.Service.Users.Messages.List(c.user()).Q(query).PageToken(pageToken)
+		if maxResults > 0 {
+			call = call.MaxResults(maxResults)
+		}
+		r, err = call.Do()
+		return err
+	})
+	return r, err
+}
+
+func (c *Client) GetMessage(id string, format string) (*gmail.Message, error) {
+	var m *gmail.Message
+	err := c.do("messages.get", Retryable, func() (err error) {
+		m, err = c.Service.Users.Messages.Get(c.user(), id).Format(format).Do()
+		return err
+	})
+	return m, err
+}
+
+// How deep GetMessageStructure leaves out body data. Parts nested deeper come whole.
+const structureDepth = 8
+
+// Fields of a message in full format, without the data of any part's body.
+func structureFields() string {
+	part := "partId,mimeType,filename,headers,body(size,attachmentId)"
+	parts := "parts"
+	for i := 0; i < structureDepth; i++ {
+		parts = "parts(" + part + "," + parts + ")"
+	}
+	return "id,threadId,labelIds,snippet,historyId,internalDate,sizeEstimate,payload(" + part + "," + parts + ")"
+}
+
+// Gets message id in full format without body data, which is enough for its headers,
+// labels and the sizes of its parts, and much smaller than the full format.
+func (c *Client) GetMessageStructure(id string) (*gmail.Message, error) {
+	var m *gmail.Message
+	err := c.do("messages.get", Retryable, func() (err error) {
+		m, err = c.Service.Users.Messages.Get(c.user(), id).Format("full").Fields(googleapi.Field(structureFields())).Do()
+		return err
+	})
+	return m, err
+}
+
+func (c *Client) GetAttachment(messageId string, attachmentId string) (*gmail.MessagePartBody, error) {
+	var b *gmail.MessagePartBody
+	err := c.do("messages.attachments.get", Retryable, func() (err error) {
+		b, err = c.Service.Users.Messages.Attachments.Get(c.user(), messageId, attachmentId).Do()
+		return err
+	})
+	return b, err
+}
+
+// Inserts m, uploading its raw message as media rather than as base64 in the JSON body.
+func (c *Client) InsertMessage(m *gmail.Message, internalDateSource string) (*gmail.Message, error) {
+	return c.InsertRaw(m, base64Source(m), internalDateSource)
+}
+
+// Imports m with neverMarkSpam, and without adding calendar invitations to the calendar.
+func (c *Client) ImportMessage(m *gmail.Message, internalDateSource string) (*gmail.Message, error) {
+	return c.ImportRaw(m, base64Source(m), internalDateSource)
+}
+
+func (c *Client) DeleteMessage(id string) error {
+	return c.do("messages.delete", RateLimited, func() error {
+		return c.Service.Users.Messages.Delete(c.user(), id).Do()
+	})
+}
+
+func (c *Client) BatchModify(ids []string, addLabelIds []string, removeLabelIds []string) error {
+	req := &gmail.BatchModifyMessagesRequest{Ids: ids, AddLabelIds: addLabelIds, RemoveLabelIds: removeLabelIds}
+	return c.do("messages.batchModify", Retryable, func() error {
+		return c.Service.Users.Messages.BatchModify(c.user(), req).Do()
+	})
+}
+
+func (c *Client) BatchDelete(ids []string) error {
+	req := &gmail.BatchDeleteMessagesRequest{Ids: ids}
+	return c.do("messages.batchDelete", RateLimited, func() error {
+		return c.Service.Users.Messages.BatchDelete(c.user(), req).Do()
+	})
+}
+
+func (c *Client) TrashMessage(id string) (*gmail.Message, error) {
+	var m *gmail.Message
+	err := c.do("messages.trash", Retryable, func() (err error) {
+		m, err = c.Service.Users.Messages.Trash(c.user(), id).Do()
+		return err
+	})
+	return m, err
+}
+
+func (c *Client) UntrashMessage(id string) (*gmail.Message, error) {
+	var m *gmail.Message
+	err := c.do("messages.untrash", Retryable, func() (err error) {
+		m, err = c.Service.Users.Messages.Untrash(c.user(), id).Do()
+		return err
+	})
+	return m, err
+}
+
+func (c *Client) ModifyMessage(id string, addLabelIds []string, removeLabelIds []string) (*gmail.Message, error) {
+	req := &gmail.ModifyMessageRequest{AddLabelIds: addLabelIds, RemoveLabelIds: removeLabelIds}
+	var m *gmail.Message
+	err := c.do("messages.modify", Retryable, func() (err error) {
+		m, err = c.Service.Users.Messages.Modify(c.user(), id, req).Do()
+		return err
+	})
+	return m, err
+}
+
+func (c *Client) CreateDraft(m *gmail.Message) (*gmail.Draft, error) {
+	var d *gmail.Draft
+	err := c.do("drafts.create", RateLimited, func() (err error) {
+		d, err = c.Service.Users.Drafts.Create(c.user(), &gmail.Draft{Message: m}).Do()
+		return err
+	})
+	return d, err
+}
+
+func (c *Client) ListDrafts(pageToken string, maxResults int64) (*gmail.ListDraftsResponse, error) {
+	var r *gmail.ListDraftsResponse
+	err := c.do("drafts.list", Retryable, func() (err error) {
+		call := c.Service.Users.Drafts.List(c.user()).PageToken(pageToken)
+		if maxResults > 0 {
+			call = call.MaxResults(maxResults)
+		}
+		r, err = call.Do()
+		return err
+	})
+	return r, err
+}
+
+func (c *Client) GetDraft(id string, format string) (*gmail.Draft, error) {
+	var d *gmail.Draft
+	err := c.do("drafts.get", Retryable, func() (err error) {
+		d, err = c.Service.Users.Drafts.Get(c.user(), id).Format(format).Do()
+		return err
+	})
+	return d, err
+}
+
+func (c *Client) DeleteDraft(id string) error {
+	return c.do("drafts.delete", RateLimited, func() error {
+		return c.Service.Users.Drafts.Delete(c.user(), id).Do()
+	})
+}
+
+func (c *Client) GetThread(id string, format string) (*gmail.Thread, error) {
+	var t *gmail.Thread
+	err := c.do("threads.get", Retryable, func() (err error) {
+		t, err = c.Service.Users.Threads.Get(c.user(), id).Format(format).Do()
+		return err
+	})
+	return t, err
+}
+
+func (c *Client) ModifyThread(id string, addLabelIds []string, removeLabelIds []string) (*gmail.Thread, error) {
+	req := &gmail.ModifyThreadRequest{AddLabelIds: addLabelIds, RemoveLabelIds: removeLabelIds}
+	var t *gmail.Thread
+	err := c.do("threads.modify", Retryable, func() (err error) {
+		t, err = c.Service.Users.Threads.Modify(c.user(), id, req).Do()
+		return err
+	})
+	return t, err
+}
+
+func (c *Client) ListLabels() ([]*gmail.Label, error) {
+	var r *gmail.ListLabelsResponse
+	err := c.do("labels.list", Retryable, func() (err error) {
+		r, err = c.Service.Users.Labels.List(c.user()).Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r.Labels, nil
+}
+
+// Creates a user label shown in the label list and on messages.
+func (c *Client) CreateLabel(name string) (*gmail.Label, error) {
+	return c.InsertLabel(&gmail.Label{
+		Name:                  name,
+		LabelListVisibility:   "labelShow",
+		MessageListVisibility: "show",
+	})
+}
+
+// Creates a user label with the settings of label.
+func (c *Client) InsertLabel(label *gmail.Label) (*gmail.Label, error) {
+	var l *gmail.Label
+	err := c.do("labels.create", RateLimited, func() (err error) {
+		l, err = c.Service.Users.Labels.Create(c.user(), label).Do()
+		return err
+	})
+	return l, err
+}
+
+// Changes the settings of label id set in label.
+func (c *Client) PatchLabel(id string, label *gmail.Label) (*gmail.Label, error) {
+	var l *gmail.Label
+	err := c.do("labels.patch", Retryable, func() (err error) {
+		l, err = c.Service.Users.Labels.Patch(c.user(), id, label).Do()
+		return err
+	})
+	return l, err
+}
+
+func (c *Client) GetProfile() (*gmail.Profile, error) {
+	var p *gmail.Profile
+	err := c.do("getProfile", Retryable, func() (err error) {
+		p, err = c.Service.Users.GetProfile(c.user()).Do()
+		return err
+	})
+	return p, err
+}
+
+// Lists the addresses the user can send as, including the account's own.
+func (c *Client) ListSendAs() ([]*gmail.SendAs, error) {
+	var r *gmail.ListSendAsResponse
+	err := c.do("settings.sendAs.list", Retryable, func() (err error) {
+		r, err = c.Service.Users.Settings.SendAs.List(c.user()).Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r.SendAs, nil
+}
+
+func (c *Client) ListHistory(startHistoryId uint64, pageToken string) (*gmail.ListHistoryResponse, error) {
+	var r *gmail.ListHistoryResponse
+	err := c.do("history.list", Retryable, func() (err error) {
+		r, err = c.Service.Users.History.List(c.user()).StartHistoryId(startHistoryId).PageToken(pageToken).MaxResults(500).Do()
+		return err
+	})
+	return r, err
+}
@@ -0,0 +1,192 @@
+package gmailapi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+func apiError(code int, reasons ...string) error {
+	err := &googleapi.Error{Code: code}
+	for _, reason := range reasons {
+		err.Errors = append(err.Errors, googleapi.ErrorItem{Reason: reason})
+	}
+	return err
+}
+
+func TestRetryClassification(t *testing.T) {
+	tests := []struct {
+		name            string
+		err             error
+		wantRateLimited bool
+		wantRetryable   bool
+	}{
+		{"nil", nil, false, false},
+		{"not an api error", errors.New("connection reset"), false, false},
+		{"too many requests", apiError(http.StatusTooManyRequests), true, true},
+		{"rate limit exceeded", apiError(http.StatusForbidden, "rateLimitExceeded"), true, true},
+		{"user rate limit exceeded", apiError(http.StatusForbidden, "userRateLimitExceeded"), true, true},
+		{"wrapped rate limit", fmt.Errorf("inserting: %w", apiError(http.StatusTooManyRequests)), true, true},
+		{"forbidden", apiError(http.StatusForbidden, "insufficientPermissions"), false, false},
+		{"internal server error", apiError(http.StatusInternalServerError), false, true},
+		{"bad gateway", apiError(http.StatusBadGateway), false, true},
+		{"service unavailable", apiError(http.StatusServiceUnavailable), false, true},
+		{"gateway timeout", apiError(http.StatusGatewayTimeout), false, true},
+		{"wrapped server error", fmt.Errorf("getting: %w", apiError(http.StatusServiceUnavailable)), false, true},
+		{"not found", apiError(http.StatusNotFound), false, false},
+		{"bad request", apiError(http.StatusBadRequest, "invalidArgument"), false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RateLimited(tt.err); got != tt.wantRateLimited {
+				t.Errorf("RateLimited() = %v, want %v", got, tt.wantRateLimited)
+			}
+			if got := Retryable(tt.err); got != tt.wantRetryable {
+				t.Errorf("Retryable() = %v, want %v", got, tt.wantRetryable)
+			}
+		})
+	}
+}
+
+func TestDo(t *testing.T) {
+	rateLimited := apiError(http.StatusTooManyRequests)
+	unavailable := apiError(http.StatusServiceUnavailable)
+	notFound := apiError(http.StatusNotFound)
+	tests := []struct {
+		name     string
+		attempts int
+		retry    func(error) bool
+		// The error of each call in turn; calls after the last succeed.
+		errs      []error
+		wantErr   error
+		wantCalls int
+		wantWaits []time.Duration
+	}{
+		{
+			name:      "succeeds at once",
+			retry:     Retryable,
+			wantCalls: 1,
+		},
+		{
+			name:      "retries with doubling backoff",
+			retry:     Retryable,
+			errs:      []error{unavailable, rateLimited},
+			wantCalls: 3,
+			wantWaits: []time.Duration{time.Second, 2 * time.Second},
+		},
+		{
+			name:      "gives up after the default attempts",
+			retry:     Retryable,
+			errs:      []error{unavailable, unavailable, unavailable, unavailable, unavailable},
+			wantErr:   unavailable,
+			wantCalls: DefaultAttempts,
+			wantWaits: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second},
+		},
+		{
+			name:      "gives up after the configured attempts",
+			attempts:  2,
+			retry:     Retryable,
+			errs:      []error{rateLimited, rateLimited, rateLimited},
+			wantErr:   rateLimited,
+			wantCalls: 2,
+			wantWaits: []time.Duration{time.Second},
+		},
+		{
+			name:      "doesn't retry what retry rejects",
+			retry:     Retryable,
+			errs:      []error{notFound},
+			wantErr:   notFound,
+			wantCalls: 1,
+		},
+		{
+			name:      "changes that can't happen twice aren't retried after a server error",
+			retry:     RateLimited,
+			errs:      []error{unavailable},
+			wantErr:   unavailable,
+			wantCalls: 1,
+		},
+		{
+			name:      "changes that can't happen twice are retried when rate limited",
+			retry:     RateLimited,
+			errs:      []error{rateLimited},
+			wantCalls: 2,
+			wantWaits: []time.Duration{time.Second},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var waits []time.Duration
+			c := &Client{Attempts: tt.attempts, Sleep: func(d time.Duration) { waits = append(waits, d) }}
+			var charged []string
+			c.Charge = func(method string) error {
+				charged = append(charged, method)
+				return nil
+			}
+			calls := 0
+			err := c.do("messages.get", tt.retry, func() error {
+				calls++
+				if calls <= len(tt.errs) {
+					return tt.errs[calls-1]
+				}
+				return nil
+			})
+			if err != tt.wantErr {
+				t.Errorf("do() error = %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("do() made %d calls, want %d", calls, tt.wantCalls)
+			}
+			if !reflect.DeepEqual(waits, tt.wantWaits) {
+				t.Errorf("do() waited %v, want %v", waits, tt.wantWaits)
+			}
+			if len(charged) != calls-1 {
+				t.Errorf("do() charged %d retries, want %d", len(charged), calls-1)
+			}
+		})
+	}
+}
+
+func TestDoBackoff(t *testing.T) {
+	var waits []time.Duration
+	c := &Client{Backoff: 10 * time.Millisecond, Sleep: func(d time.Duration) { waits = append(waits, d) }}
+	c.do("messages.get", Retryable, func() error { return apiError(http.StatusBadGateway) })
+	want := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond}
+	if !reflect.DeepEqual(waits, want) {
+		t.Errorf("do() waited %v, want %v", waits, want)
+	}
+}
+
+func TestDoChargeStopsRetries(t *testing.T) {
+	exceeded := errors.New("budget exceeded")
+	c := &Client{Sleep: func(time.Duration) {}, Charge: func(string) error { return exceeded }}
+	calls := 0
+	err := c.do("messages.get", Retryable, func() error {
+		calls++
+		return apiError(http.StatusBadGateway)
+	})
+	if err != exceeded {
+		t.Errorf("do() error = %v, want %v", err, exceeded)
+	}
+	if calls != 1 {
+		t.Errorf("do() made %d calls, want 1", calls)
+	}
+}
+
+func TestStructureFields(t *testing.T) {
+	fields := structureFields()
+	if strings.Count(fields, "(") != strings.Count(fields, ")") {
+		t.Errorf("structureFields() = %s, with unbalanced parentheses", fields)
+	}
+	if strings.Contains(fields, "data") {
+		t.Errorf("structureFields() = %s, which asks for body data", fields)
+	}
+	if got := strings.Count(fields, "parts("); got != structureDepth {
+		t.Errorf("structureFields() selects %d levels of parts, want %d", got, structureDepth)
+	}
+}
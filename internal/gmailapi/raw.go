@@ -0,0 +1,282 @@
+package gmailapi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// A raw RFC 822 message to upload, opened again for each try.
+type RawSource func() (io.ReadCloser, error)
+
+// Returns a source for the base64url raw message of m, decoded as it is read.
+func base64Source(m *gmail.Message) RawSource {
+	return func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(base64.NewDecoder(base64.URLEncoding, strings.NewReader(m.Raw))), nil
+	}
+}
+
+// Returns m without its raw message and parsed payload, which go in the upload instead of
+// the JSON body.
+func uploadMetadata(m *gmail.Message) *gmail.Message {
+	return &gmail.Message{LabelIds: m.LabelIds, ThreadId: m.ThreadId}
+}
+
+// Inserts the message raw reads, streaming it as a media upload, with the labels and
+// thread of m.
+func (c *Client) InsertRaw(m *gmail.Message, raw RawSource, internalDateSource string) (*gmail.Message, error) {
+	var r *gmail.Message
+	err := c.do("messages.insert", RateLimited, func() error {
+		body, err := raw()
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		r, err = c.Service.Users.Messages.Insert(c.user(), uploadMetadata(m)).InternalDateSource(internalDateSource).
+			Media(body, googleapi.ContentType("message/rfc822")).Do()
+		return err
+	})
+	return r, err
+}
+
+// Imports the message raw reads as ImportMessage does, streaming it as a media upload.
+func (c *Client) ImportRaw(m *gmail.Message, raw RawSource, internalDateSource string) (*gmail.Message, error) {
+	var r *gmail.Message
+	err := c.do("messages.import", RateLimited, func() error {
+		body, err := raw()
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		r, err = c.Service.Users.Messages.Import(c.user(), uploadMetadata(m)).InternalDateSource(internalDateSource).NeverMarkSpam(true).ProcessForCalendar(false).
+			Media(body, googleapi.ContentType("message/rfc822")).Do()
+		return err
+	})
+	return r, err
+}
+
+// Gets message id in raw format, writing the decoded raw message to w as it arrives
+// instead of holding it as a JSON string, then as a base64 string, then decoded.
+// Returns the message's other fields. Only retried until the raw message starts, since
+// w may have part of it after that.
+func (c *Client) GetRawMessage(id string, w io.Writer) (*gmail.Message, error) {
+	if c.HTTP == nil {
+		return nil, errors.New("streaming needs Client.HTTP")
+	}
+	u := c.Service.BasePath + "gmail/v1/users/" + url.PathEscape(c.user()) + "/messages/" + url.PathEscape(id) + "?format=raw&alt=json"
+	var m *gmail.Message
+	err := c.do("messages.get", Retryable, func() error {
+		resp, err := c.HTTP.Get(u)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if err := googleapi.CheckResponse(resp); err != nil {
+			return err
+		}
+		m, err = decodeRawResponse(resp.Body, w)
+		return err
+	})
+	return m, err
+}
+
+// Reads a messages.get response in raw format from body, decoding the raw field into w
+// and the other fields into the returned message.
+func decodeRawResponse(body io.Reader, w io.Writer) (*gmail.Message, error) {
+	r := bufio.NewReader(body)
+	if c, err := nextToken(r); err != nil || c != '{' {
+		return nil, fmt.Errorf("response isn't a JSON object: %v", err)
+	}
+	var others bytes.Buffer
+	others.WriteByte('{')
+	for {
+		c, err := nextToken(r)
+		if err != nil {
+			return nil, err
+		}
+		if c == '}' {
+			break
+		}
+		if c == ',' {
+			continue
+		}
+		if c != '"' {
+			return nil, fmt.Errorf("unexpected %q in response", c)
+		}
+		key, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		if c, err := nextToken(r); err != nil || c != ':' {
+			return nil, fmt.Errorf("no value for field [%s] in response", key)
+		}
+		if key == "raw" {
+			if c, err := nextToken(r); err != nil || c != '"' {
+				return nil, errors.New("raw isn't a string in response")
+			}
+			if _, err := io.Copy(w, base64.NewDecoder(base64.URLEncoding, &unquoteReader{r: r})); err != nil {
+				return nil, fmt.Errorf("decoding raw message: %w", err)
+			}
+			continue
+		}
+		value, err := readValue(r)
+		if err != nil {
+			return nil, err
+		}
+		if others.Len() > 1 {
+			others.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		others.Write(k)
+		others.WriteByte(':')
+		others.Write(value)
+	}
+	others.WriteByte('}')
+	var m gmail.Message
+	if err := json.Unmarshal(others.Bytes(), &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// Returns the next byte of r that isn't whitespace.
+func nextToken(r *bufio.Reader) (byte, error) {
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			return c, nil
+		}
+	}
+}
+
+// Reads the rest of a JSON string whose opening quote was read, returning it unquoted.
+func readString(r *bufio.Reader) (string, error) {
+	quoted := []byte{'"'}
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		quoted = append(quoted, c)
+		if c == '\\' {
+			next, err := r.ReadByte()
+			if err != nil {
+				return "", err
+			}
+			quoted = append(quoted, next)
+			continue
+		}
+		if c == '"' {
+			var s string
+			err := json.Unmarshal(quoted, &s)
+			return s, err
+		}
+	}
+}
+
+// Reads one JSON value as is: a string, number, literal, array or object.
+func readValue(r *bufio.Reader) ([]byte, error) {
+	c, err := nextToken(r)
+	if err != nil {
+		return nil, err
+	}
+	value := []byte{c}
+	depth := 0
+	switch c {
+	case '"':
+		s, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(s)
+	case '[', '{':
+		depth = 1
+	default:
+		// A number or literal ends at the next delimiter, which is left for the caller.
+		for {
+			next, err := r.Peek(1)
+			if err != nil {
+				return nil, err
+			}
+			if strings.IndexByte(",}] \t\r\n", next[0]) >= 0 {
+				return value, nil
+			}
+			b, _ := r.ReadByte()
+			value = append(value, b)
+		}
+	}
+	for depth > 0 {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		switch c {
+		case '"':
+			s, err := readString(r)
+			if err != nil {
+				return nil, err
+			}
+			quoted, _ := json.Marshal(s)
+			value = append(value, quoted...)
+			continue
+		case '[', '{':
+			depth++
+		case ']', '}':
+			depth--
+		}
+		value = append(value, c)
+	}
+	return value, nil
+}
+
+// Reads the rest of a JSON string whose opening quote was read, up to the closing quote.
+// Base64url never needs escaping, so an escape is an error.
+type unquoteReader struct {
+	r    *bufio.Reader
+	done bool
+}
+
+func (u *unquoteReader) Read(p []byte) (int, error) {
+	if u.done {
+		return 0, io.EOF
+	}
+	n := 0
+	for n < len(p) {
+		c, err := u.r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+		switch c {
+		case '"':
+			u.done = true
+			if n == 0 {
+				return 0, io.EOF
+			}
+			return n, nil
+		case '\\':
+			return n, errors.New("unexpected escape in raw message")
+		}
+		p[n] = c
+		n++
+		if u.r.Buffered() == 0 && n > 0 {
+			return n, nil
+		}
+	}
+	return n, nil
+}
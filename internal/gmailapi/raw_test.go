@@ -0,0 +1,234 @@
+package gmailapi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+const fixtureMessage = "From: alice@example.com\r\nSubject: Hello\r\n\r\nHi Bob,\r\nsee you tomorrow.\r\n"
+
+func TestDecodeRawResponse(t *testing.T) {
+	raw := base64.URLEncoding.EncodeToString([]byte(fixtureMessage))
+	tests := []struct {
+		name    string
+		body    string
+		want    *gmail.Message
+		wantRaw string
+		wantErr bool
+	}{
+		{
+			name:    "raw format response",
+			body:    `{"id":"m1","threadId":"t1","labelIds":["INBOX","UNREAD"],"snippet":"Hi Bob","sizeEstimate":123,"historyId":"42","internalDate":"1583488800000","raw":"` + raw + `"}`,
+			want:    &gmail.Message{Id: "m1", ThreadId: "t1", LabelIds: []string{"INBOX", "UNREAD"}, Snippet: "Hi Bob", SizeEstimate: 123, HistoryId: 42, InternalDate: 1583488800000},
+			wantRaw: fixtureMessage,
+		},
+		{
+			name:    "raw first, pretty printed",
+			body:    "{\n  \"raw\": \"" + raw + "\",\n  \"id\" : \"m1\",\n\t\"labelIds\": [ \"INBOX\" ]\n}\n",
+			want:    &gmail.Message{Id: "m1", LabelIds: []string{"INBOX"}},
+			wantRaw: fixtureMessage,
+		},
+		{
+			name:    "escapes in other fields",
+			body:    `{"id":"m1","snippet":"say \"hi\" \\ ü } ]","raw":"` + raw + `"}`,
+			want:    &gmail.Message{Id: "m1", Snippet: `say "hi" \ ü } ]`},
+			wantRaw: fixtureMessage,
+		},
+		{
+			name:    "nested objects and unknown fields are skipped over",
+			body:    `{"id":"m1","unknown":{"a":[1,{"b":"}"}],"c":null},"flag":true,"raw":"` + raw + `"}`,
+			want:    &gmail.Message{Id: "m1"},
+			wantRaw: fixtureMessage,
+		},
+		{
+			name: "no raw field",
+			body: `{"id":"m1"}`,
+			want: &gmail.Message{Id: "m1"},
+		},
+		{
+			name:    "not an object",
+			body:    `["m1"]`,
+			wantErr: true,
+		},
+		{
+			name:    "raw isn't a string",
+			body:    `{"raw":12}`,
+			wantErr: true,
+		},
+		{
+			name:    "escape in raw",
+			body:    `{"raw":"SGk\/"}`,
+			wantErr: true,
+		},
+		{
+			name:    "raw isn't base64url",
+			body:    `{"raw":"not base64!"}`,
+			wantErr: true,
+		},
+		{
+			name:    "truncated raw",
+			body:    `{"id":"m1","raw":"` + raw[:20],
+			wantErr: true,
+		},
+		{
+			name:    "truncated object",
+			body:    `{"id":"m1"`,
+			wantErr: true,
+		},
+		{
+			name:    "field without a value",
+			body:    `{"id" "m1"}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var w bytes.Buffer
+			got, err := decodeRawResponse(strings.NewReader(tt.body), &w)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeRawResponse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeRawResponse() = %+v, want %+v", got, tt.want)
+			}
+			if w.String() != tt.wantRaw {
+				t.Errorf("decodeRawResponse() wrote %q, want %q", w.String(), tt.wantRaw)
+			}
+		})
+	}
+}
+
+// The raw message comes out the same however the response body is split into reads.
+func TestDecodeRawResponseReads(t *testing.T) {
+	message := strings.Repeat(fixtureMessage, 500)
+	body := `{"id":"m1","raw":"` + base64.URLEncoding.EncodeToString([]byte(message)) + `","threadId":"t1"}`
+	readers := map[string]func(io.Reader) io.Reader{
+		"one byte at a time": iotest.OneByteReader,
+		"half reads":         iotest.HalfReader,
+		"whole":              func(r io.Reader) io.Reader { return r },
+	}
+	for name, reader := range readers {
+		t.Run(name, func(t *testing.T) {
+			var w bytes.Buffer
+			got, err := decodeRawResponse(reader(strings.NewReader(body)), &w)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Id != "m1" || got.ThreadId != "t1" {
+				t.Errorf("decodeRawResponse() = %+v, want id m1 and thread t1", got)
+			}
+			if w.String() != message {
+				t.Errorf("decodeRawResponse() wrote %d bytes, want the %d of the message", w.Len(), len(message))
+			}
+		})
+	}
+}
+
+func TestReadValue(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       string
+		want     string
+		wantRest string
+		wantErr  bool
+	}{
+		{"string", `"abc",`, `"abc"`, ",", false},
+		{"string with escapes is normalized", `"a\"bü" }`, `"a\"bü"`, " }", false},
+		{"number", `123,"next"`, "123", `,"next"`, false},
+		{"negative float", "-1.5e3}", "-1.5e3", "}", false},
+		{"literal", "true ]", "true", " ]", false},
+		{"null", "null\n}", "null", "\n}", false},
+		{"leading whitespace", " \t\r\n42,", "42", ",", false},
+		{"array", `[1, "two", [3]],`, `[1, "two", [3]]`, ",", false},
+		{"object", `{"a":{"b":[]}}}`, `{"a":{"b":[]}}`, "}", false},
+		{"brackets in strings", `{"a":"}]"}`, `{"a":"}]"}`, "", false},
+		{"unterminated string", `"abc`, "", "", true},
+		{"unterminated array", `[1, 2`, "", "", true},
+		{"number at end of input", "12", "", "", true},
+		{"nothing", "", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.in))
+			got, err := readValue(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readValue() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if string(got) != tt.want {
+				t.Errorf("readValue() = %s, want %s", got, tt.want)
+			}
+			rest, _ := ioutil.ReadAll(r)
+			if string(rest) != tt.wantRest {
+				t.Errorf("readValue() left %q, want %q", rest, tt.wantRest)
+			}
+		})
+	}
+}
+
+func TestUnquoteReader(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       string
+		want     string
+		wantRest string
+		wantErr  bool
+	}{
+		{"up to the closing quote", `SGVsbG8=","id":"m1"}`, "SGVsbG8=", `,"id":"m1"}`, false},
+		{"empty", `"}`, "", "}", false},
+		{"escape", `SGV\/sbG8="`, "", "", true},
+		{"no closing quote", "SGVsbG8=", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReaderSize(iotest.OneByteReader(strings.NewReader(tt.in)), 16)
+			got, err := ioutil.ReadAll(&unquoteReader{r: r})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("reading error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if string(got) != tt.want {
+				t.Errorf("read %q, want %q", got, tt.want)
+			}
+			rest, _ := ioutil.ReadAll(r)
+			if string(rest) != tt.wantRest {
+				t.Errorf("left %q, want %q", rest, tt.wantRest)
+			}
+		})
+	}
+}
+
+// After the closing quote, further reads return io.EOF without reading on.
+func TestUnquoteReaderDone(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader(`ab"cd`))
+	u := &unquoteReader{r: r}
+	p := make([]byte, 10)
+	n, err := u.Read(p)
+	if n != 2 || err != nil || string(p[:n]) != "ab" {
+		t.Fatalf("Read() = %d, %v (%q), want 2, nil (\"ab\")", n, err, p[:n])
+	}
+	for i := 0; i < 2; i++ {
+		if n, err := u.Read(p); n != 0 || err != io.EOF {
+			t.Errorf("Read() after the quote = %d, %v, want 0, EOF", n, err)
+		}
+	}
+	if rest, _ := ioutil.ReadAll(r); string(rest) != "cd" {
+		t.Errorf("left %q, want \"cd\"", rest)
+	}
+}
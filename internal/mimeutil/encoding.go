@@ -0,0 +1,69 @@
+package mimeutil
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// Encodes data as base64 in lines of 76 characters, as MIME requires.
+func WrapBase64(data []byte) string {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var b strings.Builder
+	for len(encoded) > 76 {
+		b.WriteString(encoded[:76])
+		b.WriteString("\r\n")
+		encoded = encoded[76:]
+	}
+	b.WriteString(encoded)
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// See here why this is needed: https://stackoverflow.com/a/15621614
+func QuotedPrintable(s string) string {
+	var b strings.Builder
+	w := quotedprintable.NewWriter(&b)
+	w.Write([]byte(s))
+	w.Close()
+
+	return b.String()
+}
+
+// Decodes a body in the given Content-Transfer-Encoding. Bodies in other encodings,
+// such as 7bit and 8bit, are returned as they are.
+func DecodeTransferEncoding(body []byte, encoding string) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		cleaned := bytes.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+				return -1
+			}
+			return r
+		}, body)
+		return base64.StdEncoding.DecodeString(string(cleaned))
+	case "quoted-printable":
+		return ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+	}
+	return body, nil
+}
+
+// Reports whether p is an attached email, such as a message forwarded as an attachment.
+func IsAttachedMessage(p *gmail.MessagePart) bool {
+	return strings.EqualFold(p.MimeType, "message/rfc822")
+}
+
+// The Content-Transfer-Encoding for an attached email kept in a rebuilt message.
+// MIME doesn't allow base64 or quoted-printable for message/rfc822.
+func AttachedMessageEncoding(data []byte) string {
+	for _, b := range data {
+		if b >= 0x80 {
+			return "8bit"
+		}
+	}
+	return "7bit"
+}
@@ -0,0 +1,228 @@
+// Package mimeutil parses raw messages into the structure the Gmail API uses, and
+// serializes that structure back into a raw message without its attachments.
+package mimeutil
+
+import (
+	"encoding/base64"
+	"mime"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// Returns the value of the first header named name (case-insensitive), or "" if there is none.
+func HeaderValue(headers []*gmail.MessagePartHeader, name string) string {
+	for _, header := range headers {
+		if strings.EqualFold(header.Name, name) {
+			return header.Value
+		}
+	}
+	return ""
+}
+
+// Returns headers with the named header set to value, replacing any existing one.
+func WithHeader(headers []*gmail.MessagePartHeader, name string, value string) []*gmail.MessagePartHeader {
+	var result []*gmail.MessagePartHeader
+	for _, header := range headers {
+		if !strings.EqualFold(header.Name, name) {
+			result = append(result, header)
+		}
+	}
+	return append(result, &gmail.MessagePartHeader{Name: name, Value: value})
+}
+
+// Headers that clients use to place a message in its conversation.
+var threadingHeaderNames = []string{"In-Reply-To", "References"}
+
+var messageIdPattern = regexp.MustCompile(`<[^<>\s]+>`)
+
+func isThreadingHeader(name string) bool {
+	for _, n := range threadingHeaderNames {
+		if strings.EqualFold(name, n) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the top-level headers of p with In-Reply-To and References normalized,
+// hoisting them from nested parts when the top level lacks them. Attached messages
+// (message/rfc822) are not searched, since their headers belong to another conversation.
+func ThreadingHeaders(p *gmail.MessagePart) []*gmail.MessagePartHeader {
+	var headers []*gmail.MessagePartHeader
+	found := map[string]bool{}
+	for _, header := range p.Headers {
+		if isThreadingHeader(header.Name) {
+			found[strings.ToLower(header.Name)] = true
+			header = normalizeThreadingHeader(header)
+		}
+		headers = append(headers, header)
+	}
+
+	for _, name := range threadingHeaderNames {
+		if found[strings.ToLower(name)] {
+			continue
+		}
+		if header := findNestedHeader(p.Parts, name); header != nil {
+			headers = append(headers, normalizeThreadingHeader(header))
+		}
+	}
+
+	return headers
+}
+
+func findNestedHeader(parts []*gmail.MessagePart, name string) *gmail.MessagePartHeader {
+	for _, part := range parts {
+		if IsAttachedMessage(part) {
+			continue
+		}
+		for _, header := range part.Headers {
+			if strings.EqualFold(header.Name, name) {
+				return header
+			}
+		}
+		if header := findNestedHeader(part.Parts, name); header != nil {
+			return header
+		}
+	}
+	return nil
+}
+
+// Unfolds a threading header and refolds it between message ids so that no line
+// exceeds 78 characters where possible. Values without message ids are only unfolded.
+func normalizeThreadingHeader(header *gmail.MessagePartHeader) *gmail.MessagePartHeader {
+	unfolded := strings.Join(strings.Fields(header.Value), " ")
+	ids := messageIdPattern.FindAllString(unfolded, -1)
+	if len(ids) == 0 {
+		return &gmail.MessagePartHeader{Name: header.Name, Value: unfolded}
+	}
+
+	var b strings.Builder
+	lineLength := len(header.Name) + len(": ")
+	for i, id := range ids {
+		if i > 0 {
+			if lineLength+1+len(id) > 78 {
+				b.WriteString("\r\n")
+				lineLength = 0
+			}
+			b.WriteString(" ")
+			lineLength++
+		}
+		b.WriteString(id)
+		lineLength += len(id)
+	}
+
+	return &gmail.MessagePartHeader{Name: header.Name, Value: b.String()}
+}
+
+// RFC 5322 line lengths: lines should be no longer than 78 characters and must be no
+// longer than 998, not counting the CRLF.
+const (
+	foldLineLength = 78
+	maxLineLength  = 998
+)
+
+// Headers whose value is free text, which can be split anywhere once encoded.
+var unstructuredHeaders = map[string]bool{"subject": true, "comments": true}
+
+// Unfolds a header value: line breaks followed by whitespace are removed, and any other
+// line break, which would start a new header, becomes a space.
+func UnfoldHeader(value string) string {
+	value = strings.NewReplacer("\r\n ", " ", "\r\n\t", "\t", "\n ", " ", "\n\t", "\t").Replace(value)
+	return strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ").Replace(value)
+}
+
+// Serializes a header field as RFC 5322 requires: the value is unfolded, then folded
+// again before whitespace so that lines are at most 78 characters where possible. A
+// Subject or Comments with a word too long for a 998 character line is written as
+// RFC 2047 encoded words instead, which can be folded anywhere. Ends with CRLF.
+func FoldHeader(name string, value string) string {
+	value = strings.TrimSpace(UnfoldHeader(value))
+	words := splitBeforeWhitespace(value)
+	if unstructuredHeaders[strings.ToLower(name)] {
+		for _, w := range words {
+			if len(name)+len(": ")+len(w) > maxLineLength {
+				words = encodedWords(value)
+				break
+			}
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(name + ":")
+	lineLength := len(name) + len(":")
+	for i, w := range words {
+		if i == 0 {
+			w = " " + w
+		}
+		if i > 0 && lineLength+len(w) > foldLineLength {
+			b.WriteString("\r\n")
+			lineLength = 0
+		}
+		b.WriteString(w)
+		lineLength += len(w)
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// Splits s into words, each after the first starting with the whitespace before it, so
+// a fold can go before any of them.
+func splitBeforeWhitespace(s string) []string {
+	var words []string
+	start := 0
+	for i := 1; i < len(s); i++ {
+		if (s[i] == ' ' || s[i] == '\t') && s[i-1] != ' ' && s[i-1] != '\t' {
+			words = append(words, s[start:i])
+			start = i
+		}
+	}
+	return append(words, s[start:])
+}
+
+// Returns s as RFC 2047 base64 encoded words short enough for a 78 character line,
+// each starting with a space but the first, and never splitting a UTF-8 character.
+func encodedWords(s string) []string {
+	const chunk = 42
+	var words []string
+	for len(s) > 0 {
+		n := chunk
+		if n > len(s) {
+			n = len(s)
+		}
+		for n < len(s) && n > 0 && !utf8.RuneStart(s[n]) {
+			n--
+		}
+		word := "=?utf-8?b?" + base64.StdEncoding.EncodeToString([]byte(s[:n])) + "?="
+		if len(words) > 0 {
+			word = " " + word
+		}
+		words = append(words, word)
+		s = s[n:]
+	}
+	return words
+}
+
+var filenameDecoder = new(mime.WordDecoder)
+
+// An RFC 2231 extended value, charset'language'percent-encoded-name, that reached us undecoded.
+var rfc2231Value = regexp.MustCompile(`^([A-Za-z0-9_-]+)'[A-Za-z-]*'(.*)$`)
+
+// Decodes RFC 2047 encoded words and RFC 2231 extended values left in an attachment
+// filename. Names that can't be decoded are returned unchanged.
+func DecodeFilename(name string) string {
+	if strings.Contains(name, "=?") {
+		if decoded, err := filenameDecoder.DecodeHeader(name); err == nil {
+			name = decoded
+		}
+	}
+	if m := rfc2231Value.FindStringSubmatch(name); m != nil && strings.EqualFold(m[1], "utf-8") {
+		if decoded, err := url.PathUnescape(m[2]); err == nil && utf8.ValidString(decoded) {
+			name = decoded
+		}
+	}
+	return name
+}
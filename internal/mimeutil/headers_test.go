@@ -0,0 +1,254 @@
+package mimeutil
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestFoldHeader(t *testing.T) {
+	long := strings.Repeat("x", 1000)
+	tests := []struct {
+		name  string
+		field string
+		value string
+		want  string
+	}{
+		{
+			name:  "short",
+			field: "Subject",
+			value: "Hello",
+			want:  "Subject: Hello\r\n",
+		},
+		{
+			name:  "folded value is unfolded",
+			field: "Subject",
+			value: "Hello\r\n  world",
+			want:  "Subject: Hello  world\r\n",
+		},
+		{
+			name:  "bare line break can't start a new header",
+			field: "Subject",
+			value: "Hello\nBcc: eve@example.com",
+			want:  "Subject: Hello Bcc: eve@example.com\r\n",
+		},
+		{
+			name:  "folded before whitespace at 78 characters",
+			field: "To",
+			value: "alice@example.com, bob@example.com, carol@example.com, dave@example.com, erin@example.com",
+			want:  "To: alice@example.com, bob@example.com, carol@example.com, dave@example.com,\r\n erin@example.com\r\n",
+		},
+		{
+			name:  "long word in a structured header is kept whole",
+			field: "X-Long",
+			value: long,
+			want:  "X-Long: " + long + "\r\n",
+		},
+		{
+			name:  "non-ascii Subject that fits is left alone",
+			field: "Subject",
+			value: strings.Repeat("ü", 30),
+			want:  "Subject: " + strings.Repeat("ü", 30) + "\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FoldHeader(tt.field, tt.value); got != tt.want {
+				t.Errorf("FoldHeader(%q, %q) =\n%q\nwant\n%q", tt.field, tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFoldHeaderEncodesLongSubject(t *testing.T) {
+	subject := strings.Repeat("ä", 600)
+	got := FoldHeader("Subject", subject)
+	lines := strings.Split(strings.TrimSuffix(got, "\r\n"), "\r\n")
+	if len(lines) < 2 {
+		t.Fatalf("FoldHeader() = %q, want several lines", got)
+	}
+	for _, line := range lines {
+		if len(line) > foldLineLength {
+			t.Errorf("line %q is %d characters, want at most %d", line, len(line), foldLineLength)
+		}
+	}
+	decoded, err := filenameDecoder.DecodeHeader(strings.TrimPrefix(UnfoldHeader(got), "Subject: "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(decoded) != subject {
+		t.Errorf("decoded subject = %q, want %q", decoded, subject)
+	}
+}
+
+func TestDecodeFilename(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "report.pdf", "report.pdf"},
+		{"rfc 2047 base64", "=?UTF-8?B?TcO8bmNoZW4uanBn?=", "München.jpg"},
+		{"rfc 2047 quoted-printable", "=?utf-8?q?=C3=BCbersicht.xlsx?=", "übersicht.xlsx"},
+		{"rfc 2047 latin-1", "=?ISO-8859-1?Q?Gr=FC=DFe.txt?=", "Grüße.txt"},
+		{"rfc 2231", "UTF-8''%C3%BCbersicht.xlsx", "übersicht.xlsx"},
+		{"rfc 2231 with language", "utf-8'de'M%C3%BCnchen.jpg", "München.jpg"},
+		{"rfc 2231 in another charset is left alone", "iso-8859-1''Gr%FC%DFe.txt", "iso-8859-1''Gr%FC%DFe.txt"},
+		{"rfc 2231 that isn't utf-8 is left alone", "utf-8''%FC.txt", "utf-8''%FC.txt"},
+		{"broken encoded word is left alone", "=?UTF-8?B?not base64?=", "=?UTF-8?B?not base64?="},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DecodeFilename(tt.in); got != tt.want {
+				t.Errorf("DecodeFilename(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestThreadingHeaders(t *testing.T) {
+	header := func(name, value string) *gmail.MessagePartHeader {
+		return &gmail.MessagePartHeader{Name: name, Value: value}
+	}
+	longReferences := "<aaaaaaaaaaaaaaaa@example.com> <bbbbbbbbbbbbbbbb@example.com> <cccccccccccccccc@example.com> <dddddddddddddddd@example.com>"
+	tests := []struct {
+		name string
+		part *gmail.MessagePart
+		want []*gmail.MessagePartHeader
+	}{
+		{
+			name: "no threading headers",
+			part: &gmail.MessagePart{Headers: []*gmail.MessagePartHeader{header("Subject", "Hello")}},
+			want: []*gmail.MessagePartHeader{header("Subject", "Hello")},
+		},
+		{
+			name: "top-level headers are kept in place",
+			part: &gmail.MessagePart{Headers: []*gmail.MessagePartHeader{
+				header("Subject", "Re: Hello"),
+				header("In-Reply-To", "<a@example.com>"),
+				header("References", "<root@example.com> <a@example.com>"),
+				header("To", "bob@example.com"),
+			}},
+			want: []*gmail.MessagePartHeader{
+				header("Subject", "Re: Hello"),
+				header("In-Reply-To", "<a@example.com>"),
+				header("References", "<root@example.com> <a@example.com>"),
+				header("To", "bob@example.com"),
+			},
+		},
+		{
+			name: "folded references are unfolded",
+			part: &gmail.MessagePart{Headers: []*gmail.MessagePartHeader{
+				header("References", "<root@example.com>\r\n\t<a@example.com>\r\n  <b@example.com>"),
+			}},
+			want: []*gmail.MessagePartHeader{header("References", "<root@example.com> <a@example.com> <b@example.com>")},
+		},
+		{
+			name: "long references are refolded between ids",
+			part: &gmail.MessagePart{Headers: []*gmail.MessagePartHeader{header("References", longReferences)}},
+			want: []*gmail.MessagePartHeader{header("References",
+				"<aaaaaaaaaaaaaaaa@example.com> <bbbbbbbbbbbbbbbb@example.com>\r\n <cccccccccccccccc@example.com> <dddddddddddddddd@example.com>")},
+		},
+		{
+			name: "text around ids is dropped",
+			part: &gmail.MessagePart{Headers: []*gmail.MessagePartHeader{header("In-Reply-To", `<a@example.com> (Alice's message of "Mon")`)}},
+			want: []*gmail.MessagePartHeader{header("In-Reply-To", "<a@example.com>")},
+		},
+		{
+			name: "value without ids is only unfolded",
+			part: &gmail.MessagePart{Headers: []*gmail.MessagePartHeader{header("in-reply-to", "Alice's\r\n message")}},
+			want: []*gmail.MessagePartHeader{header("in-reply-to", "Alice's message")},
+		},
+		{
+			name: "missing headers are hoisted from nested parts",
+			part: &gmail.MessagePart{
+				Headers: []*gmail.MessagePartHeader{header("Subject", "Re: Hello")},
+				Parts: []*gmail.MessagePart{
+					{Headers: []*gmail.MessagePartHeader{header("Content-Type", "text/plain")}},
+					{
+						Headers: []*gmail.MessagePartHeader{header("Content-Type", "multipart/alternative")},
+						Parts: []*gmail.MessagePart{
+							{Headers: []*gmail.MessagePartHeader{header("References", "<root@example.com>\r\n <a@example.com>")}},
+							{Headers: []*gmail.MessagePartHeader{header("In-Reply-To", "<a@example.com>")}},
+						},
+					},
+				},
+			},
+			want: []*gmail.MessagePartHeader{
+				header("Subject", "Re: Hello"),
+				header("In-Reply-To", "<a@example.com>"),
+				header("References", "<root@example.com> <a@example.com>"),
+			},
+		},
+		{
+			name: "top-level header wins over a nested one",
+			part: &gmail.MessagePart{
+				Headers: []*gmail.MessagePartHeader{header("IN-REPLY-TO", "<top@example.com>")},
+				Parts: []*gmail.MessagePart{
+					{Headers: []*gmail.MessagePartHeader{header("In-Reply-To", "<nested@example.com>")}},
+				},
+			},
+			want: []*gmail.MessagePartHeader{header("IN-REPLY-TO", "<top@example.com>")},
+		},
+		{
+			name: "the first nested header is used",
+			part: &gmail.MessagePart{
+				Parts: []*gmail.MessagePart{
+					{Headers: []*gmail.MessagePartHeader{header("In-Reply-To", "<first@example.com>")}},
+					{Headers: []*gmail.MessagePartHeader{header("In-Reply-To", "<second@example.com>")}},
+				},
+			},
+			want: []*gmail.MessagePartHeader{header("In-Reply-To", "<first@example.com>")},
+		},
+		{
+			name: "attached messages aren't searched",
+			part: &gmail.MessagePart{
+				Headers: []*gmail.MessagePartHeader{header("Subject", "Fwd: Hello")},
+				Parts: []*gmail.MessagePart{
+					{MimeType: "message/rfc822", Headers: []*gmail.MessagePartHeader{header("In-Reply-To", "<other@example.com>")}},
+					{MimeType: "message/rfc822", Parts: []*gmail.MessagePart{
+						{Headers: []*gmail.MessagePartHeader{header("References", "<other@example.com>")}},
+					}},
+				},
+			},
+			want: []*gmail.MessagePartHeader{header("Subject", "Fwd: Hello")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ThreadingHeaders(tt.part)
+			if len(got) != len(tt.want) {
+				t.Fatalf("ThreadingHeaders() = %s, want %s", formatHeaders(got), formatHeaders(tt.want))
+			}
+			for i := range got {
+				if got[i].Name != tt.want[i].Name || got[i].Value != tt.want[i].Value {
+					t.Errorf("ThreadingHeaders() = %s, want %s", formatHeaders(got), formatHeaders(tt.want))
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestThreadingHeadersLeavesPartUnchanged(t *testing.T) {
+	references := &gmail.MessagePartHeader{Name: "References", Value: "<root@example.com>\r\n <a@example.com>"}
+	nested := &gmail.MessagePartHeader{Name: "In-Reply-To", Value: " <a@example.com> "}
+	p := &gmail.MessagePart{
+		Headers: []*gmail.MessagePartHeader{references},
+		Parts:   []*gmail.MessagePart{{Headers: []*gmail.MessagePartHeader{nested}}},
+	}
+	ThreadingHeaders(p)
+	if len(p.Headers) != 1 || p.Headers[0].Value != "<root@example.com>\r\n <a@example.com>" || nested.Value != " <a@example.com> " {
+		t.Errorf("ThreadingHeaders() changed the part: %s, nested %q", formatHeaders(p.Headers), nested.Value)
+	}
+}
+
+func formatHeaders(headers []*gmail.MessagePartHeader) string {
+	var lines []string
+	for _, h := range headers {
+		lines = append(lines, fmt.Sprintf("%s: %q", h.Name, h.Value))
+	}
+	return "[" + strings.Join(lines, ", ") + "]"
+}
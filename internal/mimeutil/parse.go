@@ -0,0 +1,188 @@
+package mimeutil
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// Parses a raw RFC 5322 message into the structure the Gmail API returns in full format,
+// so messages from other backends can go through the same rewriting.
+// Bodies, including attachments, are decoded and set inline in Body.Data.
+func Parse(raw []byte) (*gmail.Message, error) {
+	payload, err := parsePart(raw, "")
+	if err != nil {
+		return nil, err
+	}
+	return &gmail.Message{Payload: payload, SizeEstimate: int64(len(raw))}, nil
+}
+
+func parsePart(raw []byte, partId string) (*gmail.MessagePart, error) {
+	headerBlock, body := SplitHeaderBlock(raw)
+	part := &gmail.MessagePart{PartId: partId, Headers: ParseHeaderBlock(headerBlock)}
+
+	contentType := HeaderValue(part.Headers, "Content-Type")
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if contentType == "" || err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+	part.MimeType = mediaType
+	part.Filename = partFilename(part.Headers, params)
+
+	var subparts [][]byte
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" {
+		subparts = splitMultipart(body, params["boundary"])
+	}
+	if len(subparts) == 0 && strings.HasPrefix(mediaType, "multipart/") {
+		// Without a usable boundary the body is kept whole as text rather than lost.
+		part.MimeType = "text/plain"
+		if partId != "" {
+			part.Headers = WithHeader(part.Headers, "Content-Type", "text/plain")
+		}
+	}
+	if len(subparts) > 0 {
+		part.Body = &gmail.MessagePartBody{}
+		for i, sub := range subparts {
+			subId := strconv.Itoa(i)
+			if partId != "" {
+				subId = partId + "." + subId
+			}
+			subpart, err := parsePart(sub, subId)
+			if err != nil {
+				return nil, err
+			}
+			part.Parts = append(part.Parts, subpart)
+		}
+		return part, nil
+	}
+
+	data, err := DecodeTransferEncoding(body, HeaderValue(part.Headers, "Content-Transfer-Encoding"))
+	if err != nil {
+		return nil, fmt.Errorf("part [%s]: %w", partId, err)
+	}
+	part.Body = &gmail.MessagePartBody{Data: base64.URLEncoding.EncodeToString(data), Size: int64(len(data))}
+	return part, nil
+}
+
+// Splits raw at the first empty line into the header block and the body.
+func SplitHeaderBlock(raw []byte) ([]byte, []byte) {
+	for _, sep := range [][]byte{[]byte("\r\n\r\n"), []byte("\n\n")} {
+		if i := bytes.Index(raw, sep); i >= 0 {
+			return raw[:i], raw[i+len(sep):]
+		}
+	}
+	if bytes.HasPrefix(raw, []byte("\r\n")) {
+		return nil, raw[2:]
+	}
+	return raw, nil
+}
+
+// Reads r up to the end of its header block, including the empty line after it, without
+// reading the body.
+func ReadHeaderBlock(r io.Reader) ([]byte, error) {
+	br := bufio.NewReader(r)
+	var block []byte
+	for {
+		line, err := br.ReadBytes('\n')
+		block = append(block, line...)
+		if err == io.EOF || len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return block, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Parses header fields in order, unfolding continuation lines.
+func ParseHeaderBlock(block []byte) []*gmail.MessagePartHeader {
+	var headers []*gmail.MessagePartHeader
+	for _, line := range strings.Split(strings.ReplaceAll(string(block), "\r\n", "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+			last := headers[len(headers)-1]
+			last.Value += " " + strings.TrimSpace(line)
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			continue
+		}
+		headers = append(headers, &gmail.MessagePartHeader{Name: line[:i], Value: strings.TrimSpace(line[i+1:])})
+	}
+	return headers
+}
+
+// Returns the parts between the boundary delimiter lines of a multipart body.
+func splitMultipart(body []byte, boundary string) [][]byte {
+	delimiter := []byte("--" + boundary)
+	closing := []byte("--" + boundary + "--")
+	var parts [][]byte
+	var current []byte
+	inPart, closed := false, false
+	for _, line := range bytes.SplitAfter(body, []byte("\n")) {
+		trimmed := bytes.TrimRight(line, " \t\r\n")
+		if bytes.Equal(trimmed, delimiter) || bytes.Equal(trimmed, closing) {
+			if inPart {
+				// The line break before a delimiter belongs to the delimiter.
+				current = bytes.TrimSuffix(current, []byte("\n"))
+				current = bytes.TrimSuffix(current, []byte("\r"))
+				parts = append(parts, current)
+			}
+			if bytes.Equal(trimmed, closing) {
+				closed = true
+				break
+			}
+			current = nil
+			inPart = true
+			continue
+		}
+		if inPart {
+			current = append(current, line...)
+		}
+	}
+	if inPart && !closed {
+		// A missing closing delimiter ends the last part at the end of the body.
+		parts = append(parts, bytes.TrimRight(current, "\r\n"))
+	}
+	return parts
+}
+
+// Returns the filename from Content-Disposition, falling back to the Content-Type name parameter.
+func partFilename(headers []*gmail.MessagePartHeader, contentTypeParams map[string]string) string {
+	if _, params, err := mime.ParseMediaType(HeaderValue(headers, "Content-Disposition")); err == nil && params["filename"] != "" {
+		return DecodeFilename(params["filename"])
+	}
+	return DecodeFilename(contentTypeParams["name"])
+}
+
+// Describes the structure of p, one part per line, indented by depth, with each part's
+// id, type, filename and decoded size.
+func Outline(p *gmail.MessagePart) string {
+	var b strings.Builder
+	outline(&b, p, 0)
+	return b.String()
+}
+
+func outline(b *strings.Builder, p *gmail.MessagePart, depth int) {
+	fmt.Fprintf(b, "%s[%s] %s", strings.Repeat("  ", depth), p.PartId, p.MimeType)
+	if p.Filename != "" {
+		fmt.Fprintf(b, " filename=%q", p.Filename)
+	}
+	if p.Body != nil && len(p.Parts) == 0 {
+		fmt.Fprintf(b, " size=%d", p.Body.Size)
+	}
+	b.WriteString("\n")
+	for _, subpart := range p.Parts {
+		outline(b, subpart, depth+1)
+	}
+}
@@ -0,0 +1,269 @@
+package mimeutil
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+var (
+	quotedBoundaryPattern = regexp.MustCompile(`boundary="([^\"]*)"`)
+	boundaryPattern       = regexp.MustCompile(`boundary=([^\r\n]*)`)
+)
+
+// Returns the multipart boundary from the Content-Type among headers.
+func Boundary(headers []*gmail.MessagePartHeader) (string, error) {
+	var boundary string
+	for _, header := range headers {
+		if strings.ToLower(header.Name) != "content-type" || !strings.Contains(header.Value, `boundary=`) {
+			continue
+		}
+		if boundary != "" {
+			return "", fmt.Errorf("previously found boundary [%s], header [%s: %s] has another", boundary, header.Name, header.Value)
+		}
+		matches := quotedBoundaryPattern.FindStringSubmatch(header.Value)
+		if len(matches) <= 1 {
+			matches = boundaryPattern.FindStringSubmatch(header.Value)
+		}
+		if len(matches) <= 1 {
+			return "", fmt.Errorf("unable to find boundary in header [%s: %s]", header.Name, header.Value)
+		}
+		boundary = matches[1]
+	}
+	if boundary == "" {
+		return "", fmt.Errorf("unable to find boundary in headers [%+v]", headers)
+	}
+	return boundary, nil
+}
+
+// Serializes a message that isn't multipart, e.g. after a transformer rewrote its text.
+func SinglePartToRaw(p *gmail.MessagePart) string {
+	var result string
+	headers := WithHeader(ThreadingHeaders(p), "Content-Transfer-Encoding", "quoted-printable")
+	for _, header := range headers {
+		result += FoldHeader(header.Name, header.Value)
+	}
+	result += "\r\n"
+	if p.Body != nil {
+		decodedData, _ := base64.URLEncoding.DecodeString(p.Body.Data)
+		result += QuotedPrintable(string(decodedData))
+	}
+	return result
+}
+
+// Serializes the multipart message p without its attachments, except those for which
+// keep returns true. keep may be nil. Nested multiparts keep their own boundaries, and
+// removed attachments are left out along with their headers.
+func PartToRaw(p *gmail.MessagePart, boundary string, keep func(*gmail.MessagePart) bool) (string, error) {
+	var b strings.Builder
+	if err := WriteMultipart(&b, p, boundary, keep, nil); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// Opens the decoded body of a part whose body isn't in Body.Data but has an
+// AttachmentId, such as one Spool.Parse left in the file.
+type BodyOpener func(*gmail.MessagePart) (io.Reader, error)
+
+// Writes what PartToRaw returns to w. Kept bodies that aren't in Body.Data are read from
+// open, which may be nil, as they are written, so an attachment is never held in memory
+// whole.
+func WriteMultipart(w io.Writer, p *gmail.MessagePart, boundary string, keep func(*gmail.MessagePart) bool, open BodyOpener) error {
+	b := &rawWriter{w: w, open: open}
+	b.writeHeaders(ThreadingHeaders(p))
+	if err := b.writeMultipartBody(p, boundary, keep); err != nil {
+		return err
+	}
+	return b.err
+}
+
+// Writes to w, keeping the first error so that a rebuild can check once at the end.
+type rawWriter struct {
+	w    io.Writer
+	open BodyOpener
+	err  error
+}
+
+func (b *rawWriter) Write(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.w.Write(p)
+	b.err = err
+	return n, err
+}
+
+func (b *rawWriter) WriteString(s string) {
+	io.WriteString(b, s)
+}
+
+// Returns a reader of the decoded body of p.
+func (b *rawWriter) body(p *gmail.MessagePart) (io.Reader, error) {
+	if p.Body != nil && p.Body.Data == "" && p.Body.AttachmentId != "" {
+		if b.open != nil {
+			return b.open(p)
+		}
+		if IsSpooled(p) {
+			return nil, fmt.Errorf("part [%s]: %w", p.PartId, errNoSpool)
+		}
+	}
+	var data []byte
+	if p.Body != nil {
+		data, _ = base64.URLEncoding.DecodeString(p.Body.Data)
+	}
+	return bytes.NewReader(data), nil
+}
+
+func (b *rawWriter) writeHeaders(headers []*gmail.MessagePartHeader) {
+	for _, header := range headers {
+		b.WriteString(FoldHeader(header.Name, header.Value))
+	}
+	b.WriteString("\r\n")
+}
+
+// Writes the parts of multipart p that aren't removed, each after a delimiter line, and
+// the closing delimiter. The line break before a delimiter belongs to the delimiter, so
+// every part ends with one.
+func (b *rawWriter) writeMultipartBody(p *gmail.MessagePart, boundary string, keep func(*gmail.MessagePart) bool) error {
+	for _, subpart := range p.Parts {
+		if subpart.Filename != "" && (keep == nil || !keep(subpart)) {
+			continue
+		}
+		b.WriteString("--" + boundary + "\r\n")
+		if err := b.writePart(subpart, keep); err != nil {
+			return err
+		}
+	}
+	b.WriteString("--" + boundary + "--\r\n")
+	return nil
+}
+
+func (b *rawWriter) writePart(p *gmail.MessagePart, keep func(*gmail.MessagePart) bool) error {
+	attachedMessage := IsAttachedMessage(p)
+	if len(p.Parts) > 0 && !attachedMessage {
+		boundary, err := Boundary(p.Headers)
+		if err != nil {
+			return fmt.Errorf("part [%s]: %w", p.PartId, err)
+		}
+		b.writeHeaders(p.Headers)
+		return b.writeMultipartBody(p, boundary, keep)
+	}
+
+	switch {
+	case attachedMessage:
+		// The attached email is written as is. Its parts are not serialized separately.
+		// It is read twice, first for its encoding and how it ends.
+		r, err := b.body(p)
+		if err != nil {
+			return err
+		}
+		var check attachedMessageCheck
+		if _, err := io.Copy(&check, r); err != nil {
+			return fmt.Errorf("part [%s]: %w", p.PartId, err)
+		}
+		b.writeHeaders(WithHeader(p.Headers, "Content-Transfer-Encoding", check.encoding()))
+		if r, err = b.body(p); err != nil {
+			return err
+		}
+		if _, err := io.Copy(b, r); err != nil {
+			return fmt.Errorf("part [%s]: %w", p.PartId, err)
+		}
+		if !check.endsWithLineBreak() {
+			b.WriteString("\r\n")
+		}
+	case p.Filename != "" || !strings.HasPrefix(strings.ToLower(p.MimeType), "text/"):
+		// Also inline images and other binary parts without a filename, which quoted-printable
+		// would corrupt by normalizing their line breaks.
+		r, err := b.body(p)
+		if err != nil {
+			return err
+		}
+		b.writeHeaders(WithHeader(p.Headers, "Content-Transfer-Encoding", "base64"))
+		lines := &lineWrapper{w: b}
+		encoder := base64.NewEncoder(base64.StdEncoding, lines)
+		if _, err := io.Copy(encoder, r); err != nil {
+			return fmt.Errorf("part [%s]: %w", p.PartId, err)
+		}
+		encoder.Close()
+		b.WriteString("\r\n")
+	default:
+		// Bodies are decoded, so they are encoded again whatever their original encoding was.
+		r, err := b.body(p)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("part [%s]: %w", p.PartId, err)
+		}
+		b.writeHeaders(WithHeader(p.Headers, "Content-Transfer-Encoding", "quoted-printable"))
+		b.WriteString(QuotedPrintable(string(data)))
+		b.WriteString("\r\n")
+	}
+	return nil
+}
+
+// Breaks what is written into lines of 76 characters, as WrapBase64 does.
+type lineWrapper struct {
+	w      io.Writer
+	column int
+}
+
+func (l *lineWrapper) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if l.column == 76 {
+			if _, err := io.WriteString(l.w, "\r\n"); err != nil {
+				return written, err
+			}
+			l.column = 0
+		}
+		n := 76 - l.column
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := l.w.Write(p[:n]); err != nil {
+			return written, err
+		}
+		l.column += n
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Sees an attached email through, for AttachedMessageEncoding and its last line break.
+type attachedMessageCheck struct {
+	eightBit bool
+	last     [2]byte
+	size     int
+}
+
+func (c *attachedMessageCheck) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if b >= 0x80 {
+			c.eightBit = true
+		}
+		c.last[0], c.last[1] = c.last[1], b
+	}
+	c.size += len(p)
+	return len(p), nil
+}
+
+func (c *attachedMessageCheck) encoding() string {
+	if c.eightBit {
+		return "8bit"
+	}
+	return "7bit"
+}
+
+func (c *attachedMessageCheck) endsWithLineBreak() bool {
+	return c.size >= 2 && c.last == [2]byte{'\r', '\n'}
+}
@@ -0,0 +1,253 @@
+package mimeutil
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+var update = flag.Bool("update", false, "write the .golden files in testdata instead of comparing with them")
+
+func TestBoundary(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []*gmail.MessagePartHeader
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "quoted",
+			headers: []*gmail.MessagePartHeader{{Name: "Content-Type", Value: `multipart/mixed; boundary="outer"`}},
+			want:    "outer",
+		},
+		{
+			name:    "unquoted",
+			headers: []*gmail.MessagePartHeader{{Name: "Content-Type", Value: "multipart/mixed; boundary=plain-boundary"}},
+			want:    "plain-boundary",
+		},
+		{
+			name:    "quoted with spaces",
+			headers: []*gmail.MessagePartHeader{{Name: "Content-Type", Value: `multipart/alternative; boundary="a b c"; charset=utf-8`}},
+			want:    "a b c",
+		},
+		{
+			name: "header name in another case among other headers",
+			headers: []*gmail.MessagePartHeader{
+				{Name: "Subject", Value: "boundary=subject"},
+				{Name: "content-type", Value: `multipart/related; boundary="related"`},
+			},
+			want: "related",
+		},
+		{
+			name:    "no content type",
+			headers: []*gmail.MessagePartHeader{{Name: "Subject", Value: "Hello"}},
+			wantErr: true,
+		},
+		{
+			name:    "no boundary",
+			headers: []*gmail.MessagePartHeader{{Name: "Content-Type", Value: "text/plain"}},
+			wantErr: true,
+		},
+		{
+			name:    "empty boundary",
+			headers: []*gmail.MessagePartHeader{{Name: "Content-Type", Value: `multipart/mixed; boundary=""`}},
+			wantErr: true,
+		},
+		{
+			name: "two content types",
+			headers: []*gmail.MessagePartHeader{
+				{Name: "Content-Type", Value: `multipart/mixed; boundary="one"`},
+				{Name: "Content-Type", Value: `multipart/mixed; boundary="two"`},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Boundary(tt.headers)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Boundary() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Boundary() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// Reads the .eml fixtures in testdata, by name.
+func readFixtures(t *testing.T) map[string][]byte {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join("testdata", "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no .eml fixtures in testdata")
+	}
+	fixtures := map[string][]byte{}
+	for _, path := range paths {
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fixtures[strings.TrimSuffix(filepath.Base(path), ".eml")] = raw
+	}
+	return fixtures
+}
+
+// Parses raw and serializes it again without its attachments, the way gmail-cleanup
+// strips a message. Attached emails without a filename are named after their subject,
+// so they count as attachments too.
+func strip(raw []byte) (*gmail.Message, string, error) {
+	m, err := Parse(raw)
+	if err != nil {
+		return nil, "", err
+	}
+	nameAttachedMessages(m.Payload)
+	if len(m.Payload.Parts) == 0 {
+		return m, SinglePartToRaw(m.Payload), nil
+	}
+	boundary, err := Boundary(m.Payload.Headers)
+	if err != nil {
+		return nil, "", err
+	}
+	rebuilt, err := PartToRaw(m.Payload, boundary, nil)
+	return m, rebuilt, err
+}
+
+func nameAttachedMessages(p *gmail.MessagePart) {
+	if IsAttachedMessage(p) && p.Filename == "" {
+		p.Filename = "attached message.eml"
+		if block, _ := SplitHeaderBlock(decoded(p)); block != nil {
+			if subject := HeaderValue(ParseHeaderBlock(block), "Subject"); subject != "" {
+				p.Filename = subject + ".eml"
+			}
+		}
+		return
+	}
+	for _, subpart := range p.Parts {
+		nameAttachedMessages(subpart)
+	}
+}
+
+func decoded(p *gmail.MessagePart) []byte {
+	if p.Body == nil {
+		return nil
+	}
+	data, _ := base64.URLEncoding.DecodeString(p.Body.Data)
+	return data
+}
+
+// Returns the parts of p that are stripped: those with a filename.
+func attachments(p *gmail.MessagePart) []*gmail.MessagePart {
+	var parts []*gmail.MessagePart
+	if p.Filename != "" {
+		parts = append(parts, p)
+	}
+	for _, subpart := range p.Parts {
+		parts = append(parts, attachments(subpart)...)
+	}
+	return parts
+}
+
+// Returns the mime types of the parts of p that are kept, in order.
+func keptTypes(p *gmail.MessagePart) []string {
+	if p.Filename != "" {
+		return nil
+	}
+	types := []string{p.MimeType}
+	for _, subpart := range p.Parts {
+		types = append(types, keptTypes(subpart)...)
+	}
+	return types
+}
+
+func TestRebuildRoundTrip(t *testing.T) {
+	for name, raw := range readFixtures(t) {
+		t.Run(name, func(t *testing.T) {
+			m, rebuilt, err := strip(raw)
+			if err != nil {
+				t.Fatalf("stripping: %v", err)
+			}
+			stripped, again, err := strip([]byte(rebuilt))
+			if err != nil {
+				t.Fatalf("stripping the copy: %v", err)
+			}
+			if n := len(attachments(stripped.Payload)); n != 0 {
+				t.Errorf("the copy has %d attachments, want none:\n%s", n, Outline(stripped.Payload))
+			}
+			if got, want := strings.Join(keptTypes(stripped.Payload), " "), strings.Join(keptTypes(m.Payload), " "); got != want {
+				t.Errorf("the copy has parts %s, want %s", got, want)
+			}
+			if again != rebuilt {
+				t.Errorf("stripping the copy again changed it:\n%s\nwant:\n%s", again, rebuilt)
+			}
+		})
+	}
+}
+
+// Strips each .eml fixture in testdata and compares the outline of the parsed fixture,
+// the rebuilt copy and the outline of the copy parsed again with its .golden file.
+// With -update, writes the .golden files instead.
+func TestGolden(t *testing.T) {
+	for name, raw := range readFixtures(t) {
+		t.Run(name, func(t *testing.T) {
+			m, rebuilt, err := strip(raw)
+			if err != nil {
+				t.Fatalf("stripping: %v", err)
+			}
+			reparsed, err := Parse([]byte(rebuilt))
+			if err != nil {
+				t.Fatalf("parsing the copy: %v", err)
+			}
+			var b strings.Builder
+			b.WriteString("== parsed ==\n")
+			b.WriteString(Outline(m.Payload))
+			b.WriteString("== rebuilt ==\n")
+			b.WriteString(strings.ReplaceAll(rebuilt, "\r\n", "\n"))
+			b.WriteString("== reparsed ==\n")
+			b.WriteString(Outline(reparsed.Payload))
+			got := b.String()
+
+			goldenPath := filepath.Join("testdata", name+".golden")
+			if *update {
+				if err := ioutil.WriteFile(goldenPath, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := ioutil.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatalf("%v; run with -update to write it", err)
+			}
+			if got != string(want) {
+				t.Errorf("doesn't match %s:\n%s", goldenPath, firstDifference(string(want), got))
+			}
+		})
+	}
+}
+
+// Shows the first line where got differs from want.
+func firstDifference(want string, got string) string {
+	wantLines, gotLines := strings.Split(want, "\n"), strings.Split(got, "\n")
+	for i := 0; i < len(wantLines) || i < len(gotLines); i++ {
+		var w, g string
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if w != g {
+			return fmt.Sprintf("  line %d:\n  want: %q\n  got:  %q\n", i+1, w, g)
+		}
+	}
+	return ""
+}
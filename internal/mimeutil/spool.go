@@ -0,0 +1,456 @@
+package mimeutil
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"os"
+	"strconv"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// Prefix of the AttachmentId of a part whose body Spool.Parse left in the file.
+const spoolRefPrefix = "spool:"
+
+// Lines of a multipart body are only read this far to look for delimiters, which are
+// far shorter.
+const maxDelimiterLine = 1024
+
+// A raw message written to a temporary file as it is read, so that it isn't held in
+// memory. Parse reads its structure back from the file, leaving attachment bodies there
+// for Open.
+type Spool struct {
+	f    *os.File
+	size int64
+	hash hash.Hash
+}
+
+// Creates an empty spool in the default directory for temporary files.
+func NewSpool() (*Spool, error) {
+	f, err := ioutil.TempFile("", "gmail-cleanup-*.eml")
+	if err != nil {
+		return nil, err
+	}
+	return &Spool{f: f, hash: sha256.New()}, nil
+}
+
+// Appends p to the message.
+func (s *Spool) Write(p []byte) (int, error) {
+	n, err := s.f.Write(p)
+	s.hash.Write(p[:n])
+	s.size += int64(n)
+	return n, err
+}
+
+// The size of the message written so far.
+func (s *Spool) Size() int64 {
+	return s.size
+}
+
+// The SHA-256 of the message written so far.
+func (s *Spool) SHA256() [sha256.Size]byte {
+	var sum [sha256.Size]byte
+	copy(sum[:], s.hash.Sum(nil))
+	return sum
+}
+
+// Returns a reader of the whole message.
+func (s *Spool) Reader() io.Reader {
+	return io.NewSectionReader(s.f, 0, s.size)
+}
+
+// Returns the message up to the end of its header block, including the empty line
+// after it.
+func (s *Spool) HeaderBlock() ([]byte, error) {
+	return ReadHeaderBlock(s.Reader())
+}
+
+// Removes the file.
+func (s *Spool) Close() error {
+	err := s.f.Close()
+	if removeErr := os.Remove(s.f.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+// Parses the message as Parse does, except that the bodies of attachments, which are
+// parts with a filename and attached emails, stay in the file. Their Body.Size is set,
+// and Body.AttachmentId refers to them for Open, as an attachment id refers to a body the
+// Gmail API leaves out of the full format.
+func (s *Spool) Parse() (*gmail.Message, error) {
+	p := &spoolParser{spool: s, r: bufio.NewReader(s.Reader())}
+	payload, _, err := p.part("", nil)
+	if err != nil {
+		return nil, err
+	}
+	return &gmail.Message{Payload: payload, SizeEstimate: s.size}, nil
+}
+
+// Reports whether the body of p is in a spool rather than in p.Body.Data.
+func IsSpooled(p *gmail.MessagePart) bool {
+	return p.Body != nil && strings.HasPrefix(p.Body.AttachmentId, spoolRefPrefix)
+}
+
+// Returns a reader of the decoded body of p, a part Parse left in the file.
+func (s *Spool) Open(p *gmail.MessagePart) (io.Reader, error) {
+	if !IsSpooled(p) {
+		return nil, fmt.Errorf("part [%s] isn't spooled", p.PartId)
+	}
+	var start, end int64
+	if _, err := fmt.Sscanf(strings.TrimPrefix(p.Body.AttachmentId, spoolRefPrefix), "%d-%d", &start, &end); err != nil || start > end || end > s.size {
+		return nil, fmt.Errorf("part [%s] has an invalid spool reference [%s]", p.PartId, p.Body.AttachmentId)
+	}
+	return decodingReader(io.NewSectionReader(s.f, start, end-start), HeaderValue(p.Headers, "Content-Transfer-Encoding")), nil
+}
+
+// Returns the decoded body of p, a part Parse left in the file.
+func (s *Spool) Body(p *gmail.MessagePart) ([]byte, error) {
+	r, err := s.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// Decodes r as DecodeTransferEncoding does, as it is read.
+func decodingReader(r io.Reader, encoding string) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &whitespaceDropper{r: r})
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+// Drops the whitespace DecodeTransferEncoding ignores in base64.
+type whitespaceDropper struct {
+	r io.Reader
+}
+
+func (w *whitespaceDropper) Read(p []byte) (int, error) {
+	for {
+		n, err := w.r.Read(p)
+		kept := 0
+		for _, c := range p[:n] {
+			if c != '\r' && c != '\n' && c != ' ' && c != '\t' {
+				p[kept] = c
+				kept++
+			}
+		}
+		if kept > 0 || err != nil {
+			return kept, err
+		}
+	}
+}
+
+// Reads the parts of a spooled message line by line, keeping track of offsets.
+type spoolParser struct {
+	spool  *Spool
+	r      *bufio.Reader
+	offset int64
+	// A line read but not consumed, when pending is set.
+	pending bool
+	line    spoolLine
+}
+
+type spoolLine struct {
+	start int64
+	end   int64
+	// The line, up to maxDelimiterLine bytes unless it was read whole.
+	text []byte
+	// Whether the line has anything but its line break.
+	content bool
+}
+
+// Returns the next line, whole if whole is set, or io.EOF after the last one.
+func (p *spoolParser) next(whole bool) (spoolLine, error) {
+	if p.pending {
+		p.pending = false
+		return p.line, nil
+	}
+	l := spoolLine{start: p.offset}
+	for {
+		chunk, err := p.r.ReadSlice('\n')
+		if len(chunk) > 0 {
+			if whole || len(l.text) < maxDelimiterLine {
+				l.text = append(l.text, chunk...)
+			}
+			if len(bytes.TrimRight(chunk, "\r\n")) > 0 {
+				l.content = true
+			}
+			p.offset += int64(len(chunk))
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		l.end = p.offset
+		if err == io.EOF && l.end == l.start {
+			return l, io.EOF
+		}
+		if err != nil && err != io.EOF {
+			return l, err
+		}
+		return l, nil
+	}
+}
+
+// Puts l back, to be returned by the next call to next.
+func (p *spoolParser) unread(l spoolLine) {
+	p.pending = true
+	p.line = l
+}
+
+// A line that ends the part being read: a delimiter of one of the enclosing multiparts,
+// or the end of the message.
+type spoolEnd struct {
+	// The index of the multipart among those enclosing the part, or -1 at the end of the message.
+	level   int
+	closing bool
+	line    spoolLine
+}
+
+// Returns the delimiter among boundaries, outermost first, that l is, or -1.
+func delimiterLevel(l spoolLine, boundaries []string) (int, bool) {
+	if int64(len(l.text)) < l.end-l.start {
+		return -1, false
+	}
+	trimmed := bytes.TrimRight(l.text, " \t\r\n")
+	for i, boundary := range boundaries {
+		if string(trimmed) == "--"+boundary {
+			return i, false
+		}
+		if string(trimmed) == "--"+boundary+"--" {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+// Reads lines up to the next delimiter of boundaries or the end of the message, which it
+// returns without consuming.
+func (p *spoolParser) skipTo(boundaries []string) (spoolEnd, error) {
+	for {
+		l, err := p.next(false)
+		if err == io.EOF {
+			return spoolEnd{level: -1, line: spoolLine{start: p.offset, end: p.offset}}, nil
+		}
+		if err != nil {
+			return spoolEnd{}, err
+		}
+		if level, closing := delimiterLevel(l, boundaries); level >= 0 {
+			p.unread(l)
+			return spoolEnd{level: level, closing: closing, line: l}, nil
+		}
+	}
+}
+
+// Reads a part up to the delimiter or end of message that ends it, which it leaves
+// unconsumed, and returns the part and that end.
+func (p *spoolParser) part(partId string, boundaries []string) (*gmail.MessagePart, spoolEnd, error) {
+	// The header block, up to the first empty line.
+	var block []byte
+	for {
+		l, err := p.next(true)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, spoolEnd{}, err
+		}
+		if level, _ := delimiterLevel(l, boundaries); level >= 0 {
+			p.unread(l)
+			break
+		}
+		if !l.content {
+			break
+		}
+		block = append(block, l.text...)
+	}
+	part := &gmail.MessagePart{PartId: partId, Headers: ParseHeaderBlock(block)}
+	bodyStart := p.offset
+	if p.pending {
+		bodyStart = p.line.start
+	}
+
+	contentType := HeaderValue(part.Headers, "Content-Type")
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if contentType == "" || err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+	part.MimeType = mediaType
+	part.Filename = partFilename(part.Headers, params)
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		// Lines up to the first delimiter are the preamble. Without a boundary of its own
+		// the multipart still ends at a delimiter of an enclosing one.
+		inner := boundaries
+		if params["boundary"] != "" {
+			inner = append(boundaries[:len(boundaries):len(boundaries)], params["boundary"])
+		}
+		end, err := p.skipTo(inner)
+		if err != nil {
+			return nil, spoolEnd{}, err
+		}
+		if end.level == len(boundaries) && !end.closing {
+			part.Body = &gmail.MessagePartBody{}
+			for i := 0; ; i++ {
+				// Consumes the delimiter.
+				p.next(false)
+				subId := strconv.Itoa(i)
+				if partId != "" {
+					subId = partId + "." + subId
+				}
+				subpart, end, err := p.part(subId, inner)
+				if err != nil {
+					return nil, spoolEnd{}, err
+				}
+				part.Parts = append(part.Parts, subpart)
+				if end.level == len(boundaries) && !end.closing {
+					continue
+				}
+				if end.level == len(boundaries) {
+					// The epilogue after the closing delimiter.
+					p.next(false)
+					end, err = p.skipTo(boundaries)
+					if err != nil {
+						return nil, spoolEnd{}, err
+					}
+				}
+				return part, end, nil
+			}
+		}
+		// Without a usable boundary the body is kept whole as text rather than lost.
+		part.MimeType = "text/plain"
+		if partId != "" {
+			part.Headers = WithHeader(part.Headers, "Content-Type", "text/plain")
+		}
+		if end.level == len(boundaries) {
+			// The closing delimiter alone makes no parts either; the body goes on past it.
+			p.next(false)
+			end, err = p.skipTo(boundaries)
+			if err != nil {
+				return nil, spoolEnd{}, err
+			}
+		}
+		return p.leaf(part, bodyStart, boundaries, end, true)
+	}
+
+	end, err := p.skipTo(boundaries)
+	if err != nil {
+		return nil, spoolEnd{}, err
+	}
+	return p.leaf(part, bodyStart, boundaries, end, false)
+}
+
+// Sets the body of part, from bodyStart to end, as Parse would: the line break before a
+// delimiter of the enclosing multipart belongs to the delimiter, and a part that isn't
+// ended by one ends at its last line with content.
+func (p *spoolParser) leaf(part *gmail.MessagePart, bodyStart int64, boundaries []string, end spoolEnd, wholeText bool) (*gmail.MessagePart, spoolEnd, error) {
+	bodyEnd := end.line.start
+	switch {
+	case len(boundaries) > 0 && end.level == len(boundaries)-1:
+		if bodyEnd > bodyStart {
+			prev, err := p.lineBefore(bodyEnd)
+			if err != nil {
+				return nil, spoolEnd{}, err
+			}
+			bodyEnd -= prev
+		}
+	case len(boundaries) > 0:
+		last, err := p.lastContent(bodyStart, bodyEnd)
+		if err != nil {
+			return nil, spoolEnd{}, err
+		}
+		bodyEnd = last
+	}
+	if bodyEnd < bodyStart {
+		bodyEnd = bodyStart
+	}
+
+	attachment := !wholeText && (part.Filename != "" || IsAttachedMessage(part))
+	if !attachment {
+		raw := make([]byte, bodyEnd-bodyStart)
+		if _, err := p.spool.f.ReadAt(raw, bodyStart); err != nil && err != io.EOF {
+			return nil, spoolEnd{}, err
+		}
+		data, err := DecodeTransferEncoding(raw, HeaderValue(part.Headers, "Content-Transfer-Encoding"))
+		if err != nil {
+			return nil, spoolEnd{}, fmt.Errorf("part [%s]: %w", part.PartId, err)
+		}
+		part.Body = &gmail.MessagePartBody{Data: base64.URLEncoding.EncodeToString(data), Size: int64(len(data))}
+		return part, end, nil
+	}
+
+	part.Body = &gmail.MessagePartBody{AttachmentId: fmt.Sprintf("%s%d-%d", spoolRefPrefix, bodyStart, bodyEnd)}
+	r, err := p.spool.Open(part)
+	if err != nil {
+		return nil, spoolEnd{}, err
+	}
+	size, err := io.Copy(ioutil.Discard, r)
+	if err != nil {
+		return nil, spoolEnd{}, fmt.Errorf("part [%s]: %w", part.PartId, err)
+	}
+	part.Body.Size = size
+	if size == 0 {
+		// As Parse leaves an empty body, which isn't taken for an attachment.
+		part.Body.AttachmentId = ""
+	}
+	return part, end, nil
+}
+
+// Returns the length of the line break that ends just before offset: 0, 1 or 2.
+func (p *spoolParser) lineBefore(offset int64) (int64, error) {
+	start := offset - 2
+	if start < 0 {
+		start = 0
+	}
+	b := make([]byte, offset-start)
+	if _, err := p.spool.f.ReadAt(b, start); err != nil && err != io.EOF {
+		return 0, err
+	}
+	switch {
+	case bytes.HasSuffix(b, []byte("\r\n")):
+		return 2, nil
+	case bytes.HasSuffix(b, []byte("\n")):
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// Returns the offset just past the last byte between start and end that isn't CR or LF,
+// or start if there is none.
+func (p *spoolParser) lastContent(start int64, end int64) (int64, error) {
+	b := make([]byte, 4096)
+	for end > start {
+		n := int64(len(b))
+		if end-start < n {
+			n = end - start
+		}
+		if _, err := p.spool.f.ReadAt(b[:n], end-n); err != nil && err != io.EOF {
+			return 0, err
+		}
+		if i := bytes.LastIndexFunc(b[:n], func(r rune) bool { return r != '\r' && r != '\n' }); i >= 0 {
+			return end - n + int64(i) + 1, nil
+		}
+		end -= n
+	}
+	if end < start {
+		return start, nil
+	}
+	return end, nil
+}
+
+// Returned by the rebuild for a spooled body when it wasn't given a BodyOpener.
+var errNoSpool = errors.New("part body is in a spool but none was given")
@@ -0,0 +1,147 @@
+package mimeutil
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// Writes raw to a new spool, in small writes.
+func spoolOf(t *testing.T, raw []byte) *Spool {
+	t.Helper()
+	s, err := NewSpool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if _, err := io.CopyBuffer(s, bytes.NewReader(raw), make([]byte, 7)); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// Reads the spooled bodies of p into Body.Data, as Parse sets them.
+func loadSpooled(t *testing.T, s *Spool, p *gmail.MessagePart) {
+	t.Helper()
+	if IsSpooled(p) {
+		data, err := s.Body(p)
+		if err != nil {
+			t.Fatalf("part [%s]: %v", p.PartId, err)
+		}
+		p.Body = &gmail.MessagePartBody{Data: base64.URLEncoding.EncodeToString(data), Size: int64(len(data))}
+	}
+	for _, subpart := range p.Parts {
+		loadSpooled(t, s, subpart)
+	}
+}
+
+// Messages whose delimiters and line breaks the fixtures don't cover.
+func spoolCases(t *testing.T) map[string][]byte {
+	cases := readFixtures(t)
+	big := WrapBase64(bytes.Repeat([]byte("0123456789abcdef\x00\xff"), 20000))
+	cases["large attachment"] = []byte("Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nhi\r\n" +
+		"--b\r\nContent-Type: application/octet-stream; name=big.bin\r\nContent-Transfer-Encoding: base64\r\n\r\n" + big +
+		"--b--\r\n")
+	cases["bare line feeds"] = []byte("Content-Type: multipart/mixed; boundary=b\n\n" +
+		"preamble\n--b\nContent-Type: text/plain\n\nhi\n\n" +
+		"--b\nContent-Disposition: attachment; filename=a.txt\n\nfile\n--b--\nepilogue\n")
+	cases["unclosed nested multipart"] = []byte("Content-Type: multipart/mixed; boundary=outer\r\n\r\n" +
+		"--outer\r\nContent-Type: multipart/alternative; boundary=inner\r\n\r\n" +
+		"--inner\r\nContent-Type: text/plain\r\n\r\ntext\r\n\r\n\r\n" +
+		"--outer\r\nContent-Disposition: attachment; filename=a.txt\r\n\r\nfile\r\n\r\n" +
+		"--outer--\r\n")
+	cases["unclosed at the end"] = []byte("Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Disposition: attachment; filename=a.txt\r\n\r\nfile\r\n\r\n")
+	cases["no line break at the end"] = []byte("Subject: hi\r\n\r\nbody")
+	cases["only headers"] = []byte("Subject: hi\r\n")
+	cases["empty attachment"] = []byte("Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Disposition: attachment; filename=a.txt\r\n\r\n--b--\r\n")
+	cases["closing delimiter first"] = []byte("Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"text\r\n--b--\r\nmore\r\n")
+	return cases
+}
+
+func TestSpoolParse(t *testing.T) {
+	for name, raw := range spoolCases(t) {
+		t.Run(name, func(t *testing.T) {
+			want, err := Parse(raw)
+			if err != nil {
+				t.Fatalf("Parse(): %v", err)
+			}
+			s := spoolOf(t, raw)
+			got, err := s.Parse()
+			if err != nil {
+				t.Fatalf("Spool.Parse(): %v", err)
+			}
+			for _, a := range attachments(got.Payload) {
+				if a.Body.Size > 0 && !IsSpooled(a) {
+					t.Errorf("attachment [%s] was read into memory", a.PartId)
+				}
+			}
+			loadSpooled(t, s, got.Payload)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Spool.Parse() =\n%s\nwant\n%s", Outline(got.Payload), Outline(want.Payload))
+			}
+			if s.Size() != int64(len(raw)) {
+				t.Errorf("Size() = %d, want %d", s.Size(), len(raw))
+			}
+		})
+	}
+}
+
+// Rebuilding a spooled message, reading kept attachments from the spool, writes what
+// PartToRaw returns for the message parsed in memory.
+func TestWriteMultipartFromSpool(t *testing.T) {
+	keepAll := func(*gmail.MessagePart) bool { return true }
+	for name, raw := range spoolCases(t) {
+		t.Run(name, func(t *testing.T) {
+			m, err := Parse(raw)
+			if err != nil {
+				t.Fatalf("Parse(): %v", err)
+			}
+			if len(m.Payload.Parts) == 0 {
+				t.Skip("not multipart")
+			}
+			boundary, err := Boundary(m.Payload.Headers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := PartToRaw(m.Payload, boundary, keepAll)
+			if err != nil {
+				t.Fatalf("PartToRaw(): %v", err)
+			}
+
+			s := spoolOf(t, raw)
+			spooled, err := s.Parse()
+			if err != nil {
+				t.Fatalf("Spool.Parse(): %v", err)
+			}
+			var b strings.Builder
+			if err := WriteMultipart(&b, spooled.Payload, boundary, keepAll, s.Open); err != nil {
+				t.Fatalf("WriteMultipart(): %v", err)
+			}
+			if b.String() != want {
+				t.Errorf("WriteMultipart() differs from PartToRaw():\n%s", firstDifference(want, b.String()))
+			}
+		})
+	}
+}
+
+func TestWriteMultipartWithoutSpool(t *testing.T) {
+	s := spoolOf(t, []byte("Content-Type: multipart/mixed; boundary=b\r\n\r\n"+
+		"--b\r\nContent-Disposition: attachment; filename=a.txt\r\n\r\nfile\r\n--b--\r\n"))
+	m, err := s.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keepAll := func(*gmail.MessagePart) bool { return true }
+	if _, err := PartToRaw(m.Payload, "b", keepAll); err == nil {
+		t.Error("PartToRaw() kept a spooled attachment without reading it")
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+
+	"github.com/weineran/gmail-cleanup/internal/mimeutil"
+)
+
+// Actions recorded in the run journal.
+const (
+	journalTrashed  = "trashed"
+	journalStripped = "stripped"
+	journalFailed   = "failed"
+	// A copy is about to be inserted. If no journalStripped entry follows, the run died
+	// or the insert failed, and fsck looks for a copy nothing knows about.
+	journalCopying = "copying"
+)
+
+// One destructive change made by a run, with what's needed to undo it,
+// or a message the run failed to process.
+type journalEntry struct {
+	RunId     string   `json:"runId"`
+	Time      string   `json:"time"`
+	Action    string   `json:"action"`
+	MessageId string   `json:"messageId"`
+	ThreadId  string   `json:"threadId"`
+	LabelIds  []string `json:"labelIds"`
+	// The Message-ID header, which a copy shares with its original.
+	RFC822MessageId string `json:"rfc822MessageId,omitempty"`
+	// The stripped copy that replaced the message, for journalStripped.
+	CopyId string `json:"copyId,omitempty"`
+	// Hex SHA-256 of the original raw message, if it was fetched.
+	RawSHA256 string `json:"rawSha256,omitempty"`
+	// The attachments removed, for journalStripped.
+	Attachments []manifestAttachment `json:"attachments,omitempty"`
+	// Why processing failed, for journalFailed.
+	Error string `json:"error,omitempty"`
+	// Whether the message had been approved when it failed, for journalFailed.
+	Approved bool `json:"approved,omitempty"`
+	// For journalCopying, whether the original was deleted before the insert, leaving it
+	// only in its backup until the copy is recorded.
+	DeletedFirst bool `json:"deletedFirst,omitempty"`
+}
+
+// Returns an entry for action on m, with the labels it has before the action.
+func newJournalEntry(action string, m *gmail.Message) journalEntry {
+	e := journalEntry{Action: action, MessageId: m.Id, ThreadId: m.ThreadId, LabelIds: m.LabelIds}
+	if m.Payload != nil {
+		e.RFC822MessageId = mimeutil.HeaderValue(m.Payload.Headers, "Message-ID")
+	}
+	return e
+}
+
+// Appends the changes of one run to a profile's JSON Lines journal.
+type runJournal struct {
+	path  string
+	runId string
+	// Keeps entries recorded from several goroutines whole.
+	mu sync.Mutex
+}
+
+func newRunJournal(profile string, runId string) *runJournal {
+	return &runJournal{path: profileJournalFile(profile), runId: runId}
+}
+
+func profileJournalFile(profile string) string {
+	return profilePath(profile, "journal.jsonl")
+}
+
+// Appends e, stamped with the run id and the current time, and syncs it to disk,
+// so an entry recorded before an API call survives a crash during the call.
+func (j *runJournal) record(e journalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	f, err := os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	e.RunId = j.runId
+	e.Time = time.Now().Format(time.RFC3339)
+	if err := json.NewEncoder(f).Encode(e); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Reads every entry of the journal at path. A missing journal has no entries.
+// A last line cut short by a crash while it was written is ignored.
+func readJournal(path string) ([]journalEntry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []journalEntry
+	var torn error
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if torn != nil {
+			return nil, torn
+		}
+		var e journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			torn = fmt.Errorf("%s: entry %d: %w", path, len(entries)+1, err)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if torn != nil {
+		log.Printf("Ignoring the incomplete last entry of the journal: %v\n", torn)
+	}
+	return entries, scanner.Err()
+}
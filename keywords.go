@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+
+	"github.com/weineran/gmail-cleanup/internal/mimeutil"
+)
+
+// Patterns for mail that is likely legally or financially important.
+var defaultProtectionPatterns = []string{
+	`\binvoices?\b`,
+	`\bcontracts?\b`,
+	`\btax(es)?\b`,
+	`\breceipts?\b`,
+	`\bboarding pass(es)?\b`,
+}
+
+// Label for messages left alone because they match a protection pattern, unless --protected-label says otherwise.
+const defaultProtectedLabel = "gmail-cleanup/protected"
+
+// How much of the plain text body is searched, besides the subject and snippet.
+const protectionBodyBytes = 4096
+
+// A case-insensitive pattern protecting matching messages from destructive operations.
+type protectionPattern struct {
+	source string
+	re     *regexp.Regexp
+}
+
+// Compiles patterns, one regular expression each, matched case-insensitively.
+func compileProtectionPatterns(patterns []string) ([]protectionPattern, error) {
+	var result []protectionPattern
+	for _, p := range patterns {
+		re, err := regexp.Compile("(?i)" + p)
+		if err != nil {
+			return nil, fmt.Errorf("protection pattern [%s]: %w", p, err)
+		}
+		result = append(result, protectionPattern{source: p, re: re})
+	}
+	return result, nil
+}
+
+// Reads protection patterns from path, one per line, ignoring blank lines and # comments.
+// Without a path the default patterns are used.
+func loadProtectionPatterns(path string) ([]protectionPattern, error) {
+	if path == "" {
+		return compileProtectionPatterns(defaultProtectionPatterns)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return compileProtectionPatterns(patterns)
+}
+
+// Returns the first pattern matching the subject, snippet or beginning of the plain text body
+// of m, fetched in full format, or "" if none does.
+func matchProtection(patterns []protectionPattern, m *gmail.Message) string {
+	if len(patterns) == 0 || m.Payload == nil {
+		return ""
+	}
+	texts := []string{mimeutil.HeaderValue(m.Payload.Headers, "Subject"), m.Snippet, plainTextBody(m.Payload, protectionBodyBytes)}
+	for _, p := range patterns {
+		for _, text := range texts {
+			if p.re.MatchString(text) {
+				return p.source
+			}
+		}
+	}
+	return ""
+}
+
+// Returns up to limit bytes of the first text/plain part of p that isn't an attachment.
+func plainTextBody(p *gmail.MessagePart, limit int) string {
+	var parts []*gmail.MessagePart
+	for _, part := range getMessagePartsRecursively(p, parts) {
+		if part.Filename != "" || part.Body == nil || !strings.HasPrefix(strings.ToLower(part.MimeType), "text/plain") {
+			continue
+		}
+		data, err := base64.URLEncoding.DecodeString(part.Body.Data)
+		if err != nil {
+			continue
+		}
+		if len(data) > limit {
+			data = data[:limit]
+		}
+		return string(data)
+	}
+	return ""
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// User labels with their settings, as written by `labels export`.
+type labelTaxonomy struct {
+	Labels []exportedLabel `json:"labels"`
+}
+
+type exportedLabel struct {
+	Name string `json:"name"`
+	// labelShow, labelShowIfUnread or labelHide.
+	LabelListVisibility string `json:"labelListVisibility,omitempty"`
+	// show or hide.
+	MessageListVisibility string `json:"messageListVisibility,omitempty"`
+	// Hex colors from Gmail's palette, or "" for none.
+	TextColor       string `json:"textColor,omitempty"`
+	BackgroundColor string `json:"backgroundColor,omitempty"`
+}
+
+func newExportedLabel(l *gmail.Label) exportedLabel {
+	e := exportedLabel{Name: l.Name, LabelListVisibility: l.LabelListVisibility, MessageListVisibility: l.MessageListVisibility}
+	if l.Color != nil {
+		e.TextColor, e.BackgroundColor = l.Color.TextColor, l.Color.BackgroundColor
+	}
+	return e
+}
+
+// Returns the label settings of e to create or patch.
+func (e exportedLabel) label() *gmail.Label {
+	l := &gmail.Label{Name: e.Name, LabelListVisibility: e.LabelListVisibility, MessageListVisibility: e.MessageListVisibility}
+	if e.TextColor != "" || e.BackgroundColor != "" {
+		l.Color = &gmail.LabelColor{TextColor: e.TextColor, BackgroundColor: e.BackgroundColor}
+	}
+	return l
+}
+
+// `labels export` and `labels import`.
+func runLabels(args []string) {
+	if len(args) == 0 {
+		log.Fatalf("Usage: gmail-cleanup labels export|import FILE")
+	}
+	switch args[0] {
+	case "export":
+		runLabelsExport(args[1:])
+	case "import":
+		runLabelsImport(args[1:])
+	default:
+		log.Fatalf("Unknown labels command [%s], expected export or import", args[0])
+	}
+}
+
+// Writes the account's user labels, with their colors and visibility, to a file that
+// `labels import` can set up another account from.
+func runLabelsExport(args []string) {
+	fs := flag.NewFlagSet("labels export", flag.ExitOnError)
+	var opts mailboxOptions
+	opts.register(fs)
+	prefix := fs.String("prefix", "", "Only export labels whose names start with this, e.g. gmail-cleanup/")
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		log.Fatalf("Usage: gmail-cleanup labels export [--prefix PREFIX] FILE")
+	}
+
+	opts.readOnly = true
+	mb := openMailbox(&opts)
+	defer mb.quota.printSummary()
+	labels, err := mb.listLabels()
+	if err != nil {
+		exitf(exitCodeFor(err), "Unable to list labels: %v", err)
+	}
+	var t labelTaxonomy
+	for _, l := range labels {
+		if l.Type == "user" && strings.HasPrefix(l.Name, *prefix) {
+			t.Labels = append(t.Labels, newExportedLabel(l))
+		}
+	}
+	sort.Slice(t.Labels, func(i, j int) bool { return t.Labels[i].Name < t.Labels[j].Name })
+	if err := writeJSONAtomic(fs.Arg(0), t); err != nil {
+		log.Fatalf("Unable to write labels: %v", err)
+	}
+	fmt.Printf("Exported %d labels to [%s]\n", len(t.Labels), fs.Arg(0))
+}
+
+// Creates the labels of a `labels export` file that the account doesn't have, and gives
+// those it has the file's colors and visibility. Other labels are left alone.
+func runLabelsImport(args []string) {
+	fs := flag.NewFlagSet("labels import", flag.ExitOnError)
+	var opts mailboxOptions
+	opts.register(fs)
+	dryRun := fs.Bool("dry-run", false, "Only print what would be created or changed")
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		log.Fatalf("Usage: gmail-cleanup labels import [--dry-run] FILE")
+	}
+	var t labelTaxonomy
+	if err := readJSON(fs.Arg(0), &t); err != nil {
+		log.Fatalf("Unable to read labels: %v", err)
+	}
+
+	mb := openMailbox(&opts)
+	defer mb.quota.printSummary()
+	labels, err := mb.listLabels()
+	if err != nil {
+		exitf(exitCodeFor(err), "Unable to list labels: %v", err)
+	}
+	existing := map[string]*gmail.Label{}
+	for _, l := range labels {
+		existing[l.Name] = l
+	}
+
+	// Parents sort before their children, so nested labels are created in order.
+	sort.Slice(t.Labels, func(i, j int) bool { return t.Labels[i].Name < t.Labels[j].Name })
+	var created, updated, unchanged int
+	for _, want := range t.Labels {
+		l, ok := existing[want.Name]
+		switch {
+		case !ok:
+			fmt.Printf("* %s: create\n", want.Name)
+			created++
+			if !*dryRun {
+				if _, err := mb.createLabel(want.label()); err != nil {
+					exitf(exitCodeFor(err), "Unable to create label [%s]: %v", want.Name, err)
+				}
+			}
+		case l.Type != "user":
+			log.Printf("Label [%s] is a system label, skipping.\n", want.Name)
+		case newExportedLabel(l) == want:
+			unchanged++
+		default:
+			fmt.Printf("* %s: update colors and visibility\n", want.Name)
+			updated++
+			if !*dryRun {
+				if _, err := mb.patchLabel(l.Id, want.label()); err != nil {
+					exitf(exitCodeFor(err), "Unable to update label [%s]: %v", want.Name, err)
+				}
+			}
+		}
+	}
+	verb := ""
+	if *dryRun {
+		verb = "would be "
+	}
+	fmt.Printf("%d labels %screated, %d %supdated, %d unchanged\n", created, verb, updated, verb, unchanged)
+}
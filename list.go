@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+
+	"github.com/weineran/gmail-cleanup/internal/mimeutil"
+)
+
+// A thread with messages matching the list query, added up over all its messages.
+type threadSummary struct {
+	id       string
+	subject  string
+	messages int
+	// How many of its messages match the query.
+	matching int
+	bytes    int64
+	first    time.Time
+	last     time.Time
+	// Addresses in From, To and Cc, in order of first appearance.
+	participants []string
+}
+
+// Lists messages matching a query, biggest first. With --threads, lists the threads they
+// are in instead, by the size of the whole thread, since a weekly report with an
+// attachment adds up over the years to more than any one message.
+func runList(args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	var opts mailboxOptions
+	opts.register(fs)
+	query := fs.String("query", "larger:1M", "Messages to list")
+	byThread := fs.Bool("threads", false, "Group messages by thread, with each thread's total size, message count and participants")
+	top := fs.Int("top", 50, "Number of messages or threads to show (0 means all)")
+	breakdown := fs.Bool("breakdown", true, "Show how much of each message listed is body and how much attachments, which costs a request per message")
+	bySavings := fs.Bool("by-savings", false, "List messages by the bytes stripping their attachments would free instead of by size, which costs a request per matching message")
+	parseFlags(fs, args)
+	checkQuery(*query, false, false)
+
+	opts.readOnly = true
+	mb := openMailbox(&opts)
+	defer mb.quota.printSummary()
+
+	c := mb.cleaner()
+	c.MetadataHeaders = []string{"From", "Subject"}
+	var messages []*gmail.Message
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for r := range c.Messages(ctx, *query) {
+		if errors.Is(r.Err, errQuotaBudgetExceeded) {
+			log.Printf("Stopping after %d messages: %v\n", len(messages), r.Err)
+			break
+		}
+		if r.Err != nil {
+			exitf(exitCodeFor(r.Err), "Unable to retrieve messages: %v", r.Err)
+		}
+		messages = append(messages, r.Message)
+	}
+	if len(messages) == 0 {
+		fmt.Println("No messages found.")
+		return
+	}
+
+	if !*byThread {
+		sort.SliceStable(messages, func(i, j int) bool { return messages[i].SizeEstimate > messages[j].SizeEstimate })
+		shown := messages
+		if *top > 0 && len(shown) > *top && !*bySavings {
+			shown = shown[:*top]
+		}
+		sizes := map[string]partSizes{}
+		if *breakdown || *bySavings {
+			for _, m := range shown {
+				skeleton, err := mb.getMessageSkeleton(m.Id)
+				if errors.Is(err, errQuotaBudgetExceeded) {
+					log.Printf("Stopping after %d messages' sizes: %v\n", len(sizes), err)
+					break
+				}
+				if err != nil {
+					exitf(exitCodeFor(err), "Unable to get message [%s]: %v", m.Id, err)
+				}
+				sizes[m.Id] = messagePartSizes(skeleton)
+			}
+		}
+		if *bySavings {
+			sort.SliceStable(shown, func(i, j int) bool { return sizes[shown[i].Id].savings > sizes[shown[j].Id].savings })
+			if *top > 0 && len(shown) > *top {
+				shown = shown[:*top]
+			}
+		}
+		fmt.Printf("%d messages matching [%s]\n", len(messages), *query)
+		for _, m := range shown {
+			var headers []*gmail.MessagePartHeader
+			if m.Payload != nil {
+				headers = m.Payload.Headers
+			}
+			size := formatBytes(m.SizeEstimate)
+			if s, ok := sizes[m.Id]; ok {
+				size += fmt.Sprintf(" (body: %s, attachments: %s)", formatBytes(s.body), formatBytes(s.attachments))
+			}
+			fmt.Printf("* %s: %s, %s, from [%s], subject [%s]\n", m.Id, internalDate(m).Format("2006-01-02"), size,
+				mimeutil.HeaderValue(headers, "From"), mimeutil.HeaderValue(headers, "Subject"))
+		}
+		return
+	}
+
+	matching := map[string]int{}
+	var threadIds []string
+	for _, m := range messages {
+		if matching[m.ThreadId] == 0 {
+			threadIds = append(threadIds, m.ThreadId)
+		}
+		matching[m.ThreadId]++
+	}
+	var threads []threadSummary
+	for _, id := range threadIds {
+		t, err := mb.getThread(id, "metadata")
+		if errors.Is(err, errQuotaBudgetExceeded) {
+			log.Printf("Stopping after %d threads: %v\n", len(threads), err)
+			break
+		}
+		if err != nil {
+			exitf(exitCodeFor(err), "Unable to get thread [%s]: %v", id, err)
+		}
+		threads = append(threads, summarizeThread(t, matching[id]))
+	}
+	sort.SliceStable(threads, func(i, j int) bool { return threads[i].bytes > threads[j].bytes })
+
+	fmt.Printf("%d messages matching [%s] in %d threads\n", len(messages), *query, len(threadIds))
+	for i, t := range threads {
+		if *top > 0 && i == *top {
+			break
+		}
+		fmt.Printf("* %s: %s, %d messages (%d matching), %s to %s, subject [%s]\n", t.id, formatBytes(t.bytes), t.messages, t.matching,
+			t.first.Format("2006-01-02"), t.last.Format("2006-01-02"), t.subject)
+		fmt.Printf("  participants: %s\n", strings.Join(t.participants, ", "))
+	}
+}
+
+// How a message's size splits between its body and its attachments.
+type partSizes struct {
+	// The rest of the message: headers, text and inline images.
+	body int64
+	// The attachments' decoded sizes.
+	attachments int64
+	// What the attachments take in the message, base64-encoded in lines of 76
+	// characters, and so what stripping them frees.
+	savings int64
+}
+
+// Adds up the parts of m, fetched in full format. Gmail's size estimate is of the raw
+// message, where attachments take a third more than their decoded size.
+func messagePartSizes(m *gmail.Message) partSizes {
+	var s partSizes
+	s.addAttachments(m.Payload)
+	if s.savings > m.SizeEstimate {
+		s.savings = m.SizeEstimate
+	}
+	s.body = m.SizeEstimate - s.savings
+	return s
+}
+
+// Adds the attachments in p, including attached emails, which are counted whole. Unlike
+// attachmentParts, it doesn't need the bodies, which skeletons don't have.
+func (s *partSizes) addAttachments(p *gmail.MessagePart) {
+	if p == nil {
+		return
+	}
+	if p.Body != nil && (p.Filename != "" || mimeutil.IsAttachedMessage(p)) {
+		s.attachments += p.Body.Size
+		s.savings += base64EncodedSize(p.Body.Size)
+		return
+	}
+	for _, subpart := range p.Parts {
+		s.addAttachments(subpart)
+	}
+}
+
+// Returns the size of n bytes base64-encoded in MIME lines of 76 characters with CRLF.
+func base64EncodedSize(n int64) int64 {
+	encoded := (n + 2) / 3 * 4
+	return encoded + (encoded+75)/76*2
+}
+
+// Adds up t, whose messages are fetched in metadata format.
+func summarizeThread(t *gmail.Thread, matching int) threadSummary {
+	s := threadSummary{id: t.Id, messages: len(t.Messages), matching: matching}
+	seen := map[string]bool{}
+	for _, m := range t.Messages {
+		s.bytes += m.SizeEstimate
+		date := internalDate(m)
+		if s.first.IsZero() || date.Before(s.first) {
+			s.first = date
+		}
+		if date.After(s.last) {
+			s.last = date
+		}
+		if m.Payload == nil {
+			continue
+		}
+		if s.subject == "" {
+			s.subject = mimeutil.HeaderValue(m.Payload.Headers, "Subject")
+		}
+		for _, name := range []string{"From", "To", "Cc"} {
+			for _, addr := range headerAddresses(mimeutil.HeaderValue(m.Payload.Headers, name)) {
+				if !seen[addr] {
+					seen[addr] = true
+					s.participants = append(s.participants, addr)
+				}
+			}
+		}
+	}
+	return s
+}
+
+// Returns the lowercase addresses in an address list header.
+func headerAddresses(value string) []string {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+	list, err := mail.ParseAddressList(value)
+	if err != nil {
+		return []string{senderAddress(value)}
+	}
+	var addrs []string
+	for _, a := range list {
+		addrs = append(addrs, strings.ToLower(a.Address))
+	}
+	return addrs
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// The files under a local directory, looked up by content, so an attachment is only
+// removed from a sent message when a copy of it is on disk. Files are indexed by size
+// and only hashed when an attachment of their size comes along.
+type localCopies struct {
+	dir    string
+	bySize map[int64][]string
+	// SHA-256 of the files hashed so far, by path.
+	hashes map[string]string
+}
+
+func indexLocalCopies(dir string) (*localCopies, error) {
+	l := &localCopies{dir: dir, bySize: map[int64][]string{}, hashes: map[string]string{}}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			l.bySize[info.Size()] = append(l.bySize[info.Size()], path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Returns the path of a file with the same content as data, or "" if there is none.
+func (l *localCopies) find(r io.Reader) (string, error) {
+	h := sha256.New()
+	size, err := io.Copy(h, r)
+	if err != nil {
+		return "", err
+	}
+	want := hex.EncodeToString(h.Sum(nil))
+	for _, path := range l.bySize[size] {
+		hash, ok := l.hashes[path]
+		if !ok {
+			var err error
+			hash, err = hashFile(path)
+			if err != nil {
+				return "", err
+			}
+			l.hashes[path] = hash
+		}
+		if hash == want {
+			return path, nil
+		}
+	}
+	return "", nil
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Returned by lockFile when another process holds the lock and we're not waiting.
+var errLocked = errors.New("locked")
+
+// An advisory lock on a profile, held until the process exits, so concurrent runs
+// against the same account can't both insert copies and delete originals. Runs that
+// only read the account share it, so they don't wait for each other.
+type profileLock struct {
+	f *os.File
+}
+
+// Locks profile, shared if the run only reads the account, waiting for another run
+// to finish if wait is set.
+func acquireProfileLock(profile string, shared bool, wait bool) (*profileLock, error) {
+	path := profilePath(profile, "gmail-cleanup.lock")
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = lockFile(f, shared, false)
+	if err == errLocked && wait {
+		fmt.Printf("Waiting for %s holding %s to finish...\n", lockHolder(path), path)
+		err = lockFile(f, shared, true)
+	}
+	if err == errLocked {
+		f.Close()
+		return nil, fmt.Errorf("%s is using this account; wait for it or pass --wait-for-lock", lockHolder(path))
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// Only the one run that may change the account leaves its pid.
+	if !shared {
+		if err := f.Truncate(0); err == nil {
+			f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+		}
+	}
+	return &profileLock{f: f}, nil
+}
+
+// Describes the runs holding path's lock: runs that only read the account if they
+// share it, or else the run whose pid is in the file.
+func lockHolder(path string) string {
+	if f, err := os.Open(path); err == nil {
+		shared := lockFile(f, true, false) == nil
+		f.Close()
+		if shared {
+			return "a gmail-cleanup run that only reads mail"
+		}
+	}
+	pid := "unknown"
+	if b, err := ioutil.ReadFile(path); err == nil && len(strings.TrimSpace(string(b))) > 0 {
+		pid = strings.TrimSpace(string(b))
+	}
+	return fmt.Sprintf("another gmail-cleanup run (pid %s)", pid)
+}
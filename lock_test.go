@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLockFile(t *testing.T) {
+	tests := []struct {
+		name          string
+		first, second bool
+		want          error
+	}{
+		{"shared after shared", true, true, nil},
+		{"exclusive after shared", true, false, errLocked},
+		{"shared after exclusive", false, true, errLocked},
+		{"exclusive after exclusive", false, false, errLocked},
+	}
+	dir, err := ioutil.TempDir("", "gmail-cleanup-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gmail-cleanup.lock")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer first.Close()
+			if err := lockFile(first, tt.first, false); err != nil {
+				t.Fatal(err)
+			}
+			second, err := os.OpenFile(path, os.O_RDWR, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer second.Close()
+			if err := lockFile(second, tt.second, false); err != tt.want {
+				t.Errorf("lockFile() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
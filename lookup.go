@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+
+	"google.golang.org/api/googleapi"
+
+	"github.com/weineran/gmail-cleanup/internal/mimeutil"
+)
+
+// Header on each copy with the id of the message it replaced.
+const originalIdHeader = "X-Gmail-Cleanup-Original-Id"
+
+// Resolves a message id, e.g. from a Gmail permalink, to the copies that replaced it
+// and the originals it replaced, following replacements of replacements.
+func runLookup(args []string) {
+	fs := flag.NewFlagSet("lookup", flag.ExitOnError)
+	var opts mailboxOptions
+	opts.register(fs)
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		log.Fatal("Usage: gmail-cleanup lookup [flags] MESSAGE_ID")
+	}
+	id := fs.Arg(0)
+
+	entries, err := readJournal(profileJournalFile(opts.profile))
+	if err != nil {
+		log.Fatalf("Unable to read journal: %v", err)
+	}
+	copyOf := map[string]journalEntry{}
+	originalOf := map[string]journalEntry{}
+	inThread := map[string][]journalEntry{}
+	for _, e := range entries {
+		if e.Action != journalStripped || e.CopyId == "" {
+			continue
+		}
+		copyOf[e.MessageId] = e
+		originalOf[e.CopyId] = e
+		inThread[e.ThreadId] = append(inThread[e.ThreadId], e)
+	}
+
+	found := false
+	// Back to the first original, then forward to the latest copy.
+	for current := id; ; {
+		e, ok := originalOf[current]
+		if !ok {
+			break
+		}
+		fmt.Printf("[%s] is the copy of [%s], which run %s replaced on %s\n", current, e.MessageId, e.RunId, e.Time)
+		current = e.MessageId
+		found = true
+	}
+	for current := id; ; {
+		e, ok := copyOf[current]
+		if !ok {
+			break
+		}
+		fmt.Printf("[%s] was replaced by copy [%s] in run %s on %s\n", current, e.CopyId, e.RunId, e.Time)
+		current = e.CopyId
+		found = true
+		if _, ok := copyOf[current]; !ok {
+			fmt.Printf("Latest copy: %s\n", messageLink(current))
+		}
+	}
+	for _, e := range inThread[id] {
+		fmt.Printf("[%s] is a thread in which [%s] was replaced by copy [%s] in run %s\n", id, e.MessageId, e.CopyId, e.RunId)
+		found = true
+	}
+	if found {
+		return
+	}
+
+	// The journal may be on another machine; a copy also names its original in a header.
+	opts.readOnly = true
+	mb := openMailbox(&opts)
+	defer mb.quota.printSummary()
+	m, err := mb.getMessage(id, "metadata")
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		exitf(exitNothingMatched, "Message [%s] is neither in the journal nor in the mailbox", id)
+	}
+	if err != nil {
+		exitf(exitCodeFor(err), "Unable to get message [%s]: %v", id, err)
+	}
+	if original := mimeutil.HeaderValue(m.Payload.Headers, originalIdHeader); original != "" {
+		fmt.Printf("[%s] is the copy of [%s], according to its %s header\n", id, original, originalIdHeader)
+		return
+	}
+	fmt.Printf("[%s] exists and hasn't been replaced: %s\n", id, messageLink(id))
+}
+
+// Gmail web link to message id.
+func messageLink(id string) string {
+	return "https://mail.google.com/mail/u/0/#all/" + id
+}
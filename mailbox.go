@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
+
+	"github.com/weineran/gmail-cleanup/cleaner"
+	"github.com/weineran/gmail-cleanup/internal/auth"
+	"github.com/weineran/gmail-cleanup/internal/gmailapi"
+	"github.com/weineran/gmail-cleanup/internal/mimeutil"
+)
+
+// Largest number of ids accepted by batchModify and batchDelete.
+const maxBatchSize = 1000
+
+// Options shared by every subcommand that talks to Gmail.
+type mailboxOptions struct {
+	profile     string
+	quotaBudget int64
+	quotaFile   string
+	// Scopes needed beyond Gmail, e.g. for the People API.
+	extraScopes []string
+	// The command only reads mail, so a read-only token will do.
+	readOnly    bool
+	waitForLock bool
+	// Authorize with Application Default Credentials instead of credentials.json and a token.
+	adc bool
+	// Keep the token encrypted with a passphrase, from tokenPassphraseCmd if not "".
+	encryptToken       bool
+	tokenPassphraseCmd string
+	// How requests reach Google, for corporate networks.
+	proxy               string
+	caCert              string
+	requestTimeout      time.Duration
+	maxIdleConnsPerHost int
+}
+
+func (o *mailboxOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.profile, "profile", "", "Account profile under profiles/ to use instead of token.json in the current directory")
+	fs.Int64Var(&o.quotaBudget, "quota-budget", 0, "Daily Gmail API quota budget in units, shared across runs (0 means no limit)")
+	fs.StringVar(&o.quotaFile, "quota-file", "", "File that tracks quota units used today across runs, per profile (default quota.json in the config directory)")
+	fs.BoolVar(&o.waitForLock, "wait-for-lock", false, "If another run is using the account, wait for it instead of exiting")
+	fs.BoolVar(&o.adc, "adc", false, "Authorize with Application Default Credentials (gcloud auth application-default login, or the attached service account on GCP) instead of credentials.json")
+	fs.BoolVar(&o.encryptToken, "encrypt-token", false, "Encrypt the token file with a passphrase, from $"+tokenPassphraseEnv+", --token-passphrase-cmd or a prompt; encrypted tokens are always read")
+	fs.StringVar(&o.tokenPassphraseCmd, "token-passphrase-cmd", "", `Command that prints the token passphrase, e.g. "pass show gmail-cleanup"`)
+	fs.StringVar(&o.proxy, "proxy", "", "Send requests through this proxy, e.g. http://proxy.example.com:3128, instead of the one in $HTTPS_PROXY")
+	fs.StringVar(&o.caCert, "ca-cert", "", "PEM file of CA certificates to trust besides the system's, e.g. of a proxy that inspects TLS")
+	fs.DurationVar(&o.requestTimeout, "request-timeout", 0, "Give up on a request after this long, including reading its response, e.g. 2m (0 means no limit)")
+	fs.IntVar(&o.maxIdleConnsPerHost, "max-idle-conns-per-host", defaultMaxIdleConnsPerHost, "Connections to keep open to each Google host for reuse, e.g. by --verify-workers")
+}
+
+// Thin wrapper around the Gmail API that charges every call against the quota tracker.
+type mailbox struct {
+	api   *gmailapi.Client
+	quota *quotaTracker
+	// The authorized client, for other Google APIs.
+	client *http.Client
+	// Message skeletons kept between runs, or nil.
+	cache *metadataCache
+	// Held for the rest of the process.
+	lock *profileLock
+	// The user's own addresses, once listed.
+	own map[string]bool
+}
+
+// Authorizes with the profile's credentials and returns a mailbox for its user.
+func openMailbox(opts *mailboxOptions) *mailbox {
+	ctx := context.Background()
+	lock, err := acquireProfileLock(opts.profile, opts.readOnly, opts.waitForLock)
+	if err != nil {
+		log.Fatalf("Unable to lock profile: %v", err)
+	}
+
+	base, err := opts.baseHTTPClient()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// The OAuth flows and the authorized client make their requests with base.
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, base)
+
+	// If modifying these scopes, delete your previously saved token files.
+	scopes := append([]string{gmail.GmailReadonlyScope, gmail.GmailInsertScope, gmail.MailGoogleComScope}, opts.extraScopes...)
+	var client *http.Client
+	if opts.adc {
+		client, err = google.DefaultClient(ctx, scopes...)
+		if err != nil {
+			exitf(exitAuth, "Unable to find Application Default Credentials: %v", err)
+		}
+		client = checkScopes(ctx, opts, client, nil)
+	} else {
+		b, err := ioutil.ReadFile(profileCredentialsFile(opts.profile))
+		if err != nil {
+			exitf(exitAuth, "Unable to read client secret file: %v", err)
+		}
+		config, err := google.ConfigFromJSON(b, scopes...)
+		if err != nil {
+			exitf(exitAuth, "Unable to parse client secret file to config: %v", err)
+		}
+		client, err = auth.Client(ctx, config, profileTokenFile(opts.profile), opts.tokenEncryption(), os.Stdin, os.Stdout)
+		if err != nil {
+			exitf(exitAuth, "Unable to authorize: %v%s", err, transportHint(err))
+		}
+		client = checkScopes(ctx, opts, client, config)
+	}
+	client.Timeout = opts.requestTimeout
+
+	service, err := gmail.NewService(ctx, option.WithHTTPClient(client))
+	if err != nil {
+		log.Fatalf("Unable to retrieve Gmail client: %v", err)
+	}
+
+	quota, err := newQuotaTracker(quotaFilePath(opts), opts.profile, opts.quotaBudget)
+	if err != nil {
+		log.Fatalf("Unable to read quota file: %v", err)
+	}
+
+	api := gmailapi.New(service)
+	api.User = "me"
+	api.HTTP = client
+	mb := &mailbox{api: api, quota: quota, client: client, lock: lock}
+	// Gmail charges retries too. Through mb, as migrate swaps in the other account's tracker.
+	api.Charge = func(method string) error { return mb.quota.charge(method) }
+	return mb
+}
+
+func (mb *mailbox) listMessages(query string) (*gmail.ListMessagesResponse, error) {
+	if err := mb.quota.charge("messages.list"); err != nil {
+		return nil, err
+	}
+	return mb.api.ListMessages(query, "", 0)
+}
+
+func (mb *mailbox) getMessage(id string, format string) (*gmail.Message, error) {
+	if err := mb.quota.charge("messages.get"); err != nil {
+		return nil, err
+	}
+	return mb.api.GetMessage(id, format)
+}
+
+// Gets message id in raw format and parses it locally into the structure of the full
+// format, with attachment bodies inline. Returns the raw message as well. The raw
+// message is decoded as it is downloaded rather than held as JSON and base64 first, but
+// it is held whole next to its parsed parts; getSpooledMessage doesn't hold either.
+func (mb *mailbox) getParsedMessage(id string) (*gmail.Message, []byte, error) {
+	if err := mb.quota.charge("messages.get"); err != nil {
+		return nil, nil, err
+	}
+	var buf bytes.Buffer
+	m, err := mb.api.GetRawMessage(id, &buf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("message [%s]: %w", id, err)
+	}
+	raw := buf.Bytes()
+	parsed, err := mimeutil.Parse(raw)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to parse message [%s]: %w", id, err)
+	}
+	parsed.Id, parsed.ThreadId, parsed.LabelIds = m.Id, m.ThreadId, m.LabelIds
+	parsed.InternalDate, parsed.SizeEstimate, parsed.Snippet, parsed.HistoryId = m.InternalDate, m.SizeEstimate, m.Snippet, m.HistoryId
+	return parsed, raw, nil
+}
+
+// Gets message id in raw format into a spool file as it is downloaded, and parses it
+// from there, leaving attachment bodies in the file. The caller closes the spool.
+func (mb *mailbox) getSpooledMessage(id string) (*gmail.Message, *mimeutil.Spool, error) {
+	if err := mb.quota.charge("messages.get"); err != nil {
+		return nil, nil, err
+	}
+	spool, err := mimeutil.NewSpool()
+	if err != nil {
+		return nil, nil, err
+	}
+	m, err := mb.api.GetRawMessage(id, spool)
+	if err != nil {
+		spool.Close()
+		return nil, nil, fmt.Errorf("message [%s]: %w", id, err)
+	}
+	parsed, err := spool.Parse()
+	if err != nil {
+		spool.Close()
+		return nil, nil, fmt.Errorf("Unable to parse message [%s]: %w", id, err)
+	}
+	parsed.Id, parsed.ThreadId, parsed.LabelIds = m.Id, m.ThreadId, m.LabelIds
+	parsed.InternalDate, parsed.SizeEstimate, parsed.Snippet, parsed.HistoryId = m.InternalDate, m.SizeEstimate, m.Snippet, m.HistoryId
+	return parsed, spool, nil
+}
+
+func (mb *mailbox) getAttachment(messageId string, attachmentId string) (*gmail.MessagePartBody, error) {
+	if err := mb.quota.charge("messages.attachments.get"); err != nil {
+		return nil, err
+	}
+	return mb.api.GetAttachment(messageId, attachmentId)
+}
+
+func (mb *mailbox) insertMessage(m *gmail.Message, internalDateSource string) (*gmail.Message, error) {
+	if err := mb.quota.charge("messages.insert"); err != nil {
+		return nil, err
+	}
+	return mb.api.InsertMessage(m, internalDateSource)
+}
+
+func (mb *mailbox) importMessage(m *gmail.Message, internalDateSource string) (*gmail.Message, error) {
+	if err := mb.quota.charge("messages.import"); err != nil {
+		return nil, err
+	}
+	return mb.api.ImportMessage(m, internalDateSource)
+}
+
+// Ways of adding a stripped copy to the mailbox.
+const (
+	insertMethodInsert = "insert"
+	insertMethodImport = "import"
+)
+
+const insertMethodUsage = "How copies are added: insert (Messages.Insert, stored as is, but Gmail occasionally re-classifies the copy) " +
+	"or import (Messages.Import with neverMarkSpam and processForCalendar=false, scanned like delivered mail but never sent to spam and never adding calendar events)"
+
+// Adds a copy with the given insert method, dated from its Date header.
+func (mb *mailbox) addCopy(m *gmail.Message, method string) (*gmail.Message, error) {
+	if method == insertMethodImport {
+		return mb.importMessage(m, "dateHeader")
+	}
+	return mb.insertMessage(m, "dateHeader")
+}
+
+// Adds the raw message source reads with the given insert method, dated from its Date
+// header, with the labels and thread of m. The message is streamed, so it is never held
+// in memory.
+func (mb *mailbox) addRaw(m *gmail.Message, raw gmailapi.RawSource, method string) (*gmail.Message, error) {
+	if method == insertMethodImport {
+		if err := mb.quota.charge("messages.import"); err != nil {
+			return nil, err
+		}
+		return mb.api.ImportRaw(m, raw, "dateHeader")
+	}
+	if err := mb.quota.charge("messages.insert"); err != nil {
+		return nil, err
+	}
+	return mb.api.InsertRaw(m, raw, "dateHeader")
+}
+
+func checkInsertMethod(method string) error {
+	if method != insertMethodInsert && method != insertMethodImport {
+		return fmt.Errorf("unknown --insert-method [%s], expected %s or %s", method, insertMethodInsert, insertMethodImport)
+	}
+	return nil
+}
+
+func (mb *mailbox) deleteMessage(id string) error {
+	if err := mb.quota.charge("messages.delete"); err != nil {
+		return err
+	}
+	return mb.api.DeleteMessage(id)
+}
+
+// Adds and removes labels on ids, split into batches of maxBatchSize.
+func (mb *mailbox) batchModify(ids []string, addLabelIds []string, removeLabelIds []string) error {
+	for start := 0; start < len(ids); start += maxBatchSize {
+		end := start + maxBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		if err := mb.quota.charge("messages.batchModify"); err != nil {
+			return err
+		}
+		if err := mb.api.BatchModify(ids[start:end], addLabelIds, removeLabelIds); err != nil {
+			return fmt.Errorf("batch %d-%d: %w", start, end, err)
+		}
+		log.Printf("Modified messages %d-%d of %d\n", start+1, end, len(ids))
+	}
+	return nil
+}
+
+// Permanently deletes ids, split into batches of maxBatchSize.
+func (mb *mailbox) batchDelete(ids []string) error {
+	for start := 0; start < len(ids); start += maxBatchSize {
+		end := start + maxBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		if err := mb.quota.charge("messages.batchDelete"); err != nil {
+			return err
+		}
+		if err := mb.api.BatchDelete(ids[start:end]); err != nil {
+			return fmt.Errorf("batch %d-%d: %w", start, end, err)
+		}
+		log.Printf("Deleted messages %d-%d of %d\n", start+1, end, len(ids))
+	}
+	return nil
+}
+
+func (mb *mailbox) trashMessage(id string) (*gmail.Message, error) {
+	if err := mb.quota.charge("messages.trash"); err != nil {
+		return nil, err
+	}
+	return mb.api.TrashMessage(id)
+}
+
+func (mb *mailbox) untrashMessage(id string) (*gmail.Message, error) {
+	if err := mb.quota.charge("messages.untrash"); err != nil {
+		return nil, err
+	}
+	return mb.api.UntrashMessage(id)
+}
+
+func (mb *mailbox) modifyMessage(id string, addLabelIds []string, removeLabelIds []string) (*gmail.Message, error) {
+	if err := mb.quota.charge("messages.modify"); err != nil {
+		return nil, err
+	}
+	return mb.api.ModifyMessage(id, addLabelIds, removeLabelIds)
+}
+
+func (mb *mailbox) createDraft(m *gmail.Message) (*gmail.Draft, error) {
+	if err := mb.quota.charge("drafts.create"); err != nil {
+		return nil, err
+	}
+	return mb.api.CreateDraft(m)
+}
+
+// Follows NextPageToken until every draft has been listed.
+func (mb *mailbox) listAllDrafts() ([]*gmail.Draft, error) {
+	var drafts []*gmail.Draft
+	pageToken := ""
+	for {
+		if err := mb.quota.charge("drafts.list"); err != nil {
+			return drafts, err
+		}
+		r, err := mb.api.ListDrafts(pageToken, 500)
+		if err != nil {
+			return drafts, err
+		}
+		drafts = append(drafts, r.Drafts...)
+		if r.NextPageToken == "" {
+			return drafts, nil
+		}
+		pageToken = r.NextPageToken
+	}
+}
+
+func (mb *mailbox) getDraft(id string, format string) (*gmail.Draft, error) {
+	if err := mb.quota.charge("drafts.get"); err != nil {
+		return nil, err
+	}
+	return mb.api.GetDraft(id, format)
+}
+
+func (mb *mailbox) deleteDraft(id string) error {
+	if err := mb.quota.charge("drafts.delete"); err != nil {
+		return err
+	}
+	return mb.api.DeleteDraft(id)
+}
+
+func (mb *mailbox) getThread(id string, format string) (*gmail.Thread, error) {
+	if err := mb.quota.charge("threads.get"); err != nil {
+		return nil, err
+	}
+	return mb.api.GetThread(id, format)
+}
+
+func (mb *mailbox) modifyThread(id string, addLabelIds []string, removeLabelIds []string) (*gmail.Thread, error) {
+	if err := mb.quota.charge("threads.modify"); err != nil {
+		return nil, err
+	}
+	return mb.api.ModifyThread(id, addLabelIds, removeLabelIds)
+}
+
+func (mb *mailbox) listLabels() ([]*gmail.Label, error) {
+	if err := mb.quota.charge("labels.list"); err != nil {
+		return nil, err
+	}
+	return mb.api.ListLabels()
+}
+
+func (mb *mailbox) createLabel(label *gmail.Label) (*gmail.Label, error) {
+	if err := mb.quota.charge("labels.create"); err != nil {
+		return nil, err
+	}
+	return mb.api.InsertLabel(label)
+}
+
+func (mb *mailbox) patchLabel(id string, label *gmail.Label) (*gmail.Label, error) {
+	if err := mb.quota.charge("labels.patch"); err != nil {
+		return nil, err
+	}
+	return mb.api.PatchLabel(id, label)
+}
+
+// Returns the id of the user label called name, creating it if needed.
+func (mb *mailbox) ensureLabel(name string) (string, error) {
+	labels, err := mb.listLabels()
+	if err != nil {
+		return "", err
+	}
+	for _, label := range labels {
+		if label.Name == name {
+			return label.Id, nil
+		}
+	}
+
+	if err := mb.quota.charge("labels.create"); err != nil {
+		return "", err
+	}
+	label, err := mb.api.CreateLabel(name)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Created label [%s]\n", name)
+	return label.Id, nil
+}
+
+// Returns a library Cleaner for this mailbox that charges the quota tracker.
+func (mb *mailbox) cleaner() *cleaner.Cleaner {
+	c := cleaner.New(mb.api.Service)
+	c.User = mb.api.User
+	c.Charge = mb.quota.charge
+	return c
+}
+
+func (mb *mailbox) getProfile() (*gmail.Profile, error) {
+	if err := mb.quota.charge("getProfile"); err != nil {
+		return nil, err
+	}
+	return mb.api.GetProfile()
+}
+
+func (mb *mailbox) listSendAs() ([]*gmail.SendAs, error) {
+	if err := mb.quota.charge("settings.sendAs.list"); err != nil {
+		return nil, err
+	}
+	return mb.api.ListSendAs()
+}
+
+// Returns the user's own addresses, lowercased: the account's and its send-as aliases,
+// so that mail sent from an alias, such as a backup mailed to oneself, counts as from
+// the user rather than from someone else.
+func (mb *mailbox) ownAddresses() (map[string]bool, error) {
+	if mb.own != nil {
+		return mb.own, nil
+	}
+	profile, err := mb.getProfile()
+	if err != nil {
+		return nil, err
+	}
+	aliases, err := mb.listSendAs()
+	if err != nil {
+		return nil, err
+	}
+	own := map[string]bool{strings.ToLower(profile.EmailAddress): true}
+	for _, a := range aliases {
+		own[strings.ToLower(a.SendAsEmail)] = true
+	}
+	mb.own = own
+	return own, nil
+}
+
+func (mb *mailbox) listHistory(startHistoryId uint64, pageToken string) (*gmail.ListHistoryResponse, error) {
+	if err := mb.quota.charge("history.list"); err != nil {
+		return nil, err
+	}
+	return mb.api.ListHistory(startHistoryId, pageToken)
+}
+
+// Returns the message in full format without body data, from the metadata cache
+// when one is open and holds it.
+func (mb *mailbox) getMessageSkeleton(id string) (*gmail.Message, error) {
+	if mb.cache != nil {
+		if m, err := mb.cache.get(id); err != nil || m != nil {
+			return m, err
+		}
+	}
+
+	if err := mb.quota.charge("messages.get"); err != nil {
+		return nil, err
+	}
+	m, err := mb.api.GetMessageStructure(id)
+	if err != nil {
+		return nil, err
+	}
+	// Parts nested deeper than the structure leaves out come with their bodies.
+	stripBodyData(m.Payload)
+	if mb.cache != nil {
+		if err := mb.cache.put(m); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
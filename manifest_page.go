@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"html/template"
+	"io/ioutil"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+
+	"github.com/weineran/gmail-cleanup/internal/mimeutil"
+	"github.com/weineran/gmail-cleanup/transform"
+)
+
+// An HTML page listing every attachment archived during one run. Rewritten messages
+// carry a single link to it, which keeps them small however many attachments they had.
+type manifestPage struct {
+	dir      string
+	path     string
+	url      string
+	baseURL  string
+	created  time.Time
+	messages []manifestPageMessage
+	// When set, the page is uploaded there too and links to it and to the attachments
+	// in it are signed to expire after expiry.
+	remote *s3StoreFS
+	expiry time.Duration
+}
+
+type manifestPageMessage struct {
+	Id          string
+	From        string
+	Subject     string
+	Date        string
+	Attachments []manifestPageAttachment
+}
+
+type manifestPageAttachment struct {
+	Filename string
+	SafeName string
+	Size     int64
+	SHA256   string
+	Link     string
+}
+
+var manifestPageTemplate = template.Must(template.New("manifest").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Archived attachments {{.Created}}</title></head>
+<body>
+<h1>Attachments archived by gmail-cleanup on {{.Created}}</h1>
+{{range .Messages}}
+<h2 id="{{.Id}}">{{.Subject}}</h2>
+<p>From {{.From}}, {{.Date}}</p>
+<ul>
+{{range .Attachments}}<li><a href="{{.Link}}" download="{{.SafeName}}">{{.Filename}}</a> ({{.Size}} bytes, SHA-256 {{.SHA256}})</li>
+{{end}}</ul>
+{{end}}
+</body>
+</html>
+`))
+
+// The page is written to archiveDir/manifests/. Links are relative to baseURL, or
+// file:// URLs into archiveDir when baseURL is empty.
+func newManifestPage(archiveDir string, baseURL string, created time.Time) *manifestPage {
+	name := "manifest-" + newRunId(created) + ".html"
+	p := &manifestPage{
+		dir:     archiveDir,
+		path:    filepath.Join(archiveDir, "manifests", name),
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		created: created,
+	}
+	p.url = p.link(p.path, "")
+	return p
+}
+
+// Uploads the page to s's bucket, so that it can be opened from anywhere, with links
+// that stop working after expiry.
+func (p *manifestPage) rehost(s *s3StoreFS, expiry time.Duration) {
+	p.remote = s
+	p.expiry = expiry
+	p.url = s.presign(s.key(p.remoteName()), expiry, url.Values{"response-content-type": {"text/html; charset=utf-8"}})
+}
+
+func (p *manifestPage) remoteName() string {
+	return "manifests/" + filepath.Base(p.path)
+}
+
+// Returns a link to the file at path, which downloads it as name if it is in the
+// remote bucket.
+func (p *manifestPage) link(path string, name string) string {
+	if p.remote != nil {
+		if key, ok := p.remote.keyAt(path); ok {
+			disposition := mime.FormatMediaType("attachment", map[string]string{"filename": name})
+			return p.remote.presign(key, p.expiry, url.Values{"response-content-disposition": {disposition}})
+		}
+	}
+	if strings.Contains(path, "://") {
+		// Already a URL, e.g. for attachments stored over SFTP.
+		return path
+	}
+	if p.baseURL == "" {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			abs = path
+		}
+		return (&url.URL{Scheme: "file", Path: filepath.ToSlash(abs)}).String()
+	}
+	rel, err := filepath.Rel(p.dir, path)
+	if err != nil {
+		rel = filepath.Base(path)
+	}
+	var segments []string
+	for _, s := range strings.Split(filepath.ToSlash(rel), "/") {
+		segments = append(segments, url.PathEscape(s))
+	}
+	return p.baseURL + "/" + strings.Join(segments, "/")
+}
+
+// Adds a message's archived attachments and rewrites the page.
+func (p *manifestPage) add(m *gmail.Message, archived []archivedAttachment) error {
+	entry := manifestPageMessage{
+		Id:      m.Id,
+		From:    mimeutil.HeaderValue(m.Payload.Headers, "From"),
+		Subject: mimeutil.HeaderValue(m.Payload.Headers, "Subject"),
+		Date:    messageDate(m).Format("2006-01-02"),
+	}
+	for _, a := range archived {
+		entry.Attachments = append(entry.Attachments, manifestPageAttachment{
+			Filename: a.Filename,
+			SafeName: a.SafeName,
+			Size:     a.Size,
+			SHA256:   a.SHA256,
+			Link:     p.link(a.Location, a.SafeName),
+		})
+	}
+	p.messages = append(p.messages, entry)
+
+	var b bytes.Buffer
+	err := manifestPageTemplate.Execute(&b, struct {
+		Created  string
+		Messages []manifestPageMessage
+	}{p.created.Format("2006-01-02 15:04"), p.messages})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p.path), 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(p.path, b.Bytes(), 0600); err != nil {
+		return err
+	}
+	if p.remote != nil {
+		return p.remote.writeFile(p.remoteName(), b.Bytes())
+	}
+	return nil
+}
+
+// Appends a link to the message's entry on the page to the first text/plain and
+// text/html bodies of each rewritten message.
+func (p *manifestPage) linkTransformer() transform.Transformer {
+	return transform.Func(func(m *transform.ParsedMessage) error {
+		link := p.url + "#" + m.Original.Id
+		var doneText, doneHTML bool
+		for _, part := range m.Parts() {
+			if part.Filename != "" || part.Body == nil || part.Body.Data == "" {
+				continue
+			}
+			body, err := transform.Body(part)
+			if err != nil {
+				return err
+			}
+			switch {
+			case part.MimeType == "text/plain" && !doneText:
+				body = append(body, fmt.Sprintf("\r\n\r\n[%s %s: %s]\r\n", tr("Attachments removed by gmail-cleanup."), tr("Archived copies"), link)...)
+				doneText = true
+			case part.MimeType == "text/html" && !doneHTML:
+				note := fmt.Sprintf(`<p>[%s <a href="%s">%s</a>]</p>`, html.EscapeString(tr("Attachments removed by gmail-cleanup.")),
+					html.EscapeString(link), html.EscapeString(tr("Archived copies")))
+				body = insertBeforeBodyEnd(body, note)
+				doneHTML = true
+			default:
+				continue
+			}
+			transform.SetBody(part, body)
+		}
+		return nil
+	})
+}
+
+// Inserts s before </body>, or appends it when there is none.
+func insertBeforeBodyEnd(body []byte, s string) []byte {
+	i := bytes.LastIndex(bytes.ToLower(body), []byte("</body>"))
+	if i < 0 {
+		return append(body, s...)
+	}
+	out := make([]byte, 0, len(body)+len(s))
+	out = append(out, body[:i]...)
+	out = append(out, s...)
+	return append(out, body[i:]...)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+
+	"github.com/weineran/gmail-cleanup/cleaner"
+	"github.com/weineran/gmail-cleanup/internal/mimeutil"
+)
+
+// Maps the label ids of a source account to those of a destination account, creating
+// the destination's user labels as needed with the source's colors and visibility.
+type labelMapper struct {
+	dst *mailbox
+	// The source's labels by id.
+	source map[string]*gmail.Label
+	// The destination's label ids by name.
+	names map[string]string
+}
+
+func newLabelMapper(src *mailbox, dst *mailbox) (*labelMapper, error) {
+	m := &labelMapper{dst: dst, source: map[string]*gmail.Label{}, names: map[string]string{}}
+	labels, err := src.listLabels()
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range labels {
+		m.source[l.Id] = l
+	}
+	labels, err = dst.listLabels()
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range labels {
+		m.names[l.Name] = l.Id
+	}
+	return m, nil
+}
+
+// Returns the destination ids of the source's label ids. System labels such as INBOX
+// and UNREAD have the same ids in every account.
+func (m *labelMapper) ids(sourceIds []string) ([]string, error) {
+	var ids []string
+	for _, id := range sourceIds {
+		l, ok := m.source[id]
+		if !ok || l.Type != "user" {
+			ids = append(ids, id)
+			continue
+		}
+		dstId, err := m.ensure(l)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create label [%s]: %w", l.Name, err)
+		}
+		ids = append(ids, dstId)
+	}
+	return ids, nil
+}
+
+// Returns the id of the destination label named like l, creating it and any missing
+// parents, so nested labels stay nested.
+func (m *labelMapper) ensure(l *gmail.Label) (string, error) {
+	if id, ok := m.names[l.Name]; ok {
+		return id, nil
+	}
+	if i := strings.LastIndex(l.Name, "/"); i > 0 {
+		if _, err := m.ensure(&gmail.Label{Name: l.Name[:i]}); err != nil {
+			return "", err
+		}
+	}
+	created, err := m.dst.createLabel(newExportedLabel(l).label())
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Created label [%s]\n", l.Name)
+	m.names[l.Name] = created.Id
+	return created.Id, nil
+}
+
+// Copies the messages matching a query, raw and with their labels, into another
+// profile's account, and optionally trashes them here: cleanup by relocation.
+func runMigrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	var opts mailboxOptions
+	opts.register(fs)
+	toProfile := fs.String("to-profile", "", "Profile of the account to copy messages into")
+	query := fs.String("query", "", `Messages to copy, e.g. "label:projects/old"`)
+	insertMethod := fs.String("insert-method", insertMethodInsert, insertMethodUsage)
+	deleteSource := fs.Bool("delete-source", false, "Move each message to the trash here once it is in the other account")
+	dryRun := fs.Bool("dry-run", false, "Only count the messages that would be copied")
+	assumeYes := fs.Bool("yes", false, "Copy without asking")
+	limit := registerDestructiveLimit(fs)
+	parseFlags(fs, args)
+	if *toProfile == "" || *query == "" {
+		log.Fatal(`Usage: gmail-cleanup migrate --to-profile NAME --query "label:projects/old" [--delete-source]`)
+	}
+	if *toProfile == opts.profile {
+		log.Fatal("--to-profile is the profile being migrated from")
+	}
+	if err := checkInsertMethod(*insertMethod); err != nil {
+		log.Fatal(err)
+	}
+
+	opts.readOnly = !*deleteSource
+	src := openMailbox(&opts)
+	defer src.quota.printSummary()
+	messages, err := cleaner.Collect(src.cleaner().List(context.Background(), *query))
+	if err != nil {
+		exitf(exitCodeFor(err), "Unable to list messages: %v", err)
+	}
+	fmt.Printf("Count: %+v\n", len(messages))
+	if len(messages) == 0 {
+		fmt.Println("No messages found.")
+		return
+	}
+	if *dryRun {
+		fmt.Printf("Dry run: would copy %d messages to profile [%s].\n", len(messages), *toProfile)
+		return
+	}
+	question := fmt.Sprintf("Do you want to copy these %d messages to profile [%s]?", len(messages), *toProfile)
+	if *deleteSource {
+		limit.check(opts.profile, len(messages))
+		question = fmt.Sprintf("Do you want to copy these %d messages to profile [%s] and trash them here?", len(messages), *toProfile)
+	}
+	if !*assumeYes && !askYesNo(question) {
+		log.Println("Nothing copied.")
+		return
+	}
+
+	dstOpts := opts
+	dstOpts.profile = *toProfile
+	dstOpts.readOnly = false
+	dst := openMailbox(&dstOpts)
+	// Both accounts' calls count against the same budget and quota file.
+	dst.quota = src.quota
+	labels, err := newLabelMapper(src, dst)
+	if err != nil {
+		exitf(exitCodeFor(err), "Unable to list labels: %v", err)
+	}
+
+	journal := newRunJournal(opts.profile, newRunId(time.Now()))
+	var copied, present, trashed int
+	for _, msg := range messages {
+		result, err := migrateMessage(src, dst, labels, journal, msg.Id, *insertMethod, *deleteSource)
+		if err != nil {
+			exitf(exitCodeFor(err), "Unable to migrate message [%s] after %d copied: %v", msg.Id, copied, err)
+		}
+		switch result {
+		case migrateCopied:
+			copied++
+		case migratePresent:
+			present++
+		}
+		if result != migrateSkipped && *deleteSource {
+			trashed++
+		}
+	}
+	fmt.Printf("Copied %d messages to profile [%s], %d were already there.\n", copied, *toProfile, present)
+	if *deleteSource {
+		fmt.Printf("Trashed %d messages here; untrash recovers them for 30 days.\n", trashed)
+	}
+}
+
+// What migrateMessage did with a message.
+const (
+	migrateCopied  = "copied"
+	migratePresent = "already there"
+	migrateSkipped = "skipped"
+)
+
+// Copies message id from src into dst unless a message with its Message-ID is there
+// already, e.g. from an interrupted run, then trashes it in src if deleteSource.
+func migrateMessage(src *mailbox, dst *mailbox, labels *labelMapper, journal *runJournal, id string, insertMethod string, deleteSource bool) (string, error) {
+	m, raw, err := src.getParsedMessage(id)
+	if err != nil {
+		return "", err
+	}
+	if isChatMessage(m.LabelIds) {
+		skipChatMessage(id)
+		return migrateSkipped, nil
+	}
+	if hasLabel(m, "DRAFT") {
+		log.Printf("Message [%s] is a draft, skipping.\n", id)
+		return migrateSkipped, nil
+	}
+
+	result := migrateCopied
+	var existing []*gmail.Message
+	if messageId := mimeutil.HeaderValue(m.Payload.Headers, "Message-ID"); messageId != "" {
+		existing, err = cleaner.Collect(dst.cleaner().List(context.Background(), "in:anywhere rfc822msgid:"+strings.Trim(messageId, "<>")))
+		if err != nil {
+			return "", err
+		}
+	}
+	if len(existing) > 0 {
+		log.Printf("Message [%s] is already there as [%s]\n", id, existing[0].Id)
+		result = migratePresent
+	} else {
+		labelIds, err := labels.ids(m.LabelIds)
+		if err != nil {
+			return "", err
+		}
+		source := func() (io.ReadCloser, error) { return ioutil.NopCloser(bytes.NewReader(raw)), nil }
+		added, err := dst.addRaw(&gmail.Message{LabelIds: labelIds}, source, insertMethod)
+		if err != nil {
+			return "", fmt.Errorf("Unable to add copy: %w", err)
+		}
+		log.Printf("Copied message [%s] as [%s]\n", id, added.Id)
+	}
+
+	if deleteSource {
+		if err := journal.record(newJournalEntry(journalTrashed, m)); err != nil {
+			return "", fmt.Errorf("Unable to write journal: %w", err)
+		}
+		if _, err := src.trashMessage(id); err != nil {
+			return "", fmt.Errorf("Unable to trash message: %w", err)
+		}
+	}
+	return result, nil
+}
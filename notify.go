@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// Where alerts are sent: a webhook, a message to yourself, or a desktop notification.
+type notifier struct {
+	// "webhook", "email" or "desktop".
+	kind string
+	// The URL, for webhooks.
+	url string
+}
+
+// Parses --notify: webhook:URL, email or desktop.
+func parseNotifier(spec string) (*notifier, error) {
+	switch {
+	case strings.HasPrefix(spec, "webhook:"):
+		url := strings.TrimPrefix(spec, "webhook:")
+		if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			return nil, fmt.Errorf("--notify [%s]: expected webhook:https://...", spec)
+		}
+		return &notifier{kind: "webhook", url: url}, nil
+	case spec == "email" || spec == "desktop":
+		return &notifier{kind: spec}, nil
+	}
+	return nil, fmt.Errorf("unknown --notify [%s], expected webhook:URL, email or desktop", spec)
+}
+
+// Sends subject and body. Email goes to the mailbox's own inbox, unread.
+func (n *notifier) notify(mb *mailbox, subject string, body string) error {
+	switch n.kind {
+	case "webhook":
+		return postWebhook(n.url, subject, body)
+	case "email":
+		return emailSelf(mb, subject, body)
+	}
+	return notifyDesktop(subject, body)
+}
+
+// Posts a JSON payload that Slack ("text"), Discord ("content") and generic receivers
+// ("subject" and "body") all understand.
+func postWebhook(url string, subject string, body string) error {
+	return postJSON(url, webhookPayload(subject, body))
+}
+
+func webhookPayload(subject string, body string) map[string]interface{} {
+	text := subject + "\n" + body
+	return map[string]interface{}{"text": text, "content": text, "subject": subject, "body": body}
+}
+
+func postJSON(url string, payload interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Posts s to url, with the summary as text and, under "summary", as JSON.
+func notifyRunSummary(url string, s *runSummary) {
+	subject := fmt.Sprintf("gmail-cleanup run finished: %s", s.Status)
+	if s.Profile != "" {
+		subject = fmt.Sprintf("gmail-cleanup run for %s finished: %s", s.Profile, s.Status)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Matched %d, stripped %d, trashed %d, skipped %d, failed %d\n", s.Matched,
+		s.Outcomes[outcomeStripped]+s.Outcomes[outcomeKept], s.Outcomes[outcomeTrashed], s.Outcomes[outcomeSkipped], s.Outcomes[outcomeFailed])
+	fmt.Fprintf(&b, "Reclaimed about %s\n", formatBytes(s.ReclaimedBytes))
+	if s.VerifiedReclaimedBytes != nil {
+		fmt.Fprintf(&b, "Verified: %s reclaimed, %d replacements freed less than expected\n", formatBytes(*s.VerifiedReclaimedBytes), len(s.LowSavings))
+	}
+	if s.Stopped != "" {
+		fmt.Fprintf(&b, "Stopped early: %s\n", s.Stopped)
+	}
+	for i, e := range s.Errors {
+		if i == 5 {
+			fmt.Fprintf(&b, "... and %d more errors\n", len(s.Errors)-i)
+			break
+		}
+		fmt.Fprintf(&b, "* %s: %s\n", e.MessageId, e.Error)
+	}
+	payload := webhookPayload(subject, b.String())
+	payload["summary"] = s
+	if err := postJSON(url, payload); err != nil {
+		log.Printf("Unable to post run summary to webhook: %v\n", err)
+	}
+}
+
+// Inserts a message from and to the account into its inbox; inserting needs no send scope.
+func emailSelf(mb *mailbox, subject string, body string) error {
+	profile, err := mb.getProfile()
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: gmail-cleanup <%s>\r\n", profile.EmailAddress)
+	fmt.Fprintf(&b, "To: %s\r\n", profile.EmailAddress)
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("Content-Type: text/plain; charset=\"UTF-8\"\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	m := &gmail.Message{Raw: base64.URLEncoding.EncodeToString([]byte(b.String())), LabelIds: []string{"INBOX", "UNREAD"}}
+	_, err = mb.insertMessage(m, "receivedTime")
+	return err
+}
+
+func notifyDesktop(subject string, body string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("osascript", "-e", fmt.Sprintf("display notification %q with title %q", body, subject))
+	case "windows":
+		cmd = exec.Command("msg", "*", subject+"\n"+body)
+	default:
+		cmd = exec.Command("notify-send", subject, body)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w: %s", cmd.Path, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+
+	"github.com/weineran/gmail-cleanup/transform"
+)
+
+// The largest message Messages.Insert and Messages.Import take.
+const maxInsertSize = 50 << 20
+
+// Removes the text/html part of each multipart/alternative that also has a text/plain
+// part, leaving the plain text.
+type htmlAlternativeDropper struct{}
+
+func (htmlAlternativeDropper) Transform(m *transform.ParsedMessage) error {
+	for _, part := range m.Parts() {
+		if !strings.EqualFold(part.MimeType, "multipart/alternative") {
+			continue
+		}
+		hasPlain := false
+		for _, subpart := range part.Parts {
+			hasPlain = hasPlain || strings.EqualFold(subpart.MimeType, "text/plain")
+		}
+		if !hasPlain {
+			continue
+		}
+		var kept []*gmail.MessagePart
+		for _, subpart := range part.Parts {
+			if !strings.EqualFold(subpart.MimeType, "text/html") {
+				kept = append(kept, subpart)
+			}
+		}
+		part.Parts = kept
+	}
+	return nil
+}
+
+// Returns newMsg, or if it is too big to insert, a copy of m rebuilt without HTML
+// alternatives and quoted history, with a warning, closing newMsg. Fails if even that is
+// too big.
+func fitInsertSize(m *gmail.Message, newMsg *messageCopy, fetched []fetchedAttachment, transformers []transform.Transformer) (*messageCopy, error) {
+	size := newMsg.size()
+	if size <= maxInsertSize {
+		return newMsg, nil
+	}
+	newMsg.close()
+	log.Printf("Warning: the copy of message [%s] is %s, over Gmail's insert limit of %s; dropping HTML alternatives and quoted history.\n",
+		m.Id, formatBytes(size), formatBytes(maxInsertSize))
+	smaller, err := buildCopy(m, fetched, append(transformers[:len(transformers):len(transformers)], htmlAlternativeDropper{}, quoteStripper{}))
+	if err != nil {
+		return nil, err
+	}
+	if size := smaller.size(); size > maxInsertSize {
+		smaller.close()
+		return nil, fmt.Errorf("the copy is %s even without HTML alternatives and quoted history, over Gmail's insert limit of %s",
+			formatBytes(size), formatBytes(maxInsertSize))
+	}
+	return smaller, nil
+}
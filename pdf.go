@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/weineran/gmail-cleanup/transform"
+)
+
+// Keeps PDF attachments as versions recompressed by Ghostscript instead of removing
+// them, if that makes them at least minSavings percent smaller.
+type pdfRecompressor struct {
+	ghostscript string
+	settings    string
+	minSavings  int
+}
+
+func (r *pdfRecompressor) Transform(m *transform.ParsedMessage) error {
+	for _, part := range m.Parts() {
+		if !m.Downloaded(part) || !isPDF(part.MimeType, part.Filename) {
+			continue
+		}
+		data, _, err := m.Attachment(part)
+		if err != nil {
+			return fmt.Errorf("reading [%s]: %w", part.Filename, err)
+		}
+
+		smaller, err := r.recompress(data)
+		if err != nil {
+			log.Printf("Unable to recompress [%s], removing it instead: %v\n", part.Filename, err)
+			continue
+		}
+		if int64(len(smaller))*100 > int64(len(data))*int64(100-r.minSavings) {
+			log.Printf("Recompressing [%s] saves less than %d%%, removing it instead.\n", part.Filename, r.minSavings)
+			continue
+		}
+
+		log.Printf("Recompressed [%s] from %s to %s\n", part.Filename, formatBytes(int64(len(data))), formatBytes(int64(len(smaller))))
+		transform.SetBody(part, smaller)
+		part.Body.AttachmentId = ""
+		m.Keep(part)
+	}
+	return nil
+}
+
+func (r *pdfRecompressor) recompress(data []byte) ([]byte, error) {
+	dir, err := ioutil.TempDir("", "gmail-cleanup-pdf")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	in := filepath.Join(dir, "in.pdf")
+	out := filepath.Join(dir, "out.pdf")
+	if err := ioutil.WriteFile(in, data, 0600); err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(r.ghostscript, "-q", "-dNOPAUSE", "-dBATCH", "-dSAFER",
+		"-sDEVICE=pdfwrite", "-dCompatibilityLevel=1.4", "-dPDFSETTINGS=/"+r.settings,
+		"-sOutputFile="+out, in)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", r.ghostscript, err, strings.TrimSpace(string(output)))
+	}
+	return ioutil.ReadFile(out)
+}
+
+func isPDF(mimeType string, filename string) bool {
+	return strings.EqualFold(mimeType, "application/pdf") ||
+		strings.EqualFold(filepath.Ext(filename), ".pdf")
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+
+	"github.com/weineran/gmail-cleanup/internal/mimeutil"
+)
+
+// Lets the tool upload to Google Photos and create albums, but not see anything else there.
+const photosAppendOnlyScope = "https://www.googleapis.com/auth/photoslibrary.appendonly"
+
+const photosAPI = "https://photoslibrary.googleapis.com/v1"
+
+// How --photos-album groups uploads.
+const (
+	photosAlbumYear   = "year"
+	photosAlbumSender = "sender"
+)
+
+// What the uploader remembers between runs: the albums it created, since it can't list
+// them with the append-only scope, and what it uploaded, so retries don't upload twice.
+type photosState struct {
+	// Album ids by title.
+	Albums map[string]string `json:"albums"`
+	// Media item ids by hex SHA-256 of the content.
+	Uploaded map[string]string `json:"uploaded"`
+}
+
+// Uploads image and video attachments to Google Photos before they are stripped, for
+// --upload-photos, into an album per year or per sender.
+type photosUploader struct {
+	client    *http.Client
+	albumBy   string
+	statePath string
+	state     photosState
+}
+
+func newPhotosUploader(client *http.Client, profile string, albumBy string) (*photosUploader, error) {
+	if albumBy != photosAlbumYear && albumBy != photosAlbumSender {
+		return nil, fmt.Errorf("unknown --photos-album [%s], expected %s or %s", albumBy, photosAlbumYear, photosAlbumSender)
+	}
+	u := &photosUploader{client: client, albumBy: albumBy, statePath: profilePath(profile, "photos.json")}
+	if err := readJSON(u.statePath, &u.state); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if u.state.Albums == nil {
+		u.state.Albums = map[string]string{}
+	}
+	if u.state.Uploaded == nil {
+		u.state.Uploaded = map[string]string{}
+	}
+	return u, nil
+}
+
+// Returns the MIME type of an attachment if Google Photos takes it, or "".
+func photoMimeType(part *gmail.MessagePart) string {
+	t := strings.ToLower(part.MimeType)
+	if !strings.HasPrefix(t, "image/") && !strings.HasPrefix(t, "video/") {
+		t, _, _ = mime.ParseMediaType(mime.TypeByExtension(strings.ToLower(filepath.Ext(mimeutil.DecodeFilename(part.Filename)))))
+	}
+	if strings.HasPrefix(t, "image/") || strings.HasPrefix(t, "video/") {
+		return t
+	}
+	return ""
+}
+
+// Uploads the photos and videos among attachments of m, and returns how many were added.
+func (u *photosUploader) upload(m *gmail.Message, attachments []fetchedAttachment) (int, error) {
+	type newMediaItem struct {
+		Description     string `json:"description"`
+		SimpleMediaItem struct {
+			UploadToken string `json:"uploadToken"`
+			FileName    string `json:"fileName"`
+		} `json:"simpleMediaItem"`
+	}
+	var items []newMediaItem
+	var hashes []string
+	from := mimeutil.HeaderValue(m.Payload.Headers, "From")
+	for _, a := range attachments {
+		mimeType := photoMimeType(a.part)
+		if mimeType == "" {
+			continue
+		}
+		data, err := a.data()
+		if err != nil {
+			return 0, err
+		}
+		sum := sha256.Sum256(data)
+		hash := hex.EncodeToString(sum[:])
+		if _, ok := u.state.Uploaded[hash]; ok {
+			continue
+		}
+		token, err := u.uploadBytes(data, mimeType)
+		if err != nil {
+			return 0, fmt.Errorf("uploading [%s]: %w", a.part.Filename, err)
+		}
+		var item newMediaItem
+		item.Description = fmt.Sprintf("From %s: %s", from, mimeutil.HeaderValue(m.Payload.Headers, "Subject"))
+		item.SimpleMediaItem.UploadToken = token
+		item.SimpleMediaItem.FileName = mimeutil.DecodeFilename(a.part.Filename)
+		items = append(items, item)
+		hashes = append(hashes, hash)
+	}
+	if len(items) == 0 {
+		return 0, nil
+	}
+
+	albumId, err := u.album(m)
+	if err != nil {
+		return 0, err
+	}
+	var resp struct {
+		NewMediaItemResults []struct {
+			Status struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			} `json:"status"`
+			MediaItem struct {
+				Id string `json:"id"`
+			} `json:"mediaItem"`
+		} `json:"newMediaItemResults"`
+	}
+	if err := u.post("/mediaItems:batchCreate", map[string]interface{}{"albumId": albumId, "newMediaItems": items}, &resp); err != nil {
+		return 0, err
+	}
+	added := 0
+	var failed []string
+	for i, r := range resp.NewMediaItemResults {
+		if r.Status.Code != 0 || r.MediaItem.Id == "" {
+			failed = append(failed, fmt.Sprintf("%s: %s", items[i].SimpleMediaItem.FileName, r.Status.Message))
+			continue
+		}
+		u.state.Uploaded[hashes[i]] = r.MediaItem.Id
+		added++
+	}
+	if err := writeJSONAtomic(u.statePath, u.state); err != nil {
+		return added, err
+	}
+	if len(failed) > 0 {
+		return added, fmt.Errorf("Google Photos didn't add %s", strings.Join(failed, ", "))
+	}
+	return added, nil
+}
+
+// Returns the id of the album for m, creating it the first time.
+func (u *photosUploader) album(m *gmail.Message) (string, error) {
+	title := fmt.Sprintf("Photos from email, %d", messageDate(m).Year())
+	if u.albumBy == photosAlbumSender {
+		title = "Photos from " + senderAddress(mimeutil.HeaderValue(m.Payload.Headers, "From"))
+	}
+	if id, ok := u.state.Albums[title]; ok {
+		return id, nil
+	}
+	var album struct {
+		Id string `json:"id"`
+	}
+	if err := u.post("/albums", map[string]interface{}{"album": map[string]string{"title": title}}, &album); err != nil {
+		return "", fmt.Errorf("creating album [%s]: %w", title, err)
+	}
+	log.Printf("Created Google Photos album [%s]\n", title)
+	u.state.Albums[title] = album.Id
+	return album.Id, writeJSONAtomic(u.statePath, u.state)
+}
+
+// Uploads data and returns the token that adds it to the library.
+func (u *photosUploader) uploadBytes(data []byte, mimeType string) (string, error) {
+	req, err := http.NewRequest(http.MethodPost, photosAPI+"/uploads", bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Goog-Upload-Content-Type", mimeType)
+	req.Header.Set("X-Goog-Upload-Protocol", "raw")
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return string(body), nil
+}
+
+func (u *photosUploader) post(path string, request interface{}, response interface{}) error {
+	b, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	resp, err := u.client.Post(photosAPI+path, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.Unmarshal(body, response)
+}
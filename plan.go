@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"reflect"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+
+	"github.com/weineran/gmail-cleanup/internal/mimeutil"
+)
+
+// Planned actions.
+const (
+	planStrip = "strip"
+	planTrash = "trash"
+)
+
+// What --plan recorded a run would do, for --apply to do later.
+type actionPlan struct {
+	Created  time.Time       `json:"created"`
+	Profile  string          `json:"profile"`
+	Query    string          `json:"query"`
+	Messages []plannedAction `json:"messages"`
+}
+
+// What is done to one message.
+type plannedAction struct {
+	MessageId string `json:"messageId"`
+	From      string `json:"from"`
+	Subject   string `json:"subject"`
+	// SHA-256 of the raw message when planned. --apply leaves the message alone if it changed.
+	RawSHA256 string `json:"rawSha256"`
+	// planStrip or planTrash.
+	Action string `json:"action"`
+	// Attachments removed from the copy, and those kept in it.
+	Remove []plannedAttachment `json:"remove,omitempty"`
+	Keep   []plannedAttachment `json:"keep,omitempty"`
+	Redact bool                `json:"redact,omitempty"`
+	// Where the removed attachments marked archive are saved, if anywhere.
+	ArchiveDir string `json:"archiveDir,omitempty"`
+	ExportDir  string `json:"exportDir,omitempty"`
+	// How the copy is added, and whether the original is deleted after.
+	InsertMethod   string `json:"insertMethod,omitempty"`
+	DeleteOriginal bool   `json:"deleteOriginal"`
+}
+
+type plannedAttachment struct {
+	PartId   string `json:"partId"`
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	Archive  bool   `json:"archive,omitempty"`
+}
+
+func newPlannedAction(m *gmail.Message, rawSum [32]byte, action string) plannedAction {
+	return plannedAction{
+		MessageId: m.Id,
+		From:      mimeutil.HeaderValue(m.Payload.Headers, "From"),
+		Subject:   mimeutil.HeaderValue(m.Payload.Headers, "Subject"),
+		RawSHA256: hex.EncodeToString(rawSum[:]),
+		Action:    action,
+	}
+}
+
+// Returns the strip planned for m: removing the attachments in removed, archiving those
+// in archivable, and keeping the rest of fetched.
+func newPlannedStrip(opts *removeOptions, m *gmail.Message, rawSum [32]byte, fetched, removed, archivable []fetchedAttachment, redacting bool) plannedAction {
+	p := newPlannedAction(m, rawSum, planStrip)
+	p.Redact = redacting
+	p.InsertMethod = opts.insertMethod
+	p.DeleteOriginal = !opts.complianceMode
+	archived := map[string]bool{}
+	for _, a := range archivable {
+		archived[a.part.PartId] = true
+	}
+	if len(archivable) > 0 && opts.store != nil {
+		p.ArchiveDir = opts.store.dir
+	}
+	if len(archivable) > 0 && opts.exporter != nil {
+		p.ExportDir = opts.exporter.dir
+	}
+	isRemoved := map[string]bool{}
+	for _, a := range removed {
+		isRemoved[a.part.PartId] = true
+		p.Remove = append(p.Remove, plannedAttachment{
+			PartId:   a.part.PartId,
+			Filename: a.part.Filename,
+			Size:     a.part.Body.Size,
+			Archive:  archived[a.part.PartId] && (opts.store != nil || opts.exporter != nil),
+		})
+	}
+	for _, a := range fetched {
+		if !isRemoved[a.part.PartId] {
+			p.Keep = append(p.Keep, plannedAttachment{PartId: a.part.PartId, Filename: a.part.Filename, Size: a.part.Body.Size})
+		}
+	}
+	return p
+}
+
+// Records or checks the action processMessage is about to take. With --plan, records it
+// and returns outcomePlanned; with --apply, returns outcomeNotPlanned if it isn't what
+// the plan says. Otherwise returns "" to go ahead.
+func (opts *removeOptions) checkPlan(action plannedAction) outcome {
+	if opts.plan != nil {
+		opts.plan.Messages = append(opts.plan.Messages, action)
+		log.Printf("Planned to %s message [%+v]\n", action.Action, action.MessageId)
+		return outcomePlanned
+	}
+	if opts.applying == nil {
+		return ""
+	}
+	want, ok := opts.applying[action.MessageId]
+	if !ok {
+		log.Printf("Message [%+v] isn't in the plan, skipping.\n", action.MessageId)
+		return outcomeNotPlanned
+	}
+	if diff := planDifference(want, action); diff != "" {
+		log.Printf("Message [%+v]: %s since it was planned, skipping.\n", action.MessageId, diff)
+		return outcomeNotPlanned
+	}
+	return ""
+}
+
+// Describes how got differs from want, or returns "" if it doesn't.
+func planDifference(want, got plannedAction) string {
+	switch {
+	case want.RawSHA256 != got.RawSHA256:
+		return "the message changed"
+	case want.Action != got.Action:
+		return fmt.Sprintf("the action changed from %s to %s", want.Action, got.Action)
+	case !reflect.DeepEqual(want.Remove, got.Remove) || !reflect.DeepEqual(want.Keep, got.Keep):
+		return "the attachments to remove changed"
+	case !reflect.DeepEqual(want, got):
+		return "the flags changed"
+	}
+	return ""
+}
+
+// Writes the plan to path.
+func (p *actionPlan) write(path string) error {
+	return writeJSONAtomic(path, p)
+}
+
+func readPlan(path string) (*actionPlan, error) {
+	var p actionPlan
+	if err := readJSON(path, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Does what plan says, in its order, after one confirmation for all of it.
+// Returns false if the run should stop.
+func applyPlan(mb *mailbox, plan *actionPlan, removeOpts *removeOptions, force bool, summary *runSummary) bool {
+	if len(plan.Messages) == 0 {
+		fmt.Println("No messages found.")
+		return true
+	}
+	counts := map[string]int{}
+	var ids []string
+	for _, a := range plan.Messages {
+		counts[a.Action]++
+		ids = append(ids, a.MessageId)
+	}
+	fmt.Printf("Plan of %s for [%s]: strip %d messages, trash %d\n", plan.Created.Local().Format("2006-01-02 15:04"), plan.Query,
+		counts[planStrip], counts[planTrash])
+	if !removeOpts.assumeYes {
+		if !askYesNo(fmt.Sprintf("Do you want to apply the plan to these %d messages?", len(ids))) {
+			summary.Outcomes[outcomeSkipped] += len(ids)
+			return true
+		}
+		for _, id := range ids {
+			removeOpts.approved[id] = true
+		}
+	}
+	removeOpts.keepOrder = true
+	return processIds(mb, ids, removeOpts, force, summary)
+}
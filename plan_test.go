@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPlanRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gmail-cleanup-plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	created := time.Date(2024, 3, 9, 14, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		plan actionPlan
+	}{
+		{"empty", actionPlan{Created: created, Query: "larger:10M"}},
+		{"strip", actionPlan{Created: created, Profile: "work", Query: "has:attachment", Messages: []plannedAction{{
+			MessageId:      "m1",
+			From:           "Ann <ann@example.com>",
+			Subject:        "Photos",
+			RawSHA256:      "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+			Action:         planStrip,
+			Remove:         []plannedAttachment{{PartId: "1", Filename: "a.jpg", Size: 2048, Archive: true}},
+			Keep:           []plannedAttachment{{PartId: "2", Filename: "invite.ics", Size: 300}},
+			Redact:         true,
+			ArchiveDir:     "attachments",
+			InsertMethod:   insertMethodImport,
+			DeleteOriginal: true,
+		}}}},
+		{"trash and strip", actionPlan{Created: created, Messages: []plannedAction{
+			{MessageId: "m2", Action: planTrash, RawSHA256: "00"},
+			{MessageId: "m3", Action: planStrip, RawSHA256: "01", Remove: []plannedAttachment{{PartId: "0.1", Filename: "b.pdf", Size: 1}}},
+		}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name+".plan.json")
+			if err := tt.plan.write(path); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readPlan(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*got, tt.plan) {
+				t.Errorf("readPlan() = %+v, want %+v", *got, tt.plan)
+			}
+		})
+	}
+}
+
+func TestPlanDifference(t *testing.T) {
+	want := plannedAction{
+		MessageId:      "m1",
+		RawSHA256:      "00",
+		Action:         planStrip,
+		Remove:         []plannedAttachment{{PartId: "1", Filename: "a.jpg", Size: 2048}},
+		InsertMethod:   insertMethodInsert,
+		DeleteOriginal: true,
+	}
+	tests := []struct {
+		name   string
+		change func(a *plannedAction)
+		want   string
+	}{
+		{"same", func(a *plannedAction) {}, ""},
+		{"message changed", func(a *plannedAction) { a.RawSHA256 = "01" }, "the message changed"},
+		{"action changed", func(a *plannedAction) { a.Action = planTrash }, "the action changed from strip to trash"},
+		{"attachments changed", func(a *plannedAction) { a.Remove = nil }, "the attachments to remove changed"},
+		{"kept attachments changed", func(a *plannedAction) { a.Keep = []plannedAttachment{{PartId: "2"}} }, "the attachments to remove changed"},
+		{"flags changed", func(a *plannedAction) { a.InsertMethod = insertMethodImport }, "the flags changed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := want
+			got.Remove = append([]plannedAttachment(nil), want.Remove...)
+			tt.change(&got)
+			if diff := planDifference(want, got); diff != tt.want {
+				t.Errorf("planDifference() = %q, want %q", diff, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckPlan(t *testing.T) {
+	planned := plannedAction{MessageId: "m1", RawSHA256: "00", Action: planTrash}
+	tests := []struct {
+		name   string
+		opts   removeOptions
+		action plannedAction
+		want   outcome
+	}{
+		{"neither", removeOptions{}, planned, ""},
+		{"planning", removeOptions{plan: &actionPlan{}}, planned, outcomePlanned},
+		{"applying as planned", removeOptions{applying: map[string]plannedAction{"m1": planned}}, planned, ""},
+		{"applying, not in plan", removeOptions{applying: map[string]plannedAction{}}, planned, outcomeNotPlanned},
+		{"applying, changed", removeOptions{applying: map[string]plannedAction{"m1": planned}},
+			plannedAction{MessageId: "m1", RawSHA256: "01", Action: planTrash}, outcomeNotPlanned},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.opts.checkPlan(tt.action); got != tt.want {
+				t.Errorf("checkPlan() = %q, want %q", got, tt.want)
+			}
+			if tt.opts.plan != nil && !reflect.DeepEqual(tt.opts.plan.Messages, []plannedAction{tt.action}) {
+				t.Errorf("plan = %+v, want the action recorded", tt.opts.plan.Messages)
+			}
+		})
+	}
+}
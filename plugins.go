@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"plugin"
+	"strings"
+
+	"github.com/weineran/gmail-cleanup/transform"
+)
+
+// Opens each Go plugin in a comma-separated list. Plugins register their
+// transformers from init functions, which run when the plugin is opened.
+func loadPlugins(paths string) error {
+	for _, path := range splitList(paths) {
+		if _, err := plugin.Open(path); err != nil {
+			return fmt.Errorf("loading plugin %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// Resolves a comma-separated list of registered transformer names, keeping their order.
+func lookupTransformers(names string) ([]transform.Transformer, error) {
+	var transformers []transform.Transformer
+	for _, name := range splitList(names) {
+		t, ok := transform.Lookup(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown transformer [%s], registered: %v", name, transform.Names())
+		}
+		transformers = append(transformers, t)
+	}
+	return transformers, nil
+}
+
+// Splits a comma-separated flag value, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
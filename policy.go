@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+
+	"github.com/weineran/gmail-cleanup/internal/mimeutil"
+)
+
+// Policy actions.
+const (
+	actionStrip  = "strip"
+	actionDelete = "delete"
+)
+
+// One rule of a policy such as "strip: photos; delete: automated reports older than 1y".
+type policyRule struct {
+	action    string
+	category  string
+	olderThan time.Duration
+	// Only mail from the mailing list with this List-Id, or from any list for anyListId, if not "".
+	listId string
+	// Leave starred messages alone.
+	exceptStarred bool
+	// Only mail from members of the contact group with this name, if not "".
+	contactGroup string
+	// The lowercase addresses of contactGroup's members, filled in by resolveContactGroups.
+	groupMembers map[string]bool
+}
+
+// The listId of rules for mail from any mailing list.
+const anyListId = "*"
+
+// What policy rules look at in a message.
+type policySubject struct {
+	category string
+	date     time.Time
+	// As returned by messageListId.
+	listId  string
+	starred bool
+	// As returned by messageSender.
+	sender string
+}
+
+func newPolicySubject(m *gmail.Message, own map[string]bool) policySubject {
+	return policySubject{category: classifyMessage(m, own), date: messageDate(m), listId: messageListId(m), starred: hasLabel(m, "STARRED"),
+		sender: messageSender(m)}
+}
+
+// Returns the identifier of m's List-Id header, e.g. "news.example.com" for
+// "Example News <news.example.com>", lowercased, or "" if it has none.
+func messageListId(m *gmail.Message) string {
+	if m.Payload == nil {
+		return ""
+	}
+	return normalizeListId(mimeutil.HeaderValue(m.Payload.Headers, "List-Id"))
+}
+
+func normalizeListId(value string) string {
+	value = strings.TrimSpace(value)
+	if i := strings.LastIndex(value, "<"); i >= 0 {
+		if j := strings.Index(value[i:], ">"); j >= 0 {
+			value = value[i+1 : i+j]
+		}
+	}
+	return strings.ToLower(strings.TrimSpace(value))
+}
+
+// Parses semicolon-separated rules of the form "ACTION: TARGET [older than AGE] [except starred]",
+// where TARGET is a category, "list mail" for mail from any mailing list, "list LIST_ID",
+// or "group NAME" for mail from the members of a contact group.
+func parsePolicy(s string) ([]policyRule, error) {
+	var rules []policyRule
+	for _, r := range strings.Split(s, ";") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		colon := strings.Index(r, ":")
+		if colon < 0 {
+			return nil, fmt.Errorf("policy rule [%s]: expected ACTION: CATEGORY", r)
+		}
+		rule := policyRule{action: strings.ToLower(strings.TrimSpace(r[:colon]))}
+		if rule.action != actionStrip && rule.action != actionDelete {
+			return nil, fmt.Errorf("policy rule [%s]: unknown action [%s], expected %s or %s", r, rule.action, actionStrip, actionDelete)
+		}
+
+		target := strings.ToLower(strings.TrimSpace(r[colon+1:]))
+		if strings.HasSuffix(target, " except starred") {
+			rule.exceptStarred = true
+			target = strings.TrimSpace(strings.TrimSuffix(target, " except starred"))
+		}
+		if i := strings.Index(target, " older than "); i >= 0 {
+			age, err := parseAge(strings.TrimSpace(target[i+len(" older than "):]))
+			if err != nil {
+				return nil, fmt.Errorf("policy rule [%s]: %v", r, err)
+			}
+			rule.olderThan = age
+			target = strings.TrimSpace(target[:i])
+		}
+		switch {
+		case target == "":
+			return nil, fmt.Errorf("policy rule [%s]: missing category", r)
+		case target == "list mail":
+			rule.listId = anyListId
+		case strings.HasPrefix(target, "list "):
+			rule.listId = normalizeListId(strings.TrimPrefix(target, "list "))
+		case strings.HasPrefix(target, "group "):
+			rule.contactGroup = strings.Trim(strings.TrimSpace(strings.TrimPrefix(target, "group ")), `"'`)
+		default:
+			rule.category = target
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Parses ages like "30d", "2w", "6m" and "1y".
+func parseAge(s string) (time.Duration, error) {
+	digits := len(s) - len(strings.TrimLeft(s, "0123456789"))
+	n, err := strconv.Atoi(s[:digits])
+	if err != nil {
+		return 0, fmt.Errorf("invalid age [%s], expected a number followed by d, w, m or y", s)
+	}
+	day := 24 * time.Hour
+	switch unit := s[digits:]; unit {
+	case "d":
+		return time.Duration(n) * day, nil
+	case "w":
+		return time.Duration(n) * 7 * day, nil
+	case "m":
+		return time.Duration(n) * 30 * day, nil
+	case "y":
+		return time.Duration(n) * 365 * day, nil
+	case "":
+		return 0, fmt.Errorf("invalid age [%s], missing unit d, w, m or y", s)
+	default:
+		return 0, fmt.Errorf("unknown unit [%s] in age [%s], expected d, w, m or y", unit, s)
+	}
+}
+
+// Returns the first rule matching a message, or nil.
+// A rule's category matches by prefix, so "photos" targets "photos from contacts".
+func matchPolicy(rules []policyRule, m policySubject) *policyRule {
+	return matchPolicyAt(rules, m, time.Now())
+}
+
+// Like matchPolicy, but evaluates ages as of now.
+func matchPolicyAt(rules []policyRule, m policySubject, now time.Time) *policyRule {
+	for i, rule := range rules {
+		if !strings.HasPrefix(m.category, rule.category) {
+			continue
+		}
+		if rule.listId != "" && (m.listId == "" || (rule.listId != anyListId && rule.listId != m.listId)) {
+			continue
+		}
+		if rule.exceptStarred && m.starred {
+			continue
+		}
+		if rule.contactGroup != "" && !rule.groupMembers[m.sender] {
+			continue
+		}
+		if rule.olderThan > 0 && now.Sub(m.date) < rule.olderThan {
+			continue
+		}
+		return &rules[i]
+	}
+	return nil
+}
+
+// A policies.yaml file:
+//
+//	policies:
+//	  - action: strip
+//	    category: photos
+//	  - action: delete
+//	    category: automated reports
+//	    older_than: 1y
+//	  - action: delete
+//	    list_id: "*"
+//	    older_than: 90d
+//	    except_starred: true
+//	  - action: strip
+//	    contact_group: Family
+//	    older_than: 1y
+//	senders:
+//	  approve: [photos@example.com]
+//	  skip: [boss@example.com]
+//	budgets:
+//	  - sender: "@newsletter.example.com"
+//	    max: 50M
+//	    action: delete
+//	  - max: 200M
+//	attachments:
+//	  - extensions: [ics]
+//	    action: delete
+//	    older_than: 1y
+type policyFile struct {
+	Policies []policyFileRule `yaml:"policies"`
+	// Storage budgets per sender, enforced with the oldest large messages first.
+	Budgets []policyFileBudget `yaml:"budgets"`
+	// What happens to attachments by file extension.
+	Attachments []policyFileAttachmentRule `yaml:"attachments"`
+	// Senders whose mail is approved or skipped without asking, saved from interactive runs.
+	Senders struct {
+		Approve []string `yaml:"approve"`
+		Skip    []string `yaml:"skip"`
+	} `yaml:"senders"`
+	// How long messages stay in the trash, enforced by empty-trash and the daemon.
+	Trash struct {
+		MaxAge string `yaml:"max_age"`
+	} `yaml:"trash"`
+}
+
+type policyFileRule struct {
+	Action    string `yaml:"action"`
+	Category  string `yaml:"category"`
+	OlderThan string `yaml:"older_than"`
+	// A List-Id such as news.example.com, or "*" for any mailing list.
+	ListId        string `yaml:"list_id"`
+	ExceptStarred bool   `yaml:"except_starred"`
+	// The name of a contact group whose members' mail the rule is limited to.
+	ContactGroup string `yaml:"contact_group"`
+}
+
+type policyFileBudget struct {
+	Sender  string `yaml:"sender"`
+	Max     string `yaml:"max"`
+	Action  string `yaml:"action"`
+	MinSize string `yaml:"min_size"`
+}
+
+// A limit on the storage used by each sender it matches.
+type policyBudget struct {
+	// An address, an "@domain", or "" for every sender.
+	sender   string
+	maxBytes int64
+	// actionStrip or actionDelete, applied to messages until the sender is under budget.
+	action string
+	// Only messages at least this large are stripped or deleted.
+	minSize int64
+}
+
+// Default min_size of a budget: smaller messages save too little to be worth a change each.
+const defaultBudgetMinSize = 1 << 20
+
+// Reads and validates the policies file at path.
+func readPolicyFile(path string) (*policyFile, error) {
+	var f policyFile
+	if _, err := readValidatedYAML(path, policyFileSchema, &f); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// Loads the budgets of the policies file named by spec. Inline policies have none.
+func loadBudgets(spec string) ([]policyBudget, error) {
+	if !isPolicyFile(spec) {
+		return nil, nil
+	}
+	f, err := readPolicyFile(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	var budgets []policyBudget
+	for i, fb := range f.Budgets {
+		budget := policyBudget{sender: strings.ToLower(strings.TrimSpace(fb.Sender)), action: strings.ToLower(fb.Action), minSize: defaultBudgetMinSize}
+		if budget.sender == "*" {
+			budget.sender = ""
+		}
+		if budget.action == "" {
+			budget.action = actionStrip
+		}
+		if budget.action != actionStrip && budget.action != actionDelete {
+			return nil, fmt.Errorf("%s: budgets[%d].action: unknown action [%s], expected %s or %s", spec, i, fb.Action, actionStrip, actionDelete)
+		}
+		if fb.Max == "" {
+			return nil, fmt.Errorf("%s: budgets[%d].max: missing", spec, i)
+		}
+		budget.maxBytes, err = parseSize(fb.Max)
+		if err != nil {
+			return nil, fmt.Errorf("%s: budgets[%d].max: %v", spec, i, err)
+		}
+		if fb.MinSize != "" {
+			budget.minSize, err = parseSize(fb.MinSize)
+			if err != nil {
+				return nil, fmt.Errorf("%s: budgets[%d].min_size: %v", spec, i, err)
+			}
+		}
+		budgets = append(budgets, budget)
+	}
+	return budgets, nil
+}
+
+// Loads rules from a YAML file when spec names one, and otherwise parses spec as inline rules.
+// Rules in a file without a category apply to every category.
+func loadPolicy(spec string) ([]policyRule, error) {
+	if !isPolicyFile(spec) {
+		return parsePolicy(spec)
+	}
+
+	f, err := readPolicyFile(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []policyRule
+	for i, r := range f.Policies {
+		rule := policyRule{action: strings.ToLower(r.Action), category: strings.ToLower(strings.TrimSpace(r.Category)),
+			listId: normalizeListId(r.ListId), exceptStarred: r.ExceptStarred, contactGroup: strings.TrimSpace(r.ContactGroup)}
+		if rule.action != actionStrip && rule.action != actionDelete {
+			return nil, fmt.Errorf("%s: policies[%d].action: unknown action [%s], expected %s or %s", spec, i, r.Action, actionStrip, actionDelete)
+		}
+		if r.OlderThan != "" {
+			rule.olderThan, err = parseAge(r.OlderThan)
+			if err != nil {
+				return nil, fmt.Errorf("%s: policies[%d].older_than: %v", spec, i, err)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
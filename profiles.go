@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Each profile is a directory here holding the account's token.json and,
+// optionally, its own credentials.json.
+const profilesDir = "profiles"
+
+// Directory holding credentials.json, token.json and profiles/: the current directory
+// if it has either, as before, or else gmail-cleanup under the user's config directory,
+// which is %AppData% on Windows and ~/.config on Linux.
+func configDir() string {
+	for _, name := range []string{"credentials.json", profilesDir} {
+		if _, err := os.Stat(name); err == nil {
+			return "."
+		}
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "."
+	}
+	return filepath.Join(dir, "gmail-cleanup")
+}
+
+// Path of a per-account file: in the profile's directory, or the config directory without a profile.
+func profilePath(profile string, name string) string {
+	if profile == "" {
+		return filepath.Join(configDir(), name)
+	}
+	return filepath.Join(configDir(), profilesDir, profile, name)
+}
+
+func profileTokenFile(profile string) string {
+	return profilePath(profile, "token.json")
+}
+
+// Profiles use the shared credentials.json unless they have their own.
+func profileCredentialsFile(profile string) string {
+	if profile != "" {
+		path := profilePath(profile, "credentials.json")
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return profilePath("", "credentials.json")
+}
+
+// Returns the names of all profiles that have completed authorization.
+func listProfiles() ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(configDir(), profilesDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var profiles []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(profileTokenFile(e.Name())); err == nil {
+			profiles = append(profiles, e.Name())
+		}
+	}
+	sort.Strings(profiles)
+	return profiles, nil
+}
+
+// Runs a subcommand once per profile, each in its own process, then prints a combined report.
+func runAllProfiles(args []string) {
+	fs := flag.NewFlagSet("all-profiles", flag.ExitOnError)
+	concurrent := fs.Bool("concurrent", false, "Run all profiles at the same time (requires --yes and --force)")
+	parseFlags(fs, args)
+
+	if fs.NArg() < 1 || fs.Arg(0) != "attachments" {
+		log.Fatalf("Usage: gmail-cleanup all-profiles [--concurrent] attachments [flags] [query]")
+	}
+	command := fs.Arg(0)
+	commandArgs := fs.Args()[1:]
+	if *concurrent && (!hasFlag(commandArgs, "yes") || !(hasFlag(commandArgs, "force") || hasFlag(commandArgs, "compliance-mode"))) {
+		log.Fatalf("--concurrent cannot ask for confirmation; pass --yes and --force to %s", command)
+	}
+
+	profiles, err := listProfiles()
+	if err != nil {
+		log.Fatalf("Unable to list profiles: %v", err)
+	}
+	if len(profiles) == 0 {
+		log.Fatalf("No profiles found in [%s]. Authorize one with --profile NAME first.", filepath.Join(configDir(), profilesDir))
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatalf("Unable to find executable: %v", err)
+	}
+	tmpDir, err := ioutil.TempDir("", "gmail-cleanup-summaries")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	results := make([]profileResult, len(profiles))
+	var wg sync.WaitGroup
+	var outputMu sync.Mutex
+	for i, profile := range profiles {
+		summaryFile := filepath.Join(tmpDir, profile+".json")
+		childArgs := append([]string{command, "--profile", profile, "--summary-file", summaryFile}, commandArgs...)
+		cmd := exec.Command(exe, childArgs...)
+
+		run := func(i int, profile string, cmd *exec.Cmd) {
+			err := cmd.Run()
+			results[i] = profileResult{profile: profile, err: err}
+			results[i].summary, _ = readRunSummary(summaryFile)
+		}
+
+		if !*concurrent {
+			fmt.Printf("=============== Profile [%s] ===============\n", profile)
+			cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+			run(i, profile, cmd)
+			continue
+		}
+
+		stdout := &prefixWriter{mu: &outputMu, w: os.Stdout, prefix: "[" + profile + "] "}
+		stderr := &prefixWriter{mu: &outputMu, w: os.Stderr, prefix: "[" + profile + "] "}
+		cmd.Stdout, cmd.Stderr = stdout, stderr
+		wg.Add(1)
+		go func(i int, profile string, cmd *exec.Cmd) {
+			defer wg.Done()
+			run(i, profile, cmd)
+			stdout.flush()
+			stderr.flush()
+		}(i, profile, cmd)
+	}
+	wg.Wait()
+
+	printCombinedReport(results)
+}
+
+type profileResult struct {
+	profile string
+	summary *runSummary
+	err     error
+}
+
+func printCombinedReport(results []profileResult) {
+	fmt.Println("=============== Combined report ===============")
+	totals := map[outcome]int{}
+	var matched int
+	var units int64
+	failed := 0
+	for _, r := range results {
+		if r.summary == nil {
+			status := "ok"
+			if r.err != nil {
+				status = "failed: " + r.err.Error()
+				failed++
+			}
+			fmt.Printf("* %s: no summary (%s)\n", r.profile, status)
+			continue
+		}
+		// The child exits with the code in its summary; finding nothing isn't a failure.
+		status := r.summary.Status
+		if r.summary.ExitCode != exitOK && r.summary.ExitCode != exitNothingMatched {
+			failed++
+		}
+		if r.summary.Stopped != "" {
+			status += ", stopped early: " + r.summary.Stopped
+		}
+		fmt.Printf("* %s: matched %d, stripped %d, skipped %d, trashed %d, %d quota units (%s)\n", r.profile,
+			r.summary.Matched, r.summary.Outcomes[outcomeStripped]+r.summary.Outcomes[outcomeKept],
+			r.summary.Outcomes[outcomeSkipped], r.summary.Outcomes[outcomeTrashed], r.summary.QuotaUnits, status)
+		matched += r.summary.Matched
+		units += r.summary.QuotaUnits
+		for o, n := range r.summary.Outcomes {
+			totals[o] += n
+		}
+	}
+	fmt.Printf("Total: %d profiles (%d failed), matched %d, stripped %d, skipped %d, trashed %d, %d quota units\n",
+		len(results), failed, matched, totals[outcomeStripped]+totals[outcomeKept], totals[outcomeSkipped], totals[outcomeTrashed], units)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// Reports whether args set the boolean flag name.
+func hasFlag(args []string, name string) bool {
+	for _, arg := range args {
+		switch arg {
+		case "-" + name, "--" + name, "-" + name + "=true", "--" + name + "=true":
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the value args give the flag name, or "" if they don't set it.
+func flagValue(args []string, name string) string {
+	for i, arg := range args {
+		for _, prefix := range []string{"-" + name, "--" + name} {
+			if arg == prefix && i+1 < len(args) {
+				return args[i+1]
+			}
+			if strings.HasPrefix(arg, prefix+"=") {
+				return strings.TrimPrefix(arg, prefix+"=")
+			}
+		}
+	}
+	return ""
+}
+
+// Writes whole lines to w, each prefixed, so output from concurrent runs doesn't interleave mid-line.
+type prefixWriter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+		p.mu.Lock()
+		_, err := fmt.Fprintf(p.w, "%s%s\n", p.prefix, p.buf[:i])
+		p.mu.Unlock()
+		p.buf = p.buf[i+1:]
+		if err != nil {
+			return len(b), err
+		}
+	}
+}
+
+func (p *prefixWriter) flush() {
+	if len(p.buf) > 0 {
+		p.Write([]byte("\n"))
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// The messages a run has processed, one id per line, so a run restarted after a crash,
+// deploy or reboot skips them instead of evaluating everything again. Unlike a
+// continuation it doesn't depend on the processing order, so it works with
+// --size-sweep and --score-expr too.
+type progressLog struct {
+	path string
+	done map[string]bool
+}
+
+// Opens the progress file at path, reading the messages processed so far. A missing
+// file has none.
+func openProgressLog(path string) (*progressLog, error) {
+	p := &progressLog{path: path, done: map[string]bool{}}
+	ids, err := readIdsFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, id := range ids {
+		p.done[id] = true
+	}
+	return p, nil
+}
+
+// Appends id and syncs it to disk. A line cut short by a crash only means that
+// message is evaluated again.
+func (p *progressLog) record(id string) error {
+	f, err := os.OpenFile(p.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, id); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	p.done[id] = true
+	return f.Close()
+}
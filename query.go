@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// Gmail search operators, from https://support.google.com/mail/answer/7190. Gmail
+// searches for an unknown one as text, so a typo silently matches something else.
+var gmailOperators = map[string]bool{
+	"after": true, "bcc": true, "before": true, "category": true, "cc": true, "deliveredto": true,
+	"filename": true, "from": true, "has": true, "in": true, "is": true, "label": true,
+	"larger": true, "list": true, "newer": true, "newer_than": true, "older": true,
+	"older_than": true, "rfc822msgid": true, "size": true, "smaller": true, "subject": true, "to": true,
+}
+
+// The values operators with a fixed set of them take.
+var gmailOperatorValues = map[string][]string{
+	"category": {"primary", "social", "promotions", "updates", "forums", "reservations", "purchases"},
+	"has": {"attachment", "drive", "document", "spreadsheet", "presentation", "youtube", "userlabels", "nouserlabels",
+		"yellow-star", "orange-star", "red-star", "purple-star", "blue-star", "green-star",
+		"red-bang", "orange-guillemet", "yellow-bang", "green-check", "blue-info", "purple-question"},
+	"is": {"read", "unread", "starred", "important", "snoozed", "muted", "unmuted", "chat"},
+}
+
+var (
+	// An operator and its value, after optional negation, outside quotes.
+	queryTermPattern = regexp.MustCompile(`^-?([A-Za-z_0-9]+):(.*)$`)
+	querySizePattern = regexp.MustCompile(`^\d+([KkMm][Bb]?)?$`)
+	queryAgePattern  = regexp.MustCompile(`^\d+[dmy]$`)
+	queryDatePattern = regexp.MustCompile(`^(\d{4}/\d{1,2}/\d{1,2}|\d{1,2}/\d{1,2}/\d{4}|\d+)$`)
+)
+
+// Returns what looks wrong with a Gmail search query, with suggestions: unknown operators,
+// such as lager: for larger:, and values the operator doesn't take.
+func queryProblems(query string) []string {
+	var problems []string
+	for _, term := range queryTerms(query) {
+		term = strings.Trim(term, "{}")
+		if inner := strings.TrimPrefix(term, "-"); strings.HasPrefix(inner, "(") {
+			problems = append(problems, queryProblems(strings.TrimSuffix(inner[1:], ")"))...)
+			continue
+		}
+		match := queryTermPattern.FindStringSubmatch(term)
+		if match == nil {
+			continue
+		}
+		op, value := strings.ToLower(match[1]), strings.Trim(match[2], `"(){}`)
+		if !gmailOperators[op] {
+			problems = append(problems, withSuggestion(fmt.Sprintf("unknown operator %s:", op), op+":", closest(op, operatorNames(), "", ":")))
+			continue
+		}
+		if value == "" {
+			problems = append(problems, fmt.Sprintf("%s: has no value", op))
+			continue
+		}
+		switch op {
+		case "larger", "smaller", "size":
+			if !querySizePattern.MatchString(value) {
+				problems = append(problems, fmt.Sprintf("%s:%s isn't a size, such as %s:10M", op, value, op))
+			}
+		case "older_than", "newer_than":
+			if !queryAgePattern.MatchString(value) {
+				problems = append(problems, fmt.Sprintf("%s:%s isn't an age, such as %s:2y, 6m or 30d", op, value, op))
+			}
+		case "after", "before", "older", "newer":
+			if !queryDatePattern.MatchString(value) {
+				problems = append(problems, fmt.Sprintf("%s:%s isn't a date, such as %s:2020/01/31", op, value, op))
+			}
+		default:
+			values, ok := gmailOperatorValues[op]
+			if !ok || containsFold(values, value) {
+				continue
+			}
+			problems = append(problems, withSuggestion(fmt.Sprintf("%s:%s isn't a value %s: takes", op, value, op), op+":"+value, closest(strings.ToLower(value), values, op+":", "")))
+		}
+	}
+	return problems
+}
+
+// Splits a query on spaces outside double quotes and parentheses.
+func queryTerms(query string) []string {
+	var terms []string
+	var term strings.Builder
+	quoted, depth := false, 0
+	for _, r := range query {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == '(' && !quoted:
+			depth++
+		case r == ')' && !quoted && depth > 0:
+			depth--
+		case (r == ' ' || r == '\t') && !quoted && depth == 0:
+			if term.Len() > 0 {
+				terms = append(terms, term.String())
+				term.Reset()
+			}
+			continue
+		}
+		term.WriteRune(r)
+	}
+	if term.Len() > 0 {
+		terms = append(terms, term.String())
+	}
+	return terms
+}
+
+func operatorNames() []string {
+	names := make([]string, 0, len(gmailOperators))
+	for op := range gmailOperators {
+		names = append(names, op)
+	}
+	return names
+}
+
+func withSuggestion(problem string, got string, suggestion string) string {
+	if suggestion == "" {
+		return problem
+	}
+	return fmt.Sprintf("%s (did you mean %s instead of %s?)", problem, suggestion, got)
+}
+
+// Returns the candidate nearest to word, with prefix and suffix, if it is close enough to be a typo.
+// Ties go to the candidate first in alphabetical order, so suggestions don't vary.
+func closest(word string, candidates []string, prefix string, suffix string) string {
+	best, bestDistance := "", 3
+	for _, c := range candidates {
+		if d := editDistance(word, c); d < bestDistance || (d == bestDistance && best != "" && c < best) {
+			best, bestDistance = c, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return prefix + best + suffix
+}
+
+// Returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(minInt(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Warns about problems with query. For commands that delete or change messages, a query
+// with problems stops the run unless allow is set.
+func checkQuery(query string, destructive bool, allow bool) {
+	problems := queryProblems(query)
+	if len(problems) == 0 {
+		return
+	}
+	for _, p := range problems {
+		log.Printf("Query [%s]: %s\n", query, p)
+	}
+	if destructive && !allow {
+		log.Fatal("Gmail searches for unknown operators as text, so this query may match nothing or everything. Fix it, or pass --allow-query-problems to run it anyway.")
+	}
+}
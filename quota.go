@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Quota units charged per Gmail API method.
+// See https://developers.google.com/gmail/api/reference/quota
+var quotaUnits = map[string]int64{
+	"drafts.create":            10,
+	"drafts.delete":            10,
+	"drafts.get":               5,
+	"drafts.list":              5,
+	"drafts.send":              100,
+	"getProfile":               1,
+	"history.list":             2,
+	"labels.create":            5,
+	"labels.delete":            5,
+	"labels.get":               1,
+	"labels.list":              1,
+	"labels.patch":             5,
+	"labels.update":            5,
+	"messages.attachments.get": 5,
+	"messages.batchDelete":     50,
+	"messages.batchModify":     50,
+	"messages.delete":          10,
+	"messages.get":             5,
+	"messages.import":          25,
+	"messages.insert":          25,
+	"messages.list":            5,
+	"messages.modify":          5,
+	"messages.send":            100,
+	"messages.trash":           5,
+	"messages.untrash":         5,
+	"settings.sendAs.list":     1,
+	"threads.get":              10,
+	"threads.list":             10,
+	"threads.modify":           10,
+	"threads.trash":            10,
+}
+
+var errQuotaBudgetExceeded = errors.New("quota budget exceeded")
+
+// Units a profile consumed on a given day. The quota file maps each profile, "" for the
+// account without one, to its usage, so scheduled runs of every account share one file.
+type quotaUsage struct {
+	Day   string `json:"day"`
+	Units int64  `json:"units"`
+}
+
+type quotaTracker struct {
+	// Guards charges from concurrent workers, e.g. copy verifiers and the cleaner's
+	// batched metadata fetches, which all share one tracker.
+	mu        sync.Mutex
+	path      string
+	profile   string
+	budget    int64
+	day       string
+	usedToday int64
+	units     map[string]int64
+	calls     map[string]int
+}
+
+// Gmail's daily quotas reset at midnight Pacific Time.
+func quotaDay(now time.Time) string {
+	loc, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		loc = time.UTC
+	}
+	return now.In(loc).Format("2006-01-02")
+}
+
+// The quota file, in the config directory unless --quota-file names another.
+func quotaFilePath(opts *mailboxOptions) string {
+	if opts.quotaFile != "" {
+		return opts.quotaFile
+	}
+	return filepath.Join(configDir(), "quota.json")
+}
+
+// Loads profile's usage today from path. A budget of 0 means no limit, and
+// a path of "" keeps usage in memory only.
+func newQuotaTracker(path string, profile string, budget int64) (*quotaTracker, error) {
+	q := &quotaTracker{
+		path:    path,
+		profile: profile,
+		budget:  budget,
+		units:   map[string]int64{},
+		calls:   map[string]int{},
+	}
+	if err := q.add("", 0); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Records a call to method, or returns errQuotaBudgetExceeded if the call
+// would push today's usage over the budget.
+func (q *quotaTracker) charge(method string) error {
+	cost, ok := quotaUnits[method]
+	if !ok {
+		panic(fmt.Sprintf("Unknown quota method [%s]", method))
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := q.add(method, cost); err != nil {
+		return err
+	}
+	q.units[method] += cost
+	q.calls[method]++
+	return nil
+}
+
+// Adds cost to today's usage, starting from 0 once the day rolls over. Other runs
+// may have charged since the last call, so the file is re-read, added to and written
+// back under a lock.
+func (q *quotaTracker) add(method string, cost int64) error {
+	day := quotaDay(time.Now())
+	if q.path == "" {
+		if q.day != day {
+			q.day, q.usedToday = day, 0
+		}
+		if err := q.checkBudget(method, cost); err != nil {
+			return err
+		}
+		q.usedToday += cost
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(q.path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(q.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	// Closing releases the lock.
+	defer f.Close()
+	if err := lockFile(f, false, true); err != nil {
+		return fmt.Errorf("locking %s: %v", q.path, err)
+	}
+
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	usage := map[string]quotaUsage{}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &usage); err != nil {
+			return fmt.Errorf("parsing %s: %v", q.path, err)
+		}
+	}
+	u := usage[q.profile]
+	if u.Day != day {
+		u = quotaUsage{Day: day}
+	}
+	q.day, q.usedToday = day, u.Units
+	if cost == 0 {
+		return nil
+	}
+	if err := q.checkBudget(method, cost); err != nil {
+		return err
+	}
+
+	u.Units += cost
+	usage[q.profile] = u
+	b, err = json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(b, 0); err != nil {
+		return err
+	}
+	q.usedToday = u.Units
+	return nil
+}
+
+func (q *quotaTracker) checkBudget(method string, cost int64) error {
+	if q.budget > 0 && q.usedToday+cost > q.budget {
+		return fmt.Errorf("%w: %s needs %d units, %d of %d used today", errQuotaBudgetExceeded, method, cost, q.usedToday, q.budget)
+	}
+	return nil
+}
+
+func (q *quotaTracker) total() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.unitsThisRun()
+}
+
+func (q *quotaTracker) unitsThisRun() int64 {
+	var total int64
+	for _, units := range q.units {
+		total += units
+	}
+	return total
+}
+
+func (q *quotaTracker) printSummary() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	fmt.Println("Quota:")
+	methods := make([]string, 0, len(q.units))
+	for method := range q.units {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	for _, method := range methods {
+		fmt.Printf("* %s: %d calls, %d units\n", method, q.calls[method], q.units[method])
+	}
+	fmt.Printf("Units this run: %d\n", q.unitsThisRun())
+	if q.budget > 0 {
+		fmt.Printf("Units today: %d of %d\n", q.usedToday, q.budget)
+	} else {
+		fmt.Printf("Units today: %d\n", q.usedToday)
+	}
+}
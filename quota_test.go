@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func tempQuotaFile(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "gmail-cleanup-quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "quota.json")
+}
+
+func TestQuotaTrackersShareFile(t *testing.T) {
+	path := tempQuotaFile(t)
+	a, err := newQuotaTracker(path, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newQuotaTracker(path, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Runs charging at the same time don't lose each other's units.
+	var wg sync.WaitGroup
+	for _, q := range []*quotaTracker{a, b} {
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(q *quotaTracker) {
+				defer wg.Done()
+				if err := q.charge("messages.get"); err != nil {
+					t.Error(err)
+				}
+			}(q)
+		}
+	}
+	wg.Wait()
+
+	c, err := newQuotaTracker(path, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.usedToday != 200 {
+		t.Errorf("usedToday = %d, want 200", c.usedToday)
+	}
+	if a.total() != 100 {
+		t.Errorf("total() = %d, want the run's own 100", a.total())
+	}
+}
+
+func TestQuotaBudgetCountsOtherRuns(t *testing.T) {
+	path := tempQuotaFile(t)
+	a, err := newQuotaTracker(path, "work", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newQuotaTracker(path, "work", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.charge("messages.delete"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.charge("messages.get"); !errors.Is(err, errQuotaBudgetExceeded) {
+		t.Errorf("charge() after another run used the budget = %v, want %v", err, errQuotaBudgetExceeded)
+	}
+}
+
+func TestQuotaPerProfile(t *testing.T) {
+	path := tempQuotaFile(t)
+	tests := []struct {
+		profile string
+		charges int
+	}{
+		{"", 1},
+		{"work", 2},
+		{"home", 3},
+	}
+	for _, tt := range tests {
+		q, err := newQuotaTracker(path, tt.profile, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < tt.charges; i++ {
+			if err := q.charge("messages.list"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, tt := range tests {
+		t.Run(tt.profile, func(t *testing.T) {
+			q, err := newQuotaTracker(path, tt.profile, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := int64(tt.charges) * quotaUnits["messages.list"]; q.usedToday != want {
+				t.Errorf("usedToday = %d, want %d", q.usedToday, want)
+			}
+		})
+	}
+}
+
+func TestQuotaNewDay(t *testing.T) {
+	path := tempQuotaFile(t)
+	yesterday := quotaDay(time.Now().AddDate(0, 0, -1))
+	if err := ioutil.WriteFile(path, []byte(`{"": {"day": "`+yesterday+`", "units": 9000}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	q, err := newQuotaTracker(path, "", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.usedToday != 0 {
+		t.Errorf("usedToday = %d, want 0 on a new day", q.usedToday)
+	}
+
+	// A run still going when the day rolls over starts the new day from 0.
+	q.day = yesterday
+	q.usedToday = 9000
+	if err := q.charge("messages.get"); err != nil {
+		t.Fatal(err)
+	}
+	if q.usedToday != 5 {
+		t.Errorf("usedToday = %d, want 5", q.usedToday)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"google.golang.org/api/googleapi"
+)
+
+// A replacement made by this run, kept to check afterwards what it actually freed.
+type replacement struct {
+	originalId string
+	copyId     string
+	// Raw size of the original, and the decoded size of the attachments removed from it.
+	originalBytes   int64
+	attachmentBytes int64
+}
+
+// A replacement that freed less than its attachments' size led to expect.
+type lowSaving struct {
+	MessageId       string `json:"messageId"`
+	CopyId          string `json:"copyId"`
+	OriginalBytes   int64  `json:"originalBytes"`
+	CopyBytes       int64  `json:"copyBytes"`
+	AttachmentBytes int64  `json:"attachmentBytes"`
+	// Set if the original still exists, so nothing was freed.
+	OriginalRemains bool `json:"originalRemains,omitempty"`
+}
+
+// Fetches each copy's raw message and checks its original is gone, then sets
+// VerifiedReclaimedBytes in summary to the originals' raw sizes less the copies', and
+// lists in LowSavings the replacements that freed less than minPercent of their
+// attachments' size.
+func verifyReclaimed(mb *mailbox, replacements []replacement, minPercent int, summary *runSummary) error {
+	var verified int64
+	for _, r := range replacements {
+		copyMsg, err := mb.getMessage(r.copyId, "raw")
+		if err != nil {
+			return fmt.Errorf("Unable to get copy [%s]: %w", r.copyId, err)
+		}
+		raw, err := base64.URLEncoding.DecodeString(copyMsg.Raw)
+		if err != nil {
+			return fmt.Errorf("copy [%s]: %w", r.copyId, err)
+		}
+		copyBytes := int64(len(raw))
+
+		_, err = mb.getMessage(r.originalId, "minimal")
+		var apiErr *googleapi.Error
+		remains := !(errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound)
+		if remains && err != nil {
+			return fmt.Errorf("Unable to check original [%s]: %w", r.originalId, err)
+		}
+
+		saved := r.originalBytes - copyBytes
+		if remains {
+			saved = -copyBytes
+		}
+		verified += saved
+		if remains || saved*100 < r.attachmentBytes*int64(minPercent) {
+			summary.LowSavings = append(summary.LowSavings, lowSaving{
+				MessageId:       r.originalId,
+				CopyId:          r.copyId,
+				OriginalBytes:   r.originalBytes,
+				CopyBytes:       copyBytes,
+				AttachmentBytes: r.attachmentBytes,
+				OriginalRemains: remains,
+			})
+		}
+	}
+	summary.VerifiedReclaimedBytes = &verified
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+
+	"github.com/weineran/gmail-cleanup/transform"
+)
+
+const redactedText = "[REDACTED]"
+
+// A kind of sensitive text. valid, if set, rejects matches that only look like one.
+type redactionPattern struct {
+	name  string
+	re    *regexp.Regexp
+	valid func(match string) bool
+}
+
+var builtinRedactions = []redactionPattern{
+	{name: "credit-card", re: regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`), valid: luhnValid},
+	{name: "ssn", re: regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`), valid: ssnValid},
+	{name: "api-key", re: regexp.MustCompile(`\bAKIA[0-9A-Z]{16}\b` +
+		`|\bgh[pousr]_[A-Za-z0-9]{36,}\b` +
+		`|\bxox[abposr]-[A-Za-z0-9-]{10,}\b` +
+		`|\b[sr]k_live_[0-9A-Za-z]{24,}\b` +
+		`|\bAIza[0-9A-Za-z_-]{35}\b` +
+		`|-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`)},
+}
+
+// Replaces sensitive text in the bodies of rewritten messages with [REDACTED].
+type redactor struct {
+	patterns []redactionPattern
+}
+
+// Builds a redactor from built-in pattern names, or "all", and a file of extra regular
+// expressions, one per line.
+func newRedactor(names []string, patternsFile string) (*redactor, error) {
+	r := &redactor{}
+	for _, name := range names {
+		found := false
+		for _, p := range builtinRedactions {
+			if name == "all" || name == p.name {
+				r.patterns = append(r.patterns, p)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown redaction [%s], expected credit-card, ssn, api-key or all", name)
+		}
+	}
+	if patternsFile != "" {
+		f, err := os.Open(patternsFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			re, err := regexp.Compile(line)
+			if err != nil {
+				return nil, fmt.Errorf("redaction pattern [%s]: %w", line, err)
+			}
+			r.patterns = append(r.patterns, redactionPattern{name: line, re: re})
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Returns text with every valid match replaced, and how many were replaced.
+func (r *redactor) redact(text []byte) ([]byte, int) {
+	count := 0
+	for _, p := range r.patterns {
+		text = p.re.ReplaceAllFunc(text, func(match []byte) []byte {
+			if p.valid != nil && !p.valid(string(match)) {
+				return match
+			}
+			count++
+			return []byte(redactedText)
+		})
+	}
+	return text, count
+}
+
+func (r *redactor) Transform(m *transform.ParsedMessage) error {
+	for _, part := range m.Parts() {
+		if !isRedactable(part) {
+			continue
+		}
+		body, err := transform.Body(part)
+		if err != nil {
+			return err
+		}
+		redacted, count := r.redact(body)
+		if count > 0 {
+			log.Printf("Redacted %d matches in part [%s] of message [%s]\n", count, part.PartId, m.Original.Id)
+			transform.SetBody(part, redacted)
+		}
+	}
+	return nil
+}
+
+// Reports whether a message fetched in full format has anything to redact, so it is
+// rewritten even without attachments.
+func (r *redactor) matches(m *gmail.Message) bool {
+	var parts []*gmail.MessagePart
+	for _, part := range getMessagePartsRecursively(m.Payload, parts) {
+		if !isRedactable(part) {
+			continue
+		}
+		body, err := base64.URLEncoding.DecodeString(part.Body.Data)
+		if err != nil {
+			continue
+		}
+		if _, count := r.redact(body); count > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Text bodies, not attachments.
+func isRedactable(p *gmail.MessagePart) bool {
+	return p.Filename == "" && p.Body != nil && p.Body.Data != "" && strings.HasPrefix(strings.ToLower(p.MimeType), "text/")
+}
+
+// Reports whether the digits in s pass the Luhn check used by card numbers.
+func luhnValid(s string) bool {
+	sum, n := 0, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n >= 13 && sum%10 == 0
+}
+
+// Rejects numbers the SSA never issues: area 000, 666 or 9xx, group 00 or serial 0000.
+func ssnValid(s string) bool {
+	area, group, serial := s[0:3], s[4:6], s[7:11]
+	return area != "000" && area != "666" && area[0] != '9' && group != "00" && serial != "0000"
+}
@@ -20,250 +20,1280 @@ package main
 import (
 	"context"
 	"encoding/base64"
-	"encoding/json"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
 	//"github.com/kylelemons/godebug/diff"
+	"io"
 	"io/ioutil"
 	"log"
-	"mime/quotedprintable"
 	"net/http"
 	"os"
-	"regexp"
-	"sort"
+	"os/exec"
 	"strings"
+	"time"
 
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
+	"google.golang.org/api/drive/v3"
 	"google.golang.org/api/gmail/v1"
-	"google.golang.org/api/option"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/people/v1"
+
+	"github.com/weineran/gmail-cleanup/internal/gmailapi"
+	"github.com/weineran/gmail-cleanup/internal/mimeutil"
+	"github.com/weineran/gmail-cleanup/transform"
 )
 
-// Retrieve a token, saves the token, then returns the generated client.
-func getClient(config *oauth2.Config) *http.Client {
-	// The file token.json stores the user's access and refresh tokens, and is
-	// created automatically when the authorization flow completes for the first
-	// time.
-	tokFile := "token.json"
-	tok, err := tokenFromFile(tokFile)
+// Builds a copy of m without attachments, after running the transformers on its payload.
+// Transformers can keep an attachment, e.g. after shrinking it.
+func copyMessageExAttachments(m *gmail.Message, attachments []fetchedAttachment, transformers []transform.Transformer) (*gmail.Message, error) {
+	c, err := buildCopy(m, attachments, transformers)
 	if err != nil {
-		tok = getTokenFromWeb(config)
-		saveToken(tokFile, tok)
+		return nil, err
 	}
-	return config.Client(context.Background(), tok)
+	defer c.close()
+	return c.withRaw()
 }
 
-// Request a token from the web, then returns the retrieved token.
-func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
-	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
-	fmt.Printf("Go to the following link in your browser then type the "+
-		"authorization code: \n%v\n", authURL)
+// A copy of a message without attachments, its raw source in a spool file rather than
+// in memory, since it has the attachments the transformers kept.
+type messageCopy struct {
+	// The copy's labels, thread and payload. Raw isn't set.
+	*gmail.Message
+	raw *mimeutil.Spool
+}
 
-	var authCode string
-	if _, err := fmt.Scan(&authCode); err != nil {
-		log.Fatalf("Unable to read authorization code: %v", err)
+// Builds the copy copyMessageExAttachments returns, streaming kept attachments from
+// where they were downloaded into the copy's spool file.
+func buildCopy(m *gmail.Message, attachments []fetchedAttachment, transformers []transform.Transformer) (*messageCopy, error) {
+	if m.Payload == nil {
+		errorString := fmt.Sprintf("Message [%+v] must have a Payload", m)
+		panic(errorString)
 	}
 
-	tok, err := config.Exchange(context.TODO(), authCode)
+	parsed, err := transform.NewParsedMessage(m)
 	if err != nil {
-		log.Fatalf("Unable to retrieve token from web: %v", err)
+		return nil, err
+	}
+	downloaded := map[string]fetchedAttachment{}
+	for _, a := range attachments {
+		downloaded[a.part.PartId] = a
+		parsed.AddAttachment(a.part, a.data)
+	}
+	for _, t := range transformers {
+		if err := t.Transform(parsed); err != nil {
+			return nil, fmt.Errorf("transforming message [%s]: %w", m.Id, err)
+		}
 	}
-	return tok
-}
 
-// Retrieves a token from a local file.
-func tokenFromFile(file string) (*oauth2.Token, error) {
-	f, err := os.Open(file)
+	ensureDateHeader(parsed)
+	// Links the copy back to the message it replaces; the journal links the other way.
+	parsed.Payload.Headers = mimeutil.WithHeader(parsed.Payload.Headers, originalIdHeader, m.Id)
+
+	raw, err := mimeutil.NewSpool()
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-	tok := &oauth2.Token{}
-	err = json.NewDecoder(f).Decode(tok)
-	return tok, err
+	if len(parsed.Payload.Parts) == 0 {
+		_, err = io.WriteString(raw, mimeutil.SinglePartToRaw(parsed.Payload))
+	} else {
+		var boundary string
+		boundary, err = mimeutil.Boundary(parsed.Payload.Headers)
+		if err == nil {
+			open := func(p *gmail.MessagePart) (io.Reader, error) {
+				a, ok := downloaded[p.PartId]
+				if !ok {
+					return nil, fmt.Errorf("attachment [%s] wasn't downloaded", p.Filename)
+				}
+				return a.open()
+			}
+			err = mimeutil.WriteMultipart(raw, parsed.Payload, boundary, parsed.Kept, open)
+		}
+	}
+	if err != nil {
+		raw.Close()
+		return nil, fmt.Errorf("message [%s]: %w", m.Id, err)
+	}
+
+	newMsg := gmail.Message{InternalDate: m.InternalDate, LabelIds: m.LabelIds, Payload: parsed.Payload, ThreadId: m.ThreadId}
+	return &messageCopy{Message: &newMsg, raw: raw}, nil
+}
+
+// The size of the copy's raw source.
+func (c *messageCopy) size() int64 {
+	return c.raw.Size()
+}
+
+// Returns a source streaming the copy's raw source from its spool file.
+func (c *messageCopy) source() gmailapi.RawSource {
+	return func() (io.ReadCloser, error) { return ioutil.NopCloser(c.raw.Reader()), nil }
 }
 
-// Saves a token to a file path.
-func saveToken(path string, token *oauth2.Token) {
-	fmt.Printf("Saving credential file to: %s\n", path)
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+// Returns the copy as a message with Raw set, read into memory.
+func (c *messageCopy) withRaw() (*gmail.Message, error) {
+	raw, err := ioutil.ReadAll(c.raw.Reader())
 	if err != nil {
-		log.Fatalf("Unable to cache oauth token: %v", err)
+		return nil, err
 	}
-	defer f.Close()
-	json.NewEncoder(f).Encode(token)
+	m := *c.Message
+	m.Raw = base64.URLEncoding.EncodeToString(raw)
+	return &m, nil
 }
 
-// See here why this is needed: https://stackoverflow.com/a/15621614
-func convertToQuotedPrintable(s string) string {
-	var b strings.Builder
-	w := quotedprintable.NewWriter(&b)
-	w.Write([]byte(s))
-	w.Close()
+// Removes the spool file.
+func (c *messageCopy) close() {
+	c.raw.Close()
+}
 
-	return b.String()
+func getMessagePartsRecursively(p *gmail.MessagePart, parts []*gmail.MessagePart) []*gmail.MessagePart {
+	parts = append(parts, p)
+
+	for _, subpart := range p.Parts {
+		// recurse
+		parts = getMessagePartsRecursively(subpart, parts)
+	}
+
+	return parts
 }
 
-func convertPartToRawExAttachments(p *gmail.MessagePart, boundary string, depth int) string {
-	var result string
+// Asks a y/n question on stdin. Exits on any other answer.
+func askYesNo(question string) bool {
+	fmt.Println(trf("%s (y or n)", question))
+	yes, ok := parseYesNo(strings.ToLower(strings.TrimSpace(readLine())))
+	if !ok {
+		log.Fatal(trf("Invalid input. Allowed values are [%s]. Exiting.", yesNoChoices()))
+	}
+	return yes
+}
+
+// Options for removing attachments.
+type removeOptions struct {
+	transformers []transform.Transformer
+	store        *attachmentStore
+	// Also writes the attachments to archive to a directory of the user's choosing, if not nil.
+	exporter     *attachmentExporter
+	photos       *photosUploader
+	scanner      *attachmentScanner
+	manifestPage *manifestPage
+	policy       []policyRule
+	// The user's own addresses, whose mail is categorized as from me.
+	own map[string]bool
+	// Messages picked to bring their sender under a budget, whose action replaces the policy's.
+	overBudget map[string]*policyBudget
+
+	// In compliance mode originals are never deleted. Copies get only complianceLabelId
+	// and are recorded in manifestPath.
+	complianceMode    bool
+	complianceLabelId string
+	manifestPath      string
+
+	// Approve every message without asking.
+	assumeYes bool
+	// Messages approved in this run, or by the earlier run being retried.
+	approved map[string]bool
+	// Senders whose remaining messages are approved (true) or skipped (false) without asking,
+	// and the policies file to save new decisions to, if any.
+	senderDecisions     map[string]bool
+	senderDecisionsFile string
+	// For messages whose copy an earlier run inserted without deleting the original,
+	// the journal entry recording the copy.
+	replaced map[string]journalEntry
+
+	// Lowercase addresses whose mail needs an extra confirmation, or is skipped with assumeYes.
+	protectedContacts map[string]bool
+
+	// Records trashed and replaced messages so they can be restored.
+	journal *runJournal
+	// Saves the raw original of each replaced message here first, for rollback, if not "".
+	backupDir string
+
+	// Stop after this many messages, if not 0.
+	maxMessages int
+	// The most messages the run may delete or strip, or 0 for no limit.
+	maxDestructive int
+	// Skip messages up to where an earlier run stopped, if not nil.
+	resumeAfter *continuation
+	// Skip messages processed before a restart, and record those processed now, if not nil.
+	progress *progressLog
+	// Order messages by descending score instead of size, if not nil.
+	scoreExpr *scoreExpr
+	// Process messages in the order given, e.g. a thread's, instead of by size or score.
+	keepOrder bool
+
+	// insertMethodInsert or insertMethodImport.
+	insertMethod string
+	// Fetch messages from and add copies to this backend instead of the Gmail API, if not nil.
+	// Only the Gmail API has drafts, labels, copy verification and --delete-first.
+	backend mailBackend
+
+	// Pause outside these hours, if not nil.
+	activeHours *activeHours
+
+	// Fail messages whose copy lost or reordered original top-level headers, except those
+	// with lowercase names in strictHeadersIgnore.
+	strictHeaders       bool
+	strictHeadersIgnore map[string]bool
+
+	// Create stripped copies as drafts recorded in this file, instead of replacing originals.
+	draftsFile string
+
+	// Rewrites messages with sensitive text even if they have no attachments, if not nil.
+	redactor *redactor
+
+	// Labels threads with rewritten messages, if not nil.
+	threadLabels *threadLabeler
+
+	// What happens to attachments by file extension, from the policies file.
+	attachmentRules []attachmentRule
+	// Keep calendar invitations in copies, and leave messages with no other attachments alone.
+	keepCalendar bool
+	// Only process sent messages, and keep their attachments without a copy here, if not nil.
+	localCopies *localCopies
+
+	// Messages matching these are labeled protectedLabelId and left alone.
+	protectionPatterns []protectionPattern
+	protectedLabelId   string
+
+	// Bytes freed so far: each replaced original's size less its copy's.
+	reclaimed int64
+	// The size of the messages trashed so far.
+	trashed int64
+	// What was stripped or trashed so far, by category, for trends.
+	cleaned map[string]*categoryTotals
+	// Record the replacements made, to verify what they freed after the run.
+	verifyReclaimed bool
+	replacements    []replacement
+
+	// Checks copies in the background, deleting originals only once theirs check out, if not nil.
+	verifier *copyVerifier
+	// Delete each original, once its backup checks out, before inserting its copy, for
+	// accounts too full to take the copy first.
+	deleteFirst bool
+
+	// Record what would be done to each message here instead of doing it, if not nil.
+	plan *actionPlan
+	// Only do what a plan recorded, by message id, if not nil.
+	applying map[string]plannedAction
+
+	// Interactive decisions kept across sessions, if not nil.
+	review *reviewState
+	// Set when the reviewer quits at a question.
+	quitting bool
+}
 
-	for _, header := range p.Headers {
-		result = result + header.Name + ": " + header.Value + "\r\n"
+// Asks question about msg unless it, or its sender, is decided already, and remembers a yes.
+func (opts *removeOptions) approve(msg *gmail.Message, question string) bool {
+	if opts.assumeYes || opts.approved[msg.Id] {
+		return true
 	}
+	var sender string
+	if msg.Payload != nil {
+		sender = senderAddress(mimeutil.HeaderValue(msg.Payload.Headers, "From"))
+	}
+	approve, decided := opts.senderDecisions[sender]
+	if decided {
+		log.Printf("Decided for all mail from [%s]: approve %v\n", sender, approve)
+	} else {
+		answer := askSenderDecision(question, sender)
+		if answer.quit {
+			opts.quitting = true
+			return false
+		}
+		approve = answer.approve
+		if opts.review != nil {
+			decision := decisionSkipped
+			if approve {
+				decision = decisionApproved
+			} else if answer.later {
+				decision = decisionLater
+			}
+			if err := opts.review.record(msg.Id, decision); err != nil {
+				log.Printf("Unable to save decision: %v\n", err)
+			}
+		}
+		if answer.allFromSender {
+			opts.senderDecisions[sender] = approve
+			if opts.senderDecisionsFile != "" && askYesNo(trf("Save this decision for [%s] in [%s] for later runs?", sender, opts.senderDecisionsFile)) {
+				if err := saveSenderDecision(opts.senderDecisionsFile, sender, approve); err != nil {
+					log.Printf("Unable to save decision: %v\n", err)
+				}
+			}
+		}
+	}
+	if approve {
+		opts.approved[msg.Id] = true
+	}
+	return approve
+}
 
-	if p.Filename == "" && p.Body != nil {
-		result += "\r\n"
-		decodedData, _ := base64.URLEncoding.DecodeString(p.Body.Data)
-		decodedDataStr := convertToQuotedPrintable(string(decodedData))
-		result += decodedDataStr
-		result += "\r\n"
-		result = result + "--" + boundary + "\r\n"
+// Shows a message and its attachments, and if confirmed replaces it with a copy without
+// attachments, through opts.mailBackend(mb).
+func processMessage(mb *mailbox, msg *gmail.Message, opts *removeOptions) (outcome, error) {
+	if isChatMessage(msg.LabelIds) {
+		return skipChatMessage(msg.Id), nil
+	}
+	backend := opts.mailBackend(mb)
+
+	fmt.Println("------------------------------")
+	fmt.Println("Message:")
+	fmt.Printf("Id: %+v\n", msg.Id)
+	fmt.Printf("Snippet: %+v\n", msg.Snippet)
+	fmt.Printf("SizeEstimate: %+v\n", msg.SizeEstimate)
+	fmt.Printf("LabelIds: %+v\n", msg.LabelIds)
+	fmt.Println("Headers:")
+	if msg.Payload != nil {
+		for _, header := range msg.Payload.Headers {
+			fmt.Printf("* %+v: %+v\n", header.Name, header.Value)
+		}
+	}
+	fmt.Println("Body:")
+	if msg.Payload != nil && msg.Payload.Body != nil {
+		fmt.Printf("%+v", msg.Payload.Body.Data)
 	}
 
-	for _, subpart := range p.Parts {
-		// recurse
-		result += convertPartToRawExAttachments(subpart, boundary, depth+1)
+	if entry, ok := opts.replaced[msg.Id]; ok {
+		return finishReplacement(mb, msg, entry, opts)
+	}
+	if opts.localCopies != nil && !hasLabel(msg, "SENT") {
+		log.Printf("Message [%+v] wasn't sent by you, skipping.\n", msg.Id)
+		return outcomeSkipped, nil
 	}
 
-	// The last boundary has a trailing "--". See e.g. https://docs.microsoft.com/en-us/exchange/troubleshoot/administration/multipart-mixed-mime-message-format
-	if depth == 0 {
-		expectedSuffix := "\r\n"
-		if !strings.HasSuffix(result, expectedSuffix) {
-			log.Fatalf(`Expected suffix [%s] on result [%s]`, expectedSuffix, result)
+	// One raw fetch, parsed locally, stands in for full format and fetching each attachment.
+	// The message is spooled to a file, and attachments are read from there when needed.
+	fullMsg, spool, err := backend.fetch(msg.Id)
+	if err != nil {
+		return "", err
+	}
+	defer spool.Close()
+	if isChatMessage(fullMsg.LabelIds) {
+		return skipChatMessage(msg.Id), nil
+	}
+	fmt.Println("-------------RAW DECODED MESSAGE--------------------")
+	io.Copy(os.Stdout, spool.Reader())
+	fmt.Println()
+	rawSum := spool.SHA256()
+	fmt.Println("----------------------------------------------------")
+
+	if sender := senderAddress(mimeutil.HeaderValue(fullMsg.Payload.Headers, "From")); opts.protectedContacts[sender] && !opts.approved[msg.Id] {
+		if opts.assumeYes {
+			log.Printf("Message [%+v] is from protected contact [%s], skipping.\n", msg.Id, sender)
+			return outcomeSkipped, nil
 		}
+		if !askYesNo(trf("This email is from protected contact [%s]. Do you still want to consider it?", sender)) {
+			log.Printf("Skipped message [%+v]\n", msg.Id)
+			return outcomeSkipped, nil
+		}
+	}
 
-		newLength := len(result) - len(expectedSuffix)
-		result = result[:newLength]
+	if pattern := matchProtection(opts.protectionPatterns, fullMsg); pattern != "" {
+		log.Printf("Message [%+v] matches protection pattern [%s], skipping. Use --override-protection to process it.\n", msg.Id, pattern)
+		// Other backends have no labels to mark it with.
+		if opts.plan != nil || opts.protectedLabelId == "" {
+			return outcomeProtected, nil
+		}
+		if _, err := mb.modifyMessage(msg.Id, []string{opts.protectedLabelId}, nil); err != nil {
+			return "", fmt.Errorf("Unable to label protected message: %w", err)
+		}
+		return outcomeProtected, nil
+	}
 
-		result += "--"
-	} else {
-		if depth < 0 {
-			log.Fatalf(`Recursion depth [%d] cannot be less than 0`, depth)
+	category := classifyMessage(fullMsg, opts.own)
+	fmt.Printf("Category: %+v\n", category)
+	var rule *policyRule
+	if budget, ok := opts.overBudget[msg.Id]; ok {
+		fmt.Printf("Sender is over its budget of %s\n", formatBytes(budget.maxBytes))
+		rule = &policyRule{action: budget.action}
+	} else if opts.policy != nil {
+		rule = matchPolicy(opts.policy, newPolicySubject(fullMsg, opts.own))
+		if rule == nil {
+			log.Printf("No policy rule matches message [%+v], skipping.\n", msg.Id)
+			return outcomeSkipped, nil
 		}
 	}
+	if rule != nil && rule.action == actionDelete {
+		if opts.complianceMode {
+			log.Printf("Compliance mode: not deleting message [%+v]\n", msg.Id)
+			return outcomeSkipped, nil
+		}
+		if result := opts.checkPlan(newPlannedAction(fullMsg, rawSum, planTrash)); result != "" {
+			return result, nil
+		}
+		if !opts.approve(fullMsg, tr("Policy says delete. Do you want to move this email to the trash?")) {
+			log.Printf("Skipped message [%+v]\n", msg.Id)
+			return outcomeSkipped, nil
+		}
+		entry := newJournalEntry(journalTrashed, fullMsg)
+		entry.RawSHA256 = hex.EncodeToString(rawSum[:])
+		if err := opts.journal.record(entry); err != nil {
+			return "", fmt.Errorf("Unable to write journal: %w", err)
+		}
+		if err := backend.trash(msg.Id); err != nil {
+			return "", fmt.Errorf("Unable to trash message: %w", err)
+		}
+		log.Printf("Trashed message [%+v]\n", msg.Id)
+		opts.trashed += fullMsg.SizeEstimate
+		opts.countCleaned(category, fullMsg.SizeEstimate)
+		return outcomeTrashed, nil
+	}
 
-	return result
-}
+	// Useful reference: https://stackoverflow.com/questions/25832631/download-attachments-from-gmail-using-gmail-api
+	var attachments []string
+	// Every attachment, those the attachment rules remove, and those of them to archive.
+	var fetched, removed, archivable []fetchedAttachment
+	retained := retainedAttachments{}
+	now := time.Now()
+	for _, part := range attachmentParts(fullMsg.Payload) {
+		if mimeutil.IsAttachedMessage(part) && part.Filename == "" {
+			// Also marks the attached email as an attachment for the rebuild.
+			part.Filename = attachedMessageFilename(part, spool)
+		}
 
-func readBoundaryTryAgain(h string) string {
-	re := regexp.MustCompile(`boundary=([^\r\n]*)`)
-	matches := re.FindSubmatch([]byte(h))
-	if len(matches) > 2 {
-		errorString := fmt.Sprintf("Found multiple matches for boundary [%q]", matches)
-		panic(errorString)
+		f := fetchedAttachment{part: part, body: part.Body, spool: spool}
+		fetched = append(fetched, f)
+		if opts.keepCalendar && isCalendarPart(part) {
+			retained[part.PartId] = true
+			attachments = append(attachments, fmt.Sprintf("* %+v: %+v (kept, calendar invitation)", part.Filename, part.Body.Size))
+			continue
+		}
+		action := attachmentAction(opts.attachmentRules, part.Filename, messageDate(fullMsg), now)
+		if action != actionKeep && opts.localCopies != nil {
+			r, err := f.open()
+			if err != nil {
+				return "", err
+			}
+			path, err := opts.localCopies.find(r)
+			if err != nil {
+				return "", fmt.Errorf("Unable to look for a local copy of [%s]: %w", part.Filename, err)
+			}
+			if path == "" {
+				retained[part.PartId] = true
+				attachments = append(attachments, fmt.Sprintf("* %+v: %+v (kept, no local copy)", part.Filename, part.Body.Size))
+				continue
+			}
+			log.Printf("Attachment [%s] has a local copy at [%s]\n", part.Filename, path)
+		}
+		switch action {
+		case actionKeep:
+			retained[part.PartId] = true
+			attachments = append(attachments, fmt.Sprintf("* %+v: %+v (kept by policy)", part.Filename, part.Body.Size))
+		case actionDelete:
+			removed = append(removed, f)
+			attachments = append(attachments, fmt.Sprintf("* %+v: %+v (deleted by policy, not archived)", part.Filename, part.Body.Size))
+		default:
+			removed = append(removed, f)
+			archivable = append(archivable, f)
+			attachments = append(attachments, fmt.Sprintf("* %+v: %+v", part.Filename, part.Body.Size))
+		}
 	}
-	if len(matches) <= 1 {
-		errorString := fmt.Sprintf("Failed to find matches for boundary in header [%s]", h)
-		panic(errorString)
+
+	redacting := opts.redactor != nil && opts.redactor.matches(fullMsg)
+	if len(removed) == 0 && !redacting {
+		if opts.keepCalendar && len(fetched) > 0 && calendarOnly(fetched) {
+			log.Printf("Message [%+v] only has calendar invitations.\n", msg.Id)
+		} else if len(fetched) > 0 {
+			log.Printf("Policy keeps every attachment of message [%+v].\n", msg.Id)
+		} else {
+			log.Printf("No attachments found on message [%+v].\n", msg.Id)
+		}
+		return outcomeNoAttachments, nil
 	}
 
-	boundary := string(matches[1])
-	log.Printf("Found boundary on second try [%+v]\n", boundary)
+	if boundary, err := mimeutil.Boundary(fullMsg.Payload.Headers); err == nil {
+		fullMsgPayloadExAttachments, _ := mimeutil.PartToRaw(fullMsg.Payload, boundary, nil)
+		fmt.Println("-------------RAW MESSAGE EX ATTACHMENTS--------------------")
+		fmt.Printf("%+v\n", fullMsgPayloadExAttachments)
+		fmt.Println("----------------------------------------------------")
+	}
 
-	return boundary
-}
+	// TODO: Comparing the message without attachments to the original message will of course be different.
+	//       Need to add unit tests instead. Download msg, encode base64 raw, compare to raw message,
+	//       insert new message, download new message, compare parts to original message. delete/clean up.
+	// if fullMsgPayloadExAttachments != string(decodedMsg) {
+	// 	fmt.Printf("CAUTION. STRINGS ARE NOT IDENTICAL. DIFF:")
+	// 	fmt.Printf("%+v\n", diff.Diff(string(decodedMsg), fullMsgPayloadExAttachments))
+	// }
+
+	fmt.Printf("Attachments (%+v):\n", len(attachments))
+	for _, a := range attachments {
+		fmt.Println(a)
+	}
 
-func readBoundaryFromHeaders(headers []*gmail.MessagePartHeader) string {
-	var boundary string
+	question := tr("Do you want to delete the attachments from this email?")
+	if redacting {
+		fmt.Println("Message contains text to redact.")
+		question = tr("Do you want to delete the attachments from this email and redact it?")
+		if len(removed) == 0 {
+			question = tr("Do you want to redact this email?")
+		}
+	}
+	if result := opts.checkPlan(newPlannedStrip(opts, fullMsg, rawSum, fetched, removed, archivable, redacting)); result != "" {
+		return result, nil
+	}
+	if !opts.approve(fullMsg, question) {
+		log.Printf("Skipped message [%+v]\n", msg.Id)
+		return outcomeSkipped, nil
+	}
 
-	for _, header := range headers {
-		if strings.ToLower(header.Name) == "content-type" && strings.Contains(header.Value, `boundary=`) {
-			if boundary != "" {
-				errorString := fmt.Sprintf("Previously found boundary [%s]. This header also contains boundary [%s: %s].", boundary, header.Name, header.Value)
-				panic(errorString)
+	if opts.exporter != nil {
+		for _, a := range archivable {
+			data, err := a.data()
+			if err != nil {
+				return "", err
 			}
-
-			log.Printf("Extracting boundary from header [%s: %s]\n", header.Name, header.Value)
-			re := regexp.MustCompile(`boundary="([^\"]*)"`)
-			matches := re.FindSubmatch([]byte(header.Value))
-			if len(matches) > 2 {
-				errorString := fmt.Sprintf("Found multiple matches for boundary [%q]", matches)
-				panic(errorString)
+			path, err := opts.exporter.export(newAttachmentName(fullMsg, a.part.Filename, data), data)
+			if err != nil {
+				return "", fmt.Errorf("Unable to export attachment [%s]: %w", a.part.Filename, err)
 			}
-			if len(matches) <= 1 {
-				boundary = readBoundaryTryAgain(header.Value)
-			} else {
-				boundary = string(matches[1])
+			log.Printf("Exported attachment [%s] to [%s]\n", a.part.Filename, path)
+		}
+	}
+	if opts.photos != nil {
+		added, err := opts.photos.upload(fullMsg, archivable)
+		if err != nil {
+			return "", fmt.Errorf("Unable to upload to Google Photos: %w", err)
+		}
+		if added > 0 {
+			log.Printf("Added %d photos and videos of message [%s] to Google Photos\n", added, fullMsg.Id)
+		}
+	}
+	if opts.store != nil && len(archivable) > 0 {
+		archived, err := archiveAttachments(opts.store, opts.scanner, fullMsg, archivable)
+		if err != nil {
+			return "", fmt.Errorf("Unable to archive attachments: %w", err)
+		}
+		if opts.manifestPage != nil {
+			if err := opts.manifestPage.add(fullMsg, archived); err != nil {
+				return "", fmt.Errorf("Unable to write manifest page: %w", err)
 			}
+		}
+	}
+
+	log.Printf("Copying message [%+v]\n", fullMsg.Id)
+	// Use original date of message: InternalDateSource('dateHeader'). See also:
+	// * https://developers.google.com/gmail/api/reference/rest/v1/InternalDateSource
+	// * https://stackoverflow.com/questions/46434390/remove-an-attachment-of-a-gmail-email-with-google-apps-script
+	transformers := opts.transformers
+	if len(retained) > 0 {
+		transformers = append([]transform.Transformer{retained}, transformers...)
+	}
+	newMsg, err := buildCopy(fullMsg, fetched, transformers)
+	if err != nil {
+		return "", err
+	}
+	newMsg, err = fitInsertSize(fullMsg, newMsg, fetched, transformers)
+	if err != nil {
+		return "", err
+	}
+	defer newMsg.close()
 
+	if opts.strictHeaders {
+		original, err := spool.HeaderBlock()
+		if err != nil {
+			return "", err
+		}
+		rebuilt, err := newMsg.raw.HeaderBlock()
+		if err != nil {
+			return "", err
+		}
+		if err := checkHeadersPreserved(original, rebuilt, opts.strictHeadersIgnore); err != nil {
+			return "", fmt.Errorf("%w: --strict-headers: %v", errVerificationFailed, err)
 		}
 	}
 
-	if boundary == "" {
-		for _, header := range headers {
-			log.Printf("%+v: %+v\n", header.Name, header.Value)
+	if opts.complianceMode {
+		newMsg.LabelIds = []string{opts.complianceLabelId}
+	}
+
+	entry := newJournalEntry(journalStripped, fullMsg)
+	entry.RawSHA256 = hex.EncodeToString(rawSum[:])
+	entry.Attachments = describeAttachments(removed)
+	if opts.draftsFile != "" {
+		draft, err := newMsg.withRaw()
+		if err != nil {
+			return "", err
 		}
-		log.Fatalf("Unable to find boundary in headers [%+v]", headers)
+		if err := previewAsDraft(mb, draft, entry, opts.draftsFile); err != nil {
+			return "", err
+		}
+		return outcomeDrafted, nil
 	}
-	log.Printf("Found boundary [%s]\n", boundary)
 
-	return boundary
-}
+	if !opts.complianceMode {
+		if opts.backupDir != "" {
+			if err := writeBackup(opts.backupDir, opts.journal.runId, msg.Id, spool.Reader()); err != nil {
+				return "", fmt.Errorf("Unable to back up message: %w", err)
+			}
+		}
+		copying := newJournalEntry(journalCopying, fullMsg)
+		if opts.deleteFirst {
+			if err := verifyDeleteFirst(mb, opts, fullMsg, entry.RawSHA256, newMsg); err != nil {
+				return "", err
+			}
+			copying.RawSHA256, copying.DeletedFirst = entry.RawSHA256, true
+		}
+		if err := opts.journal.record(copying); err != nil {
+			return "", fmt.Errorf("Unable to write journal: %w", err)
+		}
+		if opts.deleteFirst {
+			log.Printf("Deleting original message [%+v] before inserting its copy\n", msg.Id)
+			if err := backend.remove(msg.Id); err != nil {
+				return "", fmt.Errorf("Unable to delete message: %w", err)
+			}
+		}
+	}
+	log.Println("Inserting copied message without attachments.")
+	copyId, err := backend.add(newMsg, internalDate(fullMsg))
+	if err != nil && opts.deleteFirst {
+		return "", restoreDeletedFirst(mb, opts, entry, err)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Unable to insert message: %w", err)
+	}
 
-func copyMessageExAttachments(m *gmail.Message) *gmail.Message {
-	if m.Payload == nil {
-		errorString := fmt.Sprintf("Message [%+v] must have a Payload", m)
-		panic(errorString)
+	log.Printf("Inserted copy [%+v]\n", copyId)
+
+	if opts.complianceMode {
+		if err := appendManifest(opts.manifestPath, newManifestEntry(fullMsg, copyId, removed)); err != nil {
+			return "", fmt.Errorf("Unable to write manifest: %w", err)
+		}
+		log.Printf("Compliance mode: kept original message [%+v]\n", msg.Id)
+		return outcomeKept, nil
 	}
 
-	boundary := readBoundaryFromHeaders(m.Payload.Headers)
+	replace := func() (outcome, error) {
+		entry.CopyId = copyId
+		if err := opts.journal.record(entry); err != nil {
+			return "", fmt.Errorf("Unable to write journal: %w", err)
+		}
+		if !opts.deleteFirst {
+			log.Printf("Deleting original message [%+v]\n", msg.Id)
+			if err := backend.remove(msg.Id); err != nil {
+				return "", fmt.Errorf("Unable to delete message: %w", err)
+			}
+		}
+		saved := fullMsg.SizeEstimate - newMsg.size()
+		opts.reclaimed += saved
+		opts.countCleaned(category, saved)
+		if opts.verifyReclaimed {
+			r := replacement{originalId: msg.Id, copyId: copyId, originalBytes: spool.Size()}
+			for _, a := range removed {
+				r.attachmentBytes += a.part.Body.Size
+			}
+			opts.replacements = append(opts.replacements, r)
+		}
+		return outcomeStripped, nil
+	}
+	// With the original already deleted, there is nothing left to wait for.
+	if opts.verifier == nil || opts.deleteFirst {
+		return replace()
+	}
+	inserted, err := newMsg.raw.Parse()
+	if err != nil {
+		return "", fmt.Errorf("Unable to parse copy: %w", err)
+	}
+	opts.verifier.enqueue(&verification{msg: msg, copyId: copyId, inserted: mimeutil.Outline(inserted.Payload),
+		rfc822MessageId: mimeutil.HeaderValue(fullMsg.Payload.Headers, "Message-ID"), replace: replace})
+	return outcomeVerifying, nil
+}
 
-	rawPayload := convertPartToRawExAttachments(m.Payload, boundary, 0)
+// Subcommands by name. Without a subcommand the tool removes attachments.
+var commands = map[string]func(args []string){
+	"all-profiles":         runAllProfiles,
+	"archive":              runArchive,
+	"attachments":          runAttachments,
+	"audit":                runAudit,
+	"backups":              runBackups,
+	"categories":           runCategories,
+	"collapse-thread":      runCollapseThread,
+	"daemon":               runDaemon,
+	"download-attachments": runDownloadAttachments,
+	"drafts":               runDrafts,
+	"empty-trash":          runEmptyTrash,
+	"fsck":                 runFsck,
+	"init":                 runInit,
+	"inspect":              runInspect,
+	"labels":               runLabels,
+	"list":                 runList,
+	"lookup":               runLookup,
+	"migrate":              runMigrate,
+	"report":               runReport,
+	"restore-all":          runRestoreAll,
+	"retry":                runRetry,
+	"rollback":             runRollback,
+	"rpc":                  runRPC,
+	"search-local":         runSearchLocal,
+	"snapshot":             runSnapshot,
+	"selftest":             runSelftest,
+	"simulate":             runSimulate,
+	"store":                runStore,
+	"strip":                runStrip,
+	"trends":               runTrends,
+	"untrash":              runUntrash,
+	"usage":                runUsage,
+}
 
-	rawPayload = base64.URLEncoding.EncodeToString([]byte(rawPayload))
+func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			command(os.Args[2:])
+			return
+		}
+	}
+	runRemoveAttachments(os.Args[1:])
+}
 
-	newMsg := gmail.Message{InternalDate: m.InternalDate, LabelIds: m.LabelIds, Payload: m.Payload, Raw: rawPayload, ThreadId: m.ThreadId}
+func runRemoveAttachments(args []string) {
+	removeAttachments("gmail-cleanup", args)
+}
 
-	return &newMsg
+// `retry --run RUN_ID` takes the same flags as the default command.
+func runRetry(args []string) {
+	removeAttachments("retry", args)
 }
 
-func getMessagePartsRecursively(p *gmail.MessagePart, parts []*gmail.MessagePart) []*gmail.MessagePart {
-	parts = append(parts, p)
+func removeAttachments(command string, args []string) {
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	var opts mailboxOptions
+	opts.register(fs)
+	var retryRun string
+	if command == "retry" {
+		fs.StringVar(&retryRun, "run", "", "Re-process the messages that failed in this earlier run, keeping their approvals")
+	}
+	plugins := fs.String("plugin", "", "Comma-separated Go plugins (.so) to load")
+	transformers := fs.String("transform", "", "Comma-separated registered transformers to apply to each copy, in order")
+	var removeOpts removeOptions
+	fs.StringVar(&removeOpts.backupDir, "backup-dir", "", "Save each original as a .eml file under this directory before replacing it, so rollback can restore the run")
+	exportDir := fs.String("export-dir", "", "Also save the attachments removed to this directory, named by --name-template, before removing them")
+	uploadPhotos := fs.Bool("upload-photos", false, "Also add the image and video attachments removed to Google Photos before removing them")
+	photosAlbum := fs.String("photos-album", photosAlbumYear, "With --upload-photos, put each photo in an album per year or per sender")
+	nameTemplate := fs.String("name-template", defaultNameTemplate, `With --export-dir, Go template for each attachment's path, e.g. '{{.Date.Format "2006/01"}}/{{.From}}/{{.Filename}}'`)
+	archiveDir := fs.String("archive-dir", "", "Save attachments and a searchable index to this directory before removing them")
+	storeURL := fs.String("store", "", "With --archive-dir, save the attachments themselves to this sftp://user@host/path, e.g. a NAS, or s3://bucket/prefix, keeping only the index in the directory")
+	scanCmd := fs.String("scan-cmd", "", `With --archive-dir, pipe each attachment to this command before archiving it, e.g. "clamscan -", and quarantine those it exits non-zero for`)
+	writeManifestPage := fs.Bool("manifest-page", false, "With --archive-dir, write one HTML page per run listing archived attachments and link to it from each rewritten message instead of listing them")
+	archiveURL := fs.String("archive-url", "", "Base URL under which the archive directory is published, used for links on the manifest page")
+	linkExpiry := fs.Duration("link-expiry", maxLinkExpiry, "With --manifest-page and an s3:// --store, how long the signed links to the uploaded page and attachments work, at most 168h")
+	labelThreads := fs.Bool("thread-labels", true, "Label threads with rewritten messages "+threadLabelStripped+", and "+threadLabelArchived+" with --archive-dir")
+	fs.BoolVar(&removeOpts.keepCalendar, "keep-calendar", false, "Keep calendar invitations (.ics) in copies, so Gmail still shows the event, and leave messages with no other attachments alone")
+	keepAttachedMessages := fs.Bool("keep-attached-messages", false, "Keep attached emails (message/rfc822) whole instead of removing them with the other attachments")
+	recompressImages := fs.Bool("recompress-images", false, "Replace JPEG and PNG attachments with smaller re-encoded versions instead of removing them")
+	jpegQuality := fs.Int("jpeg-quality", 75, "JPEG quality for --recompress-images")
+	maxImageDimension := fs.Int("max-image-dimension", 1600, "Longest side in pixels for --recompress-images")
+	recompressPDF := fs.Bool("recompress-pdf", false, "Replace PDF attachments with versions recompressed by Ghostscript instead of removing them")
+	pdfSettings := fs.String("pdf-settings", "ebook", "Ghostscript PDFSETTINGS preset for --recompress-pdf: screen, ebook, printer or prepress")
+	pdfMinSavings := fs.Int("pdf-min-savings", 30, "Keep a recompressed PDF only if it is at least this many percent smaller")
+	ghostscript := fs.String("ghostscript", "gs", "Path to the Ghostscript executable")
+	fs.StringVar(&removeOpts.insertMethod, "insert-method", insertMethodInsert, insertMethodUsage)
+	fs.BoolVar(&removeOpts.strictHeaders, "strict-headers", false, "Fail a message, leaving it alone, if its copy would lose or reorder any of its top-level headers")
+	strictHeadersIgnore := fs.String("strict-headers-ignore", defaultStrictHeadersIgnore, "Comma-separated headers --strict-headers doesn't check")
+	dropAuthHeaders := fs.Bool("drop-auth-headers", false, "Remove DKIM-Signature and ARC headers from copies, since they can't validate after the rewrite, instead of keeping every original header")
+	fs.BoolVar(&removeOpts.complianceMode, "compliance-mode", false, "Never delete originals; label the stripped copies and record them in a manifest")
+	complianceLabel := fs.String("compliance-label", "gmail-cleanup/working-set", "Label for stripped copies in compliance mode")
+	fs.StringVar(&removeOpts.manifestPath, "manifest", "compliance-manifest.jsonl", "Export manifest written in compliance mode")
+	fs.BoolVar(&removeOpts.assumeYes, "yes", false, "Approve every message without asking")
+	force := fs.Bool("force", false, "With --yes, don't ask to type a confirmation before originals are deleted permanently")
+	maxDestructive := fs.Int("max-destructive-per-run", 0, "With --i-know-what-im-doing, allow the run to delete or strip this many messages, above max_destructive_per_run in the config file")
+	iKnow := fs.Bool("i-know-what-im-doing", false, "Let --max-destructive-per-run raise the config file's max_destructive_per_run")
+	verifyCopies := fs.Bool("verify-copies", false, "Fetch each copy again and check it matches what was inserted before deleting its original, in the background while the next messages are processed")
+	verifyWorkers := fs.Int("verify-workers", 4, "With --verify-copies, number of copies to check at once")
+	fs.BoolVar(&removeOpts.deleteFirst, "delete-first", false, "Delete each original before inserting its copy, for accounts too full to insert, once its --backup-dir backup is checked against it; needs --backup-dir")
+	checkStorageFirst := fs.Bool("check-storage", false, "Check the account's storage before the run, and if it is full, offer to delete originals before inserting their copies (needs the Drive metadata scope)")
+	fs.BoolVar(&removeOpts.verifyReclaimed, "verify-reclaimed", false, "After the run, fetch each copy and check its original is gone to report the bytes actually reclaimed")
+	verifyMinSavings := fs.Int("verify-min-savings", 50, "With --verify-reclaimed, flag messages that freed less than this percent of their attachments' size")
+	forgetDecisions := fs.Bool("forget-decisions", false, "Ask again about messages approved, skipped or left for later in earlier interactive sessions")
+	summaryFile := fs.String("summary-file", "", "Also write the run summary as JSON to this file")
+	notifyWebhook := fs.String("notify-webhook", "", "Post the run summary as JSON to this URL when the run finishes, e.g. a Slack or Discord webhook")
+	protectContacts := fs.String("protect-contacts", protectNone, "Contacts whose mail needs extra confirmation: starred, all or none")
+	protectKeywords := fs.String("protect-keywords", "", "File of regular expressions, one per line, protecting matching messages (default: invoices, contracts, tax, receipts, boarding passes)")
+	protectedLabel := fs.String("protected-label", defaultProtectedLabel, "Label for messages left alone because they match a protection pattern")
+	overrideProtection := fs.Bool("override-protection", false, "Process messages even if they match a protection pattern")
+	redact := fs.String("redact", "", "Comma-separated sensitive text to replace with [REDACTED] in message bodies: credit-card, ssn, api-key or all")
+	redactPatterns := fs.String("redact-patterns", "", "File of extra regular expressions to redact, one per line")
+	stripTracking := fs.Bool("strip-tracking", false, "Remove remote tracking images, 1x1 or hidden or from known tracking services, from HTML bodies of copies")
+	trackingPatterns := fs.String("tracking-patterns", "", "With --strip-tracking, file of regular expressions, one per line, matched against each remote <img> tag instead of the known tracking services")
+	previewDrafts := fs.Bool("preview-as-draft", false, "Create each stripped copy as a draft to check in Gmail instead of replacing the original")
+	commit := fs.Bool("commit-drafts", false, "Replace the originals of drafts created by --preview-as-draft that still exist, then delete the drafts")
+	fs.IntVar(&removeOpts.maxMessages, "max-messages-per-run", 0, "Stop after processing this many messages and print a token for --continue-from (0 means no limit)")
+	progressFile := fs.String("progress-file", "", "Skip the messages listed in this file and add each message processed to it, so a restarted run carries on where it stopped")
+	continueFrom := fs.String("continue-from", "", "Continue where a run stopped by --max-messages-per-run left off, with the same query")
+	sizeSweep := fs.String("size-sweep", "", "Comma-separated sizes such as 25M,10M,5M: process messages larger than each in turn, biggest first, combined with the query")
+	scoreExprSpec := fs.String("score-expr", "", `Process messages in descending order of this score, e.g. "size_mb * (1 + age_years)", instead of smallest first`)
+	activeHoursSpec := fs.String("active-hours", "", "Only process messages between these times of day, e.g. 01:00-06:00, pausing outside them")
+	timezone := fs.String("timezone", "", "IANA time zone of --active-hours, e.g. Europe/Berlin (default: local time)")
+	idsFromFile := fs.String("ids-from-file", "", "Process the message ids listed in this file, one per line, or in stdin for -, instead of searching")
+	fs.StringVar(idsFromFile, "ids", "", "Same as --ids-from-file, e.g. --ids - to read them from stdin")
+	threadId := fs.String("thread", "", "Process every message of this thread, oldest first, asking once for the whole thread, instead of searching")
+	planFile := fs.String("plan", "", "Write what the run would do to each message to this file instead of doing it, for --apply")
+	applyFile := fs.String("apply", "", "Do exactly what this file written by --plan says, leaving alone messages that changed since; pass the flags the plan was made with")
+	sentLocalCopies := fs.String("sent-with-local-copies", "", "Only strip messages you sent, and only attachments with a file of the same content somewhere under this directory")
+	allowQueryProblems := fs.Bool("allow-query-problems", false, "Run even if the query has unknown operators or values, such as lager:10M")
+	policy := fs.String("policy", "", `A policies.yaml file, or inline rules such as "strip: photos; delete: automated reports older than 1y"`)
+	parseFlags(fs, args)
+
+	var err error
+	if err := checkInsertMethod(removeOpts.insertMethod); err != nil {
+		log.Fatal(err)
+	}
+	removeOpts.approved = map[string]bool{}
+	if *activeHoursSpec != "" {
+		removeOpts.activeHours, err = parseActiveHours(*activeHoursSpec, *timezone)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	removeOpts.strictHeadersIgnore = map[string]bool{}
+	for _, name := range splitList(*strictHeadersIgnore) {
+		removeOpts.strictHeadersIgnore[strings.ToLower(name)] = true
+	}
+	removeOpts.senderDecisions, err = loadSenderDecisions(*policy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if isPolicyFile(*policy) {
+		removeOpts.senderDecisionsFile = *policy
+	}
+	if *idsFromFile != "" && (fs.NArg() > 0 || *continueFrom != "" || *sizeSweep != "" || command == "retry") {
+		log.Fatal("--ids-from-file can't be combined with a query, --continue-from, --size-sweep or retry")
+	}
+	// Stdin is used up by the ids, so neither questions nor the typed confirmation of
+	// permanent deletes can be answered.
+	if *idsFromFile == "-" && *planFile == "" && (!removeOpts.assumeYes || !(*force || removeOpts.complianceMode || *previewDrafts)) {
+		log.Fatal("--ids - reads the ids from stdin, which then can't answer questions or confirm permanent deletes; pass --yes --force, or --plan, or --yes with --compliance-mode or --preview-as-draft")
+	}
+	if *threadId != "" && (fs.NArg() > 0 || *idsFromFile != "" || *continueFrom != "" || *sizeSweep != "" || *scoreExprSpec != "" || command == "retry") {
+		log.Fatal("--thread can't be combined with a query, --ids-from-file, --continue-from, --size-sweep, --score-expr or retry")
+	}
+	if *planFile != "" && (*applyFile != "" || *previewDrafts || *commit || command == "retry") {
+		log.Fatal("--plan can't be combined with --apply, --preview-as-draft, --commit-drafts or retry")
+	}
+	if *applyFile != "" && (fs.NArg() > 0 || *idsFromFile != "" || *threadId != "" || *continueFrom != "" || *sizeSweep != "" || *previewDrafts || *commit || command == "retry") {
+		log.Fatal("--apply can't be combined with a query, --ids-from-file, --thread, --continue-from, --size-sweep, --preview-as-draft, --commit-drafts or retry")
+	}
+	removeOpts.maxDestructive = destructiveCap(opts.profile, *maxDestructive, *iKnow)
+	var retrying []failedMessage
+	if command == "retry" {
+		if retryRun == "" || fs.NArg() > 0 {
+			log.Fatal("Usage: gmail-cleanup retry --run RUN_ID [flags]")
+		}
+		if *continueFrom != "" || *sizeSweep != "" || removeOpts.maxMessages > 0 || *commit {
+			log.Fatal("retry can't be combined with --continue-from, --size-sweep, --max-messages-per-run or --commit-drafts")
+		}
+		entries, err := readJournal(profileJournalFile(opts.profile))
+		if err != nil {
+			log.Fatalf("Unable to read journal: %v", err)
+		}
+		retrying = failedInRun(entries, retryRun)
+		removeOpts.replaced = map[string]journalEntry{}
+		for _, f := range retrying {
+			if f.failure.Approved {
+				removeOpts.approved[f.failure.MessageId] = true
+			}
+			if f.replaced != nil {
+				removeOpts.replaced[f.failure.MessageId] = *f.replaced
+			}
+		}
+	}
 
-	for _, subpart := range p.Parts {
-		// recurse
-		parts = getMessagePartsRecursively(subpart, parts)
+	if err := loadPlugins(*plugins); err != nil {
+		log.Fatal(err)
+	}
+	removeOpts.transformers, err = lookupTransformers(*transformers)
+	if err != nil {
+		log.Fatal(err)
+	}
+	removeOpts.policy, err = loadPolicy(*policy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	removeOpts.attachmentRules, err = loadAttachmentRules(*policy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	budgets, err := loadBudgets(*policy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(budgets) > 0 && (*idsFromFile != "" || *threadId != "" || *continueFrom != "" || *sizeSweep != "" || removeOpts.maxMessages > 0 || *planFile != "" || *applyFile != "" || command == "retry") {
+		log.Fatal("Policy budgets can't be combined with --ids-from-file, --thread, --continue-from, --size-sweep, --max-messages-per-run, --plan, --apply or retry")
+	}
+	var plan *actionPlan
+	if *planFile != "" {
+		// Planning doesn't ask; the plan is what gets reviewed.
+		removeOpts.assumeYes = true
+		removeOpts.plan = &actionPlan{Created: time.Now().UTC(), Profile: opts.profile}
+	}
+	if *applyFile != "" {
+		plan, err = readPlan(*applyFile)
+		if err != nil {
+			log.Fatalf("Unable to read plan: %v", err)
+		}
+		if plan.Profile != opts.profile {
+			log.Fatalf("Plan [%s] is for profile [%s], not [%s]", *applyFile, plan.Profile, opts.profile)
+		}
+		removeOpts.applying = map[string]plannedAction{}
+		for _, a := range plan.Messages {
+			removeOpts.applying[a.MessageId] = a
+		}
+	}
+	if *previewDrafts {
+		if removeOpts.complianceMode {
+			log.Fatal("--preview-as-draft can't be combined with --compliance-mode")
+		}
+		removeOpts.draftsFile = pendingDraftsFile(opts.profile)
+	}
+	if removeOpts.deleteFirst {
+		if removeOpts.backupDir == "" {
+			log.Fatal("--delete-first needs --backup-dir; between the delete and the insert, the backup is the only copy of each message")
+		}
+		if removeOpts.complianceMode || *previewDrafts || *commit {
+			log.Fatal("--delete-first can't be combined with --compliance-mode, --preview-as-draft or --commit-drafts")
+		}
+	}
+	thresholds, err := parseSizeSweep(*sizeSweep)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *scoreExprSpec != "" {
+		if *continueFrom != "" || removeOpts.maxMessages > 0 {
+			log.Fatal("--score-expr can't be combined with --continue-from or --max-messages-per-run; scores change with age, so there is no stable point to continue from")
+		}
+		removeOpts.scoreExpr, err = parseScoreExpr(*scoreExprSpec)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *continueFrom != "" {
+		if *sizeSweep != "" {
+			log.Fatal("--continue-from can't be combined with --size-sweep; the token holds the query of the pass that stopped")
+		}
+		removeOpts.resumeAfter, err = parseContinuation(*continueFrom)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if fs.NArg() >= 1 && fs.Arg(0) != removeOpts.resumeAfter.Query {
+			log.Fatalf("--continue-from token is for query [%s], not [%s]", removeOpts.resumeAfter.Query, fs.Arg(0))
+		}
+	}
+	if *progressFile != "" {
+		removeOpts.progress, err = openProgressLog(*progressFile)
+		if err != nil {
+			log.Fatalf("Unable to read progress: %v", err)
+		}
+	}
+	if !*overrideProtection {
+		removeOpts.protectionPatterns, err = loadProtectionPatterns(*protectKeywords)
+		if err != nil {
+			log.Fatalf("Unable to load protection patterns: %v", err)
+		}
+	}
+	if *redact != "" || *redactPatterns != "" {
+		removeOpts.redactor, err = newRedactor(splitList(*redact), *redactPatterns)
+		if err != nil {
+			log.Fatal(err)
+		}
+		removeOpts.transformers = append(removeOpts.transformers, removeOpts.redactor)
+	}
+	if *stripTracking {
+		stripper, err := newTrackingStripper(*trackingPatterns)
+		if err != nil {
+			log.Fatal(err)
+		}
+		removeOpts.transformers = append(removeOpts.transformers, stripper)
+	}
+	if *keepAttachedMessages {
+		removeOpts.transformers = append(removeOpts.transformers, attachedMessageKeeper{})
+	}
+	if *dropAuthHeaders {
+		removeOpts.transformers = append(removeOpts.transformers, authHeaderDropper{})
+		for _, name := range authHeaders {
+			removeOpts.strictHeadersIgnore[strings.ToLower(name)] = true
+		}
+	}
+	if *recompressImages {
+		removeOpts.transformers = append(removeOpts.transformers, &imageRecompressor{quality: *jpegQuality, maxDimension: *maxImageDimension})
+	}
+	if *recompressPDF {
+		if _, err := exec.LookPath(*ghostscript); err != nil {
+			log.Fatalf("--recompress-pdf needs Ghostscript: %v", err)
+		}
+		if *pdfMinSavings < 0 || *pdfMinSavings > 100 {
+			log.Fatalf("--pdf-min-savings must be between 0 and 100, got %d", *pdfMinSavings)
+		}
+		removeOpts.transformers = append(removeOpts.transformers, &pdfRecompressor{ghostscript: *ghostscript, settings: *pdfSettings, minSavings: *pdfMinSavings})
+	}
+	if *verifyWorkers < 1 {
+		log.Fatalf("--verify-workers must be at least 1, got %d", *verifyWorkers)
+	}
+	if *verifyMinSavings < 0 || *verifyMinSavings > 100 {
+		log.Fatalf("--verify-min-savings must be between 0 and 100, got %d", *verifyMinSavings)
+	}
+	if *linkExpiry <= 0 || *linkExpiry > maxLinkExpiry {
+		log.Fatalf("--link-expiry must be between 1s and %v, got %v", maxLinkExpiry, *linkExpiry)
+	}
+	started := time.Now()
+	runId := newRunId(started)
+	removeOpts.journal = newRunJournal(opts.profile, runId)
+	if !removeOpts.assumeYes && removeOpts.applying == nil {
+		removeOpts.review, err = openReviewState(opts.profile, *forgetDecisions)
+		if err != nil {
+			log.Fatalf("Unable to open saved decisions: %v", err)
+		}
+		defer removeOpts.review.close()
+	}
+	if *storeURL != "" && *archiveDir == "" {
+		log.Fatal("--store needs --archive-dir for the index")
+	}
+	if *archiveDir != "" {
+		removeOpts.store, err = openAttachmentStore(*archiveDir, *storeURL, runId)
+		if err != nil {
+			log.Fatalf("Unable to open store: %v", err)
+		}
+		defer removeOpts.store.close()
+	}
+	if *exportDir != "" {
+		removeOpts.exporter, err = newAttachmentExporter(*exportDir, *nameTemplate)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *scanCmd != "" {
+		if *archiveDir == "" {
+			log.Fatal("--scan-cmd requires --archive-dir")
+		}
+		removeOpts.scanner, err = newAttachmentScanner(*scanCmd, *archiveDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *writeManifestPage {
+		if *archiveDir == "" {
+			log.Fatal("--manifest-page requires --archive-dir")
+		}
+		removeOpts.manifestPage = newManifestPage(*archiveDir, *archiveURL, started)
+		if s3, ok := removeOpts.store.fs.(*s3StoreFS); ok && *archiveURL == "" {
+			removeOpts.manifestPage.rehost(s3, *linkExpiry)
+		}
+		removeOpts.transformers = append(removeOpts.transformers, removeOpts.manifestPage.linkTransformer())
 	}
 
-	return parts
-}
+	if *sentLocalCopies != "" {
+		removeOpts.localCopies, err = indexLocalCopies(*sentLocalCopies)
+		if err != nil {
+			log.Fatalf("Unable to index local copies: %v", err)
+		}
+	}
+
+	if *protectContacts != protectNone || usesContactGroups(removeOpts.policy) {
+		opts.extraScopes = append(opts.extraScopes, people.ContactsReadonlyScope)
+	}
+	if *checkStorageFirst {
+		opts.extraScopes = append(opts.extraScopes, drive.DriveMetadataReadonlyScope)
+	}
+	if *uploadPhotos {
+		opts.extraScopes = append(opts.extraScopes, photosAppendOnlyScope)
+	}
 
-func main() {
 	fmt.Println("--------------------------------------------------------------------------------------------------------------------")
-	ctx := context.Background()
-	b, err := ioutil.ReadFile("credentials.json")
+	mb := openMailbox(&opts)
+	removeOpts.own, err = mb.ownAddresses()
 	if err != nil {
-		log.Fatalf("Unable to read client secret file: %v", err)
+		exitf(exitCodeFor(err), "Unable to list send-as addresses: %v", err)
+	}
+	summary := newRunSummary(opts.profile)
+	defer func() {
+		code := summary.finish()
+		if len(removeOpts.replacements) > 0 {
+			if err := verifyReclaimed(mb, removeOpts.replacements, *verifyMinSavings, summary); err != nil {
+				log.Printf("Unable to verify reclaimed space: %v\n", err)
+			}
+		}
+		summary.QuotaUnits = mb.quota.total()
+		if removeOpts.scanner != nil {
+			summary.Quarantined = removeOpts.scanner.quarantined
+		}
+		summary.ReclaimedBytes = removeOpts.reclaimed
+		summary.TrashedBytes = removeOpts.trashed
+		summary.Categories = removeOpts.cleaned
+		if removeOpts.plan == nil {
+			var messagesTotal int64
+			if p, err := mb.getProfile(); err == nil {
+				messagesTotal = p.MessagesTotal
+			}
+			if err := recordRun(opts.profile, runId, summary, messagesTotal); err != nil {
+				log.Printf("Unable to record run for trends: %v\n", err)
+			}
+		}
+		summary.print()
+		if *summaryFile != "" {
+			if err := summary.write(*summaryFile); err != nil {
+				log.Printf("Unable to write summary: %v\n", err)
+			}
+		}
+		if *notifyWebhook != "" {
+			notifyRunSummary(*notifyWebhook, summary)
+		}
+		mb.quota.printSummary()
+		if code != exitOK {
+			os.Exit(code)
+		}
+	}()
+	if removeOpts.plan != nil {
+		defer func() {
+			removeOpts.plan.Query = summary.Query
+			if err := removeOpts.plan.write(*planFile); err != nil {
+				log.Fatalf("Unable to write plan: %v", err)
+			}
+			fmt.Printf("Planned %d messages in [%s]. Nothing was changed; review it, then run with --apply %s and the same flags.\n",
+				len(removeOpts.plan.Messages), *planFile, *planFile)
+		}()
 	}
 
-	// If modifying these scopes, delete your previously saved token.json.
-	config, err := google.ConfigFromJSON(b, gmail.GmailReadonlyScope, gmail.GmailInsertScope, gmail.MailGoogleComScope)
-	if err != nil {
-		log.Fatalf("Unable to parse client secret file to config: %v", err)
+	if *verifyCopies {
+		removeOpts.verifier = newCopyVerifier(mb, *verifyWorkers)
+		defer removeOpts.verifier.close()
+	}
+	if *uploadPhotos {
+		removeOpts.photos, err = newPhotosUploader(mb.client, opts.profile, *photosAlbum)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *checkStorageFirst && removeOpts.plan == nil && !*commit {
+		checkStorage(mb, &removeOpts)
+	}
+
+	if *commit {
+		commitDrafts(mb, &removeOpts, pendingDraftsFile(opts.profile), *force, summary)
+		return
 	}
-	client := getClient(config)
 
-	service, err := gmail.NewService(ctx, option.WithHTTPClient(client))
+	if removeOpts.complianceMode {
+		removeOpts.complianceLabelId, err = mb.ensureLabel(*complianceLabel)
+		if err != nil {
+			log.Fatalf("Unable to create compliance label: %v", err)
+		}
+		fmt.Printf("Compliance mode: originals are kept, copies are labeled [%v]\n", *complianceLabel)
+	}
+
+	if *labelThreads {
+		removeOpts.threadLabels, err = newThreadLabeler(mb)
+		if err != nil {
+			log.Fatalf("Unable to create thread labels: %v", err)
+		}
+	}
+
+	if len(removeOpts.protectionPatterns) > 0 {
+		removeOpts.protectedLabelId, err = mb.ensureLabel(*protectedLabel)
+		if err != nil {
+			log.Fatalf("Unable to create protected label: %v", err)
+		}
+	}
+
+	removeOpts.protectedContacts, err = loadProtectedContacts(context.Background(), mb.client, *protectContacts)
 	if err != nil {
-		log.Fatalf("Unable to retrieve Gmail client: %v", err)
+		log.Fatalf("Unable to load contacts: %v", err)
+	}
+	if *protectContacts != protectNone {
+		fmt.Printf("Protecting %d contact addresses\n", len(removeOpts.protectedContacts))
+	}
+	if err := resolveContactGroups(context.Background(), mb.client, removeOpts.policy); err != nil {
+		log.Fatalf("Unable to load contact groups: %v", err)
+	}
+
+	if command == "retry" {
+		summary.Query = "retry --run " + retryRun
+		fmt.Printf("Retrying %d messages that failed in run [%v]\n", len(retrying), retryRun)
+		retryFailed(mb, retrying, &removeOpts, *force, summary)
+		return
 	}
 
-	user := "me"
+	if *idsFromFile != "" {
+		ids, err := readIdsFile(*idsFromFile)
+		if err != nil {
+			log.Fatalf("Unable to read ids: %v", err)
+		}
+		summary.Query = "ids from " + *idsFromFile
+		if *idsFromFile == "-" {
+			summary.Query = "ids from stdin"
+		}
+		processIds(mb, ids, &removeOpts, *force, summary)
+		return
+	}
+	if *threadId != "" {
+		summary.Query = "thread " + *threadId
+		processThread(mb, *threadId, &removeOpts, *force, summary)
+		return
+	}
+	if plan != nil {
+		summary.Query = "plan " + *applyFile
+		applyPlan(mb, plan, &removeOpts, *force, summary)
+		return
+	}
 
-	argsWithProg := os.Args
+	if len(budgets) > 0 {
+		queryString := defaultBudgetQuery
+		if fs.NArg() >= 1 {
+			queryString = fs.Arg(0)
+		}
+		checkQuery(queryString, true, *allowQueryProblems)
+		summary.Query = queryString
+		fmt.Printf("Enforcing sender budgets over messages matching [%v]\n", queryString)
+		enforceBudgets(mb, queryString, budgets, &removeOpts, *force, summary)
+		return
+	}
 
 	// Search for messages
 	var queryString string
 	defaultQueryString := "size:15000000"
 
-	if len(argsWithProg) < 2 {
+	if removeOpts.resumeAfter != nil {
+		queryString = removeOpts.resumeAfter.Query
+		fmt.Printf("Continuing query string [%v] after message [%v]\n", queryString, removeOpts.resumeAfter.Id)
+	} else if fs.NArg() >= 1 {
+		queryString = fs.Arg(0)
+		fmt.Printf("Using query string [%v]\n", queryString)
+	} else if *sizeSweep == "" {
 		queryString = defaultQueryString
 		fmt.Printf("Using default query string [%v]\n", queryString)
+	}
+	checkQuery(queryString, true, *allowQueryProblems)
+	if removeOpts.localCopies != nil && removeOpts.resumeAfter == nil {
+		queryString = strings.TrimSpace("in:sent " + queryString)
+	}
+	// Every rule is limited to contact groups, so only their members' mail needs fetching.
+	if groups := contactGroupQuery(removeOpts.policy); groups != "" && removeOpts.resumeAfter == nil {
+		queryString = strings.TrimSpace(queryString + " " + groups)
+	}
+	summary.Query = queryString
+
+	if *sizeSweep == "" {
+		if !processQuery(mb, queryString, &removeOpts, *force, summary, nil) {
+			return
+		}
 	} else {
-		queryString = argsWithProg[1]
-		fmt.Printf("Using query string [%v]\n", queryString)
+		// Work down from the biggest messages, skipping those an earlier pass already handled.
+		processed := map[string]bool{}
+		for _, threshold := range thresholds {
+			query := strings.TrimSpace(queryString + " larger:" + threshold)
+			fmt.Printf("=============== Sweep [%v] ===============\n", query)
+			if !processQuery(mb, query, &removeOpts, *force, summary, processed) {
+				return
+			}
+		}
 	}
 
-	listMessagesReponse, err := service.Users.Messages.List(user).Q(queryString).Do()
+	fmt.Println("|||||||||||||||||||||||||||||||||||||||||||||||||||||||")
+	fmt.Println("Querying again...")
+
+	if *sizeSweep != "" {
+		queryString = strings.TrimSpace(queryString + " larger:" + thresholds[len(thresholds)-1])
+	}
+	listMessagesReponse, err := mb.listMessages(queryString)
+	if errors.Is(err, errQuotaBudgetExceeded) {
+		log.Printf("Skipping: %v\n", err)
+		return
+	}
 	if err != nil {
 		log.Fatalf("Unable to retrieve messages: %v", err)
 	}
@@ -273,137 +1303,306 @@ func main() {
 	}
 	fmt.Println("Messages:")
 	fmt.Printf("Count: %+v\n", len(listMessagesReponse.Messages))
+}
+
+// Processes the messages matching queryString, smallest first, adding to summary.
+// Messages in processed are skipped, and the others are added to it, if it isn't nil.
+// Returns false if the run should stop.
+func processQuery(mb *mailbox, queryString string, removeOpts *removeOptions, force bool, summary *runSummary, processed map[string]bool) bool {
+	listMessagesReponse, err := mb.listMessages(queryString)
+	if errors.Is(err, errQuotaBudgetExceeded) {
+		summary.stop(err)
+		return false
+	}
+	if err != nil {
+		exitf(exitCodeFor(err), "Unable to retrieve messages: %v", err)
+	}
+
+	var ids []string
+	for _, m := range listMessagesReponse.Messages {
+		if processed[m.Id] {
+			continue
+		}
+		ids = append(ids, m.Id)
+	}
+	if len(ids) == 0 {
+		fmt.Println("No messages found.")
+		return true
+	}
+	fmt.Println("Messages:")
+	fmt.Printf("Count: %+v\n", len(ids))
+	summary.Matched += len(ids)
 
 	// Get each message
 	var messages []*gmail.Message
 
-	for _, m := range listMessagesReponse.Messages {
-		msg, _ := service.Users.Messages.Get(user, m.Id).Format("metadata").Do()
+	for _, id := range ids {
+		msg, err := mb.getMessage(id, "metadata")
+		if errors.Is(err, errQuotaBudgetExceeded) {
+			summary.stop(err)
+			return false
+		}
+		if err != nil {
+			exitf(exitCodeFor(err), "Unable to get message [%+v]: %v", id, err)
+		}
 		messages = append(messages, msg)
 	}
+	return processMessages(mb, queryString, messages, removeOpts, force, summary, processed)
+}
 
-	// Sort by estimated size
-	sort.Slice(messages, func(i, j int) bool {
-		return messages[i].SizeEstimate < messages[j].SizeEstimate
-	})
-
-	// Get each message, make a copy without attachments, and insert the copy
-	for _, msg := range messages {
-		fmt.Println("------------------------------")
-		fmt.Println("Message:")
-		fmt.Printf("Id: %+v\n", msg.Id)
-		fmt.Printf("Snippet: %+v\n", msg.Snippet)
-		fmt.Printf("SizeEstimate: %+v\n", msg.SizeEstimate)
-		fmt.Printf("LabelIds: %+v\n", msg.LabelIds)
-		fmt.Println("Headers:")
-		for _, header := range msg.Payload.Headers {
-			fmt.Printf("* %+v: %+v\n", header.Name, header.Value)
+// Processes the messages with the given ids, skipping those that no longer exist.
+// Returns false if the run should stop.
+func processIds(mb *mailbox, ids []string, removeOpts *removeOptions, force bool, summary *runSummary) bool {
+	var messages []*gmail.Message
+	for _, id := range ids {
+		msg, err := mb.getMessage(id, "metadata")
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+			log.Printf("Message [%s] no longer exists, skipping.\n", id)
+			continue
 		}
-		fmt.Println("Body:")
-		if msg.Payload != nil && msg.Payload.Body != nil {
-			fmt.Printf("%+v", msg.Payload.Body.Data)
+		if errors.Is(err, errQuotaBudgetExceeded) {
+			summary.stop(err)
+			return false
 		}
+		if err != nil {
+			exitf(exitCodeFor(err), "Unable to get message [%+v]: %v", id, err)
+		}
+		messages = append(messages, msg)
+	}
+	if len(messages) == 0 {
+		fmt.Println("No messages found.")
+		return true
+	}
+	fmt.Println("Messages:")
+	fmt.Printf("Count: %+v\n", len(messages))
+	summary.Matched += len(messages)
+	return processMessages(mb, "", messages, removeOpts, force, summary, nil)
+}
 
-		rawMsg, _ := service.Users.Messages.Get(user, msg.Id).Format("raw").Do()
-		fmt.Println("-------------RAW DECODED MESSAGE--------------------")
-		decodedMsg, _ := base64.URLEncoding.DecodeString(rawMsg.Raw)
-		fmt.Printf("%+v\n", string(decodedMsg))
-		fmt.Println("----------------------------------------------------")
-
-		fullMsg, _ := service.Users.Messages.Get(user, msg.Id).Format("full").Do()
-
-		var parts []*gmail.MessagePart
-		parts = getMessagePartsRecursively(fullMsg.Payload, parts)
+// Processes every message of thread id in the thread's order, oldest first, so the copies
+// keep their places in the conversation. Asks once for the whole thread instead of for
+// each message.
+func processThread(mb *mailbox, id string, removeOpts *removeOptions, force bool, summary *runSummary) bool {
+	thread, err := mb.getThread(id, "metadata")
+	if errors.Is(err, errQuotaBudgetExceeded) {
+		summary.stop(err)
+		return false
+	}
+	if err != nil {
+		exitf(exitCodeFor(err), "Unable to get thread [%+v]: %v", id, err)
+	}
+	messages := thread.Messages
+	if len(messages) == 0 {
+		fmt.Println("No messages found.")
+		return true
+	}
+	fmt.Printf("Thread [%s]:\n", id)
+	for _, m := range messages {
+		fmt.Printf("* %s: %s, %s, subject [%s]\n", m.Id, internalDate(m).Format("2006-01-02"), formatBytes(m.SizeEstimate),
+			mimeutil.HeaderValue(m.Payload.Headers, "Subject"))
+	}
+	summary.Matched += len(messages)
+	if !removeOpts.assumeYes {
+		if !askYesNo(trf("Do you want to delete the attachments from the %d messages of this thread?", len(messages))) {
+			summary.Outcomes[outcomeSkipped] += len(messages)
+			return true
+		}
+		for _, m := range messages {
+			removeOpts.approved[m.Id] = true
+		}
+	}
+	removeOpts.keepOrder = true
+	return processMessages(mb, "", messages, removeOpts, force, summary, nil)
+}
 
-		// Useful reference: https://stackoverflow.com/questions/25832631/download-attachments-from-gmail-using-gmail-api
-		var attachments []string
-		for _, part := range parts {
-			if part.Filename != "" && part.Body.AttachmentId != "" {
-				attachmentId := part.Body.AttachmentId
+// Returns the first of messages that fit under a --max-messages-per-run of max after
+// done messages, or all of them when max is 0.
+func capMessages(messages []*gmail.Message, max int, done int) []*gmail.Message {
+	if max <= 0 {
+		return messages
+	}
+	remaining := max - done
+	if remaining < 0 {
+		remaining = 0
+	}
+	if len(messages) > remaining {
+		return messages[:remaining]
+	}
+	return messages
+}
 
-				log.Printf("Getting attachment with ID [%+v].\n", attachmentId)
-				attachment, err := service.Users.Messages.Attachments.Get(user, msg.Id, attachmentId).Do()
-				if err != nil {
-					log.Fatalf("Unable to get attachment [%+v].\n", err)
-				}
+// Drops the messages an earlier review skipped, counting them in summary, and those
+// over --max-messages-per-run.
+func resumeReview(messages []*gmail.Message, removeOpts *removeOptions, summary *runSummary) []*gmail.Message {
+	if removeOpts.review != nil {
+		var skipped int
+		messages, skipped = removeOpts.review.resume(messages, removeOpts.approved)
+		summary.Outcomes[outcomeSkipped] += skipped
+		summary.resumedSkips += skipped
+	}
+	return capMessages(messages, removeOpts.maxMessages, summary.counted())
+}
 
-				attachments = append(attachments, fmt.Sprintf("* %+v: %+v", part.Filename, attachment.Size))
+// Processes messages, smallest first, by score or in the order given, as processQuery does for the messages matching queryString.
+func processMessages(mb *mailbox, queryString string, messages []*gmail.Message, removeOpts *removeOptions, force bool, summary *runSummary, processed map[string]bool) bool {
+	if removeOpts.scoreExpr != nil {
+		sortByScore(messages, removeOpts.scoreExpr, time.Now())
+	} else if !removeOpts.keepOrder {
+		sortForProcessing(messages)
+	}
+	if removeOpts.resumeAfter != nil {
+		var remaining []*gmail.Message
+		for _, msg := range messages {
+			if removeOpts.resumeAfter.before(msg) {
+				remaining = append(remaining, msg)
 			}
 		}
-
-		if len(attachments) == 0 {
-			log.Printf("No attachments found on message [%+v].\n", msg.Id)
-			continue
+		fmt.Printf("Skipping %d messages processed by an earlier run\n", len(messages)-len(remaining))
+		messages = remaining
+	}
+	if removeOpts.progress != nil && len(removeOpts.progress.done) > 0 {
+		var remaining []*gmail.Message
+		for _, msg := range messages {
+			if !removeOpts.progress.done[msg.Id] {
+				remaining = append(remaining, msg)
+			}
 		}
+		fmt.Printf("Skipping %d messages processed before a restart\n", len(messages)-len(remaining))
+		messages = remaining
+	}
+	messages = resumeReview(messages, removeOpts, summary)
 
-		boundary := readBoundaryFromHeaders(fullMsg.Payload.Headers)
-		fullMsgPayloadExAttachments := convertPartToRawExAttachments(fullMsg.Payload, boundary, 0)
-		fmt.Println("-------------RAW MESSAGE EX ATTACHMENTS--------------------")
-		fmt.Printf("%+v\n", fullMsgPayloadExAttachments)
-		fmt.Println("----------------------------------------------------")
+	// A query that matches far more than expected is more likely a mistake than a cleanup.
+	if removeOpts.maxDestructive > 0 && !removeOpts.complianceMode && removeOpts.draftsFile == "" && removeOpts.plan == nil &&
+		overDestructiveCap(summary.processed()+len(messages), removeOpts.maxDestructive) {
+		summary.stop(fmt.Errorf("over max_destructive_per_run %d", removeOpts.maxDestructive))
+		return false
+	}
 
-		// TODO: Comparing the message without attachments to the original message will of course be different.
-		//       Need to add unit tests instead. Download msg, encode base64 raw, compare to raw message,
-		//       insert new message, download new message, compare parts to original message. delete/clean up.
-		// if fullMsgPayloadExAttachments != string(decodedMsg) {
-		// 	fmt.Printf("CAUTION. STRINGS ARE NOT IDENTICAL. DIFF:")
-		// 	fmt.Printf("%+v\n", diff.Diff(string(decodedMsg), fullMsgPayloadExAttachments))
-		// }
+	// With --yes, originals are deleted without looking at each one.
+	if removeOpts.assumeYes && !removeOpts.complianceMode && removeOpts.draftsFile == "" && removeOpts.plan == nil && !force && !confirmHardDelete(len(messages)) {
+		log.Println("Confirmation didn't match, nothing deleted.")
+		return false
+	}
 
-		fmt.Printf("Attachments (%+v):\n", len(attachments))
-		for _, a := range attachments {
-			fmt.Println(a)
+	// Counts the outcome of msg, recording a failure in the journal.
+	// Returns false if the run should stop.
+	finish := func(msg *gmail.Message, result outcome, err error) bool {
+		if err != nil {
+			if code := exitCodeFor(err); code == exitQuota || code == exitAuth {
+				summary.stop(err)
+				return false
+			}
+			if exitCodeFor(err) == exitStorageFull {
+				log.Printf("Message [%+v] failed: %v\n", msg.Id, err)
+				if !removeOpts.deleteFirst {
+					explainStorageFull()
+					fmt.Println("Run again with --delete-first --backup-dir DIR to delete originals first.")
+				}
+				summary.stop(err)
+				return false
+			}
+			// Carry on with the other messages; `retry --run` picks this one up later.
+			log.Printf("Message [%+v] failed: %v\n", msg.Id, err)
+			summary.addError(msg.Id, err)
+			entry := newJournalEntry(journalFailed, msg)
+			entry.Error = err.Error()
+			entry.Approved = removeOpts.assumeYes || removeOpts.approved[msg.Id]
+			if err := removeOpts.journal.record(entry); err != nil {
+				log.Fatalf("Unable to write journal: %v", err)
+			}
+			result = outcomeFailed
 		}
-
-		fmt.Println("Do you want to delete the attachments from this email? (y or n)")
-		var yesOrNo string
-		fmt.Scanln(&yesOrNo)
-		yesOrNo = strings.ToLower(yesOrNo)
-
-		if yesOrNo != "y" && yesOrNo != "yes" && yesOrNo != "n" && yesOrNo != "no" {
-			log.Fatalf("Invalid input. Allowed values are [y, yes, n, no]. Exiting.")
+		summary.Outcomes[result]++
+		if removeOpts.progress != nil {
+			if err := removeOpts.progress.record(msg.Id); err != nil {
+				log.Fatalf("Unable to write progress: %v", err)
+			}
 		}
-
-		if yesOrNo == "n" || yesOrNo == "no" {
-			log.Printf("Skipped message [%+v]\n", msg.Id)
-			continue
+		if removeOpts.threadLabels != nil && (result == outcomeStripped || result == outcomeKept) {
+			err := removeOpts.threadLabels.label(mb, msg.ThreadId, removeOpts.store != nil)
+			if errors.Is(err, errQuotaBudgetExceeded) {
+				summary.stop(err)
+				return false
+			}
+			if err != nil {
+				log.Printf("Unable to label thread [%s]: %v\n", msg.ThreadId, err)
+			}
 		}
-
-		log.Println("Copying message [%+v]\n", fullMsg.Id)
-		// Use original date of message: InternalDateSource('dateHeader'). See also:
-		// * https://developers.google.com/gmail/api/reference/rest/v1/InternalDateSource
-		// * https://stackoverflow.com/questions/46434390/remove-an-attachment-of-a-gmail-email-with-google-apps-script
-		newMsg := copyMessageExAttachments(fullMsg)
-
-		log.Println("Inserting copied message without attachments.")
-		insertResponse, err := service.Users.Messages.Insert(user, newMsg).InternalDateSource("dateHeader").Do()
-		if err != nil {
-			log.Fatalf("Unable to insert message: %v\n", err)
+		if processed != nil {
+			processed[msg.Id] = true
 		}
-
-		log.Println("Insert Response[%+v]\n", insertResponse)
-
-		log.Printf("Deleting original message [%+v]\n", msg)
-		err = service.Users.Messages.Delete(user, msg.Id).Do()
-		if err != nil {
-			log.Fatalf("Unable to delete message: %v\n", err)
+		if removeOpts.maxMessages > 0 && summary.counted() >= removeOpts.maxMessages {
+			c := &continuation{Query: queryString, Id: msg.Id, Size: msg.SizeEstimate}
+			summary.Continue = c.token()
+			summary.Stopped = fmt.Sprintf("reached --max-messages-per-run %d", removeOpts.maxMessages)
+			return false
 		}
-
+		return true
 	}
-
-	fmt.Println("|||||||||||||||||||||||||||||||||||||||||||||||||||||||")
-	fmt.Println("Querying again...")
-
-	listMessagesReponse, err = service.Users.Messages.List(user).Q(queryString).Do()
-	if err != nil {
-		log.Fatalf("Unable to retrieve messages: %v", err)
+	// Finishes the messages whose copies have been checked, and with wait, all of them.
+	finishVerified := func(wait bool) bool {
+		if removeOpts.verifier == nil {
+			return true
+		}
+		jobs := removeOpts.verifier.ready()
+		if wait {
+			jobs = append(jobs, removeOpts.verifier.drain()...)
+		}
+		for _, job := range jobs {
+			result, err := removeOpts.verifier.complete(job)
+			if !finish(job.msg, result, err) {
+				return false
+			}
+		}
+		return true
 	}
-	if len(listMessagesReponse.Messages) == 0 {
-		fmt.Println("No messages found.")
-		return
+	if removeOpts.verifier != nil {
+		// Copies still being checked when the run stops are finished too, so no
+		// original is left next to an unchecked copy.
+		defer func() {
+			for _, job := range removeOpts.verifier.drain() {
+				result, err := removeOpts.verifier.complete(job)
+				finish(job.msg, result, err)
+			}
+		}()
 	}
-	fmt.Println("Messages:")
-	fmt.Printf("Count: %+v\n", len(listMessagesReponse.Messages))
+
+	// Get each message, make a copy without attachments, and insert the copy.
+	// Messages left for later are asked about again once the rest are done.
+	requeued := map[string]bool{}
+	for i := 0; i < len(messages); i++ {
+		msg := messages[i]
+		if removeOpts.activeHours != nil {
+			removeOpts.activeHours.wait()
+		}
+		result, err := processMessage(mb, msg, removeOpts)
+		if removeOpts.quitting {
+			summary.Stopped = "quit at the prompt; run again to resume the review"
+			return false
+		}
+		if err == nil && result == outcomeSkipped && removeOpts.review != nil && removeOpts.review.decision(msg.Id) == decisionLater {
+			if !requeued[msg.Id] {
+				requeued[msg.Id] = true
+				messages = append(messages, msg)
+				continue
+			}
+			result = outcomeLater
+		}
+		if err == nil && removeOpts.review != nil && result != outcomeSkipped && result != outcomeLater {
+			if err := removeOpts.review.forget(msg.Id); err != nil {
+				log.Printf("Unable to update saved decisions: %v\n", err)
+			}
+		}
+		if result != outcomeVerifying && !finish(msg, result, err) {
+			return false
+		}
+		if !finishVerified(false) {
+			return false
+		}
+	}
+	return finishVerified(true)
 }
 
 // [END gmail_quickstart]
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func messagesWithIds(ids ...string) []*gmail.Message {
+	var messages []*gmail.Message
+	for _, id := range ids {
+		messages = append(messages, &gmail.Message{Id: id})
+	}
+	return messages
+}
+
+func messageIds(messages []*gmail.Message) []string {
+	var ids []string
+	for _, m := range messages {
+		ids = append(ids, m.Id)
+	}
+	return ids
+}
+
+func TestCapMessages(t *testing.T) {
+	tests := []struct {
+		name string
+		max  int
+		done int
+		want []string
+	}{
+		{"no limit", 0, 10, []string{"a", "b", "c"}},
+		{"under the limit", 5, 1, []string{"a", "b", "c"}},
+		{"cut at the limit", 4, 2, []string{"a", "b"}},
+		{"limit reached", 2, 2, nil},
+		{"limit passed", 2, 5, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := messageIds(capMessages(messagesWithIds("a", "b", "c"), tt.max, tt.done))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("capMessages() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResumeReview(t *testing.T) {
+	decisions := map[string]string{}
+	var ids []string
+	for i := 0; i < 8; i++ {
+		id := fmt.Sprintf("m%d", i)
+		ids = append(ids, id)
+		if i < 5 {
+			decisions[id] = decisionSkipped
+		}
+	}
+	decisions["m5"] = decisionLater
+
+	tests := []struct {
+		name        string
+		maxMessages int
+		// Messages processed by earlier passes of the same run.
+		done        int
+		want        []string
+		wantSkipped int
+	}{
+		{"no limit", 0, 0, []string{"m6", "m7", "m5"}, 5},
+		{"skipped more than the limit", 2, 0, []string{"m6", "m7"}, 5},
+		{"limit partly used", 2, 1, []string{"m6"}, 5},
+		{"limit used up", 2, 2, nil, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			removeOpts := &removeOptions{
+				review:      &reviewState{decisions: decisions},
+				approved:    map[string]bool{},
+				maxMessages: tt.maxMessages,
+			}
+			summary := newRunSummary("")
+			summary.Outcomes[outcomeStripped] = tt.done
+			got := messageIds(resumeReview(messagesWithIds(ids...), removeOpts, summary))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resumeReview() = %v, want %v", got, tt.want)
+			}
+			if summary.Outcomes[outcomeSkipped] != tt.wantSkipped {
+				t.Errorf("skipped = %d, want %d", summary.Outcomes[outcomeSkipped], tt.wantSkipped)
+			}
+			if summary.counted() != tt.done {
+				t.Errorf("counted() = %d, want %d", summary.counted(), tt.done)
+			}
+		})
+	}
+}
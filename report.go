@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+
+	"github.com/weineran/gmail-cleanup/internal/mimeutil"
+)
+
+// One bar of a report chart.
+type reportBar struct {
+	label string
+	bytes int64
+	count int
+}
+
+// A titled bar chart of mailbox size.
+type reportChart struct {
+	title string
+	bars  []reportBar
+}
+
+// Groupings of the report, one chart each.
+const (
+	groupYear   = "year"
+	groupSender = "sender"
+	groupLabel  = "label"
+	groupListId = "list-id"
+)
+
+// Shows what the mailbox is made of: size by year, by sender, by label and by mailing list.
+func runReport(args []string) {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	var opts mailboxOptions
+	opts.register(fs)
+	query := fs.String("query", "larger:100K", "Messages to include; small messages barely affect storage")
+	top := fs.Int("top", 10, "Number of senders and labels to show")
+	svgPath := fs.String("svg", "", "Also write the charts as an SVG image to this file")
+	groupBy := fs.String("group-by", strings.Join([]string{groupYear, groupSender, groupLabel}, ","), "Comma-separated charts to show: year, sender, label or list-id")
+	parseFlags(fs, args)
+	checkQuery(*query, false, false)
+	groups := splitList(*groupBy)
+	for _, g := range groups {
+		if g != groupYear && g != groupSender && g != groupLabel && g != groupListId {
+			log.Fatalf("Unknown --group-by [%s], expected %s, %s, %s or %s", g, groupYear, groupSender, groupLabel, groupListId)
+		}
+	}
+
+	opts.readOnly = true
+	mb := openMailbox(&opts)
+	defer mb.quota.printSummary()
+
+	labels, err := mb.listLabels()
+	if err != nil {
+		log.Fatalf("Unable to list labels: %v", err)
+	}
+	labelNames := map[string]string{}
+	for _, l := range labels {
+		labelNames[l.Id] = l.Name
+	}
+	own, err := mb.ownAddresses()
+	if err != nil {
+		exitf(exitCodeFor(err), "Unable to list send-as addresses: %v", err)
+	}
+
+	c := mb.cleaner()
+	c.MetadataHeaders = []string{"From", "List-Id"}
+	var messages []*gmail.Message
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for r := range c.Messages(ctx, *query) {
+		if errors.Is(r.Err, errQuotaBudgetExceeded) {
+			log.Printf("Stopping after %d messages: %v\n", len(messages), r.Err)
+			break
+		}
+		if r.Err != nil {
+			log.Fatalf("Unable to retrieve messages: %v", r.Err)
+		}
+		messages = append(messages, r.Message)
+	}
+	if len(messages) == 0 {
+		fmt.Println("No messages found.")
+		return
+	}
+
+	charts := buildReportCharts(messages, labelNames, own, *top, groups)
+	var total int64
+	for _, m := range messages {
+		total += m.SizeEstimate
+	}
+	fmt.Printf("%d messages matching [%s], %s in total\n", len(messages), *query, formatBytes(total))
+	for _, chart := range charts {
+		fmt.Println()
+		printReportChart(chart)
+	}
+
+	if *svgPath != "" {
+		if err := ioutil.WriteFile(*svgPath, []byte(reportSVG(charts)), 0644); err != nil {
+			log.Fatalf("Unable to write SVG: %v", err)
+		}
+		fmt.Printf("Wrote charts to [%s]\n", *svgPath)
+	}
+}
+
+// Sums sizes by each of groups: year, sender, label and List-Id. Years are in order;
+// the others are the top biggest, with the rest folded into "other". Mail that isn't
+// from a mailing list is left out of the List-Id chart, and mail from any of own, the
+// user's addresses, is one "me" sender.
+func buildReportCharts(messages []*gmail.Message, labelNames map[string]string, own map[string]bool, top int, groups []string) []reportChart {
+	years := map[string]*reportBar{}
+	senders := map[string]*reportBar{}
+	byLabel := map[string]*reportBar{}
+	lists := map[string]*reportBar{}
+	add := func(bars map[string]*reportBar, key string, m *gmail.Message) {
+		b, ok := bars[key]
+		if !ok {
+			b = &reportBar{label: key}
+			bars[key] = b
+		}
+		b.bytes += m.SizeEstimate
+		b.count++
+	}
+	for _, m := range messages {
+		add(years, time.Unix(m.InternalDate/1000, 0).Format("2006"), m)
+		var from string
+		if m.Payload != nil {
+			from = mimeutil.HeaderValue(m.Payload.Headers, "From")
+		}
+		sender := senderAddress(from)
+		if own[sender] {
+			sender = "me"
+		}
+		add(senders, sender, m)
+		if listId := messageListId(m); listId != "" {
+			add(lists, listId, m)
+		}
+		for _, id := range m.LabelIds {
+			name := labelNames[id]
+			if name == "" {
+				name = id
+			}
+			add(byLabel, name, m)
+		}
+	}
+
+	var charts []reportChart
+	for _, g := range groups {
+		switch g {
+		case groupYear:
+			yearBars := sortedBars(years)
+			sort.Slice(yearBars, func(i, j int) bool { return yearBars[i].label < yearBars[j].label })
+			charts = append(charts, reportChart{title: "Size by year", bars: yearBars})
+		case groupSender:
+			charts = append(charts, reportChart{title: "Size by sender", bars: topBars(sortedBars(senders), top)})
+		case groupLabel:
+			charts = append(charts, reportChart{title: "Size by label", bars: topBars(sortedBars(byLabel), top)})
+		case groupListId:
+			charts = append(charts, reportChart{title: "Size by mailing list", bars: topBars(sortedBars(lists), top)})
+		}
+	}
+	return charts
+}
+
+// Returns the bars biggest first.
+func sortedBars(bars map[string]*reportBar) []reportBar {
+	result := make([]reportBar, 0, len(bars))
+	for _, b := range bars {
+		result = append(result, *b)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].bytes != result[j].bytes {
+			return result[i].bytes > result[j].bytes
+		}
+		return result[i].label < result[j].label
+	})
+	return result
+}
+
+func topBars(bars []reportBar, top int) []reportBar {
+	if top <= 0 || len(bars) <= top {
+		return bars
+	}
+	other := reportBar{label: "other"}
+	for _, b := range bars[top:] {
+		other.bytes += b.bytes
+		other.count += b.count
+	}
+	return append(bars[:top:top], other)
+}
+
+func maxBarBytes(bars []reportBar) int64 {
+	var max int64
+	for _, b := range bars {
+		if b.bytes > max {
+			max = b.bytes
+		}
+	}
+	return max
+}
+
+func printReportChart(chart reportChart) {
+	const width = 40
+	max := maxBarBytes(chart.bars)
+	labelWidth := 0
+	for _, b := range chart.bars {
+		if n := len([]rune(b.label)); n > labelWidth {
+			labelWidth = n
+		}
+	}
+	if labelWidth > 40 {
+		labelWidth = 40
+	}
+
+	fmt.Printf("%s:\n", chart.title)
+	for _, b := range chart.bars {
+		label := []rune(b.label)
+		if len(label) > labelWidth {
+			label = append(label[:labelWidth-1], '…')
+		}
+		var bar string
+		if max > 0 {
+			bar = strings.Repeat("#", int(b.bytes*width/max))
+		}
+		fmt.Printf("%-*s %-*s %s (%d)\n", labelWidth, string(label), width, bar, formatBytes(b.bytes), b.count)
+	}
+}
+
+// Renders the charts one below the other as a standalone SVG image.
+func reportSVG(charts []reportChart) string {
+	const (
+		width      = 760
+		labelWidth = 260
+		barWidth   = 360
+		rowHeight  = 20
+	)
+	var body strings.Builder
+	y := 0
+	for _, chart := range charts {
+		y += 30
+		fmt.Fprintf(&body, "<text x=\"0\" y=\"%d\" font-weight=\"bold\">%s</text>\n", y, html.EscapeString(chart.title))
+		y += 10
+		max := maxBarBytes(chart.bars)
+		for _, b := range chart.bars {
+			var w int64
+			if max > 0 {
+				w = b.bytes * barWidth / max
+			}
+			fmt.Fprintf(&body, "<text x=\"%d\" y=\"%d\" text-anchor=\"end\">%s</text>\n", labelWidth-8, y+14, html.EscapeString(b.label))
+			fmt.Fprintf(&body, "<rect x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" fill=\"#4285f4\"/>\n", labelWidth, y+3, w, rowHeight-6)
+			fmt.Fprintf(&body, "<text x=\"%d\" y=\"%d\">%s (%d)</text>\n", labelWidth+int(w)+6, y+14, formatBytes(b.bytes), b.count)
+			y += rowHeight
+		}
+	}
+	return fmt.Sprintf("<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" font-family=\"sans-serif\" font-size=\"12\">\n%s</svg>\n", width, y+10, body.String())
+}
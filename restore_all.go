@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+
+	"github.com/weineran/gmail-cleanup/cleaner"
+)
+
+// What restore-all did with one original.
+type restoreResult struct {
+	entry journalEntry
+	// The re-inserted original, or the message already there with its Message-ID.
+	restoredId string
+	duplicate  bool
+	err        error
+}
+
+// Re-inserts every original a run replaced from its --backup-dir backup, several at a
+// time, for recovering a run that went wrong at scale. Unlike rollback, the stripped
+// copies are kept unless --delete-copies is given. An original is skipped if the mailbox
+// has a message with its Message-ID other than the run's copy, e.g. one restored before.
+func runRestoreAll(args []string) {
+	fs := flag.NewFlagSet("restore-all", flag.ExitOnError)
+	var opts mailboxOptions
+	opts.register(fs)
+	run := fs.String("query-journal", "", "The run whose originals to restore, as printed in its summary")
+	backupDir := fs.String("backup-dir", "", "The --backup-dir the run saved the originals to")
+	var insertMethod string
+	fs.StringVar(&insertMethod, "insert-method", insertMethodInsert, insertMethodUsage)
+	workers := fs.Int("workers", 8, "Number of originals to restore at once")
+	rate := fs.Float64("rate", 5, "Most originals to insert per second, across workers")
+	deleteCopies := fs.Bool("delete-copies", false, "Delete each stripped copy permanently once its original is back")
+	dryRun := fs.Bool("dry-run", false, "Only list what would be restored")
+	assumeYes := fs.Bool("yes", false, "Restore without asking")
+	force := fs.Bool("force", false, "With --yes and --delete-copies, don't ask to type a confirmation before copies are deleted permanently")
+	parseFlags(fs, args)
+
+	if *run == "" || *backupDir == "" {
+		log.Fatal("Usage: gmail-cleanup restore-all --backup-dir DIR --query-journal RUN")
+	}
+	if *workers < 1 {
+		log.Fatalf("--workers must be at least 1, got %d", *workers)
+	}
+	if *rate <= 0 {
+		log.Fatalf("--rate must be more than 0, got %v", *rate)
+	}
+	if err := checkInsertMethod(insertMethod); err != nil {
+		log.Fatal(err)
+	}
+	entries, err := readJournal(profileJournalFile(opts.profile))
+	if err != nil {
+		log.Fatalf("Unable to read journal: %v", err)
+	}
+
+	// The last copying or stripped entry of each original. An original deleted ahead of
+	// a copy that was never recorded, with --delete-first, is only in its backup.
+	rolledBack := map[string]bool{}
+	latest := map[string]journalEntry{}
+	var order []string
+	for _, e := range entries {
+		if e.Action == journalRolledBack {
+			rolledBack[e.MessageId] = true
+		}
+		if e.RunId != *run || (e.Action != journalStripped && !(e.Action == journalCopying && e.DeletedFirst)) {
+			continue
+		}
+		if _, ok := latest[e.MessageId]; !ok {
+			order = append(order, e.MessageId)
+		}
+		latest[e.MessageId] = e
+	}
+	var restorable []journalEntry
+	noBackup := 0
+	for _, id := range order {
+		e := latest[id]
+		if rolledBack[e.MessageId] || (e.CopyId != "" && rolledBack[e.CopyId]) || (e.Action == journalStripped && e.CopyId == "") {
+			continue
+		}
+		if _, err := os.Stat(backupPath(*backupDir, e.RunId, e.MessageId)); err != nil {
+			fmt.Printf("* %s: no backup\n", e.MessageId)
+			noBackup++
+			continue
+		}
+		restorable = append(restorable, e)
+	}
+	fmt.Printf("Run %s: %d originals to re-insert, %d without a backup\n", *run, len(restorable), noBackup)
+	if *dryRun {
+		for _, e := range restorable {
+			fmt.Printf("* %s: re-insert, keeping copy [%s]\n", e.MessageId, e.CopyId)
+		}
+		return
+	}
+	if len(restorable) == 0 {
+		return
+	}
+	if *assumeYes {
+		if *deleteCopies && !*force && !confirmHardDelete(len(restorable)) {
+			log.Println("Confirmation didn't match, nothing restored.")
+			return
+		}
+	} else if !askYesNo(fmt.Sprintf("Do you want to re-insert %d originals?", len(restorable))) {
+		return
+	} else if *deleteCopies && !askYesNo("Do you want to delete their stripped copies permanently?") {
+		*deleteCopies = false
+	}
+
+	mb := openMailbox(&opts)
+	defer mb.quota.printSummary()
+	journal := newRunJournal(opts.profile, newRunId(time.Now()))
+
+	// Inserts are spaced out across workers, and stop for everyone once the quota runs out.
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+	defer ticker.Stop()
+	var mu sync.Mutex
+	var stopped error
+	jobs := make(chan journalEntry)
+	results := make(chan restoreResult)
+	var wg sync.WaitGroup
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range jobs {
+				mu.Lock()
+				err := stopped
+				mu.Unlock()
+				if err != nil {
+					results <- restoreResult{entry: e, err: err}
+					continue
+				}
+				r := restoreOriginal(mb, journal, *backupDir, insertMethod, e, *deleteCopies, ticker.C)
+				if errors.Is(r.err, errQuotaBudgetExceeded) {
+					mu.Lock()
+					stopped = r.err
+					mu.Unlock()
+				}
+				results <- r
+			}
+		}()
+	}
+	go func() {
+		for _, e := range restorable {
+			jobs <- e
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	restored, duplicates, failed := 0, 0, 0
+	for r := range results {
+		switch {
+		case r.err != nil:
+			if !errors.Is(r.err, errQuotaBudgetExceeded) {
+				log.Printf("Unable to restore message [%s]: %v\n", r.entry.MessageId, r.err)
+			}
+			failed++
+		case r.duplicate:
+			fmt.Printf("* %s: skipped, [%s] has its Message-ID\n", r.entry.MessageId, r.restoredId)
+			duplicates++
+		default:
+			fmt.Printf("* %s: re-inserted as [%s]\n", r.entry.MessageId, r.restoredId)
+			restored++
+		}
+	}
+	fmt.Printf("Restored run %s: re-inserted %d originals, skipped %d already there, %d failed\n", *run, restored, duplicates, failed)
+	if stopped != nil {
+		exitf(exitQuota, "Stopped early: %v", stopped)
+	}
+	if failed > 0 {
+		os.Exit(exitPartial)
+	}
+}
+
+// Re-inserts the original of e from its backup, unless a message other than its copy has
+// its Message-ID, waiting for a tick before inserting. With deleteCopy, deletes the copy.
+func restoreOriginal(mb *mailbox, journal *runJournal, backupDir string, insertMethod string, e journalEntry, deleteCopy bool, tick <-chan time.Time) restoreResult {
+	r := restoreResult{entry: e}
+	raw, err := backupSource(backupPath(backupDir, e.RunId, e.MessageId), e.RawSHA256)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	if e.RFC822MessageId != "" {
+		existing, err := cleaner.Collect(mb.cleaner().List(context.Background(), "in:anywhere rfc822msgid:"+strings.Trim(e.RFC822MessageId, "<>")))
+		if err != nil {
+			r.err = fmt.Errorf("Unable to search for duplicates: %w", err)
+			return r
+		}
+		for _, m := range existing {
+			if m.Id != e.CopyId {
+				r.restoredId, r.duplicate = m.Id, true
+				return r
+			}
+		}
+	}
+
+	<-tick
+	original := &gmail.Message{LabelIds: e.LabelIds, ThreadId: e.ThreadId}
+	inserted, err := mb.addRaw(original, raw, insertMethod)
+	if err != nil {
+		r.err = fmt.Errorf("Unable to insert message: %w", err)
+		return r
+	}
+	r.restoredId = inserted.Id
+	// Recorded against the copy when there is one, as rollback does, so neither command
+	// restores it twice.
+	removed := e.CopyId
+	if removed == "" {
+		removed = e.MessageId
+	}
+	entry := journalEntry{Action: journalRolledBack, MessageId: removed, ThreadId: e.ThreadId, LabelIds: e.LabelIds,
+		RFC822MessageId: e.RFC822MessageId, CopyId: inserted.Id, RawSHA256: e.RawSHA256}
+	if err := journal.record(entry); err != nil {
+		r.err = fmt.Errorf("Unable to write journal: %w", err)
+		return r
+	}
+	if deleteCopy && e.CopyId != "" {
+		log.Printf("Re-inserted message [%s] as [%s], deleting copy [%s]\n", e.MessageId, inserted.Id, e.CopyId)
+		if err := mb.deleteMessage(e.CopyId); err != nil {
+			r.err = fmt.Errorf("Unable to delete copy: %w", err)
+		}
+	}
+	return r
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/weineran/gmail-cleanup/transform"
+)
+
+// Keeps an attachment in the copy.
+const actionKeep = "keep"
+
+// A rule of the attachments section of a policies file, deciding what happens to
+// attachments by file extension. Strip removes an attachment, archiving it with
+// --archive-dir; delete removes it without archiving it; keep leaves it in the copy.
+// Until an attachment is older than olderThan, it is kept.
+type attachmentRule struct {
+	extensions map[string]bool
+	action     string
+	olderThan  time.Duration
+}
+
+type policyFileAttachmentRule struct {
+	Extensions []string `yaml:"extensions"`
+	Action     string   `yaml:"action"`
+	OlderThan  string   `yaml:"older_than"`
+}
+
+// Loads the attachment rules of the policies file named by spec. Inline policies have none.
+func loadAttachmentRules(spec string) ([]attachmentRule, error) {
+	if !isPolicyFile(spec) {
+		return nil, nil
+	}
+	f, err := readPolicyFile(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []attachmentRule
+	for i, fr := range f.Attachments {
+		rule := attachmentRule{extensions: map[string]bool{}, action: strings.ToLower(fr.Action)}
+		if rule.action != actionKeep && rule.action != actionStrip && rule.action != actionDelete {
+			return nil, fmt.Errorf("%s: attachments[%d].action: unknown action [%s], expected %s, %s or %s", spec, i, fr.Action, actionKeep, actionStrip, actionDelete)
+		}
+		if len(fr.Extensions) == 0 {
+			return nil, fmt.Errorf("%s: attachments[%d].extensions: missing", spec, i)
+		}
+		for _, ext := range fr.Extensions {
+			rule.extensions[strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))] = true
+		}
+		if fr.OlderThan != "" {
+			rule.olderThan, err = parseAge(fr.OlderThan)
+			if err != nil {
+				return nil, fmt.Errorf("%s: attachments[%d].older_than: %v", spec, i, err)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Returns what the first rule listing the extension of filename does with an attachment
+// of a message from date, as of now, or "" if no rule lists it.
+func attachmentAction(rules []attachmentRule, filename string, date time.Time, now time.Time) string {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(filename), "."))
+	for _, rule := range rules {
+		if !rule.extensions[ext] {
+			continue
+		}
+		if rule.olderThan > 0 && now.Sub(date) < rule.olderThan {
+			return actionKeep
+		}
+		return rule.action
+	}
+	return ""
+}
+
+// Keeps the attachment parts with these ids in the copy, as the attachment rules decided.
+type retainedAttachments map[string]bool
+
+func (r retainedAttachments) Transform(m *transform.ParsedMessage) error {
+	for _, part := range m.Parts() {
+		if !m.Downloaded(part) || !r[part.PartId] {
+			continue
+		}
+		m.Keep(part)
+	}
+	return nil
+}
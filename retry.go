@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// A message that failed in an earlier run.
+type failedMessage struct {
+	failure journalEntry
+	// The journalStripped entry, if its copy was inserted but the original not deleted.
+	replaced *journalEntry
+}
+
+// Returns the messages that failed in run runId and haven't been stripped or trashed since,
+// in journal order.
+func failedInRun(entries []journalEntry, runId string) []failedMessage {
+	stripped := map[string]journalEntry{}
+	failed := map[string]failedMessage{}
+	var order []string
+	for _, e := range entries {
+		switch e.Action {
+		case journalFailed:
+			if e.RunId != runId {
+				continue
+			}
+			f := failedMessage{failure: e}
+			if s, ok := stripped[e.MessageId]; ok {
+				f.replaced = &s
+			}
+			if _, ok := failed[e.MessageId]; !ok {
+				order = append(order, e.MessageId)
+			}
+			failed[e.MessageId] = f
+		case journalStripped, journalTrashed:
+			delete(failed, e.MessageId)
+			if e.Action == journalStripped {
+				// Stripped entries are recorded before the original is deleted.
+				stripped[e.MessageId] = e
+			}
+		}
+	}
+
+	var result []failedMessage
+	for _, id := range order {
+		if f, ok := failed[id]; ok {
+			result = append(result, f)
+		}
+	}
+	return result
+}
+
+// Processes the messages of an earlier run that failed, skipping those deleted since.
+func retryFailed(mb *mailbox, failed []failedMessage, removeOpts *removeOptions, force bool, summary *runSummary) {
+	var ids []string
+	for _, f := range failed {
+		fmt.Printf("* %s: %s\n", f.failure.MessageId, f.failure.Error)
+		ids = append(ids, f.failure.MessageId)
+	}
+	processIds(mb, ids, removeOpts, force, summary)
+}
+
+// Deletes the original of a copy an earlier run inserted, and records the replacement again.
+func finishReplacement(mb *mailbox, msg *gmail.Message, entry journalEntry, opts *removeOptions) (outcome, error) {
+	fmt.Printf("Copy [%s] of this message was inserted, but the original wasn't deleted.\n", entry.CopyId)
+	if !opts.approve(msg, "Do you want to delete the original?") {
+		log.Printf("Skipped message [%+v]\n", msg.Id)
+		return outcomeSkipped, nil
+	}
+	if err := opts.journal.record(entry); err != nil {
+		return "", fmt.Errorf("Unable to write journal: %w", err)
+	}
+	log.Printf("Deleting original message [%+v]\n", msg.Id)
+	if err := mb.deleteMessage(msg.Id); err != nil {
+		return "", fmt.Errorf("Unable to delete message: %w", err)
+	}
+	return outcomeStripped, nil
+}
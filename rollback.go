@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+
+	"github.com/weineran/gmail-cleanup/internal/gmailapi"
+)
+
+// A run's change that rollback undid. MessageId is the message it removed: the stripped
+// copy, or for a trashed message, the message itself. CopyId is the original re-inserted.
+const journalRolledBack = "rolled back"
+
+// Returns where --backup-dir keeps the raw original of messageId replaced by run runId.
+func backupPath(dir string, runId string, messageId string) string {
+	return filepath.Join(dir, runId, messageId+".eml")
+}
+
+// Saves the raw original of messageId before run runId replaces it.
+func writeBackup(dir string, runId string, messageId string, raw io.Reader) error {
+	return copyFileAtomic(backupPath(dir, runId, messageId), raw)
+}
+
+// Reads a backup, checking it against the SHA-256 the journal recorded, if any.
+func readBackup(path string, rawSHA256 string) ([]byte, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(raw)
+	if rawSHA256 != "" && hex.EncodeToString(sum[:]) != rawSHA256 {
+		return nil, fmt.Errorf("%w: %s doesn't match the journal's SHA-256", errVerificationFailed, path)
+	}
+	return raw, nil
+}
+
+// Returns a source reading the backup at path, once it has been checked against the
+// SHA-256 the journal recorded, if any, so that restoring it streams it from disk rather
+// than holding it in memory.
+func backupSource(path string, rawSHA256 string) (gmailapi.RawSource, error) {
+	sum, err := hashFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if rawSHA256 != "" && sum != rawSHA256 {
+		return nil, fmt.Errorf("%w: %s doesn't match the journal's SHA-256", errVerificationFailed, path)
+	}
+	return func() (io.ReadCloser, error) { return os.Open(path) }, nil
+}
+
+// Undoes a run: restores the messages it trashed, with their labels, and re-inserts the
+// originals it replaced from their --backup-dir backups, deleting the stripped copies.
+// Originals without a backup keep their copies.
+func runRollback(args []string) {
+	fs := flag.NewFlagSet("rollback", flag.ExitOnError)
+	var opts mailboxOptions
+	opts.register(fs)
+	run := fs.String("run", "", "The run to undo, as printed in its summary")
+	backupDir := fs.String("backup-dir", "", "The --backup-dir the run saved the originals to")
+	var insertMethod string
+	fs.StringVar(&insertMethod, "insert-method", insertMethodInsert, insertMethodUsage)
+	dryRun := fs.Bool("dry-run", false, "Only list what would be restored")
+	assumeYes := fs.Bool("yes", false, "Roll back without asking")
+	force := fs.Bool("force", false, "With --yes, don't ask to type a confirmation before copies are deleted permanently")
+	parseFlags(fs, args)
+
+	if *run == "" {
+		log.Fatal("rollback needs --run")
+	}
+	if err := checkInsertMethod(insertMethod); err != nil {
+		log.Fatal(err)
+	}
+	entries, err := readJournal(profileJournalFile(opts.profile))
+	if err != nil {
+		log.Fatalf("Unable to read journal: %v", err)
+	}
+	rolledBack := map[string]bool{}
+	for _, e := range entries {
+		if e.Action == journalRolledBack {
+			rolledBack[e.MessageId] = true
+		}
+	}
+	var trashed, restorable, noBackup []journalEntry
+	for _, e := range entries {
+		if e.RunId != *run {
+			continue
+		}
+		switch {
+		case e.Action == journalTrashed && !rolledBack[e.MessageId]:
+			trashed = append(trashed, e)
+		case e.Action == journalStripped && e.CopyId != "" && !rolledBack[e.CopyId]:
+			if *backupDir == "" {
+				noBackup = append(noBackup, e)
+				continue
+			}
+			if _, err := os.Stat(backupPath(*backupDir, e.RunId, e.MessageId)); err != nil {
+				noBackup = append(noBackup, e)
+				continue
+			}
+			restorable = append(restorable, e)
+		}
+	}
+	if len(trashed)+len(restorable)+len(noBackup) == 0 {
+		fmt.Printf("Nothing to roll back for run %s.\n", *run)
+		return
+	}
+
+	fmt.Printf("Run %s: %d trashed messages to restore, %d originals to re-insert, %d originals without a backup\n",
+		*run, len(trashed), len(restorable), len(noBackup))
+	for _, e := range noBackup {
+		fmt.Printf("* %s: no backup, keeping its copy [%s]\n", e.MessageId, e.CopyId)
+	}
+	if *dryRun {
+		for _, e := range trashed {
+			fmt.Printf("* %s: untrash %v\n", e.MessageId, e.LabelIds)
+		}
+		for _, e := range restorable {
+			fmt.Printf("* %s: re-insert, replacing copy [%s]\n", e.MessageId, e.CopyId)
+		}
+		return
+	}
+	if len(trashed)+len(restorable) == 0 {
+		return
+	}
+	if *assumeYes {
+		if len(restorable) > 0 && !*force && !confirmHardDelete(len(restorable)) {
+			log.Println("Confirmation didn't match, nothing rolled back.")
+			return
+		}
+	} else if !askYesNo(fmt.Sprintf("Do you want to restore %d messages and delete %d stripped copies permanently?", len(trashed)+len(restorable), len(restorable))) {
+		return
+	}
+
+	mb := openMailbox(&opts)
+	defer mb.quota.printSummary()
+	journal := newRunJournal(opts.profile, newRunId(time.Now()))
+
+	untrashed, reinserted, failed := 0, 0, 0
+	for _, e := range trashed {
+		_, err := untrashEntry(mb, journal, e)
+		if errors.Is(err, errQuotaBudgetExceeded) {
+			exitf(exitQuota, "Stopping after restoring %d messages: %v", untrashed+reinserted, err)
+		}
+		if errors.Is(err, errJournal) {
+			log.Fatal(err)
+		}
+		if err != nil {
+			log.Printf("Unable to untrash message [%s]: %v\n", e.MessageId, err)
+			failed++
+			continue
+		}
+		untrashed++
+	}
+	for _, e := range restorable {
+		_, err := reinsertOriginal(mb, journal, *backupDir, insertMethod, e)
+		if errors.Is(err, errQuotaBudgetExceeded) {
+			exitf(exitQuota, "Stopping after restoring %d messages: %v", untrashed+reinserted, err)
+		}
+		if err != nil {
+			log.Printf("Unable to restore message [%s]: %v\n", e.MessageId, err)
+			failed++
+			continue
+		}
+		reinserted++
+	}
+	fmt.Printf("Rolled back run %s: untrashed %d messages, re-inserted %d originals, %d failed\n", *run, untrashed, reinserted, failed)
+	if failed > 0 {
+		os.Exit(exitPartial)
+	}
+}
+
+// Wraps failures to record a rollback, after which the message is restored but the
+// journal doesn't say so.
+var errJournal = errors.New("unable to write journal")
+
+// Moves the message e trashed out of the trash and records that, then gives it back the
+// labels it had. Returns the labels added; failing to add them is only logged.
+func untrashEntry(mb *mailbox, journal *runJournal, e journalEntry) ([]string, error) {
+	m, err := mb.untrashMessage(e.MessageId)
+	if err != nil {
+		return nil, err
+	}
+	if err := journal.record(journalEntry{Action: journalRolledBack, MessageId: e.MessageId, ThreadId: e.ThreadId, LabelIds: e.LabelIds}); err != nil {
+		return nil, fmt.Errorf("%w: %v", errJournal, err)
+	}
+	added, err := restorePriorLabels(mb, m, e.LabelIds)
+	if err != nil {
+		log.Printf("Unable to restore labels on message [%s]: %v\n", e.MessageId, err)
+	}
+	return added, nil
+}
+
+// Inserts the backup of the original e replaced, with its labels and thread, then deletes
+// the stripped copy. Returns the id of the re-inserted original.
+func reinsertOriginal(mb *mailbox, journal *runJournal, backupDir string, insertMethod string, e journalEntry) (string, error) {
+	raw, err := backupSource(backupPath(backupDir, e.RunId, e.MessageId), e.RawSHA256)
+	if err != nil {
+		return "", err
+	}
+	original := &gmail.Message{LabelIds: e.LabelIds, ThreadId: e.ThreadId}
+	inserted, err := mb.addRaw(original, raw, insertMethod)
+	if err != nil {
+		return "", fmt.Errorf("Unable to insert message: %w", err)
+	}
+	entry := journalEntry{Action: journalRolledBack, MessageId: e.CopyId, ThreadId: e.ThreadId, LabelIds: e.LabelIds,
+		RFC822MessageId: e.RFC822MessageId, CopyId: inserted.Id, RawSHA256: e.RawSHA256}
+	if err := journal.record(entry); err != nil {
+		return "", fmt.Errorf("Unable to write journal: %w", err)
+	}
+	log.Printf("Re-inserted message [%s] as [%s], deleting copy [%s]\n", e.MessageId, inserted.Id, e.CopyId)
+	if err := mb.deleteMessage(e.CopyId); err != nil {
+		return inserted.Id, fmt.Errorf("Unable to delete copy: %w", err)
+	}
+	return inserted.Id, nil
+}
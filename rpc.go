@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+
+	"github.com/weineran/gmail-cleanup/internal/mimeutil"
+)
+
+// JSON-RPC 2.0 error codes. Failures of the operation itself use rpcOperationFailed,
+// with the exit code the command line would have used in the error's data.
+const (
+	rpcParseError      = -32700
+	rpcInvalidRequest  = -32600
+	rpcMethodNotFound  = -32601
+	rpcInvalidParams   = -32602
+	rpcOperationFailed = -32000
+)
+
+// Returned, wrapped, by methods whose params are missing or malformed.
+var errInvalidParams = errors.New("invalid params")
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Id      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Id      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// Data of an rpcOperationFailed error.
+type rpcErrorData struct {
+	ExitCode int    `json:"exitCode"`
+	Status   string `json:"status"`
+}
+
+// A message as list and inspect return it.
+type rpcMessage struct {
+	Id           string    `json:"id"`
+	ThreadId     string    `json:"threadId"`
+	From         string    `json:"from"`
+	Subject      string    `json:"subject"`
+	Date         string    `json:"date"`
+	SizeEstimate int64     `json:"sizeEstimate"`
+	LabelIds     []string  `json:"labelIds"`
+	Parts        []rpcPart `json:"parts,omitempty"`
+}
+
+// A MIME part, with what strip would do to it.
+type rpcPart struct {
+	PartId   string `json:"partId"`
+	MimeType string `json:"mimeType"`
+	Filename string `json:"filename,omitempty"`
+	Size     int64  `json:"size"`
+	Action   string `json:"action"`
+}
+
+type rpcServer struct {
+	mb      *mailbox
+	opts    *removeOptions
+	profile string
+	// Whether rpc was started with --force, without which strip is refused.
+	force bool
+	// Messages strip has stripped or trashed this session, counted against opts.maxDestructive.
+	destructive int
+}
+
+// Methods by name. Each decodes its own params.
+var rpcMethods = map[string]func(s *rpcServer, params json.RawMessage) (interface{}, error){
+	"list":    (*rpcServer).list,
+	"inspect": (*rpcServer).inspect,
+	"strip":   (*rpcServer).strip,
+	"restore": (*rpcServer).restore,
+}
+
+// Serves list, inspect, strip and restore as JSON-RPC 2.0 on stdin and stdout, one
+// request or response per line, so frontends in other languages can drive the tool.
+// Everything the commands would print goes to stderr instead.
+func runRPC(args []string) {
+	fs := flag.NewFlagSet("rpc", flag.ExitOnError)
+	var opts mailboxOptions
+	opts.register(fs)
+	stdio := fs.Bool("stdio", false, "Serve on stdin and stdout (the only transport)")
+	archiveDir := fs.String("archive-dir", "", "Save attachments to this directory before strip removes them")
+	backupDir := fs.String("backup-dir", "", "Save each original strip replaces as a .eml file under this directory, from which restore re-inserts it")
+	insertMethod := fs.String("insert-method", insertMethodInsert, insertMethodUsage)
+	overrideProtection := fs.Bool("override-protection", false, "Let strip process messages that match a protection pattern")
+	protectedLabel := fs.String("protected-label", defaultProtectedLabel, "Label for messages strip leaves alone because they match a protection pattern")
+	force := fs.Bool("force", false, "Enable strip, which permanently deletes each original once its copy is in, without the confirmation requests can't give")
+	maxDestructive := fs.Int("max-destructive-per-run", 0, "With --i-know-what-im-doing, allow a session to strip this many messages, above max_destructive_per_run in the config file")
+	iKnow := fs.Bool("i-know-what-im-doing", false, "Let --max-destructive-per-run raise the config file's max_destructive_per_run")
+	parseFlags(fs, args)
+
+	if !*stdio || fs.NArg() > 0 {
+		log.Fatal("Usage: gmail-cleanup rpc --stdio [flags]")
+	}
+	if err := checkInsertMethod(*insertMethod); err != nil {
+		log.Fatal(err)
+	}
+
+	// Requests can't be answered on the terminal, so strip never asks.
+	removeOpts := &removeOptions{
+		assumeYes:           true,
+		approved:            map[string]bool{},
+		senderDecisions:     map[string]bool{},
+		strictHeadersIgnore: map[string]bool{},
+		insertMethod:        *insertMethod,
+		backupDir:           *backupDir,
+		maxDestructive:      destructiveCap(opts.profile, *maxDestructive, *iKnow),
+	}
+	var err error
+	if !*overrideProtection {
+		removeOpts.protectionPatterns, err = loadProtectionPatterns("")
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	runId := newRunId(time.Now())
+	removeOpts.journal = newRunJournal(opts.profile, runId)
+	if *archiveDir != "" {
+		removeOpts.store, err = openAttachmentStore(*archiveDir, "", runId)
+		if err != nil {
+			log.Fatalf("Unable to open store: %v", err)
+		}
+		defer removeOpts.store.close()
+	}
+
+	out := os.Stdout
+	os.Stdout = os.Stderr
+	mb := openMailbox(&opts)
+	defer mb.quota.printSummary()
+	if len(removeOpts.protectionPatterns) > 0 {
+		removeOpts.protectedLabelId, err = mb.ensureLabel(*protectedLabel)
+		if err != nil {
+			exitf(exitCodeFor(err), "Unable to create label: %v", err)
+		}
+	}
+
+	s := &rpcServer{mb: mb, opts: removeOpts, profile: opts.profile, force: *force}
+	if err := s.serve(os.Stdin, out); err != nil {
+		log.Fatalf("rpc: %v", err)
+	}
+}
+
+// Answers requests from r on w until r ends.
+func (s *rpcServer) serve(r io.Reader, w io.Writer) error {
+	dec := json.NewDecoder(r)
+	enc := json.NewEncoder(w)
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err == io.EOF {
+			return nil
+		} else if err != nil {
+			// The stream can't be resynchronized after malformed JSON.
+			enc.Encode(rpcResponse{JSONRPC: "2.0", Error: &rpcError{Code: rpcParseError, Message: err.Error()}})
+			return err
+		}
+		var req rpcRequest
+		if err := json.Unmarshal(raw, &req); err != nil || req.JSONRPC != "2.0" || req.Method == "" {
+			if err := enc.Encode(rpcResponse{JSONRPC: "2.0", Error: &rpcError{Code: rpcInvalidRequest, Message: "invalid request"}}); err != nil {
+				return err
+			}
+			continue
+		}
+		resp := s.call(req)
+		if req.Id == nil {
+			// A notification: no response, even on error.
+			continue
+		}
+		if err := enc.Encode(resp); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *rpcServer) call(req rpcRequest) rpcResponse {
+	resp := rpcResponse{JSONRPC: "2.0", Id: req.Id}
+	method, ok := rpcMethods[req.Method]
+	if !ok {
+		resp.Error = &rpcError{Code: rpcMethodNotFound, Message: fmt.Sprintf("unknown method [%s]", req.Method)}
+		return resp
+	}
+	result, err := method(s, req.Params)
+	switch {
+	case errors.Is(err, errInvalidParams):
+		resp.Error = &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+	case err != nil:
+		code := exitCodeFor(err)
+		resp.Error = &rpcError{Code: rpcOperationFailed, Message: err.Error(), Data: rpcErrorData{ExitCode: code, Status: exitStatuses[code]}}
+	default:
+		resp.Result = result
+	}
+	return resp
+}
+
+// Decodes params into v. Missing params decode as an empty object.
+func decodeParams(params json.RawMessage, v interface{}) error {
+	if len(params) == 0 {
+		params = []byte("{}")
+	}
+	if err := json.Unmarshal(params, v); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidParams, err)
+	}
+	return nil
+}
+
+type rpcIdParams struct {
+	Id string `json:"id"`
+}
+
+func decodeIdParams(params json.RawMessage) (string, error) {
+	var p rpcIdParams
+	if err := decodeParams(params, &p); err != nil {
+		return "", err
+	}
+	if p.Id == "" {
+		return "", fmt.Errorf("%w: id is required", errInvalidParams)
+	}
+	return p.Id, nil
+}
+
+// Lists one page of messages matching query: {"query", "pageToken", "max"}.
+func (s *rpcServer) list(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Query     string `json:"query"`
+		PageToken string `json:"pageToken"`
+		Max       int64  `json:"max"`
+	}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Max <= 0 {
+		p.Max = 100
+	}
+	if err := s.mb.quota.charge("messages.list"); err != nil {
+		return nil, err
+	}
+	r, err := s.mb.api.ListMessages(p.Query, p.PageToken, p.Max)
+	if err != nil {
+		return nil, err
+	}
+	messages := []rpcMessage{}
+	for _, m := range r.Messages {
+		full, err := s.mb.getMessage(m.Id, "metadata")
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, newRPCMessage(full))
+	}
+	return map[string]interface{}{"messages": messages, "nextPageToken": r.NextPageToken}, nil
+}
+
+// Returns a message with its MIME parts and what strip would do to each: {"id"}. The
+// parts come from the message's structure, without their bodies.
+func (s *rpcServer) inspect(params json.RawMessage) (interface{}, error) {
+	id, err := decodeIdParams(params)
+	if err != nil {
+		return nil, err
+	}
+	m, err := s.mb.getMessageSkeleton(id)
+	if err != nil {
+		return nil, err
+	}
+	result := newRPCMessage(m)
+	for _, p := range getMessagePartsRecursively(m.Payload, nil) {
+		size := int64(0)
+		if p.Body != nil {
+			size = p.Body.Size
+		}
+		result.Parts = append(result.Parts, rpcPart{
+			PartId:   p.PartId,
+			MimeType: p.MimeType,
+			Filename: p.Filename,
+			Size:     size,
+			Action:   plannedPartAction(p, true, false, false),
+		})
+	}
+	return result, nil
+}
+
+// Replaces a message with a copy without attachments, as the default command does with
+// --yes --force: {"id"}. Returns the outcome, e.g. "stripped" or "no attachments".
+// Refused unless rpc has --force, and once the session reaches max_destructive_per_run.
+func (s *rpcServer) strip(params json.RawMessage) (interface{}, error) {
+	id, err := decodeIdParams(params)
+	if err != nil {
+		return nil, err
+	}
+	if !s.force {
+		return nil, errors.New("strip permanently deletes originals, which can't be confirmed over rpc; start rpc with --force to allow it")
+	}
+	if s.opts.maxDestructive > 0 && s.destructive >= s.opts.maxDestructive {
+		return nil, fmt.Errorf("this session has stripped or trashed %d messages, the most max_destructive_per_run allows; start rpc with --i-know-what-im-doing --max-destructive-per-run N for more", s.destructive)
+	}
+	m, err := s.mb.getMessage(id, "metadata")
+	if err != nil {
+		return nil, err
+	}
+	result, err := processMessage(s.mb, m, s.opts)
+	if result == outcomeStripped || result == outcomeTrashed {
+		s.destructive++
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"id": id, "outcome": result}, nil
+}
+
+// Undoes what a run did to a message, as rollback does: {"id"} of a message a run
+// trashed, which is moved out of the trash with the labels it had, or of an original a
+// run stripped or its copy, which is re-inserted from its --backup-dir backup in place of
+// the copy. Re-inserting deletes the copy permanently, so it needs rpc --force too.
+func (s *rpcServer) restore(params json.RawMessage) (interface{}, error) {
+	id, err := decodeIdParams(params)
+	if err != nil {
+		return nil, err
+	}
+	journal, err := readJournal(profileJournalFile(s.profile))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read journal: %w", err)
+	}
+	var found *journalEntry
+	rolledBack := map[string]bool{}
+	for _, e := range journal {
+		switch {
+		case e.Action == journalRolledBack:
+			rolledBack[e.MessageId] = true
+		case e.Action == journalTrashed && e.MessageId == id,
+			e.Action == journalStripped && e.CopyId != "" && (e.MessageId == id || e.CopyId == id):
+			entry := e
+			found = &entry
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no run trashed or stripped message [%s]", id)
+	}
+
+	if found.Action == journalTrashed {
+		if rolledBack[found.MessageId] {
+			return nil, fmt.Errorf("message [%s] was already restored", id)
+		}
+		added, err := untrashEntry(s.mb, s.opts.journal, *found)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"id": id, "restoredId": found.MessageId, "restoredLabelIds": added}, nil
+	}
+
+	if rolledBack[found.CopyId] {
+		return nil, fmt.Errorf("message [%s] was already restored", id)
+	}
+	if !s.force {
+		return nil, errors.New("restoring a stripped message permanently deletes its copy, which can't be confirmed over rpc; start rpc with --force to allow it")
+	}
+	if s.opts.backupDir == "" {
+		return nil, fmt.Errorf("message [%s] was stripped; start rpc with the run's --backup-dir to re-insert the original", id)
+	}
+	restoredId, err := reinsertOriginal(s.mb, s.opts.journal, s.opts.backupDir, s.opts.insertMethod, *found)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"id": id, "restoredId": restoredId}, nil
+}
+
+func newRPCMessage(m *gmail.Message) rpcMessage {
+	result := rpcMessage{Id: m.Id, ThreadId: m.ThreadId, SizeEstimate: m.SizeEstimate, LabelIds: m.LabelIds}
+	if m.Payload != nil {
+		result.From = mimeutil.HeaderValue(m.Payload.Headers, "From")
+		result.Subject = mimeutil.HeaderValue(m.Payload.Headers, "Subject")
+		result.Date = messageDate(m).Format(time.RFC3339)
+	}
+	return result
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3 doesn't accept presigned URLs valid for longer than a week.
+const maxLinkExpiry = 7 * 24 * time.Hour
+
+// A store in an S3 bucket, or in a bucket of a service with the same API, such as
+// MinIO or Cloudflare R2.
+type s3StoreFS struct {
+	bucket string
+	prefix string
+	// The endpoint objects are addressed under: https://BUCKET.s3.REGION.amazonaws.com,
+	// or $AWS_ENDPOINT_URL/BUCKET.
+	endpoint        *url.URL
+	region          string
+	accessKeyId     string
+	secretAccessKey string
+	sessionToken    string
+	client          *http.Client
+	// Returns the current time; time.Now if nil.
+	now func() time.Time
+}
+
+// Opens s3://bucket/prefix with the credentials in $AWS_ACCESS_KEY_ID,
+// $AWS_SECRET_ACCESS_KEY and optionally $AWS_SESSION_TOKEN, in the region in
+// $AWS_REGION or $AWS_DEFAULT_REGION, us-east-1 without either. $AWS_ENDPOINT_URL
+// points it at another service with the S3 API.
+func openS3Store(storeURL string) (*s3StoreFS, error) {
+	u, err := url.Parse(storeURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "s3" || u.Host == "" {
+		return nil, fmt.Errorf("unsupported store [%s], expected s3://bucket/prefix", storeURL)
+	}
+	s := &s3StoreFS{
+		bucket:          u.Host,
+		prefix:          strings.Trim(u.Path, "/"),
+		region:          os.Getenv("AWS_REGION"),
+		accessKeyId:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		client:          &http.Client{Timeout: 5 * time.Minute},
+	}
+	if s.accessKeyId == "" || s.secretAccessKey == "" {
+		return nil, errors.New("an s3:// store needs $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY")
+	}
+	if s.region == "" {
+		s.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	if endpoint := os.Getenv("AWS_ENDPOINT_URL"); endpoint != "" {
+		s.endpoint, err = url.Parse(strings.TrimSuffix(endpoint, "/") + "/" + s.bucket)
+		if err != nil {
+			return nil, fmt.Errorf("$AWS_ENDPOINT_URL: %w", err)
+		}
+	} else {
+		s.endpoint = &url.URL{Scheme: "https", Host: s.bucket + ".s3." + s.region + ".amazonaws.com"}
+	}
+	return s, nil
+}
+
+// Returns the key of name in the bucket.
+func (s *s3StoreFS) key(name string) string {
+	return path.Join(s.prefix, name)
+}
+
+func (s *s3StoreFS) objectURL(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+func (s *s3StoreFS) time() time.Time {
+	if s.now != nil {
+		return s.now().UTC()
+	}
+	return time.Now().UTC()
+}
+
+// Sends a request signed with AWS Signature Version 4. A 404 is reported as an error
+// satisfying os.IsNotExist.
+func (s *s3StoreFS) do(method string, key string, query url.Values, body []byte) (*http.Response, error) {
+	u := s.objectURL(key, query)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	now := s.time()
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+	headers := map[string]string{"host": u.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = req.Header.Get(name)
+	}
+	signedHeaders, signature := s.sign(method, u, headers, payloadHash, now)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKeyId, s.scope(now), signedHeaders, signature))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, &os.PathError{Op: strings.ToLower(method), Path: "s3://" + s.bucket + "/" + key, Err: os.ErrNotExist}
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%s s3://%s/%s: %s: %s", method, s.bucket, key, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+func (s *s3StoreFS) scope(t time.Time) string {
+	return t.Format("20060102") + "/" + s.region + "/s3/aws4_request"
+}
+
+// Signs a request to u with headers, whose names are lowercase and which must include
+// host. Returns the signed header names and the signature.
+func (s *s3StoreFS) sign(method string, u *url.URL, headers map[string]string, payloadHash string, t time.Time) (string, string) {
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{method, uriEncode(u.Path, false), u.RawQuery, canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + t.Format("20060102T150405Z") + "\n" + s.scope(t) + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretAccessKey), t.Format("20060102"))
+	for _, part := range []string{s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Percent-encodes s as Signature Version 4 requires: everything but unreserved
+// characters, and slashes too unless s is a path.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !encodeSlash {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// Encodes query sorted by key, as both the request and its signature need it.
+func canonicalQuery(query url.Values) string {
+	var keys []string
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			pairs = append(pairs, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// Returns a URL that downloads the object at key without credentials until expiry has
+// passed, with the response headers in overrides, e.g. response-content-type.
+func (s *s3StoreFS) presign(key string, expiry time.Duration, overrides url.Values) string {
+	now := s.time()
+	query := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {s.accessKeyId + "/" + s.scope(now)},
+		"X-Amz-Date":          {now.Format("20060102T150405Z")},
+		"X-Amz-Expires":       {strconv.Itoa(int(expiry / time.Second))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	if s.sessionToken != "" {
+		query.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+	for k, v := range overrides {
+		query[k] = v
+	}
+	u := s.objectURL(key, query)
+	_, signature := s.sign(http.MethodGet, u, map[string]string{"host": u.Host}, "UNSIGNED-PAYLOAD", now)
+	u.RawQuery += "&X-Amz-Signature=" + signature
+	return u.String()
+}
+
+// Returns the key of the object at location, if it is in this store's bucket.
+func (s *s3StoreFS) keyAt(location string) (string, bool) {
+	if !strings.HasPrefix(location, "s3://"+s.bucket+"/") {
+		return "", false
+	}
+	return strings.TrimPrefix(location, "s3://"+s.bucket+"/"), true
+}
+
+// S3 replaces an object only once the upload is complete, so readers never see part of one.
+func (s *s3StoreFS) writeFile(name string, data []byte) error {
+	resp, err := s.do(http.MethodPut, s.key(name), nil, data)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *s3StoreFS) readFile(name string) ([]byte, error) {
+	r, err := s.open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func (s *s3StoreFS) open(name string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, s.key(name), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3StoreFS) size(name string) (int64, error) {
+	resp, err := s.do(http.MethodHead, s.key(name), nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.ContentLength, nil
+}
+
+// A page of a ListObjectsV2 response.
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *s3StoreFS) list(dir string) ([]string, error) {
+	prefix := s.key(dir) + "/"
+	var names []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}, "delimiter": {"/"}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("listing s3://%s/%s: %w", s.bucket, prefix, err)
+		}
+		for _, c := range page.Contents {
+			name := strings.TrimPrefix(c.Key, prefix)
+			if name != "" && !strings.HasPrefix(name, ".") {
+				names = append(names, name)
+			}
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return names, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+func (s *s3StoreFS) remove(name string) error {
+	resp, err := s.do(http.MethodDelete, s.key(name), nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *s3StoreFS) location(name string) string {
+	return "s3://" + s.bucket + "/" + s.key(name)
+}
+
+func (s *s3StoreFS) close() error {
+	return nil
+}
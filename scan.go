@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Runs a command such as "clamscan -" on each attachment before it's archived, with the
+// attachment on stdin. Attachments it rejects with a non-zero exit status are written
+// to a quarantine directory instead of the archive.
+type attachmentScanner struct {
+	command       []string
+	quarantineDir string
+	quarantined   []quarantinedAttachment
+}
+
+// An attachment the scan command rejected.
+type quarantinedAttachment struct {
+	MessageId string `json:"messageId"`
+	Filename  string `json:"filename"`
+	Path      string `json:"path"`
+	// What the scan command printed.
+	Output string `json:"output"`
+}
+
+// Quarantines into archiveDir/quarantine/.
+func newAttachmentScanner(command string, archiveDir string) (*attachmentScanner, error) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return nil, errors.New("empty --scan-cmd")
+	}
+	if _, err := exec.LookPath(fields[0]); err != nil {
+		return nil, fmt.Errorf("--scan-cmd: %w", err)
+	}
+	return &attachmentScanner{command: fields, quarantineDir: filepath.Join(archiveDir, "quarantine")}, nil
+}
+
+// Reports whether the command accepts data, and what it printed. An error means the
+// command couldn't be run at all.
+func (s *attachmentScanner) scan(data []byte) (bool, string, error) {
+	cmd := exec.Command(s.command[0], s.command[1:]...)
+	cmd.Stdin = bytes.NewReader(data)
+	output, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return false, strings.TrimSpace(string(output)), nil
+	}
+	if err != nil {
+		return false, "", fmt.Errorf("%s: %w", s.command[0], err)
+	}
+	return true, strings.TrimSpace(string(output)), nil
+}
+
+// Writes a rejected attachment to quarantineDir/MESSAGE_ID/SAFE_NAME and remembers it for the run summary.
+func (s *attachmentScanner) quarantine(messageId string, filename string, safeName string, data []byte, output string) error {
+	dir := filepath.Join(s.quarantineDir, messageId)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, safeName)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return err
+	}
+	log.Printf("Warning: scan rejected attachment [%s] of message [%s], quarantined to [%s]: %s\n", filename, messageId, path, output)
+	s.quarantined = append(s.quarantined, quarantinedAttachment{MessageId: messageId, Filename: filename, Path: path, Output: output})
+	return nil
+}
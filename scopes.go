@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/people/v1"
+
+	"github.com/weineran/gmail-cleanup/internal/auth"
+)
+
+// Reports which scopes an access token grants, without using any Gmail quota.
+const tokenInfoURL = "https://oauth2.googleapis.com/tokeninfo"
+
+// Scopes that also grant what the scope they're listed under does.
+var broaderScopes = map[string][]string{
+	gmail.GmailReadonlyScope:         {gmail.GmailModifyScope, gmail.MailGoogleComScope},
+	gmail.GmailInsertScope:           {gmail.GmailModifyScope, gmail.MailGoogleComScope},
+	gmail.GmailModifyScope:           {gmail.MailGoogleComScope},
+	drive.DriveMetadataReadonlyScope: {drive.DriveMetadataScope, drive.DriveReadonlyScope, drive.DriveScope},
+	people.ContactsReadonlyScope:     {people.ContactsScope},
+}
+
+// Returns the scopes the command needs: reading mail for read-only commands, and
+// otherwise full access, since deleting messages permanently needs it.
+func (o *mailboxOptions) requiredScopes() []string {
+	scopes := []string{gmail.MailGoogleComScope}
+	if o.readOnly {
+		scopes = []string{gmail.GmailReadonlyScope}
+	}
+	for _, s := range o.extraScopes {
+		if !containsString(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the scopes in required that granted doesn't cover.
+func missingScopes(granted []string, required []string) []string {
+	var missing []string
+	for _, r := range required {
+		if containsString(granted, r) {
+			continue
+		}
+		covered := false
+		for _, b := range broaderScopes[r] {
+			covered = covered || containsString(granted, b)
+		}
+		if !covered {
+			missing = append(missing, r)
+		}
+	}
+	return missing
+}
+
+// Returns the scopes granted to client's token, refreshing it first if needed.
+func grantedScopes(client *http.Client) ([]string, error) {
+	t, ok := client.Transport.(*oauth2.Transport)
+	if !ok {
+		return nil, errors.New("not an OAuth client")
+	}
+	tok, err := t.Source.Token()
+	if err != nil {
+		return nil, err
+	}
+	// Through the same proxy and certificates as the client, but without the token.
+	resp, err := (&http.Client{Transport: t.Base}).Get(tokenInfoURL + "?access_token=" + url.QueryEscape(tok.AccessToken))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var info struct {
+		Scope            string `json:"scope"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tokeninfo: %s: %s", resp.Status, info.ErrorDescription)
+	}
+	return strings.Fields(info.Scope), nil
+}
+
+// Checks, before the command does anything, that client's token grants the scopes it
+// needs, rather than failing at the first insert or delete. A token that doesn't is
+// replaced by one for exactly those scopes, if the user agrees; config is nil with
+// Application Default Credentials, which have to be renewed with gcloud.
+func checkScopes(ctx context.Context, opts *mailboxOptions, client *http.Client, config *oauth2.Config) *http.Client {
+	required := opts.requiredScopes()
+	granted, err := grantedScopes(client)
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		exitf(exitAuth, "Unable to authorize: %v", err)
+	}
+	if err != nil {
+		log.Printf("Unable to check the token's scopes, carrying on: %v%s\n", err, transportHint(err))
+		return client
+	}
+	missing := missingScopes(granted, required)
+	if len(missing) == 0 {
+		return client
+	}
+	fmt.Printf("The token doesn't grant %s, which this command needs.\n", strings.Join(missing, ", "))
+	if config == nil {
+		exitf(exitAuth, "Authorize again with: gcloud auth application-default login --scopes=%s",
+			strings.Join(append([]string{"https://www.googleapis.com/auth/cloud-platform"}, required...), ","))
+	}
+	tokenFile := profileTokenFile(opts.profile)
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		exitf(exitAuth, "Run the command in a terminal to authorize again, replacing [%s].", tokenFile)
+	}
+	if !askYesNo(fmt.Sprintf("Do you want to authorize again for %s?", strings.Join(required, ", "))) {
+		exitf(exitAuth, "Not authorized for %s.", strings.Join(missing, ", "))
+	}
+	config.Scopes = required
+	client, err = auth.Reauthorize(ctx, config, tokenFile, opts.tokenEncryption(), os.Stdin, os.Stdout)
+	if err != nil {
+		exitf(exitAuth, "Unable to authorize: %v", err)
+	}
+	// Scopes can be unticked on the consent screen.
+	if granted, err = grantedScopes(client); err == nil {
+		if missing := missingScopes(granted, required); len(missing) > 0 {
+			exitf(exitAuth, "The new token doesn't grant %s either; tick every permission on the consent screen.", strings.Join(missing, ", "))
+		}
+	}
+	return client
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// Variables a score expression can use, for a message.
+var scoreVariables = map[string]func(m *gmail.Message, now time.Time) float64{
+	"size":      func(m *gmail.Message, now time.Time) float64 { return float64(m.SizeEstimate) },
+	"size_mb":   func(m *gmail.Message, now time.Time) float64 { return float64(m.SizeEstimate) / (1 << 20) },
+	"age_days":  func(m *gmail.Message, now time.Time) float64 { return now.Sub(messageDate(m)).Hours() / 24 },
+	"age_years": func(m *gmail.Message, now time.Time) float64 { return now.Sub(messageDate(m)).Hours() / 24 / 365.25 },
+}
+
+// Functions a score expression can call, by name and number of arguments.
+var scoreFunctions = map[string]struct {
+	args int
+	fn   func(args []float64) float64
+}{
+	"log":  {1, func(a []float64) float64 { return math.Log(a[0]) }},
+	"sqrt": {1, func(a []float64) float64 { return math.Sqrt(a[0]) }},
+	"min":  {2, func(a []float64) float64 { return math.Min(a[0], a[1]) }},
+	"max":  {2, func(a []float64) float64 { return math.Max(a[0], a[1]) }},
+}
+
+// A parsed --score-expr, such as "size_mb * (1 + age_years)". Messages with higher
+// scores are processed first.
+type scoreExpr struct {
+	source string
+	eval   func(vars map[string]float64) float64
+}
+
+func (e *scoreExpr) score(m *gmail.Message, now time.Time) float64 {
+	vars := map[string]float64{}
+	for name, value := range scoreVariables {
+		vars[name] = value(m, now)
+	}
+	return e.eval(vars)
+}
+
+// Orders messages by descending score, then id, and prints them with their scores.
+func sortByScore(messages []*gmail.Message, e *scoreExpr, now time.Time) {
+	scores := map[string]float64{}
+	for _, m := range messages {
+		scores[m.Id] = e.score(m, now)
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		a, b := scores[messages[i].Id], scores[messages[j].Id]
+		if a != b {
+			return a > b
+		}
+		return messages[i].Id < messages[j].Id
+	})
+	fmt.Printf("Messages by score [%s]:\n", e.source)
+	for _, m := range messages {
+		fmt.Printf("* %s: %.2f (%s, %s)\n", m.Id, scores[m.Id], formatBytes(m.SizeEstimate), messageDate(m).Format("2006-01-02"))
+	}
+}
+
+// Parses a score expression: numbers, the variables size, size_mb, age_days and
+// age_years, the operators + - * / ^ with parentheses, and log, sqrt, min and max.
+func parseScoreExpr(s string) (*scoreExpr, error) {
+	p := &scoreParser{tokens: scoreTokens(s)}
+	eval, err := p.expr()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected [%s]", p.tokens[p.pos])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("--score-expr [%s]: %w", s, err)
+	}
+	return &scoreExpr{source: s, eval: eval}, nil
+}
+
+// Splits s into numbers, names and single-character operators.
+func scoreTokens(s string) []string {
+	var tokens []string
+	for i := 0; i < len(s); {
+		r := rune(s[i])
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsDigit(r) || r == '.' || unicode.IsLetter(r) || r == '_':
+			j := i
+			for j < len(s) && (unicode.IsDigit(rune(s[j])) || s[j] == '.' || unicode.IsLetter(rune(s[j])) || s[j] == '_') {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		default:
+			tokens = append(tokens, s[i:i+1])
+			i++
+		}
+	}
+	return tokens
+}
+
+type scoreNode func(vars map[string]float64) float64
+
+// A recursive descent parser; ^ binds tighter than unary minus, which binds tighter than * and /.
+type scoreParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *scoreParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *scoreParser) expect(token string) error {
+	if p.peek() != token {
+		return fmt.Errorf("expected [%s], got [%s]", token, p.peek())
+	}
+	p.pos++
+	return nil
+}
+
+func (p *scoreParser) expr() (scoreNode, error) {
+	left, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "+" || p.peek() == "-" {
+		op := p.tokens[p.pos]
+		p.pos++
+		right, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		if op == "+" {
+			left = func(v map[string]float64) float64 { return l(v) + right(v) }
+		} else {
+			left = func(v map[string]float64) float64 { return l(v) - right(v) }
+		}
+	}
+	return left, nil
+}
+
+func (p *scoreParser) term() (scoreNode, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "*" || p.peek() == "/" {
+		op := p.tokens[p.pos]
+		p.pos++
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		if op == "*" {
+			left = func(v map[string]float64) float64 { return l(v) * right(v) }
+		} else {
+			left = func(v map[string]float64) float64 { return l(v) / right(v) }
+		}
+	}
+	return left, nil
+}
+
+func (p *scoreParser) unary() (scoreNode, error) {
+	if p.peek() == "-" {
+		p.pos++
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(v map[string]float64) float64 { return -operand(v) }, nil
+	}
+	return p.power()
+}
+
+func (p *scoreParser) power() (scoreNode, error) {
+	base, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() != "^" {
+		return base, nil
+	}
+	p.pos++
+	exponent, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	return func(v map[string]float64) float64 { return math.Pow(base(v), exponent(v)) }, nil
+}
+
+func (p *scoreParser) primary() (scoreNode, error) {
+	token := p.peek()
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case token == "(":
+		p.pos++
+		inner, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return inner, p.expect(")")
+	case unicode.IsDigit(rune(token[0])) || token[0] == '.':
+		p.pos++
+		n, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number [%s]", token)
+		}
+		return func(map[string]float64) float64 { return n }, nil
+	}
+
+	p.pos++
+	name := strings.ToLower(token)
+	if p.peek() != "(" {
+		if _, ok := scoreVariables[name]; !ok {
+			return nil, fmt.Errorf("unknown variable [%s], expected size, size_mb, age_days or age_years", token)
+		}
+		return func(v map[string]float64) float64 { return v[name] }, nil
+	}
+	f, ok := scoreFunctions[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function [%s], expected log, sqrt, min or max", token)
+	}
+	p.pos++
+	var args []scoreNode
+	for p.peek() != ")" {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	p.pos++
+	if len(args) != f.args {
+		return nil, fmt.Errorf("%s takes %d arguments, got %d", name, f.args, len(args))
+	}
+	return func(v map[string]float64) float64 {
+		values := make([]float64, len(args))
+		for i, arg := range args {
+			values[i] = arg(v)
+		}
+		return f.fn(values)
+	}, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestParseScoreExpr(t *testing.T) {
+	vars := map[string]float64{"size": 8 << 20, "size_mb": 8, "age_days": 730, "age_years": 2}
+	tests := []struct {
+		expr string
+		want float64
+	}{
+		{"42", 42},
+		{".5", 0.5},
+		{"size", 8 << 20},
+		{"size_mb * (1 + age_years)", 24},
+		{"SIZE_MB", 8},
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"10 - 4 - 3", 3},
+		{"24 / 4 / 2", 3},
+		{"2 ^ 3 ^ 2", 512},
+		{"-2 ^ 2", -4},
+		{"2 ^ -1", 0.5},
+		{"--3", 3},
+		{"sqrt(size_mb * 2)", 4},
+		{"log(1)", 0},
+		{"min(size_mb, age_years)", 2},
+		{"max(size_mb, age_days / 100)", 8},
+		{"max(min(1, 2), 3 * 0.5)", 1.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			e, err := parseScoreExpr(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := e.eval(vars); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("%s = %v, want %v", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseScoreExprErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"", "unexpected end of expression"},
+		{"size *", "unexpected end of expression"},
+		{"size_gb", "unknown variable [size_gb]"},
+		{"exp(size)", "unknown function [exp]"},
+		{"max(size)", "max takes 2 arguments, got 1"},
+		{"log(size, 2)", "log takes 1 arguments, got 2"},
+		{"min(1 2)", "expected [,], got [2]"},
+		{"(size", "expected [)], got []"},
+		{"size)", "unexpected [)]"},
+		{"1.2.3", "invalid number [1.2.3]"},
+		{"size % 2", "unexpected [%]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := parseScoreExpr(tt.expr)
+			if err == nil {
+				t.Fatalf("parseScoreExpr() = nil error, want %q", tt.want)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("parseScoreExpr() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSortByScore(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	message := func(id string, mb int64, date string) *gmail.Message {
+		return &gmail.Message{Id: id, SizeEstimate: mb << 20, Payload: &gmail.MessagePart{
+			Headers: []*gmail.MessagePartHeader{{Name: "Date", Value: date}},
+		}}
+	}
+	messages := []*gmail.Message{
+		message("recent", 12, "Sat, 25 May 2024 10:00:00 +0000"),
+		message("old", 8, "Mon, 3 Mar 2014 10:00:00 +0000"),
+		message("tie-b", 1, "Fri, 1 Jun 2018 00:00:00 +0000"),
+		message("tie-a", 1, "Fri, 1 Jun 2018 00:00:00 +0000"),
+	}
+	e, err := parseScoreExpr("size_mb * (1 + age_years)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sortByScore(messages, e, now)
+	var got []string
+	for _, m := range messages {
+		got = append(got, m.Id)
+	}
+	if want := []string{"old", "recent", "tie-a", "tie-b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sortByScore() = %v, want %v", got, want)
+	}
+}
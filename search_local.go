@@ -0,0 +1,127 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"html"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+
+	"github.com/weineran/gmail-cleanup/internal/mimeutil"
+	"github.com/weineran/gmail-cleanup/transform"
+)
+
+// The full-text index snapshot --bodies adds: each message's subject, text body and
+// attachment filenames.
+const snapshotBodiesSchema = `
+CREATE VIRTUAL TABLE bodies USING fts5(message_id UNINDEXED, subject, body, attachments);
+`
+
+// Most bytes of a body indexed; the rest of a long body rarely matters for a decision.
+const maxIndexedBody = 256 << 10
+
+// Script and style elements, whose text isn't part of the body.
+var htmlHiddenPattern = regexp.MustCompile(`(?is)<(script|style)\b.*?</(script|style)>`)
+
+// Returns the text of m's body: its first text/plain part, or else its first text/html
+// part without tags.
+func messageBodyText(m *gmail.Message) string {
+	if text := plainTextBody(m.Payload, maxIndexedBody); text != "" {
+		return text
+	}
+	var parts []*gmail.MessagePart
+	for _, part := range getMessagePartsRecursively(m.Payload, parts) {
+		if part.Filename != "" || !strings.HasPrefix(strings.ToLower(part.MimeType), "text/html") {
+			continue
+		}
+		body, err := transform.Body(part)
+		if err != nil {
+			continue
+		}
+		text := htmlTagPattern.ReplaceAllString(htmlHiddenPattern.ReplaceAllString(string(body), " "), " ")
+		text = strings.Join(strings.Fields(html.UnescapeString(text)), " ")
+		if len(text) > maxIndexedBody {
+			text = text[:maxIndexedBody]
+		}
+		return text
+	}
+	return ""
+}
+
+func insertSnapshotBody(tx *sql.Tx, m *gmail.Message) error {
+	var filenames []string
+	var parts []*gmail.MessagePart
+	for _, part := range getMessagePartsRecursively(m.Payload, parts) {
+		if part.Filename != "" {
+			filenames = append(filenames, part.Filename)
+		}
+	}
+	_, err := tx.Exec(`INSERT INTO bodies (message_id, subject, body, attachments) VALUES (?, ?, ?, ?)`,
+		m.Id, mimeutil.HeaderValue(m.Payload.Headers, "Subject"), messageBodyText(m), strings.Join(filenames, " "))
+	return err
+}
+
+// Searches the bodies of a snapshot taken with --bodies, without the API, e.g. to decide
+// what to keep before a run deletes or strips it.
+func runSearchLocal(args []string) {
+	fs := flag.NewFlagSet("search-local", flag.ExitOnError)
+	dbPath := fs.String("db", "snapshot.db", "Snapshot taken with --bodies")
+	limit := fs.Int("limit", 50, "Most messages to show (0 means all)")
+	idsOnly := fs.Bool("ids", false, "Only print the ids of matching messages, one per line, for --ids-from-file")
+	parseFlags(fs, args)
+	if fs.NArg() == 0 {
+		log.Fatal(`Usage: gmail-cleanup search-local [--db snapshot.db] "warranty"`)
+	}
+	// FTS5 syntax: words, "phrases", AND, OR, NOT, prefix*, and columns such as attachments:pdf.
+	query := strings.Join(fs.Args(), " ")
+
+	db, err := sql.Open("sqlite", *dbPath)
+	if err != nil {
+		log.Fatalf("Unable to open snapshot: %v", err)
+	}
+	defer db.Close()
+	var indexed int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name = 'bodies'`).Scan(&indexed); err != nil {
+		log.Fatalf("Unable to read snapshot [%s]: %v", *dbPath, err)
+	}
+	if indexed == 0 {
+		log.Fatalf("Snapshot [%s] has no bodies; take it with snapshot --bodies", *dbPath)
+	}
+
+	sqlQuery := `SELECT m.id, m.internal_date, m.size_estimate, m.sender, m.subject, snippet(bodies, 2, '[', ']', '...', 12)
+		FROM bodies JOIN messages m ON m.id = bodies.message_id WHERE bodies MATCH ? ORDER BY rank`
+	if *limit > 0 {
+		sqlQuery += fmt.Sprintf(" LIMIT %d", *limit)
+	}
+	rows, err := db.Query(sqlQuery, query)
+	if err != nil {
+		log.Fatalf("Unable to search [%s]: %v", query, err)
+	}
+	defer rows.Close()
+	count := 0
+	for rows.Next() {
+		var id, sender, subject, snippet string
+		var date, size int64
+		if err := rows.Scan(&id, &date, &size, &sender, &subject, &snippet); err != nil {
+			log.Fatal(err)
+		}
+		count++
+		if *idsOnly {
+			fmt.Println(id)
+			continue
+		}
+		fmt.Printf("* %s %s %s %s: %s\n", id, time.Unix(date/1000, 0).Format("2006-01-02"), formatBytes(size), sender, subject)
+		fmt.Printf("  %s\n", snippet)
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalf("Unable to search [%s]: %v", query, err)
+	}
+	if !*idsOnly {
+		fmt.Printf("%d messages match [%s]\n", count, query)
+	}
+}
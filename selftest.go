@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+
+	"github.com/weineran/gmail-cleanup/internal/mimeutil"
+)
+
+const selftestText = "This message was created by gmail-cleanup selftest and is deleted when the test ends.\r\n"
+
+// An attachment of the synthetic message.
+type selftestAttachment struct {
+	filename string
+	mimeType string
+	data     []byte
+}
+
+// Counts failed checks.
+type selftestResult struct {
+	failures int
+}
+
+func (r *selftestResult) check(ok bool, format string, v ...interface{}) bool {
+	status := "PASS"
+	if !ok {
+		status = "FAIL"
+		r.failures++
+	}
+	fmt.Printf("%s: %s\n", status, fmt.Sprintf(format, v...))
+	return ok
+}
+
+// Inserts a synthetic message with attachments under a sandbox label, strips it the way
+// the default command does, checks the copy and the archived attachments, restores the
+// original from the trash, and deletes everything it created.
+func runSelftest(args []string) {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	var opts mailboxOptions
+	opts.register(fs)
+	labelName := fs.String("label", "gmail-cleanup/selftest", "Label the test messages are inserted under, instead of the inbox")
+	keep := fs.Bool("keep", false, "Leave the test messages in the mailbox to look at them")
+	parseFlags(fs, args)
+
+	mb := openMailbox(&opts)
+	defer mb.quota.printSummary()
+
+	profile, err := mb.getProfile()
+	if err != nil {
+		exitf(exitCodeFor(err), "Unable to get profile: %v", err)
+	}
+	labelId, err := mb.ensureLabel(*labelName)
+	if err != nil {
+		exitf(exitCodeFor(err), "Unable to create label: %v", err)
+	}
+
+	runId := newRunId(time.Now())
+	attachments := selftestAttachments()
+	raw := selftestMessage(profile.EmailAddress, runId, attachments)
+	rawSum := sha256.Sum256(raw)
+
+	var result selftestResult
+	var created []string
+	cleanUp := func() {
+		if *keep {
+			fmt.Printf("Keeping test messages %v under label [%s]\n", created, *labelName)
+			return
+		}
+		for _, id := range created {
+			if err := mb.deleteMessage(id); err != nil {
+				log.Printf("Unable to delete test message [%s]: %v\n", id, err)
+			}
+		}
+	}
+	// Deletes what the test created before exiting.
+	abort := func(code int, format string, v ...interface{}) {
+		cleanUp()
+		exitf(code, format, v...)
+	}
+	defer func() {
+		cleanUp()
+		if result.failures > 0 {
+			exitf(exitVerification, "Self-test failed: %d checks failed", result.failures)
+		}
+		fmt.Println("Self-test passed.")
+	}()
+
+	inserted, err := mb.insertMessage(&gmail.Message{Raw: base64.URLEncoding.EncodeToString(raw), LabelIds: []string{labelId}}, "dateHeader")
+	if err != nil {
+		abort(exitCodeFor(err), "Unable to insert test message: %v", err)
+	}
+	created = append(created, inserted.Id)
+	fmt.Printf("Inserted test message [%s] under label [%s]\n", inserted.Id, *labelName)
+
+	original, err := mb.getMessage(inserted.Id, "full")
+	if err != nil {
+		abort(exitCodeFor(err), "Unable to get test message: %v", err)
+	}
+	if !result.check(len(attachmentParts(original.Payload)) == len(attachments), "Gmail sees %d attachments on the inserted message", len(attachments)) {
+		return
+	}
+
+	// Strip, as processMessage does: fetch, archive, rebuild, check headers, add the copy.
+	var fetched []fetchedAttachment
+	for _, part := range attachmentParts(original.Payload) {
+		body, err := mb.getAttachment(original.Id, part.Body.AttachmentId)
+		if err != nil {
+			abort(exitCodeFor(err), "Unable to get attachment: %v", err)
+		}
+		fetched = append(fetched, fetchedAttachment{part: part, body: body})
+	}
+	for _, a := range attachments {
+		found := false
+		for _, f := range fetched {
+			data, _ := base64.URLEncoding.DecodeString(f.body.Data)
+			found = found || (f.part.Filename == a.filename && bytes.Equal(data, a.data))
+		}
+		result.check(found, "attachment [%s] downloads intact", a.filename)
+	}
+
+	dir, err := ioutil.TempDir("", "gmail-cleanup-selftest")
+	if err != nil {
+		abort(exitError, "%v", err)
+	}
+	defer os.RemoveAll(dir)
+	store := newAttachmentStore(dir, runId)
+	archived, err := archiveAttachments(store, nil, original, fetched)
+	if err != nil {
+		abort(exitError, "Unable to archive attachments: %v", err)
+	}
+	for _, a := range archived {
+		hash, err := store.hashObject(a.SHA256)
+		result.check(err == nil && hash == a.SHA256, "archived [%s] matches its SHA-256", a.Filename)
+	}
+	ref, err := store.readRef(original.Id)
+	result.check(err == nil && len(ref.Attachments) == len(attachments), "the store's ref lists %d attachments", len(attachments))
+
+	newMsg, err := copyMessageExAttachments(original, fetched, nil)
+	if err != nil {
+		abort(exitError, "Unable to build copy: %v", err)
+	}
+	rebuilt, _ := base64.URLEncoding.DecodeString(newMsg.Raw)
+	err = checkHeadersPreserved(raw, rebuilt, map[string]bool{"dkim-signature": true})
+	result.check(err == nil, "the copy keeps every header of the original, in order (%v)", err)
+
+	copyResponse, err := mb.addCopy(newMsg, insertMethodInsert)
+	if err != nil {
+		abort(exitCodeFor(err), "Unable to insert copy: %v", err)
+	}
+	created = append(created, copyResponse.Id)
+	copyMsg, err := mb.getMessage(copyResponse.Id, "full")
+	if err != nil {
+		abort(exitCodeFor(err), "Unable to get copy: %v", err)
+	}
+	result.check(len(attachmentParts(copyMsg.Payload)) == 0, "the copy has no attachments")
+	result.check(copyMsg.ThreadId == original.ThreadId, "the copy is in the original's thread")
+	result.check(hasLabel(copyMsg, labelId), "the copy has the original's label")
+	result.check(mimeutil.HeaderValue(copyMsg.Payload.Headers, originalIdHeader) == original.Id, "the copy links back to the original in %s", originalIdHeader)
+	result.check(strings.Contains(selftestBody(copyMsg.Payload), strings.TrimSpace(selftestText)), "the copy keeps the text body")
+	result.check(copyMsg.SizeEstimate < original.SizeEstimate, "the copy is smaller (%s instead of %s)", formatBytes(copyMsg.SizeEstimate), formatBytes(original.SizeEstimate))
+
+	// Restore: the original goes to the trash and comes back unchanged.
+	if _, err := mb.trashMessage(original.Id); err != nil {
+		abort(exitCodeFor(err), "Unable to trash test message: %v", err)
+	}
+	if _, err := mb.untrashMessage(original.Id); err != nil {
+		abort(exitCodeFor(err), "Unable to untrash test message: %v", err)
+	}
+	restored, err := mb.getMessage(original.Id, "raw")
+	if err != nil {
+		abort(exitCodeFor(err), "Unable to get restored message: %v", err)
+	}
+	restoredRaw, _ := base64.URLEncoding.DecodeString(restored.Raw)
+	result.check(sha256.Sum256(restoredRaw) == rawSum, "the original restored from the trash is byte for byte what was inserted")
+}
+
+func selftestAttachments() []selftestAttachment {
+	binary := make([]byte, 64<<10)
+	rand.Read(binary)
+	return []selftestAttachment{
+		{filename: "selftest.txt", mimeType: "text/plain", data: []byte(strings.Repeat(selftestText, 100))},
+		{filename: "selftest.bin", mimeType: "application/octet-stream", data: binary},
+	}
+}
+
+// Builds a multipart/mixed message from and to address with a text body and the attachments.
+func selftestMessage(address string, runId string, attachments []selftestAttachment) []byte {
+	const boundary = "gmail-cleanup-selftest"
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", address)
+	fmt.Fprintf(&b, "To: %s\r\n", address)
+	fmt.Fprintf(&b, "Subject: gmail-cleanup selftest %s\r\n", runId)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <selftest-%s@gmail-cleanup>\r\n", runId)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/mixed; boundary=\"%s\"\r\n\r\n", boundary)
+	fmt.Fprintf(&b, "--%s\r\n", boundary)
+	b.WriteString("Content-Type: text/plain; charset=\"UTF-8\"\r\n\r\n")
+	b.WriteString(selftestText)
+	for _, a := range attachments {
+		fmt.Fprintf(&b, "--%s\r\n", boundary)
+		fmt.Fprintf(&b, "Content-Type: %s; name=\"%s\"\r\n", a.mimeType, a.filename)
+		fmt.Fprintf(&b, "Content-Disposition: attachment; filename=\"%s\"\r\n", a.filename)
+		b.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+		b.WriteString(mimeutil.WrapBase64(a.data))
+	}
+	fmt.Fprintf(&b, "--%s--\r\n", boundary)
+	return []byte(b.String())
+}
+
+// Returns the decoded text/plain bodies of p.
+func selftestBody(p *gmail.MessagePart) string {
+	var b strings.Builder
+	for _, part := range getMessagePartsRecursively(p, nil) {
+		if part.MimeType == "text/plain" && part.Filename == "" && part.Body != nil {
+			data, _ := base64.URLEncoding.DecodeString(part.Body.Data)
+			b.Write(data)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Returns the approve (true) and skip (false) decisions by sender address saved in the
+// senders section of a policies.yaml file. Inline policies have none.
+func loadSenderDecisions(spec string) (map[string]bool, error) {
+	decisions := map[string]bool{}
+	if !isPolicyFile(spec) {
+		return decisions, nil
+	}
+	f, err := readPolicyFile(spec)
+	if err != nil {
+		return nil, err
+	}
+	for _, sender := range f.Senders.Approve {
+		decisions[strings.ToLower(sender)] = true
+	}
+	for _, sender := range f.Senders.Skip {
+		decisions[strings.ToLower(sender)] = false
+	}
+	return decisions, nil
+}
+
+func isPolicyFile(spec string) bool {
+	return strings.HasSuffix(spec, ".yaml") || strings.HasSuffix(spec, ".yml")
+}
+
+// Adds sender to the approve or skip list of the policies file at path, and removes it
+// from the other. The rest of the file, comments included, is kept.
+func saveSenderDecision(path string, sender string, approve bool) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if doc.Kind == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s: expected a mapping at the top level", path)
+	}
+
+	senders, err := mappingChild(root, "senders", yaml.MappingNode)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	add, remove := "approve", "skip"
+	if !approve {
+		add, remove = remove, add
+	}
+	for _, key := range []string{add, remove} {
+		list, err := mappingChild(senders, key, yaml.SequenceNode)
+		if err != nil {
+			return fmt.Errorf("%s: senders: %v", path, err)
+		}
+		var kept []*yaml.Node
+		for _, n := range list.Content {
+			if !strings.EqualFold(n.Value, sender) {
+				kept = append(kept, n)
+			}
+		}
+		if key == add {
+			kept = append(kept, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: sender})
+		}
+		list.Content = kept
+	}
+
+	out, err := yaml.Marshal(&doc)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, out)
+}
+
+// Returns the value under key in the mapping m, adding an empty node of the given kind if
+// there is none.
+func mappingChild(m *yaml.Node, key string, kind yaml.Kind) (*yaml.Node, error) {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value != key {
+			continue
+		}
+		value := m.Content[i+1]
+		if value.Kind == yaml.ScalarNode && value.Tag == "!!null" {
+			value.Kind, value.Tag, value.Value = kind, "", ""
+		}
+		if value.Kind != kind {
+			return nil, fmt.Errorf("unexpected value for [%s]", key)
+		}
+		return value, nil
+	}
+	value := &yaml.Node{Kind: kind}
+	m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+	return value, nil
+}
+
+// An answer to the question about a message in an interactive review.
+type reviewAnswer struct {
+	approve bool
+	// Whether the answer applies to every remaining message from the sender.
+	allFromSender bool
+	// Skip the message for now and ask about it again later.
+	later bool
+	// Stop the review; decisions so far are kept for the next session.
+	quit bool
+}
+
+// Asks question, also offering to answer it for every remaining message from sender,
+// to ask again later, or to quit.
+func askSenderDecision(question string, sender string) reviewAnswer {
+	if sender == "" {
+		fmt.Println(trf("%s (y or n, l to ask later, q to quit)", question))
+	} else {
+		fmt.Println(trf("%s (y or n, l to ask later, q to quit, a to approve or s to skip all remaining from %s)", question, sender))
+	}
+	answer := strings.ToLower(strings.TrimSpace(readLine()))
+	if yes, ok := parseYesNo(answer); ok {
+		return reviewAnswer{approve: yes}
+	}
+	switch {
+	case answer == "l":
+		return reviewAnswer{later: true}
+	case answer == "q":
+		return reviewAnswer{quit: true}
+	case answer == "a" && sender != "":
+		return reviewAnswer{approve: true, allFromSender: true}
+	case answer == skipAllKey() && sender != "":
+		return reviewAnswer{allFromSender: true}
+	}
+	choices := []string{"l", "q"}
+	if sender != "" {
+		choices = append(choices, "a", skipAllKey())
+	}
+	log.Fatal(trf("Invalid input. Allowed values are [%s]. Exiting.", yesNoChoices(choices...)))
+	return reviewAnswer{}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// A store on an SFTP server, such as a home NAS.
+type sftpStoreFS struct {
+	url    *url.URL
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+// Connects to sftp://user@host[:port]/path with key-based authentication: the keys
+// offered by ssh-agent, then ~/.ssh/id_ed25519, id_ecdsa and id_rsa without a passphrase.
+// The host key must be in ~/.ssh/known_hosts.
+func openSFTPStore(storeURL string) (*sftpStoreFS, error) {
+	u, err := url.Parse(storeURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "sftp" || u.Host == "" || u.User == nil {
+		return nil, fmt.Errorf("unsupported store [%s], expected sftp://user@host/path", storeURL)
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	hostKeys, err := knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+	if err != nil {
+		return nil, fmt.Errorf("reading known_hosts: %w", err)
+	}
+	config := &ssh.ClientConfig{
+		User:            u.User.Username(),
+		Auth:            []ssh.AuthMethod{ssh.PublicKeysCallback(sshSigners)},
+		HostKeyCallback: hostKeys,
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	conn, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &sftpStoreFS{url: u, conn: conn, client: client}, nil
+}
+
+// Returns the keys from ssh-agent and the default key files.
+func sshSigners() ([]ssh.Signer, error) {
+	var signers []ssh.Signer
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if c, err := net.Dial("unix", sock); err == nil {
+			if agentSigners, err := agent.NewClient(c).Signers(); err == nil {
+				signers = append(signers, agentSigners...)
+			}
+		}
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return signers, nil
+	}
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		b, err := ioutil.ReadFile(filepath.Join(home, ".ssh", name))
+		if err != nil {
+			continue
+		}
+		if signer, err := ssh.ParsePrivateKey(b); err == nil {
+			signers = append(signers, signer)
+		}
+	}
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("no SSH keys: start ssh-agent, or add a key without a passphrase to ~/.ssh")
+	}
+	return signers, nil
+}
+
+func (f *sftpStoreFS) path(name string) string {
+	return path.Join(f.url.Path, name)
+}
+
+// Writes to a partial file named after name, so an interrupted upload of the same
+// content resumes where it stopped, then renames it into place.
+func (f *sftpStoreFS) writeFile(name string, data []byte) error {
+	target := f.path(name)
+	partial := path.Join(path.Dir(target), ".partial-"+path.Base(target))
+	if err := f.client.MkdirAll(path.Dir(target)); err != nil {
+		return err
+	}
+	file, err := f.client.OpenFile(partial, os.O_WRONLY|os.O_CREATE)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	offset := info.Size()
+	// Only object content is the same on every attempt; start other files over.
+	if !strings.HasPrefix(name, "objects/") || offset > int64(len(data)) {
+		offset = 0
+		if err := file.Truncate(0); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.Write(data[offset:]); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return f.client.PosixRename(partial, target)
+}
+
+func (f *sftpStoreFS) readFile(name string) ([]byte, error) {
+	r, err := f.open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func (f *sftpStoreFS) open(name string) (io.ReadCloser, error) {
+	return f.client.Open(f.path(name))
+}
+
+func (f *sftpStoreFS) size(name string) (int64, error) {
+	info, err := f.client.Stat(f.path(name))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (f *sftpStoreFS) list(dir string) ([]string, error) {
+	entries, err := f.client.ReadDir(f.path(dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+func (f *sftpStoreFS) remove(name string) error {
+	return f.client.Remove(f.path(name))
+}
+
+func (f *sftpStoreFS) location(name string) string {
+	u := *f.url
+	u.Path = f.path(name)
+	return u.String()
+}
+
+func (f *sftpStoreFS) close() error {
+	f.client.Close()
+	return f.conn.Close()
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/people/v1"
+
+	"github.com/weineran/gmail-cleanup/cleaner"
+)
+
+// Messages received this recently are taken as the inbound rate.
+const inboundWindow = 90 * 24 * time.Hour
+
+const month = 30 * 24 * time.Hour
+
+// A message as seen by the simulation.
+type simulatedMessage struct {
+	policySubject
+	size int64
+	// Bytes freed by stripping, as messagePartSizes counts them.
+	attachmentBytes int64
+}
+
+// Size of m once rules have been applied as of now.
+func (m simulatedMessage) remaining(rules []policyRule, now time.Time) int64 {
+	rule := matchPolicyAt(rules, m.policySubject, now)
+	if rule == nil {
+		return m.size
+	}
+	if rule.action == actionDelete {
+		return 0
+	}
+	if m.attachmentBytes > m.size {
+		return 0
+	}
+	return m.size - m.attachmentBytes
+}
+
+// One point of the projection.
+type storagePoint struct {
+	Month           string `json:"month"`
+	BaselineBytes   int64  `json:"baselineBytes"`
+	WithPolicyBytes int64  `json:"withPolicyBytes"`
+}
+
+// Replays policy rules against current mailbox metadata and projects storage
+// over the coming months, assuming mail keeps arriving at the recent rate.
+func runSimulate(args []string) {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	var opts mailboxOptions
+	opts.register(fs)
+	policy := fs.String("policy", "policies.yaml", "A policies.yaml file, or inline rules")
+	query := fs.String("query", "larger:1M", "Messages to include; small messages barely affect storage")
+	months := fs.Int("months", 12, "Number of months to project")
+	asJSON := fs.Bool("json", false, "Print the series as JSON instead of a chart")
+	noCache := fs.Bool("no-cache", false, "Don't use or update the local metadata cache")
+	parseFlags(fs, args)
+	checkQuery(*query, false, false)
+
+	rules, err := loadPolicy(*policy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(rules) == 0 {
+		log.Fatalf("Policy [%s] has no rules", *policy)
+	}
+
+	opts.readOnly = true
+	if usesContactGroups(rules) {
+		opts.extraScopes = append(opts.extraScopes, people.ContactsReadonlyScope)
+	}
+	mb := openMailbox(&opts)
+	defer mb.quota.printSummary()
+	if err := resolveContactGroups(context.Background(), mb.client, rules); err != nil {
+		log.Fatalf("Unable to load contact groups: %v", err)
+	}
+
+	if !*noCache {
+		mb.cache, err = openMetadataCache(mb, profilePath(opts.profile, "cache.db"))
+		if err != nil {
+			log.Fatalf("Unable to open metadata cache: %v", err)
+		}
+		defer mb.cache.close()
+	}
+
+	own, err := mb.ownAddresses()
+	if err != nil {
+		exitf(exitCodeFor(err), "Unable to list send-as addresses: %v", err)
+	}
+	messages, err := simulatedMessages(mb, *query, own)
+	if errors.Is(err, errQuotaBudgetExceeded) {
+		log.Printf("Stopping after %d messages: %v\n", len(messages), err)
+	} else if err != nil {
+		log.Fatalf("Unable to retrieve messages: %v", err)
+	}
+
+	series := projectStorage(messages, rules, time.Now(), *months)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(series); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	printStorageChart(series)
+	fmt.Printf("Storage covers only messages matching [%s].\n", *query)
+}
+
+func newSimulatedMessage(m *gmail.Message, own map[string]bool) simulatedMessage {
+	return simulatedMessage{policySubject: newPolicySubject(m, own), size: m.SizeEstimate, attachmentBytes: messagePartSizes(m).savings}
+}
+
+// Headers classifyMessage, messageDate, messageListId and messageSender look at.
+var simulateHeaders = []string{"From", "Date", "List-Id", "List-Unsubscribe", "Auto-Submitted"}
+
+// Returns the messages matching query as the simulation sees them, those read before an
+// error if there is one. Without attachments, the metadata is all it takes to classify a
+// message; those with attachments are also classified by their attachment types, so their
+// structure is fetched, from the metadata cache when it holds it.
+func simulatedMessages(mb *mailbox, query string, own map[string]bool) ([]simulatedMessage, error) {
+	c := mb.cleaner()
+	c.MetadataHeaders = simulateHeaders
+	plain, err := cleaner.Collect(c.Messages(context.Background(), "("+query+") -has:attachment"))
+	var messages []simulatedMessage
+	for _, m := range plain {
+		messages = append(messages, newSimulatedMessage(m, own))
+	}
+	if err != nil {
+		return messages, err
+	}
+
+	withAttachments, err := cleaner.Collect(c.List(context.Background(), "("+query+") has:attachment"))
+	if err != nil {
+		return messages, err
+	}
+	log.Printf("Classified %d messages without attachments, getting %d with\n", len(messages), len(withAttachments))
+	for _, m := range withAttachments {
+		msg, err := mb.getMessageSkeleton(m.Id)
+		if err != nil {
+			return messages, fmt.Errorf("message [%s]: %w", m.Id, err)
+		}
+		messages = append(messages, newSimulatedMessage(msg, own))
+	}
+	return messages, nil
+}
+
+// Projects storage with and without the policy. Messages received within the
+// inbound window recur every month, shifted forward in time.
+func projectStorage(messages []simulatedMessage, rules []policyRule, now time.Time, months int) []storagePoint {
+	var inbound []simulatedMessage
+	for _, m := range messages {
+		if now.Sub(m.date) <= inboundWindow {
+			inbound = append(inbound, m)
+		}
+	}
+	// The window holds three months of mail; each future month receives a third of it.
+	perMonth := float64(month) / float64(inboundWindow)
+
+	var series []storagePoint
+	for i := 0; i <= months; i++ {
+		at := now.Add(time.Duration(i) * month)
+		var baseline, withPolicy float64
+		for _, m := range messages {
+			baseline += float64(m.size)
+			withPolicy += float64(m.remaining(rules, at))
+		}
+		for k := 1; k <= i; k++ {
+			for _, m := range inbound {
+				future := m
+				future.date = m.date.Add(time.Duration(k) * month)
+				baseline += perMonth * float64(future.size)
+				withPolicy += perMonth * float64(future.remaining(rules, at))
+			}
+		}
+		series = append(series, storagePoint{
+			Month:           at.Format("2006-01"),
+			BaselineBytes:   int64(baseline),
+			WithPolicyBytes: int64(withPolicy),
+		})
+	}
+	return series
+}
+
+func printStorageChart(series []storagePoint) {
+	const width = 50
+	var max int64
+	for _, p := range series {
+		if p.BaselineBytes > max {
+			max = p.BaselineBytes
+		}
+	}
+	bar := func(n int64, c string) string {
+		if max == 0 {
+			return ""
+		}
+		return strings.Repeat(c, int(n*width/max))
+	}
+
+	fmt.Println("Projected storage (# without policy, = with policy):")
+	for _, p := range series {
+		fmt.Printf("%s %-*s %s\n", p.Month, width, bar(p.BaselineBytes, "#"), formatBytes(p.BaselineBytes))
+		fmt.Printf("        %-*s %s\n", width, bar(p.WithPolicyBytes, "="), formatBytes(p.WithPolicyBytes))
+	}
+	if len(series) > 0 {
+		last := series[len(series)-1]
+		fmt.Printf("Saved by %s: %s\n", last.Month, formatBytes(last.BaselineBytes-last.WithPolicyBytes))
+	}
+}
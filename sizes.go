@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Parses a size in bytes with an optional K, M or G suffix.
+func parseSize(s string) (int64, error) {
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		multiplier = 1 << 30
+	}
+	digits := s
+	if multiplier > 1 {
+		digits = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size [%s], expected a number optionally followed by K, M or G", s)
+	}
+	return n * multiplier, nil
+}
+
+// Parses a --size-sweep list into Gmail size terms, ordered from largest to smallest.
+func parseSizeSweep(s string) ([]string, error) {
+	var sizes []int64
+	for _, item := range splitList(s) {
+		n, err := parseSize(item)
+		if err != nil {
+			return nil, fmt.Errorf("--size-sweep: %w", err)
+		}
+		sizes = append(sizes, n)
+	}
+	sort.SliceStable(sizes, func(i, j int) bool {
+		return sizes[i] > sizes[j]
+	})
+	terms := make([]string, len(sizes))
+	for i, n := range sizes {
+		terms[i] = gmailSize(n)
+	}
+	return terms, nil
+}
+
+// Formats n bytes as a value for Gmail's larger: and smaller:, which take bytes or
+// an M suffix but not K or G.
+func gmailSize(n int64) string {
+	if n > 0 && n%(1<<20) == 0 {
+		return strconv.FormatInt(n>>20, 10) + "M"
+	}
+	return strconv.FormatInt(n, 10)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"1500", 1500, false},
+		{"10K", 10 << 10, false},
+		{"5M", 5 << 20, false},
+		{"2G", 2 << 30, false},
+		{"", 0, true},
+		{"M", 0, true},
+		{"-1M", 0, true},
+		{"1.5M", 0, true},
+		{"10MB", 0, true},
+		{"10k", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseSize(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseSize() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGmailSize(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0"},
+		{1000, "1000"},
+		{10 << 10, "10240"},
+		{1 << 20, "1M"},
+		{25 << 20, "25M"},
+		{1<<20 + 1, "1048577"},
+		{3 << 19, "1572864"},
+		{2 << 30, "2048M"},
+	}
+	for _, tt := range tests {
+		if got := gmailSize(tt.n); got != tt.want {
+			t.Errorf("gmailSize(%d) = %s, want %s", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestParseSizeSweep(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{"10M", []string{"10M"}, false},
+		{"5M,25M,10M", []string{"25M", "10M", "5M"}, false},
+		{"1G, 500K", []string{"1024M", "512000"}, false},
+		{"10M,big", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseSizeSweep(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSizeSweep() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSizeSweep() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+
+	"github.com/weineran/gmail-cleanup/internal/mimeutil"
+)
+
+// The schema of a snapshot. Dates are milliseconds since the epoch, as Gmail reports them,
+// and sizes are bytes.
+const snapshotSchema = `
+CREATE TABLE snapshot (key TEXT PRIMARY KEY, value TEXT NOT NULL);
+CREATE TABLE messages (
+	id            TEXT PRIMARY KEY,
+	thread_id     TEXT NOT NULL,
+	internal_date INTEGER NOT NULL,
+	size_estimate INTEGER NOT NULL,
+	sender        TEXT NOT NULL,
+	subject       TEXT NOT NULL,
+	snippet       TEXT NOT NULL
+);
+CREATE TABLE labels (id TEXT PRIMARY KEY, name TEXT NOT NULL, type TEXT NOT NULL);
+CREATE TABLE message_labels (
+	message_id TEXT NOT NULL REFERENCES messages (id),
+	label_id   TEXT NOT NULL,
+	PRIMARY KEY (message_id, label_id)
+);
+CREATE TABLE headers (
+	message_id TEXT NOT NULL REFERENCES messages (id),
+	position   INTEGER NOT NULL,
+	name       TEXT NOT NULL,
+	value      TEXT NOT NULL,
+	PRIMARY KEY (message_id, position)
+);
+CREATE INDEX messages_thread ON messages (thread_id);
+CREATE INDEX messages_sender ON messages (sender);
+CREATE INDEX message_labels_label ON message_labels (label_id);
+`
+
+// Copies the metadata of every message matching a query into a new SQLite file.
+func runSnapshot(args []string) {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	var opts mailboxOptions
+	opts.register(fs)
+	out := fs.String("out", "snapshot.db", "SQLite file to write, replacing any earlier snapshot")
+	query := fs.String("query", "", "Only include messages matching this query")
+	includeSpamTrash := fs.Bool("include-spam-trash", false, "Also include messages in the spam and trash")
+	withHeaders := fs.Bool("headers", false, "Also store every header of every message in the headers table")
+	withBodies := fs.Bool("bodies", false, "Also download every message and index its text and attachment filenames for search-local (costs a raw get per message)")
+	parseFlags(fs, args)
+	checkQuery(*query, false, false)
+
+	opts.readOnly = true
+	mb := openMailbox(&opts)
+	defer mb.quota.printSummary()
+
+	// Build the snapshot next to the old one and swap it in only when complete.
+	tmp := *out + ".tmp"
+	os.Remove(tmp)
+	db, err := sql.Open("sqlite", tmp)
+	if err != nil {
+		log.Fatalf("Unable to create snapshot: %v", err)
+	}
+	if _, err := db.Exec(snapshotSchema); err != nil {
+		log.Fatalf("Unable to create snapshot: %v", err)
+	}
+	if *withBodies {
+		if _, err := db.Exec(snapshotBodiesSchema); err != nil {
+			log.Fatalf("Unable to create snapshot: %v", err)
+		}
+	}
+
+	profile, err := mb.getProfile()
+	if err != nil {
+		log.Fatalf("Unable to get profile: %v", err)
+	}
+	labels, err := mb.listLabels()
+	if err != nil {
+		log.Fatalf("Unable to list labels: %v", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatal(err)
+	}
+	state := map[string]string{
+		"email":      profile.EmailAddress,
+		"history_id": strconv.FormatUint(profile.HistoryId, 10),
+		"taken_at":   time.Now().Format(time.RFC3339),
+		"query":      *query,
+		"headers":    strconv.FormatBool(*withHeaders),
+		"bodies":     strconv.FormatBool(*withBodies),
+	}
+	for key, value := range state {
+		if _, err := tx.Exec(`INSERT INTO snapshot (key, value) VALUES (?, ?)`, key, value); err != nil {
+			log.Fatalf("Unable to write snapshot: %v", err)
+		}
+	}
+	for _, l := range labels {
+		if _, err := tx.Exec(`INSERT INTO labels (id, name, type) VALUES (?, ?, ?)`, l.Id, l.Name, l.Type); err != nil {
+			log.Fatalf("Unable to write snapshot: %v", err)
+		}
+	}
+
+	q := *query
+	if *includeSpamTrash {
+		q = "in:anywhere " + q
+	}
+	c := mb.cleaner()
+	if !*withHeaders {
+		c.MetadataHeaders = []string{"From", "Subject"}
+	}
+	count := 0
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for r := range c.Messages(ctx, q) {
+		if errors.Is(r.Err, errQuotaBudgetExceeded) {
+			log.Fatalf("Stopping after %d messages, nothing written: %v", count, r.Err)
+		}
+		if r.Err != nil {
+			log.Fatalf("Unable to retrieve messages: %v", r.Err)
+		}
+		if err := insertSnapshotMessage(tx, r.Message, *withHeaders); err != nil {
+			log.Fatalf("Unable to write message [%s]: %v", r.Message.Id, err)
+		}
+		if *withBodies {
+			full, _, err := mb.getParsedMessage(r.Message.Id)
+			if errors.Is(err, errQuotaBudgetExceeded) {
+				log.Fatalf("Stopping after %d messages, nothing written: %v", count, err)
+			}
+			if err != nil {
+				log.Fatalf("Unable to get message [%s]: %v", r.Message.Id, err)
+			}
+			if err := insertSnapshotBody(tx, full); err != nil {
+				log.Fatalf("Unable to index message [%s]: %v", r.Message.Id, err)
+			}
+		}
+		count++
+		if count%1000 == 0 {
+			log.Printf("Snapshot: %d messages\n", count)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Fatalf("Unable to write snapshot: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		log.Fatalf("Unable to write snapshot: %v", err)
+	}
+	if err := os.Rename(tmp, *out); err != nil {
+		log.Fatalf("Unable to replace snapshot: %v", err)
+	}
+	fmt.Printf("Wrote %d messages and %d labels to [%s]\n", count, len(labels), *out)
+}
+
+func insertSnapshotMessage(tx *sql.Tx, m *gmail.Message, withHeaders bool) error {
+	var headers []*gmail.MessagePartHeader
+	if m.Payload != nil {
+		headers = m.Payload.Headers
+	}
+	_, err := tx.Exec(`INSERT INTO messages (id, thread_id, internal_date, size_estimate, sender, subject, snippet) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		m.Id, m.ThreadId, m.InternalDate, m.SizeEstimate, senderAddress(mimeutil.HeaderValue(headers, "From")), mimeutil.HeaderValue(headers, "Subject"), m.Snippet)
+	if err != nil {
+		return err
+	}
+	for _, labelId := range m.LabelIds {
+		if _, err := tx.Exec(`INSERT INTO message_labels (message_id, label_id) VALUES (?, ?)`, m.Id, labelId); err != nil {
+			return err
+		}
+	}
+	if withHeaders {
+		for i, h := range headers {
+			if _, err := tx.Exec(`INSERT INTO headers (message_id, position, name, value) VALUES (?, ?, ?, ?)`, m.Id, i, h.Name, h.Value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
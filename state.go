@@ -0,0 +1,162 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// The schema of a profile's state database, which keeps what runs need to know about
+// earlier runs beyond the journal.
+const stateSchema = `
+CREATE TABLE IF NOT EXISTS decisions (
+	message_id TEXT PRIMARY KEY,
+	decision   TEXT NOT NULL,
+	decided_at TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS runs (
+	run_id          TEXT PRIMARY KEY,
+	finished_at     TEXT NOT NULL,
+	query           TEXT NOT NULL,
+	matched         INTEGER NOT NULL,
+	stripped        INTEGER NOT NULL,
+	trashed         INTEGER NOT NULL,
+	failed          INTEGER NOT NULL,
+	reclaimed_bytes INTEGER NOT NULL,
+	trashed_bytes   INTEGER NOT NULL,
+	messages_total  INTEGER
+);
+CREATE TABLE IF NOT EXISTS run_categories (
+	run_id   TEXT NOT NULL,
+	category TEXT NOT NULL,
+	messages INTEGER NOT NULL,
+	bytes    INTEGER NOT NULL,
+	PRIMARY KEY (run_id, category)
+);
+CREATE TABLE IF NOT EXISTS usage (
+	checked_at  TEXT PRIMARY KEY,
+	total_bytes INTEGER NOT NULL,
+	gmail_bytes INTEGER NOT NULL,
+	limit_bytes INTEGER NOT NULL
+);`
+
+// Opens the profile's state database, creating it if needed.
+func openStateDB(profile string) (*sql.DB, error) {
+	path := profilePath(profile, "state.db")
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(stateSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return db, nil
+}
+
+// Answers given about single messages in interactive runs.
+const (
+	decisionApproved = "approved"
+	decisionSkipped  = "skipped"
+	decisionLater    = "later"
+)
+
+// The interactive decisions of earlier sessions, so a review that was quit halfway
+// resumes where it left off: approved messages aren't asked about again, skipped ones
+// are left alone, and those left for later are asked about last.
+type reviewState struct {
+	db        *sql.DB
+	decisions map[string]string
+}
+
+// Loads the saved decisions of profile, or with forget, deletes them.
+func openReviewState(profile string, forget bool) (*reviewState, error) {
+	db, err := openStateDB(profile)
+	if err != nil {
+		return nil, err
+	}
+	r := &reviewState{db: db, decisions: map[string]string{}}
+	if forget {
+		if _, err := db.Exec(`DELETE FROM decisions`); err != nil {
+			db.Close()
+			return nil, err
+		}
+		return r, nil
+	}
+	rows, err := db.Query(`SELECT message_id, decision FROM decisions`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, decision string
+		if err := rows.Scan(&id, &decision); err != nil {
+			db.Close()
+			return nil, err
+		}
+		r.decisions[id] = decision
+	}
+	if err := rows.Err(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *reviewState) close() error {
+	return r.db.Close()
+}
+
+func (r *reviewState) decision(id string) string {
+	return r.decisions[id]
+}
+
+func (r *reviewState) record(id string, decision string) error {
+	r.decisions[id] = decision
+	_, err := r.db.Exec(`INSERT OR REPLACE INTO decisions (message_id, decision, decided_at) VALUES (?, ?, ?)`,
+		id, decision, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// Drops the decision about a message that has been dealt with.
+func (r *reviewState) forget(id string) error {
+	if _, ok := r.decisions[id]; !ok {
+		return nil
+	}
+	delete(r.decisions, id)
+	_, err := r.db.Exec(`DELETE FROM decisions WHERE message_id = ?`, id)
+	return err
+}
+
+// Applies earlier decisions to messages: approved ones are marked in approved, skipped
+// ones are dropped, and those left for later are moved to the end. Returns the messages
+// to review and how many were skipped.
+func (r *reviewState) resume(messages []*gmail.Message, approved map[string]bool) ([]*gmail.Message, int) {
+	var now, later []*gmail.Message
+	skipped := 0
+	for _, m := range messages {
+		switch r.decisions[m.Id] {
+		case decisionSkipped:
+			skipped++
+			continue
+		case decisionApproved:
+			approved[m.Id] = true
+		case decisionLater:
+			later = append(later, m)
+			continue
+		}
+		now = append(now, m)
+	}
+	if skipped > 0 || len(later) > 0 {
+		fmt.Printf("Resuming an earlier review: skipping %d messages, asking about %d left for later at the end\n", skipped, len(later))
+	}
+	return append(now, later...), skipped
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+
+	"github.com/weineran/gmail-cleanup/internal/mimeutil"
+)
+
+// Reports whether err is Gmail refusing a message because the account is out of storage.
+// Gmail says so with a 403 or 400 mentioning storage, sometimes with the reason
+// quotaExceeded, which would otherwise read as the API's rate quota.
+func isStorageFull(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || (apiErr.Code != http.StatusForbidden && apiErr.Code != http.StatusBadRequest) {
+		return false
+	}
+	if strings.Contains(strings.ToLower(apiErr.Message), "storage") {
+		return true
+	}
+	for _, e := range apiErr.Errors {
+		if strings.Contains(strings.ToLower(e.Message), "storage") {
+			return true
+		}
+	}
+	return false
+}
+
+// Explains why copies can't be inserted into a full mailbox, and the options.
+func explainStorageFull() {
+	fmt.Println("The account is out of storage, so Gmail refuses to add the stripped copies: each one")
+	fmt.Println("has to be inserted before its original is deleted.")
+	fmt.Println("Deleting each original first frees the space for its copy, but for a moment the message")
+	fmt.Println("only exists in its --backup-dir backup, which is checked before the original is deleted (--delete-first).")
+	fmt.Println("If the copy can't be inserted then, the original is re-inserted from the backup.")
+	fmt.Println("Freeing space another way first, e.g. with empty-trash, keeps the safer order.")
+}
+
+// Checks the account's storage before a run, for --check-storage. If it is full, offers
+// to delete originals before inserting their copies, or stops.
+func checkStorage(mb *mailbox, opts *removeOptions) {
+	u, err := getStorageUsage(mb)
+	if err != nil {
+		exitf(exitCodeFor(err), "Unable to get storage usage: %v", err)
+	}
+	if u.Limit == 0 || u.Total < u.Limit {
+		fmt.Printf("Storage: %s of %s used\n", formatBytes(u.Total), formatBytes(u.Limit))
+		return
+	}
+	fmt.Printf("Storage: %s of %s used, the account is full.\n", formatBytes(u.Total), formatBytes(u.Limit))
+	if opts.deleteFirst {
+		fmt.Println("Deleting each original before inserting its copy, as --delete-first asks.")
+		return
+	}
+	explainStorageFull()
+	switch {
+	case opts.complianceMode || opts.draftsFile != "":
+		exitf(exitStorageFull, "Copies can't be added while the originals are kept; free some space first.")
+	case opts.backupDir == "":
+		exitf(exitStorageFull, "Free some space first, or run again with --delete-first --backup-dir DIR.")
+	case opts.assumeYes:
+		exitf(exitStorageFull, "Free some space first, or run again with --delete-first.")
+	case !askYesNo("Do you want to delete each original before inserting its copy?"):
+		exitf(exitStorageFull, "Free some space first, then run again.")
+	}
+	opts.deleteFirst = true
+}
+
+// Checks everything that can be checked locally before an original is deleted ahead of
+// its copy, for --delete-first: the backup is on disk and is the original byte for byte,
+// it parses into the original's parts, the original hasn't changed since it was fetched,
+// and the copy keeps the original's Message-ID.
+func verifyDeleteFirst(mb *mailbox, opts *removeOptions, original *gmail.Message, rawSHA256 string, copied *messageCopy) error {
+	path := backupPath(opts.backupDir, opts.journal.runId, original.Id)
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Unable to read backup: %w", err)
+	}
+	defer f.Close()
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("Unable to flush backup: %w", err)
+	}
+	// Parsed from a spool, as the original was, so that it isn't held in memory.
+	spool, err := mimeutil.NewSpool()
+	if err != nil {
+		return err
+	}
+	defer spool.Close()
+	if _, err := io.Copy(spool, f); err != nil {
+		return fmt.Errorf("Unable to read backup: %w", err)
+	}
+	if sum := spool.SHA256(); hex.EncodeToString(sum[:]) != rawSHA256 {
+		return fmt.Errorf("%w: %s doesn't match the journal's SHA-256", errVerificationFailed, path)
+	}
+	backup, err := spool.Parse()
+	if err != nil {
+		return fmt.Errorf("%w: the backup of message [%s] doesn't parse: %v", errVerificationFailed, original.Id, err)
+	}
+	if got, want := mimeutil.Outline(backup.Payload), mimeutil.Outline(original.Payload); got != want {
+		return fmt.Errorf("%w: the backup of message [%s] doesn't have the original's parts", errVerificationFailed, original.Id)
+	}
+	_, current, err := mb.getSpooledMessage(original.Id)
+	if err != nil {
+		return fmt.Errorf("Unable to fetch message again: %w", err)
+	}
+	sum := current.SHA256()
+	current.Close()
+	if hex.EncodeToString(sum[:]) != rawSHA256 {
+		return fmt.Errorf("%w: message [%s] changed since it was backed up", errVerificationFailed, original.Id)
+	}
+	block, err := copied.raw.HeaderBlock()
+	if err != nil {
+		return err
+	}
+	messageId := mimeutil.HeaderValue(original.Payload.Headers, "Message-ID")
+	if got := mimeutil.HeaderValue(mimeutil.ParseHeaderBlock(block), "Message-ID"); got != messageId {
+		return fmt.Errorf("%w: the copy of message [%s] has Message-ID [%s], not [%s]", errVerificationFailed, original.Id, got, messageId)
+	}
+	return nil
+}
+
+// Re-inserts the original of entry from its backup after its copy couldn't be inserted,
+// with delete-first ordering. Returns the error to report for the message.
+func restoreDeletedFirst(mb *mailbox, opts *removeOptions, entry journalEntry, insertErr error) error {
+	path := backupPath(opts.backupDir, opts.journal.runId, entry.MessageId)
+	raw, err := backupSource(path, entry.RawSHA256)
+	if err == nil {
+		var restored *gmail.Message
+		original := &gmail.Message{LabelIds: entry.LabelIds, ThreadId: entry.ThreadId}
+		if restored, err = mb.addRaw(original, raw, opts.insertMethod); err == nil {
+			log.Printf("Re-inserted original message [%s] as [%s]\n", entry.MessageId, restored.Id)
+			// Recorded like a rollback, so fsck doesn't take the original for a copy.
+			undone := journalEntry{Action: journalRolledBack, MessageId: entry.MessageId, ThreadId: entry.ThreadId, LabelIds: entry.LabelIds,
+				RFC822MessageId: entry.RFC822MessageId, CopyId: restored.Id, RawSHA256: entry.RawSHA256}
+			if err := opts.journal.record(undone); err != nil {
+				log.Printf("Unable to write journal: %v\n", err)
+			}
+			return fmt.Errorf("Unable to insert message: %w; the original was re-inserted from its backup as [%s]", insertErr, restored.Id)
+		}
+	}
+	return fmt.Errorf("Unable to insert message: %w; the original is deleted and only in its backup [%s], which couldn't be re-inserted: %v", insertErr, path, err)
+}
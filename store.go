@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A content-addressable attachment store:
+//
+//	objects/<sha256>        attachment content, stored once however many messages had it
+//	refs/<message id>.json  the attachments removed from a message
+//	runs/<run id>.json      the messages archived by a run
+//
+// Objects stay alive while a run manifest references a message that references them.
+// Deleting run manifests and running `store gc` reclaims the space.
+type attachmentStore struct {
+	// The local archive directory, holding the index and manifest pages.
+	dir string
+	// Where objects, refs and runs are kept: dir itself, an SFTP server or an S3 bucket.
+	fs    storeFS
+	runId string
+}
+
+// The attachments removed from one message.
+type messageRef struct {
+	MessageId   string          `json:"messageId"`
+	From        string          `json:"from"`
+	Subject     string          `json:"subject"`
+	Date        string          `json:"date"`
+	Attachments []attachmentRef `json:"attachments"`
+}
+
+type attachmentRef struct {
+	// The decoded filename, with the name as it appeared in the message if that differs.
+	Filename         string `json:"filename"`
+	OriginalFilename string `json:"originalFilename,omitempty"`
+	// Filename made safe and unique within the message, for saving it.
+	SafeName string `json:"safeName,omitempty"`
+	MimeType string `json:"mimeType"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+}
+
+// The messages archived by one run.
+type runManifest struct {
+	RunId    string   `json:"runId"`
+	Created  string   `json:"created"`
+	Messages []string `json:"messages"`
+}
+
+func newAttachmentStore(dir string, runId string) *attachmentStore {
+	return &attachmentStore{dir: dir, fs: &localStoreFS{root: dir}, runId: runId}
+}
+
+// Returns a store whose index is in dir, and whose files are in dir too, or at
+// storeURL if it is an sftp:// or s3:// URL.
+func openAttachmentStore(dir string, storeURL string, runId string) (*attachmentStore, error) {
+	if storeURL == "" {
+		return newAttachmentStore(dir, runId), nil
+	}
+	var fs storeFS
+	var err error
+	if strings.HasPrefix(storeURL, "s3://") {
+		fs, err = openS3Store(storeURL)
+	} else {
+		fs, err = openSFTPStore(storeURL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &attachmentStore{dir: dir, fs: fs, runId: runId}, nil
+}
+
+func (s *attachmentStore) close() error {
+	return s.fs.close()
+}
+
+func objectName(hash string) string {
+	return "objects/" + hash
+}
+
+func refName(messageId string) string {
+	return "refs/" + messageId + ".json"
+}
+
+func runName(runId string) string {
+	return "runs/" + runId + ".json"
+}
+
+// Stores data under its SHA-256 and returns the hash and object location.
+func (s *attachmentStore) put(data []byte) (string, string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	name := objectName(hash)
+	if _, err := s.fs.size(name); err == nil {
+		return hash, s.fs.location(name), nil
+	}
+	if err := s.fs.writeFile(name, data); err != nil {
+		return "", "", err
+	}
+	return hash, s.fs.location(name), nil
+}
+
+// Writes the message's ref and adds the message to this run's manifest.
+func (s *attachmentStore) addRef(ref messageRef) error {
+	if err := s.writeJSON(refName(ref.MessageId), ref); err != nil {
+		return err
+	}
+
+	run, err := s.readRun(s.runId)
+	if os.IsNotExist(err) {
+		run = &runManifest{RunId: s.runId, Created: time.Now().Format(time.RFC3339)}
+	} else if err != nil {
+		return err
+	}
+	run.Messages = append(run.Messages, ref.MessageId)
+	return s.writeJSON(runName(s.runId), run)
+}
+
+func (s *attachmentStore) writeJSON(name string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return s.fs.writeFile(name, b)
+}
+
+func (s *attachmentStore) readJSON(name string, v interface{}) error {
+	b, err := s.fs.readFile(name)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func (s *attachmentStore) readRun(runId string) (*runManifest, error) {
+	var run runManifest
+	if err := s.readJSON(runName(runId), &run); err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+func (s *attachmentStore) readRef(messageId string) (*messageRef, error) {
+	var ref messageRef
+	if err := s.readJSON(refName(messageId), &ref); err != nil {
+		return nil, err
+	}
+	return &ref, nil
+}
+
+// Returns the ids of the runs that still have a manifest.
+func (s *attachmentStore) runIds() ([]string, error) {
+	return s.jsonNames("runs")
+}
+
+// Returns the ids of all messages with a ref.
+func (s *attachmentStore) refIds() ([]string, error) {
+	return s.jsonNames("refs")
+}
+
+func (s *attachmentStore) objectHashes() ([]string, error) {
+	return s.fs.list("objects")
+}
+
+func (s *attachmentStore) jsonNames(dir string) ([]string, error) {
+	files, err := s.fs.list(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, f := range files {
+		if strings.HasSuffix(f, ".json") {
+			names = append(names, strings.TrimSuffix(f, ".json"))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Writes to a temporary file in the same directory and renames it into place,
+// so readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	return copyFileAtomic(path, bytes.NewReader(data))
+}
+
+// Writes what r reads to path as writeFileAtomic does, without holding it in memory.
+func copyFileAtomic(path string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func writeJSONAtomic(path string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b)
+}
+
+func readJSON(path string, v interface{}) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// `store gc` and `store verify`.
+func runStore(args []string) {
+	if len(args) == 0 {
+		log.Fatalf("Usage: gmail-cleanup store gc|verify --archive-dir DIR")
+	}
+	switch args[0] {
+	case "gc":
+		runStoreGC(args[1:])
+	case "verify":
+		runStoreVerify(args[1:])
+	default:
+		log.Fatalf("Unknown store command [%s], expected gc or verify", args[0])
+	}
+}
+
+func runStoreGC(args []string) {
+	fs := flag.NewFlagSet("store gc", flag.ExitOnError)
+	dir := fs.String("archive-dir", "", "Archive directory to collect")
+	storeURL := fs.String("store", "", "sftp://user@host/path or s3://bucket/prefix the attachments were stored at instead of the archive directory")
+	dryRun := fs.Bool("dry-run", false, "Only print what would be removed")
+	parseFlags(fs, args)
+	if *dir == "" && *storeURL == "" {
+		log.Fatalf("Usage: gmail-cleanup store gc --archive-dir DIR | --store URL")
+	}
+	s, err := openAttachmentStore(*dir, *storeURL, "")
+	if err != nil {
+		log.Fatalf("Unable to open store: %v", err)
+	}
+	defer s.close()
+
+	// Mark everything reachable from a retained run manifest.
+	liveRefs := map[string]bool{}
+	liveObjects := map[string]bool{}
+	runIds, err := s.runIds()
+	if err != nil {
+		log.Fatalf("Unable to list runs: %v", err)
+	}
+	for _, runId := range runIds {
+		run, err := s.readRun(runId)
+		if err != nil {
+			log.Fatalf("Unable to read run [%s]: %v", runId, err)
+		}
+		for _, messageId := range run.Messages {
+			ref, err := s.readRef(messageId)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				log.Fatalf("Unable to read ref [%s]: %v", messageId, err)
+			}
+			liveRefs[messageId] = true
+			for _, a := range ref.Attachments {
+				liveObjects[a.SHA256] = true
+			}
+		}
+	}
+
+	// Sweep.
+	refIds, err := s.refIds()
+	if err != nil {
+		log.Fatalf("Unable to list refs: %v", err)
+	}
+	var removedRefs, removedObjects int
+	var freed int64
+	for _, messageId := range refIds {
+		if liveRefs[messageId] {
+			continue
+		}
+		removedRefs++
+		if !*dryRun {
+			if err := s.fs.remove(refName(messageId)); err != nil {
+				log.Fatalf("Unable to remove ref [%s]: %v", messageId, err)
+			}
+		}
+	}
+	hashes, err := s.objectHashes()
+	if err != nil {
+		log.Fatalf("Unable to list objects: %v", err)
+	}
+	for _, hash := range hashes {
+		if liveObjects[hash] {
+			continue
+		}
+		if size, err := s.fs.size(objectName(hash)); err == nil {
+			freed += size
+		}
+		removedObjects++
+		if !*dryRun {
+			if err := s.fs.remove(objectName(hash)); err != nil {
+				log.Fatalf("Unable to remove object [%s]: %v", hash, err)
+			}
+		}
+	}
+
+	// Drop the index rows of what isn't live, so searches don't find attachments that
+	// are gone. Without --archive-dir there is no index to update.
+	removedRows := 0
+	if *dir != "" {
+		removedRows, err = pruneAttachmentIndex(*dir, liveRefs, liveObjects, *dryRun)
+		if err != nil {
+			log.Fatalf("Unable to update attachment index: %v", err)
+		}
+	}
+
+	verb := "Removed"
+	if *dryRun {
+		verb = "Would remove"
+	}
+	fmt.Printf("%s %d refs, %d objects (%d bytes) and %d index entries. %d runs retained.\n", verb, removedRefs, removedObjects, freed, removedRows, len(runIds))
+}
+
+// Deletes the rows of the index in dir for messages without a live ref or objects
+// that aren't live, or with dryRun only counts them. Returns the number of rows.
+func pruneAttachmentIndex(dir string, liveRefs map[string]bool, liveObjects map[string]bool, dryRun bool) (int, error) {
+	db, err := openAttachmentIndex(dir)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	rows, err := db.Query(`SELECT rowid, hash, message_id FROM attachments`)
+	if err != nil {
+		return 0, err
+	}
+	var dead []int64
+	for rows.Next() {
+		var rowid int64
+		var hash, messageId string
+		if err := rows.Scan(&rowid, &hash, &messageId); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if !liveRefs[messageId] || !liveObjects[hash] {
+			dead = append(dead, rowid)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if dryRun || len(dead) == 0 {
+		return len(dead), nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	for _, rowid := range dead {
+		if _, err := tx.Exec(`DELETE FROM attachments WHERE rowid = ?`, rowid); err != nil {
+			return 0, err
+		}
+	}
+	return len(dead), tx.Commit()
+}
+
+func runStoreVerify(args []string) {
+	fs := flag.NewFlagSet("store verify", flag.ExitOnError)
+	dir := fs.String("archive-dir", "", "Archive directory to verify")
+	storeURL := fs.String("store", "", "sftp://user@host/path or s3://bucket/prefix the attachments were stored at instead of the archive directory")
+	parseFlags(fs, args)
+	if *dir == "" && *storeURL == "" {
+		log.Fatalf("Usage: gmail-cleanup store verify --archive-dir DIR | --store URL")
+	}
+	s, err := openAttachmentStore(*dir, *storeURL, "")
+	if err != nil {
+		log.Fatalf("Unable to open store: %v", err)
+	}
+	defer s.close()
+
+	problems := 0
+	hashes, err := s.objectHashes()
+	if err != nil {
+		log.Fatalf("Unable to list objects: %v", err)
+	}
+	for _, hash := range hashes {
+		actual, err := s.hashObject(hash)
+		if err != nil {
+			fmt.Printf("* object %s: %v\n", hash, err)
+			problems++
+			continue
+		}
+		if actual != hash {
+			fmt.Printf("* object %s: content hashes to %s\n", hash, actual)
+			problems++
+		}
+	}
+
+	refIds, err := s.refIds()
+	if err != nil {
+		log.Fatalf("Unable to list refs: %v", err)
+	}
+	for _, messageId := range refIds {
+		ref, err := s.readRef(messageId)
+		if err != nil {
+			fmt.Printf("* ref %s: %v\n", messageId, err)
+			problems++
+			continue
+		}
+		for _, a := range ref.Attachments {
+			if _, err := s.fs.size(objectName(a.SHA256)); err != nil {
+				fmt.Printf("* ref %s: attachment [%s] is missing object %s\n", messageId, a.Filename, a.SHA256)
+				problems++
+			}
+		}
+	}
+
+	if *dir != "" {
+		n, err := checkAttachmentIndex(*dir, hashes)
+		if err != nil {
+			log.Fatalf("Unable to check attachment index: %v", err)
+		}
+		problems += n
+	}
+
+	fmt.Printf("Checked %d objects and %d refs, found %d problems.\n", len(hashes), len(refIds), problems)
+	if problems > 0 {
+		os.Exit(exitVerification)
+	}
+}
+
+// Prints the objects that index rows in dir point at but that aren't among hashes,
+// and returns how many there are.
+func checkAttachmentIndex(dir string, hashes []string) (int, error) {
+	db, err := openAttachmentIndex(dir)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	present := map[string]bool{}
+	for _, hash := range hashes {
+		present[hash] = true
+	}
+	rows, err := db.Query(`SELECT hash, COUNT(*) FROM attachments GROUP BY hash`)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	problems := 0
+	for rows.Next() {
+		var hash string
+		var count int
+		if err := rows.Scan(&hash, &count); err != nil {
+			return 0, err
+		}
+		if !present[hash] {
+			fmt.Printf("* index: %d entries point at missing object %s\n", count, hash)
+			problems++
+		}
+	}
+	return problems, rows.Err()
+}
+
+func (s *attachmentStore) hashObject(hash string) (string, error) {
+	f, err := s.fs.open(objectName(hash))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
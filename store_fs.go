@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Where an attachment store keeps its files, named by slash-separated paths relative
+// to the store's root. Missing files are reported with errors satisfying os.IsNotExist.
+type storeFS interface {
+	// Writes data to name, replacing any file there, so readers never see a partial file.
+	writeFile(name string, data []byte) error
+	readFile(name string) ([]byte, error)
+	open(name string) (io.ReadCloser, error)
+	// Returns the size of name.
+	size(name string) (int64, error)
+	// Returns the names of the files in dir, skipping hidden ones. A missing dir has none.
+	list(dir string) ([]string, error)
+	remove(name string) error
+	// Returns where name is, for the index and manifest page.
+	location(name string) string
+	close() error
+}
+
+// A store in a local directory.
+type localStoreFS struct {
+	root string
+}
+
+func (l *localStoreFS) path(name string) string {
+	return filepath.Join(l.root, filepath.FromSlash(name))
+}
+
+func (l *localStoreFS) writeFile(name string, data []byte) error {
+	return writeFileAtomic(l.path(name), data)
+}
+
+func (l *localStoreFS) readFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(l.path(name))
+}
+
+func (l *localStoreFS) open(name string) (io.ReadCloser, error) {
+	return os.Open(l.path(name))
+}
+
+func (l *localStoreFS) size(name string) (int64, error) {
+	info, err := os.Stat(l.path(name))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (l *localStoreFS) list(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(l.path(dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+func (l *localStoreFS) remove(name string) error {
+	return os.Remove(l.path(name))
+}
+
+func (l *localStoreFS) location(name string) string {
+	return l.path(name)
+}
+
+func (l *localStoreFS) close() error {
+	return nil
+}
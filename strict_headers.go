@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/weineran/gmail-cleanup/internal/mimeutil"
+)
+
+// Headers --strict-headers doesn't compare unless --strict-headers-ignore is given.
+// A copy of a copy replaces the original id header with its own original's.
+const defaultStrictHeadersIgnore = "DKIM-Signature," + originalIdHeader
+
+type headerField struct {
+	name  string
+	value string
+}
+
+func (f headerField) String() string {
+	value := f.value
+	if len(value) > 60 {
+		value = truncateUTF8(value, 60) + "..."
+	}
+	return f.name + ": " + value
+}
+
+// Returns the fields of a raw header block, unfolded as RFC 5322 describes: line breaks
+// before whitespace are removed and the whitespace is kept.
+func rawHeaderFields(block []byte) []headerField {
+	unfolded := strings.NewReplacer("\r\n ", " ", "\r\n\t", "\t", "\n ", " ", "\n\t", "\t").Replace(string(block))
+	var fields []headerField
+	for _, line := range strings.Split(strings.ReplaceAll(unfolded, "\r\n", "\n"), "\n") {
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			continue
+		}
+		fields = append(fields, headerField{name: line[:i], value: strings.TrimSpace(line[i+1:])})
+	}
+	return fields
+}
+
+// Checks that every top-level header of original appears in rebuilt with the same name and
+// value, and in the same order. Headers whose lowercase name is in ignore are skipped, and
+// rebuilt may have headers original didn't.
+func checkHeadersPreserved(original []byte, rebuilt []byte, ignore map[string]bool) error {
+	originalHeaders, _ := mimeutil.SplitHeaderBlock(original)
+	rebuiltHeaders, _ := mimeutil.SplitHeaderBlock(rebuilt)
+	have := rawHeaderFields(rebuiltHeaders)
+
+	next := 0
+	for _, f := range rawHeaderFields(originalHeaders) {
+		if ignore[strings.ToLower(f.name)] {
+			continue
+		}
+		found := -1
+		for i := next; i < len(have); i++ {
+			if have[i] == f {
+				found = i
+				break
+			}
+		}
+		if found >= 0 {
+			next = found + 1
+			continue
+		}
+		for _, h := range have[:next] {
+			if h == f {
+				return fmt.Errorf("header [%s] was moved before another original header", f)
+			}
+		}
+		return fmt.Errorf("header [%s] was dropped or changed", f)
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/people/v1"
+)
+
+// Strips attachments through a mailBackend, so it works on IMAP mailboxes as well as Gmail.
+// Each message goes through processMessage like the default command's, with the same
+// journal, policy, protection and compliance mode.
+func runStrip(args []string) {
+	fs := flag.NewFlagSet("strip", flag.ExitOnError)
+	var opts mailboxOptions
+	opts.register(fs)
+	backendName := fs.String("backend", "imap", "Mail backend: imap or gmail")
+	var imapOpts imapOptions
+	fs.StringVar(&imapOpts.server, "imap-server", "imap.gmail.com:993", "IMAP server host:port, using TLS")
+	fs.StringVar(&imapOpts.username, "imap-user", "", "IMAP username")
+	passwordEnv := fs.String("imap-password-env", "IMAP_PASSWORD", "Environment variable holding the IMAP password")
+	xoauth2 := fs.Bool("imap-xoauth2", false, "Authenticate to IMAP with the profile's Google token instead of a password")
+	fs.StringVar(&imapOpts.folder, "imap-folder", "INBOX", "IMAP folder to clean up")
+	fs.StringVar(&imapOpts.trashFolder, "imap-trash-folder", "Trash", "IMAP folder policy deletes move messages to")
+	larger := fs.String("larger", "15M", "Only messages larger than this, e.g. 500K or 15M")
+	olderThan := fs.String("older-than", "", "Only messages older than this, e.g. 90d or 1y")
+	plugins := fs.String("plugin", "", "Comma-separated Go plugins (.so) to load")
+	transformers := fs.String("transform", "", "Comma-separated registered transformers to apply to each copy, in order")
+	archiveDir := fs.String("archive-dir", "", "Save attachments to this directory before removing them")
+	storeURL := fs.String("store", "", "With --archive-dir, save the attachments themselves to this sftp://user@host/path or s3://bucket/prefix, keeping only the index in the directory")
+	scanCmd := fs.String("scan-cmd", "", `With --archive-dir, pipe each attachment to this command before archiving it, e.g. "clamscan -", and quarantine those it exits non-zero for`)
+	policy := fs.String("policy", "", `A policies.yaml file, or inline rules such as "strip: photos; delete: automated reports older than 1y"`)
+	protectKeywords := fs.String("protect-keywords", "", "File of regular expressions, one per line, protecting matching messages (default: invoices, contracts, tax, receipts, boarding passes)")
+	overrideProtection := fs.Bool("override-protection", false, "Process messages even if they match a protection pattern")
+	protectedLabel := fs.String("protected-label", defaultProtectedLabel, "With --backend gmail, label for messages left alone because they match a protection pattern")
+	protectContacts := fs.String("protect-contacts", protectNone, "Contacts whose mail needs extra confirmation: starred, all or none; needs --backend gmail or --imap-xoauth2")
+	var removeOpts removeOptions
+	fs.BoolVar(&removeOpts.complianceMode, "compliance-mode", false, "Never delete originals; label or flag the stripped copies and record them in a manifest")
+	complianceLabel := fs.String("compliance-label", "gmail-cleanup/working-set", "Label, or IMAP keyword, for stripped copies in compliance mode")
+	fs.StringVar(&removeOpts.manifestPath, "manifest", "compliance-manifest.jsonl", "Export manifest written in compliance mode")
+	fs.StringVar(&removeOpts.backupDir, "backup-dir", "", "Save each original as a .eml file under this directory before replacing it")
+	dropAuthHeaders := fs.Bool("drop-auth-headers", false, "Remove DKIM-Signature and ARC headers from copies, since they can't validate after the rewrite")
+	fs.StringVar(&removeOpts.insertMethod, "insert-method", insertMethodInsert, "With --backend gmail: "+insertMethodUsage)
+	dryRun := fs.Bool("dry-run", false, "Only show what would be done to each message")
+	notifyWebhook := fs.String("notify-webhook", "", "Post the run summary as JSON to this URL when the run finishes")
+	maxDestructive := fs.Int("max-destructive-per-run", 0, "With --i-know-what-im-doing, allow the run to delete or strip this many messages, above max_destructive_per_run in the config file")
+	iKnow := fs.Bool("i-know-what-im-doing", false, "Let --max-destructive-per-run raise the config file's max_destructive_per_run")
+	fs.BoolVar(&removeOpts.assumeYes, "yes", false, "Approve every message without asking")
+	force := fs.Bool("force", false, "With --yes, don't ask to type a confirmation before originals are deleted permanently")
+	parseFlags(fs, args)
+
+	var criteria searchCriteria
+	var err error
+	criteria.larger, err = parseSize(*larger)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *olderThan != "" {
+		age, err := parseAge(*olderThan)
+		if err != nil {
+			log.Fatal(err)
+		}
+		criteria.before = time.Now().Add(-age)
+	}
+	if err := checkInsertMethod(removeOpts.insertMethod); err != nil {
+		log.Fatal(err)
+	}
+	if *protectContacts != protectNone && *backendName != "gmail" && !*xoauth2 {
+		log.Fatal("--protect-contacts needs a Google account: --backend gmail or --imap-xoauth2")
+	}
+	removeOpts.approved = map[string]bool{}
+	removeOpts.strictHeadersIgnore = map[string]bool{}
+	removeOpts.maxDestructive = destructiveCap(opts.profile, *maxDestructive, *iKnow)
+	if err := loadPlugins(*plugins); err != nil {
+		log.Fatal(err)
+	}
+	removeOpts.transformers, err = lookupTransformers(*transformers)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *dropAuthHeaders {
+		removeOpts.transformers = append(removeOpts.transformers, authHeaderDropper{})
+		for _, name := range authHeaders {
+			removeOpts.strictHeadersIgnore[strings.ToLower(name)] = true
+		}
+	}
+	removeOpts.senderDecisions, err = loadSenderDecisions(*policy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if isPolicyFile(*policy) {
+		removeOpts.senderDecisionsFile = *policy
+	}
+	removeOpts.policy, err = loadPolicy(*policy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	removeOpts.attachmentRules, err = loadAttachmentRules(*policy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !*overrideProtection {
+		removeOpts.protectionPatterns, err = loadProtectionPatterns(*protectKeywords)
+		if err != nil {
+			log.Fatalf("Unable to load protection patterns: %v", err)
+		}
+	}
+	runId := newRunId(time.Now())
+	removeOpts.journal = newRunJournal(opts.profile, runId)
+	if *dryRun {
+		// The plan is only printed; nothing is changed.
+		removeOpts.assumeYes = true
+		removeOpts.plan = &actionPlan{Created: time.Now().UTC(), Profile: opts.profile}
+	}
+	if *storeURL != "" && *archiveDir == "" {
+		log.Fatal("--store needs --archive-dir for the index")
+	}
+	if *archiveDir != "" {
+		removeOpts.store, err = openAttachmentStore(*archiveDir, *storeURL, runId)
+		if err != nil {
+			log.Fatalf("Unable to open store: %v", err)
+		}
+		defer removeOpts.store.close()
+	}
+	if *scanCmd != "" {
+		if *archiveDir == "" {
+			log.Fatal("--scan-cmd requires --archive-dir")
+		}
+		removeOpts.scanner, err = newAttachmentScanner(*scanCmd, *archiveDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// The Gmail API, for --backend gmail and for the contacts of --protect-contacts.
+	var mb *mailbox
+	var contactsClient *http.Client
+	switch *backendName {
+	case "gmail":
+		if *protectContacts != protectNone || usesContactGroups(removeOpts.policy) {
+			opts.extraScopes = append(opts.extraScopes, people.ContactsReadonlyScope)
+		}
+		mb = openMailbox(&opts)
+		defer mb.quota.printSummary()
+		contactsClient = mb.client
+		removeOpts.backend = &gmailBackend{mb: mb, insertMethod: removeOpts.insertMethod}
+		removeOpts.own, err = mb.ownAddresses()
+		if err != nil {
+			exitf(exitCodeFor(err), "Unable to list send-as addresses: %v", err)
+		}
+		if len(removeOpts.protectionPatterns) > 0 && !*dryRun {
+			removeOpts.protectedLabelId, err = mb.ensureLabel(*protectedLabel)
+			if err != nil {
+				log.Fatalf("Unable to create protected label: %v", err)
+			}
+		}
+		removeOpts.complianceLabelId = *complianceLabel
+		if removeOpts.complianceMode && !*dryRun {
+			removeOpts.complianceLabelId, err = mb.ensureLabel(*complianceLabel)
+			if err != nil {
+				log.Fatalf("Unable to create compliance label: %v", err)
+			}
+		}
+	case "imap":
+		if *xoauth2 {
+			imapOpts.tokenSource, err = profileTokenSource(&opts)
+			if err != nil {
+				log.Fatalf("Unable to get token: %v", err)
+			}
+			contactsClient = oauth2.NewClient(context.Background(), imapOpts.tokenSource)
+		} else {
+			imapOpts.password = os.Getenv(*passwordEnv)
+		}
+		removeOpts.backend, err = openIMAPBackend(&imapOpts)
+		if err != nil {
+			log.Fatalf("Unable to connect to IMAP server: %v", err)
+		}
+		// IMAP has no send-as list; the login is the address mail from me is sent from.
+		removeOpts.own = map[string]bool{strings.ToLower(imapOpts.username): true}
+		// A keyword flag stands in for the label.
+		removeOpts.complianceLabelId = *complianceLabel
+	default:
+		log.Fatalf("Unknown --backend [%s], expected imap or gmail", *backendName)
+	}
+	defer removeOpts.backend.close()
+	removeOpts.protectedContacts, err = loadProtectedContacts(context.Background(), contactsClient, *protectContacts)
+	if err != nil {
+		log.Fatalf("Unable to load contacts: %v", err)
+	}
+	if usesContactGroups(removeOpts.policy) {
+		if contactsClient == nil {
+			log.Fatal("Policies with contact groups need a Google account: --backend gmail or --imap-xoauth2")
+		}
+		if err := resolveContactGroups(context.Background(), contactsClient, removeOpts.policy); err != nil {
+			log.Fatalf("Unable to load contact groups: %v", err)
+		}
+	}
+
+	ids, err := removeOpts.backend.search(criteria)
+	if err != nil {
+		log.Fatalf("Unable to search messages: %v", err)
+	}
+	fmt.Printf("Count: %+v\n", len(ids))
+	var messages []*gmail.Message
+	for _, id := range ids {
+		messages = append(messages, &gmail.Message{Id: id})
+	}
+	// Messages are processed in the order the backend found them.
+	removeOpts.keepOrder = true
+
+	summary := newRunSummary(opts.profile)
+	summary.Query = fmt.Sprintf("strip --backend %s --larger %s", *backendName, *larger)
+	if *olderThan != "" {
+		summary.Query += " --older-than " + *olderThan
+	}
+	summary.Matched = len(ids)
+	defer func() {
+		code := summary.finish()
+		if removeOpts.scanner != nil {
+			summary.Quarantined = removeOpts.scanner.quarantined
+		}
+		summary.ReclaimedBytes = removeOpts.reclaimed
+		summary.TrashedBytes = removeOpts.trashed
+		summary.print()
+		if *notifyWebhook != "" {
+			notifyRunSummary(*notifyWebhook, summary)
+		}
+		if code != exitOK {
+			os.Exit(code)
+		}
+	}()
+	processMessages(mb, summary.Query, messages, &removeOpts, *force, summary, nil)
+	if *dryRun {
+		fmt.Printf("Dry run: planned %d messages; nothing was changed.\n", len(removeOpts.plan.Messages))
+	}
+}
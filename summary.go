@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"time"
+)
+
+// What processMessage did with a message.
+type outcome string
+
+const (
+	outcomeNoAttachments outcome = "no attachments"
+	outcomeSkipped       outcome = "skipped"
+	outcomeLater         outcome = "left to ask later"
+	outcomeStripped      outcome = "stripped"
+	outcomeKept          outcome = "stripped, original kept"
+	outcomeTrashed       outcome = "trashed"
+	outcomeProtected     outcome = "protected"
+	outcomeDrafted       outcome = "previewed as draft"
+	outcomeRejected      outcome = "draft rejected"
+	outcomeFailed        outcome = "failed"
+	outcomeChat          outcome = "skipped, chat message"
+	outcomePlanned       outcome = "planned"
+	outcomeNotPlanned    outcome = "skipped, not as planned"
+)
+
+// Totals for one run, printed at the end and optionally written as JSON.
+type runSummary struct {
+	Profile    string          `json:"profile"`
+	Query      string          `json:"query"`
+	Matched    int             `json:"matched"`
+	Outcomes   map[outcome]int `json:"outcomes"`
+	QuotaUnits int64           `json:"quotaUnits"`
+	// Estimated from the size of each replaced original less its copy's.
+	ReclaimedBytes int64 `json:"reclaimedBytes"`
+	// The size of the messages trashed, freed once the trash is emptied.
+	TrashedBytes int64 `json:"trashedBytes,omitempty"`
+	// What was stripped or trashed, by category.
+	Categories map[string]*categoryTotals `json:"categories,omitempty"`
+	// With --verify-reclaimed, the originals' raw sizes less their copies', fetched after the run.
+	VerifiedReclaimedBytes *int64 `json:"verifiedReclaimedBytes,omitempty"`
+	// With --verify-reclaimed, replacements that freed less than expected.
+	LowSavings []lowSaving `json:"lowSavings,omitempty"`
+	// Why the run stopped before processing every message, if it did.
+	Stopped string `json:"stopped,omitempty"`
+	// Token for --continue-from, if the run stopped at --max-messages-per-run.
+	Continue string `json:"continue,omitempty"`
+	// The messages that failed.
+	Errors []runError `json:"errors,omitempty"`
+	// Attachments --scan-cmd rejected.
+	Quarantined []quarantinedAttachment `json:"quarantined,omitempty"`
+	// How the run went, as set by finish: one of exitStatuses and its exit code.
+	Status   string `json:"status"`
+	ExitCode int    `json:"exitCode"`
+
+	// Exit code of the error that stopped the run, if one did.
+	stopCode int
+	// Messages skipped because an earlier review of the same query skipped them. They
+	// are in Outcomes but don't count against --max-messages-per-run.
+	resumedSkips int
+}
+
+// A message that failed, and the kind of failure from exitStatuses.
+type runError struct {
+	MessageId string `json:"messageId"`
+	Status    string `json:"status"`
+	Error     string `json:"error"`
+}
+
+// Identifies a run by its start time.
+func newRunId(started time.Time) string {
+	return started.Format("20060102-150405")
+}
+
+func newRunSummary(profile string) *runSummary {
+	return &runSummary{Profile: profile, Outcomes: map[outcome]int{}}
+}
+
+func (s *runSummary) print() {
+	fmt.Println(tr("Summary:"))
+	if s.Profile != "" {
+		fmt.Println(trf("Profile: %+v", s.Profile))
+	}
+	fmt.Println(trf("Query: %+v", s.Query))
+	fmt.Println(trf("Matched: %+v", s.Matched))
+	outcomes := make([]string, 0, len(s.Outcomes))
+	for o := range s.Outcomes {
+		outcomes = append(outcomes, string(o))
+	}
+	sort.Strings(outcomes)
+	for _, o := range outcomes {
+		fmt.Printf("* %+v: %+v\n", tr(o), s.Outcomes[outcome(o)])
+	}
+	if s.ReclaimedBytes > 0 {
+		fmt.Println(trf("Reclaimed: about %s", formatBytes(s.ReclaimedBytes)))
+	}
+	if s.VerifiedReclaimedBytes != nil {
+		fmt.Println(trf("Reclaimed, verified: %s", formatBytes(*s.VerifiedReclaimedBytes)))
+	}
+	if len(s.LowSavings) > 0 {
+		fmt.Println(tr("Replacements that freed less than expected:"))
+		for _, l := range s.LowSavings {
+			if l.OriginalRemains {
+				fmt.Println(trf("* %+v: original still exists next to copy %+v", l.MessageId, l.CopyId))
+				continue
+			}
+			fmt.Println(trf("* %+v: %s to %s with %s of attachments (copy %+v)", l.MessageId,
+				formatBytes(l.OriginalBytes), formatBytes(l.CopyBytes), formatBytes(l.AttachmentBytes), l.CopyId))
+		}
+	}
+	if s.Stopped != "" {
+		fmt.Println(trf("Stopped early: %+v", s.Stopped))
+	}
+	if s.Continue != "" {
+		fmt.Println(trf("To continue, run with --continue-from %s", s.Continue))
+	}
+	if len(s.Errors) > 0 {
+		fmt.Println(tr("Errors:"))
+		for _, e := range s.Errors {
+			fmt.Printf("* %+v (%+v): %+v\n", e.MessageId, e.Status, e.Error)
+		}
+	}
+	if len(s.Quarantined) > 0 {
+		fmt.Println(tr("Quarantined attachments:"))
+		for _, q := range s.Quarantined {
+			fmt.Println(trf("* %+v of message %+v: %+v (%+v)", q.Filename, q.MessageId, q.Path, q.Output))
+		}
+	}
+	if s.Status != "" {
+		fmt.Println(trf("Status: %+v (exit code %d)", s.Status, s.ExitCode))
+	}
+}
+
+// Records that the run stopped because of err.
+func (s *runSummary) stop(err error) {
+	log.Printf("Stopping: %v\n", err)
+	s.Stopped = err.Error()
+	s.stopCode = exitCodeFor(err)
+}
+
+func (s *runSummary) addError(messageId string, err error) {
+	s.Errors = append(s.Errors, runError{MessageId: messageId, Status: exitStatuses[exitCodeFor(err)], Error: err.Error()})
+}
+
+// Sets Status and ExitCode. An error that stopped the run comes first, then failed
+// messages, which are a verification failure if every one of them failed verification.
+func (s *runSummary) finish() int {
+	code := exitOK
+	switch {
+	case s.stopCode != exitOK:
+		code = s.stopCode
+	case len(s.Errors) > 0:
+		code = exitVerification
+		for _, e := range s.Errors {
+			if e.Status != exitStatuses[exitVerification] {
+				code = exitPartial
+			}
+		}
+	case s.Matched == 0:
+		code = exitNothingMatched
+	}
+	s.ExitCode = code
+	s.Status = exitStatuses[code]
+	return code
+}
+
+// Returns how many messages the run has processed.
+func (s *runSummary) processed() int {
+	n := 0
+	for _, count := range s.Outcomes {
+		n += count
+	}
+	return n
+}
+
+// The messages processed that count against --max-messages-per-run.
+func (s *runSummary) counted() int {
+	return s.processed() - s.resumedSkips
+}
+
+func (s *runSummary) write(path string) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+func readRunSummary(path string) (*runSummary, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s runSummary
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Formats a byte count with a binary unit, e.g. "24.3 MB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,43 @@
+package main
+
+// Names of the labels put on threads the tool has altered.
+const (
+	threadLabelStripped = "cleanup/partially-stripped"
+	threadLabelArchived = "cleanup/archived-attachments"
+)
+
+// Labels each thread with a rewritten message once per run, so altered conversations
+// stand out in Gmail.
+type threadLabeler struct {
+	strippedLabelId string
+	archivedLabelId string
+	labeled         map[string]bool
+}
+
+func newThreadLabeler(mb *mailbox) (*threadLabeler, error) {
+	stripped, err := mb.ensureLabel(threadLabelStripped)
+	if err != nil {
+		return nil, err
+	}
+	archived, err := mb.ensureLabel(threadLabelArchived)
+	if err != nil {
+		return nil, err
+	}
+	return &threadLabeler{strippedLabelId: stripped, archivedLabelId: archived, labeled: map[string]bool{}}, nil
+}
+
+// Labels the thread, and marks it as having archived attachments if archived is set.
+func (l *threadLabeler) label(mb *mailbox, threadId string, archived bool) error {
+	if threadId == "" || l.labeled[threadId] {
+		return nil
+	}
+	add := []string{l.strippedLabelId}
+	if archived {
+		add = append(add, l.archivedLabelId)
+	}
+	if _, err := mb.modifyThread(threadId, add, nil); err != nil {
+		return err
+	}
+	l.labeled[threadId] = true
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/weineran/gmail-cleanup/internal/auth"
+)
+
+// Environment variable holding the token passphrase, e.g. for the daemon.
+const tokenPassphraseEnv = "GMAIL_CLEANUP_TOKEN_PASSPHRASE"
+
+// Returns how the token file is encrypted. The passphrase comes from $GMAIL_CLEANUP_TOKEN_PASSPHRASE,
+// --token-passphrase-cmd, or a prompt without echo, in that order, and is only looked up once.
+func (o *mailboxOptions) tokenEncryption() auth.Encryption {
+	var passphrase string
+	var err error
+	looked := false
+	return auth.Encryption{
+		Encrypt: o.encryptToken,
+		Passphrase: func() (string, error) {
+			if !looked {
+				passphrase, err = o.lookUpTokenPassphrase()
+				looked = true
+			}
+			return passphrase, err
+		},
+	}
+}
+
+func (o *mailboxOptions) lookUpTokenPassphrase() (string, error) {
+	if p := os.Getenv(tokenPassphraseEnv); p != "" {
+		return p, nil
+	}
+	if fields := strings.Fields(o.tokenPassphraseCmd); len(fields) > 0 {
+		cmd := exec.Command(fields[0], fields[1:]...)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("--token-passphrase-cmd: %w", err)
+		}
+		return strings.TrimRight(string(out), "\r\n"), nil
+	}
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return "", errors.New("no passphrase: set $" + tokenPassphraseEnv + " or --token-passphrase-cmd")
+	}
+	fmt.Print("Token passphrase: ")
+	b, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
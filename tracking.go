@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/weineran/gmail-cleanup/transform"
+)
+
+// URLs of common open-tracking services, matched against each remote image's tag.
+var defaultTrackingPatterns = []string{
+	`(?i)/wf/open\b`,              // SendGrid
+	`(?i)list-manage\.com/track/`, // Mailchimp
+	`(?i)mandrillapp\.com/track/`, // Mandrill
+	`(?i)/e(/o)?/open\b`,          // HubSpot, Mailgun and others
+	`(?i)\bmailtrack\.io/`,
+	`(?i)\bt\.sidekickopen\d*\.com/`,
+}
+
+var (
+	imgTagPattern   = regexp.MustCompile(`(?is)<img\b[^>]*>`)
+	imgSrcPattern   = regexp.MustCompile(`(?is)\bsrc\s*=\s*["']?\s*https?://`)
+	imgAttrPattern  = regexp.MustCompile(`(?is)\b(width|height)\s*=\s*["']?\s*(\d+)`)
+	imgStylePattern = regexp.MustCompile(`(?is)\b(width|height)\s*:\s*(\d+)px|display\s*:\s*none`)
+)
+
+// Removes remote tracking images from HTML bodies in the copy, for --strip-tracking:
+// images of at most 1x1 pixels or hidden, and images whose tag matches a pattern.
+type trackingStripper struct {
+	patterns []*regexp.Regexp
+}
+
+// Builds a tracking stripper with the default patterns, or those in patternsFile, one
+// regular expression per line, if not "".
+func newTrackingStripper(patternsFile string) (*trackingStripper, error) {
+	sources := defaultTrackingPatterns
+	if patternsFile != "" {
+		f, err := os.Open(patternsFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		sources = nil
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			sources = append(sources, line)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	t := &trackingStripper{}
+	for _, source := range sources {
+		re, err := regexp.Compile(source)
+		if err != nil {
+			return nil, fmt.Errorf("tracking pattern [%s]: %w", source, err)
+		}
+		t.patterns = append(t.patterns, re)
+	}
+	return t, nil
+}
+
+func (t *trackingStripper) Transform(m *transform.ParsedMessage) error {
+	for _, part := range m.Parts() {
+		if part.Filename != "" || !strings.EqualFold(part.MimeType, "text/html") || part.Body == nil || part.Body.Data == "" {
+			continue
+		}
+		body, err := transform.Body(part)
+		if err != nil {
+			return err
+		}
+		count := 0
+		stripped := imgTagPattern.ReplaceAllFunc(body, func(tag []byte) []byte {
+			if t.isTracking(tag) {
+				count++
+				return nil
+			}
+			return tag
+		})
+		if count > 0 {
+			log.Printf("Removed %d tracking images from part [%s] of message [%s]\n", count, part.PartId, m.Original.Id)
+			transform.SetBody(part, stripped)
+		}
+	}
+	return nil
+}
+
+// Reports whether an <img> tag loads a remote image that is tiny, hidden or matches a pattern.
+func (t *trackingStripper) isTracking(tag []byte) bool {
+	if !imgSrcPattern.Match(tag) {
+		return false
+	}
+	for _, re := range t.patterns {
+		if re.Match(tag) {
+			return true
+		}
+	}
+	sizes := map[string]int{}
+	for _, m := range imgAttrPattern.FindAllSubmatch(tag, -1) {
+		n, _ := strconv.Atoi(string(m[2]))
+		sizes[strings.ToLower(string(m[1]))] = n
+	}
+	for _, m := range imgStylePattern.FindAllSubmatch(tag, -1) {
+		if len(m[1]) == 0 {
+			return true
+		}
+		n, _ := strconv.Atoi(string(m[2]))
+		sizes[strings.ToLower(string(m[1]))] = n
+	}
+	width, hasWidth := sizes["width"]
+	height, hasHeight := sizes["height"]
+	return hasWidth && hasHeight && width <= 1 && height <= 1
+}
@@ -0,0 +1,151 @@
+// Package transform lets extensions modify messages while their attachments are removed.
+//
+// A transformer registers itself from an init function, either in a file compiled into
+// gmail-cleanup or in a Go plugin loaded with --plugin:
+//
+//	func init() {
+//		transform.Register("drop-signature", transform.Func(func(m *transform.ParsedMessage) error {
+//			...
+//		}))
+//	}
+//
+// Registered transformers run, in the order given to --transform, on a copy of the
+// message payload just before the copy is serialized and inserted.
+package transform
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// A message being rewritten.
+type ParsedMessage struct {
+	// The message as fetched in full format. It must not be modified.
+	Original *gmail.Message
+	// The copy of Original.Payload that will be serialized into the new message.
+	Payload *gmail.MessagePart
+
+	// Reads downloaded attachment content, by part id.
+	attachments map[string]func() ([]byte, error)
+	kept        map[string]bool
+}
+
+// Returns a ParsedMessage whose Payload is a deep copy of m.Payload.
+func NewParsedMessage(m *gmail.Message) (*ParsedMessage, error) {
+	b, err := json.Marshal(m.Payload)
+	if err != nil {
+		return nil, err
+	}
+	var payload gmail.MessagePart
+	if err := json.Unmarshal(b, &payload); err != nil {
+		return nil, err
+	}
+	return &ParsedMessage{Original: m, Payload: &payload, attachments: map[string]func() ([]byte, error){}, kept: map[string]bool{}}, nil
+}
+
+// Makes what load returns the downloaded content of the attachment part p.
+func (m *ParsedMessage) AddAttachment(p *gmail.MessagePart, load func() ([]byte, error)) {
+	m.attachments[p.PartId] = load
+}
+
+// Reports whether the content of the attachment part p was downloaded.
+func (m *ParsedMessage) Downloaded(p *gmail.MessagePart) bool {
+	_, ok := m.attachments[p.PartId]
+	return ok
+}
+
+// Returns the downloaded content of the attachment part p, and false if it wasn't
+// downloaded. The content is read each time, so that attachments no transformer looks
+// at are never held in memory.
+func (m *ParsedMessage) Attachment(p *gmail.MessagePart) ([]byte, bool, error) {
+	load, ok := m.attachments[p.PartId]
+	if !ok {
+		return nil, false, nil
+	}
+	data, err := load()
+	return data, true, err
+}
+
+// Keeps the attachment part p in the rewritten message, with the body set by SetBody,
+// or else its downloaded content. Attachments are otherwise removed.
+func (m *ParsedMessage) Keep(p *gmail.MessagePart) {
+	m.kept[p.PartId] = true
+}
+
+// Reports whether Keep was called for p.
+func (m *ParsedMessage) Kept(p *gmail.MessagePart) bool {
+	return m.kept[p.PartId]
+}
+
+// Returns every part of the payload, depth first.
+func (m *ParsedMessage) Parts() []*gmail.MessagePart {
+	var parts []*gmail.MessagePart
+	var walk func(p *gmail.MessagePart)
+	walk = func(p *gmail.MessagePart) {
+		parts = append(parts, p)
+		for _, subpart := range p.Parts {
+			walk(subpart)
+		}
+	}
+	walk(m.Payload)
+	return parts
+}
+
+// Returns the decoded body of p.
+func Body(p *gmail.MessagePart) ([]byte, error) {
+	if p.Body == nil {
+		return nil, nil
+	}
+	return base64.URLEncoding.DecodeString(p.Body.Data)
+}
+
+// Replaces the body of p with data.
+func SetBody(p *gmail.MessagePart, data []byte) {
+	if p.Body == nil {
+		p.Body = &gmail.MessagePartBody{}
+	}
+	p.Body.Data = base64.URLEncoding.EncodeToString(data)
+	p.Body.Size = int64(len(data))
+}
+
+// Modifies a message before it is serialized.
+type Transformer interface {
+	Transform(m *ParsedMessage) error
+}
+
+// Adapts an ordinary function to a Transformer.
+type Func func(m *ParsedMessage) error
+
+func (f Func) Transform(m *ParsedMessage) error {
+	return f(m)
+}
+
+var registry = map[string]Transformer{}
+
+// Makes t available under name. It panics if name is already registered.
+func Register(name string, t Transformer) {
+	if _, ok := registry[name]; ok {
+		panic(fmt.Sprintf("Transformer [%s] is already registered", name))
+	}
+	registry[name] = t
+}
+
+// Returns the transformer registered under name.
+func Lookup(name string) (Transformer, bool) {
+	t, ok := registry[name]
+	return t, ok
+}
+
+// Returns the names of all registered transformers, sorted.
+func Names() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
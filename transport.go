@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Idle connections kept per host unless --max-idle-conns-per-host says otherwise. Go's
+// default of 2 makes the verify workers and the main loop open new connections all
+// the time.
+const defaultMaxIdleConnsPerHost = 16
+
+// Returns the HTTP client every request is built on: through --proxy or else the proxy
+// in $HTTPS_PROXY, trusting the certificates in --ca-cert as well as the system's, for
+// proxies that inspect TLS. --request-timeout is set on the authorized client, since
+// the OAuth transport doesn't keep it.
+func (o *mailboxOptions) baseHTTPClient() (*http.Client, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if o.proxy != "" {
+		u, err := url.Parse(o.proxy)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("--proxy [%s] isn't a URL such as http://proxy.example.com:3128", o.proxy)
+		}
+		t.Proxy = http.ProxyURL(u)
+	}
+	if o.caCert != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := ioutil.ReadFile(o.caCert)
+		if err != nil {
+			return nil, fmt.Errorf("--ca-cert: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("--ca-cert [%s] has no PEM certificates", o.caCert)
+		}
+		t.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	t.MaxIdleConnsPerHost = o.maxIdleConnsPerHost
+	if t.MaxIdleConns < o.maxIdleConnsPerHost {
+		t.MaxIdleConns = o.maxIdleConnsPerHost
+	}
+	return &http.Client{Transport: t, Timeout: o.requestTimeout}, nil
+}
+
+// Returns what to check for a connection error, which otherwise only says a certificate
+// is signed by an unknown authority or a host can't be reached, or "".
+func transportHint(err error) string {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	// The OAuth library formats the errors of token requests into its own.
+	if errors.As(err, &unknownAuthority) || errors.As(err, &hostname) || strings.Contains(err.Error(), "x509: ") {
+		return " (behind a proxy that inspects TLS, pass its CA certificate with --ca-cert)"
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return " (behind a proxy, pass it with --proxy or $HTTPS_PROXY)"
+	}
+	return ""
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// What a run did with the messages of one category: how many it stripped or trashed,
+// and the bytes stripped from them or, for trashed ones, their size.
+type categoryTotals struct {
+	Messages int   `json:"messages"`
+	Bytes    int64 `json:"bytes"`
+}
+
+// Adds a message of category that was stripped of, or trashed with, bytes.
+func (opts *removeOptions) countCleaned(category string, bytes int64) {
+	if opts.cleaned == nil {
+		opts.cleaned = map[string]*categoryTotals{}
+	}
+	t := opts.cleaned[category]
+	if t == nil {
+		t = &categoryTotals{}
+		opts.cleaned[category] = t
+	}
+	t.Messages++
+	t.Bytes += bytes
+}
+
+// Stores the aggregates of a finished run in the profile's state database, for trends.
+// messagesTotal is the mailbox's message count after the run, or 0 if unknown.
+func recordRun(profile string, runId string, s *runSummary, messagesTotal int64) error {
+	db, err := openStateDB(profile)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	total := sql.NullInt64{Int64: messagesTotal, Valid: messagesTotal > 0}
+	_, err = tx.Exec(`INSERT OR REPLACE INTO runs (run_id, finished_at, query, matched, stripped, trashed, failed, reclaimed_bytes, trashed_bytes, messages_total)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		runId, time.Now().UTC().Format(time.RFC3339), s.Query, s.Matched, s.Outcomes[outcomeStripped], s.Outcomes[outcomeTrashed],
+		s.Outcomes[outcomeFailed], s.ReclaimedBytes, s.TrashedBytes, total)
+	if err != nil {
+		return err
+	}
+	for category, t := range s.Categories {
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO run_categories (run_id, category, messages, bytes) VALUES (?, ?, ?, ?)`,
+			runId, category, t.Messages, t.Bytes); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Stores a reading of the account's storage usage, for the size trajectory in trends.
+func recordUsage(profile string, u *storageUsage) error {
+	db, err := openStateDB(profile)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.Exec(`INSERT OR REPLACE INTO usage (checked_at, total_bytes, gmail_bytes, limit_bytes) VALUES (?, ?, ?, ?)`,
+		time.Now().UTC().Format(time.RFC3339), u.Total, u.gmailAndPhotos(), u.Limit)
+	return err
+}
+
+// What the runs of one month did, and how big the mailbox was at its end.
+type monthTrend struct {
+	Month          string `json:"month"`
+	Runs           int    `json:"runs"`
+	Stripped       int    `json:"stripped"`
+	Trashed        int    `json:"trashed"`
+	Failed         int    `json:"failed"`
+	ReclaimedBytes int64  `json:"reclaimedBytes"`
+	TrashedBytes   int64  `json:"trashedBytes"`
+	// The last readings of the month, if there were any.
+	MessagesTotal *int64 `json:"messagesTotal,omitempty"`
+	GmailBytes    *int64 `json:"gmailBytes,omitempty"`
+	LimitBytes    *int64 `json:"limitBytes,omitempty"`
+	// What was cleaned by category, showing which policies do the work.
+	Categories map[string]*categoryTotals `json:"categories,omitempty"`
+}
+
+// Reads the trends of the months since the first of from from db, oldest first.
+func readTrends(db *sql.DB, from time.Time) ([]*monthTrend, error) {
+	since := from.Format(time.RFC3339)
+	months := map[string]*monthTrend{}
+	month := func(at string) *monthTrend {
+		key := at[:7]
+		m := months[key]
+		if m == nil {
+			m = &monthTrend{Month: key, Categories: map[string]*categoryTotals{}}
+			months[key] = m
+		}
+		return m
+	}
+
+	rows, err := db.Query(`SELECT finished_at, stripped, trashed, failed, reclaimed_bytes, trashed_bytes, messages_total
+		FROM runs WHERE finished_at >= ? ORDER BY finished_at`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var at string
+		var stripped, trashed, failed int
+		var reclaimed, trashedBytes int64
+		var total sql.NullInt64
+		if err := rows.Scan(&at, &stripped, &trashed, &failed, &reclaimed, &trashedBytes, &total); err != nil {
+			return nil, err
+		}
+		m := month(at)
+		m.Runs++
+		m.Stripped += stripped
+		m.Trashed += trashed
+		m.Failed += failed
+		m.ReclaimedBytes += reclaimed
+		m.TrashedBytes += trashedBytes
+		if total.Valid {
+			n := total.Int64
+			m.MessagesTotal = &n
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query(`SELECT r.finished_at, c.category, c.messages, c.bytes
+		FROM run_categories c JOIN runs r ON r.run_id = c.run_id WHERE r.finished_at >= ?`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var at, category string
+		var t categoryTotals
+		if err := rows.Scan(&at, &category, &t.Messages, &t.Bytes); err != nil {
+			return nil, err
+		}
+		m := month(at)
+		if m.Categories[category] == nil {
+			m.Categories[category] = &categoryTotals{}
+		}
+		m.Categories[category].Messages += t.Messages
+		m.Categories[category].Bytes += t.Bytes
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query(`SELECT checked_at, gmail_bytes, limit_bytes FROM usage WHERE checked_at >= ? ORDER BY checked_at`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var at string
+		var gmailBytes, limit int64
+		if err := rows.Scan(&at, &gmailBytes, &limit); err != nil {
+			return nil, err
+		}
+		m := month(at)
+		m.GmailBytes = &gmailBytes
+		m.LimitBytes = &limit
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var trends []*monthTrend
+	for _, m := range months {
+		trends = append(trends, m)
+	}
+	sort.Slice(trends, func(i, j int) bool { return trends[i].Month < trends[j].Month })
+	return trends, nil
+}
+
+// Shows, from the runs and usage readings stored in the state database, the bytes
+// reclaimed each month, how the mailbox's size went, and what each category contributed.
+func runTrends(args []string) {
+	fs := flag.NewFlagSet("trends", flag.ExitOnError)
+	profile := fs.String("profile", "", "Show the trends of this profile")
+	months := fs.Int("months", 12, "How many months back to show")
+	asJSON := fs.Bool("json", false, "Print the months as JSON")
+	parseFlags(fs, args)
+
+	db, err := openStateDB(*profile)
+	if err != nil {
+		log.Fatalf("Unable to open state database: %v", err)
+	}
+	defer db.Close()
+	now := time.Now().UTC()
+	from := time.Date(now.Year(), now.Month()-time.Month(*months-1), 1, 0, 0, 0, 0, time.UTC)
+	trends, err := readTrends(db, from)
+	if err != nil {
+		log.Fatalf("Unable to read trends: %v", err)
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(trends); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(trends) == 0 {
+		fmt.Printf("No runs or usage readings since %s.\n", from.Format("2006-01"))
+		return
+	}
+
+	reclaimed := reportChart{title: "Reclaimed per month (messages stripped)"}
+	for _, m := range trends {
+		reclaimed.bars = append(reclaimed.bars, reportBar{label: m.Month, bytes: m.ReclaimedBytes, count: m.Stripped})
+	}
+	printReportChart(reclaimed)
+	fmt.Println()
+
+	fmt.Println("Runs per month:")
+	for _, m := range trends {
+		fmt.Printf("* %s: %d runs, %d stripped, %d trashed (%s), %d failed\n",
+			m.Month, m.Runs, m.Stripped, m.Trashed, formatBytes(m.TrashedBytes), m.Failed)
+	}
+	fmt.Println()
+
+	fmt.Println("Mailbox size at the end of each month:")
+	var lastMessages *int64
+	var lastBytes *int64
+	for _, m := range trends {
+		var parts []string
+		if m.GmailBytes != nil {
+			part := formatBytes(*m.GmailBytes)
+			if m.LimitBytes != nil && *m.LimitBytes > 0 {
+				part += " of " + formatBytes(*m.LimitBytes)
+			}
+			if lastBytes != nil {
+				part += fmt.Sprintf(" (%s)", formatByteChange(*m.GmailBytes-*lastBytes))
+			}
+			parts = append(parts, part)
+			lastBytes = m.GmailBytes
+		}
+		if m.MessagesTotal != nil {
+			part := formatCount(int(*m.MessagesTotal)) + " messages"
+			if lastMessages != nil {
+				part += fmt.Sprintf(" (%+d)", *m.MessagesTotal-*lastMessages)
+			}
+			parts = append(parts, part)
+			lastMessages = m.MessagesTotal
+		}
+		if len(parts) == 0 {
+			parts = append(parts, "no readings")
+		}
+		fmt.Printf("* %s: %s\n", m.Month, strings.Join(parts, ", "))
+	}
+	if lastBytes == nil {
+		fmt.Println("Run gmail-cleanup usage now and then to record the size in bytes.")
+	}
+	fmt.Println()
+
+	fmt.Println("Cleaned by category:")
+	for _, m := range trends {
+		categories := make([]string, 0, len(m.Categories))
+		for c := range m.Categories {
+			categories = append(categories, c)
+		}
+		sort.Slice(categories, func(i, j int) bool {
+			return m.Categories[categories[i]].Bytes > m.Categories[categories[j]].Bytes
+		})
+		var parts []string
+		for _, c := range categories {
+			t := m.Categories[c]
+			parts = append(parts, fmt.Sprintf("%s %d (%s)", c, t.Messages, formatBytes(t.Bytes)))
+		}
+		if len(parts) == 0 {
+			parts = append(parts, "nothing")
+		}
+		fmt.Printf("* %s: %s\n", m.Month, strings.Join(parts, ", "))
+	}
+}
+
+// Formats a change in bytes with its sign, e.g. "-1.2 GB".
+func formatByteChange(n int64) string {
+	if n < 0 {
+		return "-" + formatBytes(-n)
+	}
+	return "+" + formatBytes(n)
+}
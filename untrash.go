@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+
+	"github.com/weineran/gmail-cleanup/cleaner"
+)
+
+// Labels that can't or shouldn't be restored on an untrashed message.
+var unrestorableLabels = map[string]bool{
+	"TRASH": true,
+	"SPAM":  true,
+	"DRAFT": true,
+	"SENT":  true,
+	"CHAT":  true,
+}
+
+func runUntrash(args []string) {
+	fs := flag.NewFlagSet("untrash", flag.ExitOnError)
+	var opts mailboxOptions
+	opts.register(fs)
+	query := fs.String("query", "", "Restore trashed messages matching this query")
+	idsFromFile := fs.String("ids-from-file", "", "Restore the message ids listed in this file, one per line, or in stdin for -")
+	fs.StringVar(idsFromFile, "ids", "", "Same as --ids-from-file, e.g. --ids - to read them from stdin")
+	dryRun := fs.Bool("dry-run", false, "Only list the messages that would be restored")
+	assumeYes := fs.Bool("yes", false, "Restore without asking")
+	parseFlags(fs, args)
+	checkQuery(*query, false, false)
+
+	if (*query == "") == (*idsFromFile == "") {
+		log.Fatal("untrash needs exactly one of --query or --ids-from-file")
+	}
+	if *idsFromFile == "-" && !*assumeYes && !*dryRun {
+		log.Fatal("--ids - reads the ids from stdin, which then can't answer questions; pass --yes or --dry-run too")
+	}
+
+	journal, err := readJournal(profileJournalFile(opts.profile))
+	if err != nil {
+		log.Fatalf("Unable to read journal: %v", err)
+	}
+	// The labels each message had when a run last trashed it.
+	priorLabels := map[string][]string{}
+	for _, e := range journal {
+		if e.Action == journalTrashed {
+			priorLabels[e.MessageId] = e.LabelIds
+		}
+	}
+
+	mb := openMailbox(&opts)
+	defer mb.quota.printSummary()
+
+	var ids []string
+	if *idsFromFile != "" {
+		ids, err = readIdsFile(*idsFromFile)
+		if err != nil {
+			log.Fatalf("Unable to read ids: %v", err)
+		}
+	} else {
+		messages, err := cleaner.Collect(mb.cleaner().List(context.Background(), "in:trash "+*query))
+		if err != nil {
+			log.Fatalf("Unable to retrieve messages: %v", err)
+		}
+		for _, m := range messages {
+			ids = append(ids, m.Id)
+		}
+	}
+	if len(ids) == 0 {
+		fmt.Println("No messages found.")
+		return
+	}
+
+	restorable := 0
+	for _, id := range ids {
+		if _, ok := priorLabels[id]; ok {
+			restorable++
+		}
+	}
+	fmt.Printf("%d messages to restore, %d with labels from the journal\n", len(ids), restorable)
+	if *dryRun {
+		for _, id := range ids {
+			fmt.Printf("* %s %v\n", id, priorLabels[id])
+		}
+		return
+	}
+	if !*assumeYes && !askYesNo(fmt.Sprintf("Do you want to restore %d messages from the trash?", len(ids))) {
+		return
+	}
+
+	restored := 0
+	for _, id := range ids {
+		m, err := mb.untrashMessage(id)
+		if errors.Is(err, errQuotaBudgetExceeded) {
+			log.Printf("Stopping: %v\n", err)
+			break
+		}
+		if err != nil {
+			log.Printf("Unable to untrash message [%s]: %v\n", id, err)
+			continue
+		}
+		restored++
+
+		added, err := restorePriorLabels(mb, m, priorLabels[id])
+		if err != nil {
+			log.Printf("Unable to restore labels on message [%s]: %v\n", id, err)
+			continue
+		}
+		if len(added) > 0 {
+			log.Printf("Restored labels %v on message [%s]\n", added, id)
+		}
+	}
+	fmt.Printf("Restored %d of %d messages\n", restored, len(ids))
+}
+
+// Adds back those of labels the untrashed message m lacks, returning the labels added.
+func restorePriorLabels(mb *mailbox, m *gmail.Message, labels []string) ([]string, error) {
+	current := map[string]bool{}
+	for _, l := range m.LabelIds {
+		current[l] = true
+	}
+	var add []string
+	for _, l := range labels {
+		if !current[l] && !unrestorableLabels[l] {
+			add = append(add, l)
+		}
+	}
+	if len(add) == 0 {
+		return nil, nil
+	}
+	if _, err := mb.modifyMessage(m.Id, add, nil); err != nil {
+		return nil, err
+	}
+	return add, nil
+}
+
+// Reads message ids, one per line, from the file at path or stdin for "-", ignoring
+// blank lines and # comments.
+func readIdsFile(path string) ([]string, error) {
+	in := io.Reader(os.Stdin)
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var ids []string
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ids = append(ids, line)
+	}
+	return ids, scanner.Err()
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+)
+
+// Query whose messages a usage alert suggests stripping by default.
+const defaultSuggestQuery = "larger:5M"
+
+// Storage used by the account, which Gmail shares with Drive and Photos.
+type storageUsage struct {
+	// 0 for unlimited storage.
+	Limit int64
+	Total int64
+	Drive int64
+}
+
+// Gmail's share of the usage. Drive's About API doesn't separate Gmail from Photos.
+func (u *storageUsage) gmailAndPhotos() int64 {
+	return u.Total - u.Drive
+}
+
+// Reads the account's storage quota. Needs the Drive metadata scope.
+func getStorageUsage(mb *mailbox) (*storageUsage, error) {
+	service, err := drive.NewService(context.Background(), option.WithHTTPClient(mb.client))
+	if err != nil {
+		return nil, err
+	}
+	about, err := service.About.Get().Fields("storageQuota").Do()
+	if err != nil {
+		return nil, err
+	}
+	q := about.StorageQuota
+	return &storageUsage{Limit: q.Limit, Total: q.Usage, Drive: q.UsageInDrive}, nil
+}
+
+// A level of usage to alert at: a percentage of the limit, or a size.
+type usageThreshold struct {
+	spec    string
+	percent float64
+	bytes   int64
+}
+
+func (t usageThreshold) crossed(u *storageUsage) bool {
+	if t.percent > 0 {
+		return u.Limit > 0 && float64(u.Total)*100 >= t.percent*float64(u.Limit)
+	}
+	return u.Total >= t.bytes
+}
+
+// Parses --alert-at, e.g. 80%,90%,14G.
+func parseUsageThresholds(s string) ([]usageThreshold, error) {
+	var thresholds []usageThreshold
+	for _, item := range splitList(s) {
+		t := usageThreshold{spec: item}
+		if strings.HasSuffix(item, "%") {
+			p, err := strconv.ParseFloat(strings.TrimSuffix(item, "%"), 64)
+			if err != nil || p <= 0 || p > 100 {
+				return nil, fmt.Errorf("--alert-at: invalid percentage [%s]", item)
+			}
+			t.percent = p
+		} else {
+			n, err := parseSize(item)
+			if err != nil {
+				return nil, fmt.Errorf("--alert-at: %w", err)
+			}
+			t.bytes = n
+		}
+		thresholds = append(thresholds, t)
+	}
+	return thresholds, nil
+}
+
+// The thresholds already alerted for, so each crossing is reported once. A threshold
+// usage falls back under is forgotten, to alert again when it's crossed again.
+type usageAlerts struct {
+	Alerted []string `json:"alerted"`
+}
+
+func usageAlertsFile(profile string) string {
+	return profilePath(profile, "usage-alerts.json")
+}
+
+func readUsageAlerts(path string) (*usageAlerts, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &usageAlerts{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var a usageAlerts
+	if err := json.Unmarshal(b, &a); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &a, nil
+}
+
+func (a *usageAlerts) write(path string) error {
+	b, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+// Prints the account's storage usage and, with --alert-at, notifies when it crosses a threshold.
+func runUsage(args []string) {
+	fs := flag.NewFlagSet("usage", flag.ExitOnError)
+	var opts mailboxOptions
+	opts.register(fs)
+	alertAt := fs.String("alert-at", "", "Comma-separated usage thresholds to alert at, as percentages of the limit or sizes, e.g. 80%,90%,14G")
+	notify := fs.String("notify", "", "Where to send alerts: webhook:URL, email (a message to yourself) or desktop")
+	suggestQuery := fs.String("suggest-query", defaultSuggestQuery, "Query whose messages an alert suggests stripping")
+	parseFlags(fs, args)
+
+	thresholds, err := parseUsageThresholds(*alertAt)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var n *notifier
+	if *notify != "" {
+		if len(thresholds) == 0 {
+			log.Fatal("--notify needs --alert-at")
+		}
+		n, err = parseNotifier(*notify)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	opts.extraScopes = append(opts.extraScopes, drive.DriveMetadataReadonlyScope)
+	// Alerts by email insert a message.
+	opts.readOnly = n == nil || n.kind != "email"
+	mb := openMailbox(&opts)
+	defer mb.quota.printSummary()
+	u, err := getStorageUsage(mb)
+	if err != nil {
+		exitf(exitCodeFor(err), "Unable to get storage usage: %v", err)
+	}
+	if err := recordUsage(opts.profile, u); err != nil {
+		log.Printf("Unable to record usage for trends: %v\n", err)
+	}
+	status := describeUsage(u)
+	fmt.Print(status)
+	if len(thresholds) == 0 {
+		return
+	}
+
+	path := usageAlertsFile(opts.profile)
+	alerts, err := readUsageAlerts(path)
+	if err != nil {
+		log.Fatalf("Unable to read usage alerts: %v", err)
+	}
+	alerted := map[string]bool{}
+	for _, spec := range alerts.Alerted {
+		alerted[spec] = true
+	}
+	var crossed []string
+	var still []string
+	for _, t := range thresholds {
+		if !t.crossed(u) {
+			continue
+		}
+		still = append(still, t.spec)
+		if !alerted[t.spec] {
+			crossed = append(crossed, t.spec)
+		}
+	}
+	if len(crossed) == 0 {
+		fmt.Println("No new thresholds crossed.")
+	} else {
+		subject := fmt.Sprintf("gmail-cleanup: storage usage crossed %s", strings.Join(crossed, ", "))
+		suggestion, err := usageSuggestion(mb, *suggestQuery)
+		if err != nil {
+			exitf(exitCodeFor(err), "Unable to look for messages to strip: %v", err)
+		}
+		fmt.Println(subject)
+		fmt.Println(suggestion)
+		if n != nil {
+			if err := n.notify(mb, subject, status+"\n"+suggestion); err != nil {
+				exitf(exitError, "Unable to send notification: %v", err)
+			}
+			fmt.Printf("Sent notification via %s\n", n.kind)
+		}
+	}
+	alerts.Alerted = still
+	if err := alerts.write(path); err != nil {
+		log.Fatalf("Unable to write usage alerts: %v", err)
+	}
+}
+
+func describeUsage(u *storageUsage) string {
+	var b strings.Builder
+	if u.Limit > 0 {
+		fmt.Fprintf(&b, "Storage used: %s of %s (%.1f%%)\n", formatBytes(u.Total), formatBytes(u.Limit), float64(u.Total)*100/float64(u.Limit))
+	} else {
+		fmt.Fprintf(&b, "Storage used: %s (no limit)\n", formatBytes(u.Total))
+	}
+	fmt.Fprintf(&b, "* Gmail and Photos: %s\n", formatBytes(u.gmailAndPhotos()))
+	fmt.Fprintf(&b, "* Drive: %s\n", formatBytes(u.Drive))
+	return b.String()
+}
+
+// Suggests a run that would bring usage down, from what the messages matching query hold.
+func usageSuggestion(mb *mailbox, query string) (string, error) {
+	var count int
+	var total int64
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for r := range mb.cleaner().Messages(ctx, query) {
+		if r.Err != nil {
+			return "", r.Err
+		}
+		count++
+		total += r.Message.SizeEstimate
+	}
+	if count == 0 {
+		return fmt.Sprintf("No messages match [%s]; Drive or Photos may be using the space, or try a smaller --suggest-query.", query), nil
+	}
+	return fmt.Sprintf("%d messages matching [%s] hold %s. Stripping their attachments frees most of it:\n"+
+		"  gmail-cleanup --archive-dir attachments '%s'\n"+
+		"or preview what a policy would free with: gmail-cleanup simulate --policy policies.yaml",
+		count, query, formatBytes(total), query), nil
+}
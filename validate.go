@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// What a field of a YAML file may hold. A mapping has fields, or with no fields, any keys
+// whose values are items. A sequence has items, and a scalar is checked by check, if not nil.
+type fieldSchema struct {
+	kind     yaml.Kind
+	required bool
+	fields   map[string]fieldSchema
+	items    *fieldSchema
+	check    func(value string) error
+}
+
+func scalarField(check func(value string) error) fieldSchema {
+	return fieldSchema{kind: yaml.ScalarNode, check: check}
+}
+
+func requiredField(f fieldSchema) fieldSchema {
+	f.required = true
+	return f
+}
+
+func sequenceOf(item fieldSchema) fieldSchema {
+	return fieldSchema{kind: yaml.SequenceNode, items: &item}
+}
+
+func mappingOf(fields map[string]fieldSchema) fieldSchema {
+	return fieldSchema{kind: yaml.MappingNode, fields: fields}
+}
+
+// Accepts any of values, ignoring case.
+func oneOf(values ...string) func(string) error {
+	return func(value string) error {
+		for _, v := range values {
+			if strings.EqualFold(value, v) {
+				return nil
+			}
+		}
+		return fmt.Errorf("unknown value [%s], expected %s", value, strings.Join(values, ", "))
+	}
+}
+
+func checkAge(value string) error {
+	_, err := parseAge(value)
+	return err
+}
+
+func checkCount(value string) error {
+	if n, err := strconv.Atoi(value); err != nil || n < 0 {
+		return fmt.Errorf("[%s] isn't a number of messages", value)
+	}
+	return nil
+}
+
+func checkSize(value string) error {
+	_, err := parseSize(value)
+	return err
+}
+
+// Accepts what yaml.v3 decodes into a bool, including the YAML 1.1 yes, no, on and off.
+func checkBool(value string) error {
+	if _, err := strconv.ParseBool(value); err == nil {
+		return nil
+	}
+	switch strings.ToLower(value) {
+	case "yes", "no", "on", "off", "y", "n":
+		return nil
+	}
+	return fmt.Errorf("[%s] isn't true or false", value)
+}
+
+// The policies.yaml file, as policyFile describes it.
+var policyFileSchema = mappingOf(map[string]fieldSchema{
+	"policies": sequenceOf(mappingOf(map[string]fieldSchema{
+		"action":         requiredField(scalarField(oneOf(actionStrip, actionDelete))),
+		"category":       scalarField(nil),
+		"older_than":     scalarField(checkAge),
+		"list_id":        scalarField(nil),
+		"except_starred": scalarField(checkBool),
+		"contact_group":  scalarField(nil),
+	})),
+	"budgets": sequenceOf(mappingOf(map[string]fieldSchema{
+		"sender":   scalarField(nil),
+		"max":      requiredField(scalarField(checkSize)),
+		"action":   scalarField(oneOf(actionStrip, actionDelete)),
+		"min_size": scalarField(checkSize),
+	})),
+	"attachments": sequenceOf(mappingOf(map[string]fieldSchema{
+		"extensions": requiredField(sequenceOf(scalarField(nil))),
+		"action":     requiredField(scalarField(oneOf(actionKeep, actionStrip, actionDelete))),
+		"older_than": scalarField(checkAge),
+	})),
+	"senders": mappingOf(map[string]fieldSchema{
+		"approve": sequenceOf(scalarField(nil)),
+		"skip":    sequenceOf(scalarField(nil)),
+	}),
+	"trash": mappingOf(map[string]fieldSchema{
+		"max_age": requiredField(scalarField(checkAge)),
+	}),
+})
+
+// config.yaml, as configFile describes it.
+var configFileSchema = mappingOf(map[string]fieldSchema{
+	"flags":                   {kind: yaml.MappingNode, items: &fieldSchema{kind: yaml.ScalarNode}},
+	"max_destructive_per_run": scalarField(checkCount),
+	"keep_backups":            scalarField(checkAge),
+	"max_backup_size":         scalarField(checkSize),
+})
+
+// A problem with one field of a YAML file.
+type fieldError struct {
+	line int
+	// The path of the field, e.g. policies[2].older_than.
+	field   string
+	problem string
+}
+
+// Every problem found in a YAML file, one per line.
+type fileErrors struct {
+	path   string
+	errors []fieldError
+}
+
+func (e *fileErrors) Error() string {
+	var lines []string
+	for _, f := range e.errors {
+		lines = append(lines, fmt.Sprintf("%s:%d: %s: %s", e.path, f.line, f.field, f.problem))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Reads the YAML file at path, checks it against schema and decodes it into v. Every
+// problem is reported at once, with its line and field, rather than the first one found
+// while it is used. Returns the top-level node, or nil for an empty file.
+func readValidatedYAML(path string, schema fieldSchema, v interface{}) (*yaml.Node, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	root := doc.Content[0]
+	e := &fileErrors{path: path}
+	validateNode(root, schema, "", e)
+	if len(e.errors) > 0 {
+		return nil, e
+	}
+	if err := root.Decode(v); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return root, nil
+}
+
+// Checks n against schema, adding what is wrong to e. field is n's path, "" at the top.
+func validateNode(n *yaml.Node, schema fieldSchema, field string, e *fileErrors) {
+	name := field
+	if name == "" {
+		name = "top level"
+	}
+	if n.Kind == yaml.ScalarNode && n.Tag == "!!null" {
+		if schema.required {
+			e.errors = append(e.errors, fieldError{line: n.Line, field: name, problem: "missing value"})
+		}
+		return
+	}
+	if n.Kind != schema.kind {
+		e.errors = append(e.errors, fieldError{line: n.Line, field: name, problem: "expected " + kindName(schema.kind) + ", not " + kindName(n.Kind)})
+		return
+	}
+	switch n.Kind {
+	case yaml.ScalarNode:
+		if schema.check != nil {
+			if err := schema.check(n.Value); err != nil {
+				e.errors = append(e.errors, fieldError{line: n.Line, field: name, problem: err.Error()})
+			}
+		}
+	case yaml.SequenceNode:
+		for i, item := range n.Content {
+			validateNode(item, *schema.items, fmt.Sprintf("%s[%d]", field, i), e)
+		}
+	case yaml.MappingNode:
+		if schema.fields == nil {
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				if schema.items != nil {
+					validateNode(n.Content[i+1], *schema.items, childField(field, n.Content[i].Value), e)
+				}
+			}
+			return
+		}
+		var names []string
+		for key := range schema.fields {
+			names = append(names, key)
+		}
+		sort.Strings(names)
+		given := map[string]bool{}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, value := n.Content[i], n.Content[i+1]
+			child := childField(field, key.Value)
+			given[key.Value] = true
+			s, ok := schema.fields[key.Value]
+			if !ok {
+				problem := "unknown field, expected one of " + strings.Join(names, ", ")
+				if suggestion := closest(key.Value, names, "", ""); suggestion != "" {
+					problem = fmt.Sprintf("unknown field, did you mean %s?", suggestion)
+				}
+				e.errors = append(e.errors, fieldError{line: key.Line, field: child, problem: problem})
+				continue
+			}
+			validateNode(value, s, child, e)
+		}
+		for _, key := range names {
+			if schema.fields[key].required && !given[key] {
+				e.errors = append(e.errors, fieldError{line: n.Line, field: childField(field, key), problem: "missing"})
+			}
+		}
+	}
+}
+
+func childField(field string, key string) string {
+	if field == "" {
+		return key
+	}
+	return field + "." + key
+}
+
+func kindName(k yaml.Kind) string {
+	switch k {
+	case yaml.MappingNode:
+		return "a mapping"
+	case yaml.SequenceNode:
+		return "a list"
+	case yaml.ScalarNode:
+		return "a value"
+	}
+	return "an alias"
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadValidatedYAML(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gmail-cleanup-validate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name   string
+		schema fieldSchema
+		yaml   string
+		// The errors reported, without the file name, or none if the file is valid.
+		want []string
+	}{
+		{"empty policies", policyFileSchema, "", nil},
+		{"valid policies", policyFileSchema, `
+policies:
+  - action: strip
+    category: promotions
+    older_than: 2y
+    except_starred: yes
+budgets:
+  - sender: "@example.com"
+    max: 500M
+trash:
+  max_age: 7d
+`, nil},
+		{"unknown unit", policyFileSchema, `
+policies:
+  - action: strip
+  - action: delete
+  - action: strip
+    older_than: 6moths
+`, []string{"6: policies[2].older_than: unknown unit [moths] in age [6moths], expected d, w, m or y"}},
+		{"missing and unknown values", policyFileSchema, `
+policies:
+  - category: social
+    action: archive
+  - older_than: 1y
+`, []string{
+			"4: policies[0].action: unknown value [archive], expected strip, delete",
+			"5: policies[1].action: missing",
+		}},
+		{"misspelled field", policyFileSchema, `
+policies:
+  - action: strip
+    olderthan: 1y
+`, []string{"4: policies[0].olderthan: unknown field, did you mean older_than?"}},
+		{"wrong kinds", policyFileSchema, `
+policies:
+  action: strip
+budgets:
+  - max: [1, 2]
+trash:
+  max_age:
+`, []string{
+			"3: policies: expected a list, not a mapping",
+			"5: budgets[0].max: expected a value, not a list",
+			"7: trash.max_age: missing value",
+		}},
+		{"bad bool and size", policyFileSchema, `
+policies:
+  - action: strip
+    except_starred: maybe
+budgets:
+  - max: 10MB
+`, []string{
+			"4: policies[0].except_starred: [maybe] isn't true or false",
+			"6: budgets[0].max: invalid size [10MB], expected a number optionally followed by K, M or G",
+		}},
+		{"valid config", configFileSchema, `
+flags:
+  backup-dir: backups
+  verify: true
+max_destructive_per_run: 500
+keep_backups: 90d
+`, nil},
+		{"config errors", configFileSchema, `
+flags:
+  backup-dir: [a, b]
+max_destructive_per_run: -1
+max_backup_sise: 2G
+`, []string{
+			"3: flags.backup-dir: expected a value, not a list",
+			"4: max_destructive_per_run: [-1] isn't a number of messages",
+			"5: max_backup_sise: unknown field, did you mean max_backup_size?",
+		}},
+		{"not a mapping", configFileSchema, "- a\n- b\n", []string{"1: top level: expected a mapping, not a list"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "file.yaml")
+			if err := ioutil.WriteFile(path, []byte(tt.yaml), 0600); err != nil {
+				t.Fatal(err)
+			}
+			var v interface{}
+			_, err := readValidatedYAML(path, tt.schema, &v)
+			var got []string
+			if err != nil {
+				fe, ok := err.(*fileErrors)
+				if !ok {
+					t.Fatalf("readValidatedYAML() error = %v, want field errors", err)
+				}
+				for _, line := range strings.Split(fe.Error(), "\n") {
+					got = append(got, strings.TrimPrefix(line, path+":"))
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readValidatedYAML() errors =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
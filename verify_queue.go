@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"google.golang.org/api/gmail/v1"
+
+	"github.com/weineran/gmail-cleanup/internal/mimeutil"
+)
+
+// Returned by processMessage for a message whose copy is queued to be checked.
+// processMessages counts the message once the check is done.
+const outcomeVerifying outcome = "verifying"
+
+// A copy waiting to be checked before its original is deleted.
+type verification struct {
+	// The original, as processMessages has it.
+	msg    *gmail.Message
+	copyId string
+	// The outline of what was inserted, and the original's Message-ID, which the copy has
+	// to keep.
+	inserted        string
+	rfc822MessageId string
+	// Deletes the original once the copy checks out.
+	replace func() (outcome, error)
+
+	// Set by the worker, then done is closed.
+	err  error
+	done chan struct{}
+}
+
+// Checks inserted copies in the background, for --verify-copies, so the next message is
+// processed while the last copy is fetched again. Originals are only deleted by the run,
+// in the order they were queued, once their copies check out.
+type copyVerifier struct {
+	mb      *mailbox
+	jobs    chan *verification
+	wg      sync.WaitGroup
+	pending []*verification
+}
+
+func newCopyVerifier(mb *mailbox, workers int) *copyVerifier {
+	v := &copyVerifier{mb: mb, jobs: make(chan *verification, workers)}
+	for i := 0; i < workers; i++ {
+		v.wg.Add(1)
+		go func() {
+			defer v.wg.Done()
+			for job := range v.jobs {
+				job.err = v.check(job)
+				close(job.done)
+			}
+		}()
+	}
+	return v
+}
+
+// Queues a copy to check.
+func (v *copyVerifier) enqueue(job *verification) {
+	job.done = make(chan struct{})
+	v.pending = append(v.pending, job)
+	v.jobs <- job
+}
+
+// Returns the checked copies at the front of the queue, without waiting.
+func (v *copyVerifier) ready() []*verification {
+	var ready []*verification
+	for len(v.pending) > 0 && v.pending[0].checked() {
+		ready = append(ready, v.pending[0])
+		v.pending = v.pending[1:]
+	}
+	return ready
+}
+
+func (job *verification) checked() bool {
+	select {
+	case <-job.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Waits for every queued copy to be checked and returns them in order.
+func (v *copyVerifier) drain() []*verification {
+	for _, job := range v.pending {
+		<-job.done
+	}
+	ready := v.pending
+	v.pending = nil
+	return ready
+}
+
+// Stops the workers once the queue is empty.
+func (v *copyVerifier) close() {
+	close(v.jobs)
+	v.wg.Wait()
+}
+
+// Fetches the copy and checks it has the original's Message-ID and the structure, part
+// types, filenames and sizes, of what was inserted.
+func (v *copyVerifier) check(job *verification) error {
+	copied, spool, err := v.mb.getSpooledMessage(job.copyId)
+	if err != nil {
+		return fmt.Errorf("Unable to fetch copy: %w", err)
+	}
+	spool.Close()
+	if got := mimeutil.HeaderValue(copied.Payload.Headers, "Message-ID"); got != job.rfc822MessageId {
+		return fmt.Errorf("%w: copy [%s] has Message-ID [%s], not [%s]", errVerificationFailed, job.copyId, got, job.rfc822MessageId)
+	}
+	if got, want := mimeutil.Outline(copied.Payload), job.inserted; got != want {
+		return fmt.Errorf("%w: copy [%s] doesn't have the parts inserted:\n%s\ninstead of:\n%s", errVerificationFailed, job.copyId, got, want)
+	}
+	return nil
+}
+
+// Deletes the original of a checked copy. A copy that didn't check out is deleted
+// instead, leaving the original as it was.
+func (v *copyVerifier) complete(job *verification) (outcome, error) {
+	if job.err == nil {
+		log.Printf("Copy [%s] of message [%s] verified\n", job.copyId, job.msg.Id)
+		return job.replace()
+	}
+	if errors.Is(job.err, errVerificationFailed) {
+		log.Printf("Deleting copy [%s] that failed verification\n", job.copyId)
+		if err := v.mb.deleteMessage(job.copyId); err != nil {
+			log.Printf("Unable to delete copy [%s]: %v\n", job.copyId, err)
+		}
+	}
+	return "", job.err
+}